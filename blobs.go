@@ -29,6 +29,14 @@ var (
 	// ErrBlobInvalidLength returned when the blob has an expected length on
 	// commit, meaning mismatched with the descriptor or an invalid value.
 	ErrBlobInvalidLength = errors.New("blob invalid length")
+
+	// ErrBlobUploadPartsInvalid returned when the parts of an upload written
+	// out of order leave gaps or overlap, and cannot be assembled on commit.
+	ErrBlobUploadPartsInvalid = errors.New("blob upload parts invalid")
+
+	// ErrBlobTooLarge returned when the content written to a blob exceeds the
+	// maximum size of blobs.
+	ErrBlobTooLarge = errors.New("blob exceeds maximum size")
 )
 
 // ErrBlobInvalidDigest returned when digest check fails.
@@ -231,6 +239,16 @@ type BlobWriter interface {
 	Cancel(ctx context.Context) error
 }
 
+// BlobPartWriter is implemented by BlobWriters which accept parts of the blob
+// out of order, such as chunks uploaded in parallel. Parts are assembled in
+// offset order on Commit, where they must follow the content written to the
+// BlobWriter without gaps or overlaps, and the digest is only computed then.
+type BlobPartWriter interface {
+	// WritePart stores the content of r as the part of the blob starting at
+	// offset, returning the number of bytes written.
+	WritePart(ctx context.Context, offset int64, r io.Reader) (int64, error)
+}
+
 // BlobService combines the operations to access, read and write blobs. This
 // can be used to describe remote blob services.
 type BlobService interface {
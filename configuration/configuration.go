@@ -109,6 +109,12 @@ type Configuration struct {
 			// A file may contain multiple CA certificates encoded as PEM
 			ClientCAs []string `yaml:"clientcas,omitempty"`
 
+			// ClientAuth specifies the policy for client certificates when
+			// ClientCAs are configured. Options include
+			// "require-and-verify-client-cert" (the default) and
+			// "verify-client-cert-if-given".
+			ClientAuth string `yaml:"clientauth,omitempty"`
+
 			// Specifies the lowest TLS version allowed
 			MinimumTLS string `yaml:"minimumtls,omitempty"`
 
@@ -174,6 +180,10 @@ type Configuration struct {
 	// registry events are dispatched.
 	Notifications Notifications `yaml:"notifications,omitempty"`
 
+	// Audit configures the audit log, a structured trail of the write, auth
+	// and administration events of the registry.
+	Audit Audit `yaml:"audit,omitempty"`
+
 	// Redis configures the redis pool available to the registry webapp.
 	Redis Redis `yaml:"redis,omitempty"`
 
@@ -185,6 +195,14 @@ type Configuration struct {
 	// Validation configures validation options for the registry.
 	Validation Validation `yaml:"validation,omitempty"`
 
+	// Limits configures limits on the blobs and manifests pushed to the
+	// registry.
+	Limits Limits `yaml:"limits,omitempty"`
+
+	// Admission configures the webhooks which approve or reject the
+	// manifests pushed to the registry.
+	Admission Admission `yaml:"admission,omitempty"`
+
 	// Policy configures registry policy options.
 	Policy struct {
 		// Repository configures policies for repositories
@@ -196,10 +214,66 @@ type Configuration struct {
 			// the class in authorized resources.
 			Classes []string `yaml:"classes"`
 		} `yaml:"repository,omitempty"`
+
+		// Anonymous configures the access granted to clients which do not
+		// provide any credentials, whichever auth type is configured.
+		Anonymous AnonymousPolicy `yaml:"anonymous,omitempty"`
 	} `yaml:"policy,omitempty"`
 }
 
-// Catalog is composed of MaxEntries.
+// AnonymousPolicy configures the access granted to unauthenticated clients
+// when authorization is enabled.
+type AnonymousPolicy struct {
+	// Repositories specifies regular expressions (https://godoc.org/regexp/syntax)
+	// matching the whole name of repositories which can be pulled
+	// anonymously.
+	Repositories []string `yaml:"repositories,omitempty"`
+
+	// Catalog allows anonymous clients to list the catalog. Only
+	// repositories which can be pulled anonymously are listed.
+	Catalog bool `yaml:"catalog,omitempty"`
+}
+
+// Audit configures the sinks to which audit events are written. Audit
+// events are independent of notifications and are written synchronously.
+type Audit struct {
+	// File writes audit events as JSON lines to a file.
+	File AuditFile `yaml:"file,omitempty"`
+
+	// Syslog sends audit events to syslog.
+	Syslog AuditSyslog `yaml:"syslog,omitempty"`
+}
+
+// AuditFile configures the audit log file.
+type AuditFile struct {
+	// Path is the path of the audit log file. The file sink is disabled
+	// when no path is set.
+	Path string `yaml:"path,omitempty"`
+
+	// MaxSize is the size in bytes after which the file is rotated.
+	// Defaults to 100MB.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+
+	// MaxBackups is the number of rotated files which are kept. Defaults to
+	// 5.
+	MaxBackups int `yaml:"maxbackups,omitempty"`
+}
+
+// AuditSyslog configures the syslog audit sink.
+type AuditSyslog struct {
+	// Enabled enables the syslog sink.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Network and Address of the syslog daemon. The local syslog daemon is
+	// used when they are not set.
+	Network string `yaml:"network,omitempty"`
+	Address string `yaml:"address,omitempty"`
+
+	// Tag of the syslog messages. Defaults to the name of the process.
+	Tag string `yaml:"tag,omitempty"`
+}
+
+// Catalog is composed of MaxEntries and Index.
 // Catalog endpoint (/v2/_catalog) configuration, it provides the configuration
 // options to control the maximum number of entries returned by the catalog endpoint.
 type Catalog struct {
@@ -207,6 +281,11 @@ type Catalog struct {
 	// to the catalog endpoint will return at most MaxEntries entries.
 	// An empty or a negative value will set a default of 1000 maximum entries by default.
 	MaxEntries int `yaml:"maxentries,omitempty"`
+
+	// Index maintains an index of the repositories in the storage backend,
+	// which lists the catalog once it has been rebuilt rather than walking
+	// the repositories.
+	Index bool `yaml:"index,omitempty"`
 }
 
 // LogHook is composed of hook Level and Type.
@@ -396,6 +475,10 @@ func (storage Storage) Type() string {
 			// allow configuration of redirect
 		case "tag":
 			// allow configuration of tag
+		case "digest":
+			// allow configuration of digest algorithms
+		case "mount":
+			// allow configuration of mount
 		default:
 			storageType = append(storageType, k)
 		}
@@ -452,6 +535,10 @@ func (storage *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 					// allow configuration of redirect
 				case "tag":
 					// allow configuration of tag
+				case "digest":
+					// allow configuration of digest algorithms
+				case "mount":
+					// allow configuration of mount
 				default:
 					types = append(types, k)
 				}
@@ -484,17 +571,94 @@ func (storage Storage) MarshalYAML() (interface{}, error) {
 }
 
 // Auth defines the configuration for registry authorization.
+//
+// More than one authorization method may be configured, in which case the
+// "chain" entry must define the order in which they are consulted.
 type Auth map[string]Parameters
 
-// Type returns the auth type, such as htpasswd or token
+// authChain is the reserved Auth entry configuring the chaining of
+// authorization methods.
+const authChain = "chain"
+
+// Type returns the auth type, such as htpasswd or token. When several auth
+// types are chained, the first one in the chain is returned. The empty string
+// is returned if the auth types are not valid.
 func (auth Auth) Type() string {
-	// Return only key in this map
-	for k := range auth {
-		return k
+	if types, err := auth.Types(); err == nil && len(types) > 0 {
+		return types[0]
 	}
 	return ""
 }
 
+// Types returns the configured auth types, in the order in which they should
+// be consulted. An error is returned if several auth types are configured
+// without a valid chain order.
+func (auth Auth) Types() ([]string, error) {
+	types := make([]string, 0, len(auth))
+	for k := range auth {
+		if k != authChain {
+			types = append(types, k)
+		}
+	}
+
+	if _, ok := auth[authChain]; !ok {
+		if len(types) > 1 {
+			return nil, fmt.Errorf("must provide exactly one type or a chain order. Provided: %v", types)
+		}
+		return types, nil
+	}
+
+	order, err := auth.chainOrder()
+	if err != nil {
+		return nil, err
+	}
+	if len(order) != len(types) {
+		return nil, fmt.Errorf("auth chain order %v must list each configured type exactly once. Provided: %v", order, types)
+	}
+	seen := make(map[string]struct{}, len(order))
+	for _, t := range order {
+		if _, ok := auth[t]; !ok || t == authChain {
+			return nil, fmt.Errorf("auth chain order refers to an unconfigured type: %s", t)
+		}
+		if _, ok := seen[t]; ok {
+			return nil, fmt.Errorf("auth chain order lists type more than once: %s", t)
+		}
+		seen[t] = struct{}{}
+	}
+	return order, nil
+}
+
+// ChainParameters returns the Parameters map for the auth chain
+// configuration, or nil if auth types are not chained.
+func (auth Auth) ChainParameters() Parameters {
+	return auth[authChain]
+}
+
+// chainOrder returns the auth types listed in the order of the auth chain.
+func (auth Auth) chainOrder() ([]string, error) {
+	order, ok := auth[authChain]["order"]
+	if !ok {
+		return nil, nil
+	}
+
+	switch order := order.(type) {
+	case []string:
+		return order, nil
+	case []interface{}:
+		types := make([]string, 0, len(order))
+		for _, t := range order {
+			s, ok := t.(string)
+			if !ok {
+				return nil, fmt.Errorf("auth chain order must be a list of auth types")
+			}
+			types = append(types, s)
+		}
+		return types, nil
+	default:
+		return nil, fmt.Errorf("auth chain order must be a list of auth types")
+	}
+}
+
 // Parameters returns the Parameters map for an Auth configuration
 func (auth Auth) Parameters() Parameters {
 	return auth[auth.Type()]
@@ -511,16 +675,8 @@ func (auth *Auth) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var m map[string]Parameters
 	err := unmarshal(&m)
 	if err == nil {
-		if len(m) > 1 {
-			types := make([]string, 0, len(m))
-			for k := range m {
-				types = append(types, k)
-			}
-
-			// TODO(stevvooe): May want to change this slightly for
-			// authorization to allow multiple challenges.
-			return fmt.Errorf("must provide exactly one type. Provided: %v", types)
-
+		if _, err := Auth(m).Types(); err != nil {
+			return err
 		}
 		*auth = m
 		return nil
@@ -538,7 +694,7 @@ func (auth *Auth) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 // MarshalYAML implements the yaml.Marshaler interface
 func (auth Auth) MarshalYAML() (interface{}, error) {
-	if auth.Parameters() == nil {
+	if _, ok := auth[authChain]; !ok && auth.Parameters() == nil {
 		return auth.Type(), nil
 	}
 	return map[string]Parameters(auth), nil
@@ -616,6 +772,85 @@ type Validation struct {
 	Manifests ValidationManifests `yaml:"manifests,omitempty"`
 }
 
+// Limits configures limits on the size and content of pushed blobs and
+// manifests. A zero value disables the corresponding limit.
+type Limits struct {
+	// Blobs configures limits on pushed blobs.
+	Blobs BlobLimits `yaml:"blobs,omitempty"`
+
+	// Manifests configures limits on pushed manifests.
+	Manifests ManifestLimits `yaml:"manifests,omitempty"`
+
+	// MediaTypes restricts the media types of the config and layers of the
+	// manifests pushed to repositories. The first entry matching the name
+	// of a repository applies.
+	MediaTypes []MediaTypeLimits `yaml:"mediatypes,omitempty"`
+}
+
+// BlobLimits configures limits on pushed blobs.
+type BlobLimits struct {
+	// MaxSize is the maximum size of a blob in bytes.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+}
+
+// ManifestLimits configures limits on pushed manifests.
+type ManifestLimits struct {
+	// MaxSize is the maximum size of a manifest in bytes. Defaults to 4MiB.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+
+	// MaxLayers is the maximum number of layers of an image manifest.
+	MaxLayers int `yaml:"maxlayers,omitempty"`
+
+	// MaxIndexEntries is the maximum number of manifests of an image index
+	// or manifest list.
+	MaxIndexEntries int `yaml:"maxindexentries,omitempty"`
+}
+
+// MediaTypeLimits restricts the media types of the manifests pushed to a set
+// of repositories.
+type MediaTypeLimits struct {
+	// Repositories specifies regular expressions (https://godoc.org/regexp/syntax)
+	// matching the whole name of the repositories the entry applies to.
+	Repositories []string `yaml:"repositories,omitempty"`
+
+	// Config lists the allowed media types of the config of image manifests.
+	// Any media type is allowed when empty.
+	Config []string `yaml:"config,omitempty"`
+
+	// Layers lists the allowed media types of the layers of image
+	// manifests. Any media type is allowed when empty.
+	Layers []string `yaml:"layers,omitempty"`
+}
+
+// Admission configures the validating webhooks called before pushed
+// manifests are stored.
+type Admission struct {
+	// Webhooks are called in order with the manifests pushed to the
+	// repositories they apply to. A push is rejected as soon as a webhook
+	// rejects it.
+	Webhooks []AdmissionWebhook `yaml:"webhooks,omitempty"`
+}
+
+// AdmissionWebhook configures a validating webhook.
+type AdmissionWebhook struct {
+	Name    string      `yaml:"name"`    // identifies the webhook in logs and errors
+	URL     string      `yaml:"url"`     // post url for the webhook
+	Headers http.Header `yaml:"headers"` // static headers that should be added to all requests
+
+	// Timeout bounds each call to the webhook. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// FailOpen accepts the push when the webhook cannot be reached, times
+	// out or returns an invalid response. Such pushes are rejected by
+	// default.
+	FailOpen bool `yaml:"failopen,omitempty"`
+
+	// Repositories specifies regular expressions (https://godoc.org/regexp/syntax)
+	// matching the whole name of the repositories the webhook applies to.
+	// The webhook applies to all repositories when empty.
+	Repositories []string `yaml:"repositories,omitempty"`
+}
+
 type ValidationManifests struct {
 	// URLs configures validation for URLs in pushed manifests.
 	URLs struct {
@@ -81,6 +81,7 @@ var configStruct = Configuration{
 			Certificate  string   `yaml:"certificate,omitempty"`
 			Key          string   `yaml:"key,omitempty"`
 			ClientCAs    []string `yaml:"clientcas,omitempty"`
+			ClientAuth   string   `yaml:"clientauth,omitempty"`
 			MinimumTLS   string   `yaml:"minimumtls,omitempty"`
 			CipherSuites []string `yaml:"ciphersuites,omitempty"`
 			LetsEncrypt  struct {
@@ -109,6 +110,7 @@ var configStruct = Configuration{
 			Certificate  string   `yaml:"certificate,omitempty"`
 			Key          string   `yaml:"key,omitempty"`
 			ClientCAs    []string `yaml:"clientcas,omitempty"`
+			ClientAuth   string   `yaml:"clientauth,omitempty"`
 			MinimumTLS   string   `yaml:"minimumtls,omitempty"`
 			CipherSuites []string `yaml:"ciphersuites,omitempty"`
 			LetsEncrypt  struct {
@@ -426,6 +428,45 @@ func (suite *ConfigSuite) TestParseInvalidLoglevel() {
 	suite.Require().Error(err)
 }
 
+// TestParseAuthChain validates that several auth types can be configured
+// when the order in which they are chained is provided.
+func (suite *ConfigSuite) TestParseAuthChain() {
+	chainedConfigYaml := `version: 0.1
+storage: inmemory
+auth:
+  silly:
+    realm: silly
+  htpasswd:
+    realm: basic
+  chain:
+    order: [htpasswd, silly]
+`
+	config, err := Parse(bytes.NewReader([]byte(chainedConfigYaml)))
+	suite.Require().NoError(err)
+	types, err := config.Auth.Types()
+	suite.Require().NoError(err)
+	suite.Require().Equal([]string{"htpasswd", "silly"}, types)
+	suite.Require().Equal("htpasswd", config.Auth.Type())
+	suite.Require().Equal(Parameters{"realm": "basic"}, config.Auth.Parameters())
+
+	for _, invalid := range []string{
+		"auth:\n  silly:\n    realm: silly\n  htpasswd:\n    realm: basic\n",
+		"auth:\n  silly:\n    realm: silly\n  htpasswd:\n    realm: basic\n  chain:\n    order: [silly]\n",
+		"auth:\n  silly:\n    realm: silly\n  chain:\n    order: [token]\n",
+		"auth:\n  silly:\n    realm: silly\n  chain:\n    order: silly\n",
+	} {
+		_, err := Parse(bytes.NewReader([]byte("version: 0.1\nstorage: inmemory\n" + invalid)))
+		suite.Require().Error(err, invalid)
+	}
+
+	// auth types set without parsing, such as by environment variables, are
+	// validated as well, rather than picked in map order.
+	invalid := Auth{"silly": Parameters{}, "htpasswd": Parameters{}, "chain": Parameters{"order": "silly"}}
+	_, err = invalid.Types()
+	suite.Require().Error(err)
+	suite.Require().Equal("", invalid.Type())
+}
+
 // TestParseInvalidVersion validates that the parser will fail to parse a newer configuration
 // version than the CurrentVersion
 func (suite *ConfigSuite) TestParseInvalidVersion() {
@@ -240,6 +240,16 @@ func (bwl *blobWriterListener) Commit(ctx context.Context, desc distribution.Des
 	return committed, err
 }
 
+// WritePart forwards to the wrapped writer, when it accepts parts of the blob
+// out of order.
+func (bwl *blobWriterListener) WritePart(ctx context.Context, offset int64, r io.Reader) (int64, error) {
+	pw, ok := bwl.BlobWriter.(distribution.BlobPartWriter)
+	if !ok {
+		return 0, distribution.ErrUnsupported
+	}
+	return pw.WritePart(ctx, offset, r)
+}
+
 type tagServiceListener struct {
 	distribution.TagService
 	parent *repositoryListener
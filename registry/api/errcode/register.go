@@ -226,6 +226,50 @@ var (
 	})
 )
 
+const errGroupExt = "registry.api.ext"
+
+var (
+	// ErrorCodeRobotUnknown is returned when a robot account is unknown.
+	ErrorCodeRobotUnknown = register(errGroupExt, ErrorDescriptor{
+		Value:   "ROBOT_UNKNOWN",
+		Message: "robot account unknown to registry",
+		Description: `This is returned if the robot account used during an
+		operation is unknown to the registry.`,
+		HTTPStatusCode: http.StatusNotFound,
+	})
+
+	// ErrorCodeRobotInvalid is returned when a robot account definition is
+	// invalid.
+	ErrorCodeRobotInvalid = register(errGroupExt, ErrorDescriptor{
+		Value:   "ROBOT_INVALID",
+		Message: "robot account invalid",
+		Description: `When a robot account is created, its name, repositories,
+		actions and expiry are validated. If those checks fail, this error is
+		returned with the failed validation in the detail.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	// ErrorCodeRobotExists is returned when creating a robot account with the
+	// name of an existing account.
+	ErrorCodeRobotExists = register(errGroupExt, ErrorDescriptor{
+		Value:   "ROBOT_EXISTS",
+		Message: "robot account already exists",
+		Description: `This is returned when a robot account is created with
+		the name of an existing account, including revoked accounts.`,
+		HTTPStatusCode: http.StatusConflict,
+	})
+
+	// ErrorCodeRepositoryExists is returned when renaming a repository to
+	// the name of a repository holding manifests.
+	ErrorCodeRepositoryExists = register(errGroupExt, ErrorDescriptor{
+		Value:   "REPOSITORY_EXISTS",
+		Message: "repository already exists",
+		Description: `This is returned when a repository is renamed to the
+		name of a repository which already holds manifests.`,
+		HTTPStatusCode: http.StatusConflict,
+	})
+)
+
 var (
 	nextCode     = 1000
 	registerLock sync.Mutex
@@ -11,6 +11,9 @@ import (
 
 var routeDescriptorsMap map[string]RouteDescriptor
 
+// RobotNameRegexp matches the name of robot accounts.
+var RobotNameRegexp = regexp.MustCompile(`[a-z0-9]+(?:[._-][a-z0-9]+)*`)
+
 func init() {
 	routeDescriptorsMap = make(map[string]RouteDescriptor, len(routeDescriptors))
 
@@ -43,6 +46,14 @@ var (
 		Description: "A uuid identifying the upload. This field can accept characters that match `[a-zA-Z0-9-_.=]+`.",
 	}
 
+	robotParameterDescriptor = ParameterDescriptor{
+		Name:        "robot",
+		Type:        "string",
+		Format:      RobotNameRegexp.String(),
+		Required:    true,
+		Description: `Name of the target robot account.`,
+	}
+
 	digestPathParameter = ParameterDescriptor{
 		Name:        "digest",
 		Type:        "path",
@@ -1609,4 +1620,385 @@ var routeDescriptors = []RouteDescriptor{
 			},
 		},
 	},
+	{
+		Name:        RouteNameRobots,
+		Path:        "/v2/_ext/robots/",
+		Entity:      "Robots",
+		Description: "Manage the robot accounts of the registry. Robot accounts authenticate with long-lived tokens limited to a set of repositories and actions. This extension is only available when the robot auth provider is configured, and only to the configured administrators.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "List the robot accounts of the registry, including revoked accounts.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+	"robots": [
+		<robot>,
+		...
+	]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							unauthorizedResponseDescriptor,
+							deniedResponseDescriptor,
+						},
+					},
+				},
+			},
+			{
+				Method:      http.MethodPost,
+				Description: "Create a robot account. The token of the account is only returned in the response of this request.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						Body: BodyDescriptor{
+							ContentType: "application/json",
+							Format: `{
+	"name": "<name>",
+	"description": "<description>",
+	"repositories": [<pattern>, ...],
+	"actions": [<action>, ...],
+	"expiresIn": "<duration>"
+}`,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The robot account has been created. Clients authenticate as the account using basic authentication, with the username and token of the response.",
+								StatusCode:  http.StatusCreated,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Format:      "<url>",
+										Description: "The location of the created robot account.",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+	"robot": <robot>,
+	"username": "robot$<name>",
+	"token": "<token>"
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid Robot Account",
+								Description: "The robot account definition is invalid, or an account with the same name exists.",
+								StatusCode:  http.StatusBadRequest,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeRobotInvalid,
+									errcode.ErrorCodeRobotExists,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							deniedResponseDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameRobot,
+		Path:        "/v2/_ext/robots/{robot:" + RobotNameRegexp.String() + "}",
+		Entity:      "Robot",
+		Description: "Fetch or revoke a robot account.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Fetch the robot account identified by `robot`.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							robotParameterDescriptor,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+	"name": "<name>",
+	"description": "<description>",
+	"repositories": [<pattern>, ...],
+	"actions": [<action>, ...],
+	"createdAt": "<time>",
+	"createdBy": "<user>",
+	"expiresAt": "<time>",
+	"revokedAt": "<time>",
+	"revokedBy": "<user>"
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Unknown Robot Account",
+								StatusCode:  http.StatusNotFound,
+								Description: "The robot account is not known to the registry.",
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeRobotUnknown,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							deniedResponseDescriptor,
+						},
+					},
+				},
+			},
+			{
+				Method:      http.MethodDelete,
+				Description: "Revoke the robot account identified by `robot`. Revoked accounts are kept for auditing, and their token is not accepted anymore.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							robotParameterDescriptor,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusAccepted,
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Unknown Robot Account",
+								StatusCode:  http.StatusNotFound,
+								Description: "The robot account is not known to the registry.",
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeRobotUnknown,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							deniedResponseDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameRepositoryCopy,
+		Path:        "/v2/_ext/repositories/{name:" + reference.NameRegexp.String() + "}/copy",
+		Entity:      "Repository Copy",
+		Description: "Copy manifests between repositories without transferring their content through the client.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodPost,
+				Description: "Copy the manifest identified by `reference` in the repository `from` to the repository `name`, along with the manifests and blobs it references. Blobs are linked into the repository `name` rather than copied. The client must have pull access to the repository `from` and push access to the repository `name`.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+							contentLengthZeroHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "from",
+								Type:        "query",
+								Format:      "<repository name>",
+								Required:    true,
+								Description: `Name of the source repository.`,
+							},
+							{
+								Name:        "reference",
+								Type:        "query",
+								Format:      "<tag|digest>",
+								Required:    true,
+								Description: `Tag or digest of the manifest to copy.`,
+							},
+							{
+								Name:        "tag",
+								Type:        "query",
+								Format:      "<tag>",
+								Description: "Tag of the manifest in the repository `name`. Defaults to `reference` when it is a tag. Manifests copied by digest are left untagged when it is not set.",
+							},
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The manifest has been copied and is available at the provided location.",
+								StatusCode:  http.StatusCreated,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Format:      "<url>",
+										Description: "The canonical location url of the copied manifest.",
+									},
+									contentLengthZeroHeader,
+									digestHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid Copy",
+								Description: "The source repository, reference or target tag is invalid.",
+								StatusCode:  http.StatusBadRequest,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameInvalid,
+									errcode.ErrorCodeTagInvalid,
+									errcode.ErrorCodeDigestInvalid,
+								},
+							},
+							{
+								Name:        "Unknown Manifest",
+								Description: "The manifest, or one of the manifests or blobs it references, is not known to the source repository.",
+								StatusCode:  http.StatusNotFound,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeManifestUnknown,
+									errcode.ErrorCodeBlobUnknown,
+								},
+							},
+							{
+								Name:        "Not allowed",
+								Description: "Repository copy is not allowed because the registry is configured as a pull-through cache or in read-only mode.",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameRepositoryRename,
+		Path:        "/v2/_ext/repositories/{name:" + reference.NameRegexp.String() + "}/rename",
+		Entity:      "Repository Rename",
+		Description: "Rename a repository, moving its manifests, tags and blobs to a new name.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodPost,
+				Description: "Rename the repository `name` to `to`. The blobs, manifests and tags of the repository are linked into the repository `to`, then the repository `name` is deleted. The repository `to` must not hold any manifest. The client must have push and delete access to the repository `name` and push access to the repository `to`. This request is only available when `delete` is enabled.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+							contentLengthZeroHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "to",
+								Type:        "query",
+								Format:      "<repository name>",
+								Required:    true,
+								Description: `New name of the repository.`,
+							},
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The repository has been renamed.",
+								StatusCode:  http.StatusCreated,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Format:      "<url>",
+										Description: "The url of the tags of the renamed repository.",
+									},
+									contentLengthZeroHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid Name",
+								Description: "The new name of the repository is invalid.",
+								StatusCode:  http.StatusBadRequest,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameInvalid,
+								},
+							},
+							{
+								Name:        "Repository Exists",
+								Description: "The repository `to` already holds manifests.",
+								StatusCode:  http.StatusConflict,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeRepositoryExists,
+								},
+							},
+							{
+								Name:        "Not allowed",
+								Description: "Repository rename is not allowed because the registry is configured as a pull-through cache, in read-only mode or `delete` has been disabled.",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
 }
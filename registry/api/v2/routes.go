@@ -9,13 +9,17 @@ import (
 // The following are definitions of the name under which all V2 routes are
 // registered. These symbols can be used to look up a route based on the name.
 const (
-	RouteNameBase            = "base"
-	RouteNameManifest        = "manifest"
-	RouteNameTags            = "tags"
-	RouteNameBlob            = "blob"
-	RouteNameBlobUpload      = "blob-upload"
-	RouteNameBlobUploadChunk = "blob-upload-chunk"
-	RouteNameCatalog         = "catalog"
+	RouteNameBase             = "base"
+	RouteNameManifest         = "manifest"
+	RouteNameTags             = "tags"
+	RouteNameBlob             = "blob"
+	RouteNameBlobUpload       = "blob-upload"
+	RouteNameBlobUploadChunk  = "blob-upload-chunk"
+	RouteNameCatalog          = "catalog"
+	RouteNameRobots           = "robots"
+	RouteNameRobot            = "robot"
+	RouteNameRepositoryCopy   = "repository-copy"
+	RouteNameRepositoryRename = "repository-rename"
 )
 
 var (
@@ -35,6 +35,32 @@ func TestRouter(t *testing.T) {
 			RequestURI: "/v2/",
 			Vars:       map[string]string{},
 		},
+		{
+			RouteName:  RouteNameRobots,
+			RequestURI: "/v2/_ext/robots/",
+			Vars:       map[string]string{},
+		},
+		{
+			RouteName:  RouteNameRobot,
+			RequestURI: "/v2/_ext/robots/ci-builder",
+			Vars: map[string]string{
+				"robot": "ci-builder",
+			},
+		},
+		{
+			RouteName:  RouteNameRepositoryCopy,
+			RequestURI: "/v2/_ext/repositories/prod/app/copy",
+			Vars: map[string]string{
+				"name": "prod/app",
+			},
+		},
+		{
+			RouteName:  RouteNameRepositoryRename,
+			RequestURI: "/v2/_ext/repositories/staging/app/rename",
+			Vars: map[string]string{
+				"name": "staging/app",
+			},
+		},
 		{
 			RouteName:  RouteNameManifest,
 			RequestURI: "/v2/foo/manifests/bar",
@@ -202,6 +202,56 @@ func (ub *URLBuilder) BuildBlobUploadChunkURL(name reference.Named, uuid string,
 	return appendValuesURL(uploadURL, values...).String(), nil
 }
 
+// BuildRobotsURL constructs a url to list or create robot accounts.
+func (ub *URLBuilder) BuildRobotsURL() (string, error) {
+	route := ub.cloneRoute(RouteNameRobots)
+
+	robotsURL, err := route.URL()
+	if err != nil {
+		return "", err
+	}
+
+	return robotsURL.String(), nil
+}
+
+// BuildRobotURL constructs a url for the named robot account.
+func (ub *URLBuilder) BuildRobotURL(name string) (string, error) {
+	route := ub.cloneRoute(RouteNameRobot)
+
+	robotURL, err := route.URL("robot", name)
+	if err != nil {
+		return "", err
+	}
+
+	return robotURL.String(), nil
+}
+
+// BuildRepositoryCopyURL constructs a url to copy manifests to the named
+// repository, including any url values.
+func (ub *URLBuilder) BuildRepositoryCopyURL(name reference.Named, values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameRepositoryCopy)
+
+	copyURL, err := route.URL("name", name.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(copyURL, values...).String(), nil
+}
+
+// BuildRepositoryRenameURL constructs a url to rename the named repository,
+// including any url values.
+func (ub *URLBuilder) BuildRepositoryRenameURL(name reference.Named, values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameRepositoryRename)
+
+	renameURL, err := route.URL("name", name.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(renameURL, values...).String(), nil
+}
+
 // cloneRoute returns a clone of the named route from the router. Routes
 // must be cloned to avoid modifying them during url generation.
 func (ub *URLBuilder) cloneRoute(name string) clonedRoute {
@@ -0,0 +1,155 @@
+// Package audit provides the audit log of the registry: a structured trail of
+// the write, auth and administration events, with the identity of the actor
+// and the outcome of the request.
+//
+// Unlike notifications, audit events are written synchronously to local
+// sinks, such as a JSON-lines file or syslog, and are recorded whether the
+// request succeeded or not.
+package audit
+
+import (
+	"errors"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionManifestPush     = "manifest.push"
+	ActionManifestDelete   = "manifest.delete"
+	ActionTagDelete        = "tag.delete"
+	ActionBlobPush         = "blob.push"
+	ActionBlobMount        = "blob.mount"
+	ActionBlobDelete       = "blob.delete"
+	ActionBlobUploadCancel = "blob.upload.cancel"
+	ActionRepositoryCopy   = "repository.copy"
+	ActionRepositoryRename = "repository.rename"
+	ActionAuth             = "auth"
+	ActionRobotCreate      = "robot.create"
+	ActionRobotRevoke      = "robot.revoke"
+)
+
+// Outcomes of the audited requests.
+const (
+	// OutcomeSuccess is the outcome of requests which completed.
+	OutcomeSuccess = "success"
+
+	// OutcomeFailure is the outcome of requests which were authorized but
+	// failed.
+	OutcomeFailure = "failure"
+
+	// OutcomeDenied is the outcome of requests which were not authorized.
+	OutcomeDenied = "denied"
+)
+
+// ErrSinkClosed is returned when writing to a closed sink.
+var ErrSinkClosed = errors.New("audit: sink closed")
+
+// Event describes an audited event.
+type Event struct {
+	// ID uniquely identifies the event.
+	ID string `json:"id"`
+
+	// Timestamp is the time at which the event occurred.
+	Timestamp time.Time `json:"timestamp"`
+
+	// Action is the audited action, such as manifest.push.
+	Action string `json:"action"`
+
+	// Outcome is the outcome of the action: success, failure or denied.
+	Outcome string `json:"outcome"`
+
+	// Actor is the identity which performed the action.
+	Actor Actor `json:"actor"`
+
+	// Repository is the repository targeted by the action, if any.
+	Repository string `json:"repository,omitempty"`
+
+	// FromRepository is the source repository of blob mounts and manifest
+	// copies.
+	FromRepository string `json:"fromRepository,omitempty"`
+
+	// Digest is the digest of the manifest or blob targeted by the action.
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Tag is the tag targeted by the action.
+	Tag string `json:"tag,omitempty"`
+
+	// Target names the target of actions which do not target repository
+	// content, such as the robot account of administration actions, or the
+	// new name of renamed repositories.
+	Target string `json:"target,omitempty"`
+
+	// Request describes the request which generated the event.
+	Request Request `json:"request"`
+
+	// Status is the status code of the response.
+	Status int `json:"status,omitempty"`
+
+	// Error describes why the action failed or was denied.
+	Error string `json:"error,omitempty"`
+}
+
+// Actor identifies the agent which performed an action.
+type Actor struct {
+	// Name is the name of the authenticated user, if any.
+	Name string `json:"name,omitempty"`
+
+	// Anonymous is set when the request was authorized without
+	// credentials.
+	Anonymous bool `json:"anonymous,omitempty"`
+}
+
+// Request describes the request which generated an event.
+type Request struct {
+	// ID is the request ID, also found in the registry logs.
+	ID string `json:"id"`
+
+	// ClientIP is the address of the client, taking the X-Forwarded-For and
+	// X-Real-Ip headers into account.
+	ClientIP string `json:"clientIP,omitempty"`
+
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+// Sink receives audit events.
+type Sink interface {
+	// Write records an event.
+	Write(event Event) error
+
+	// Close closes the sink. Events written afterwards are rejected with
+	// ErrSinkClosed.
+	Close() error
+}
+
+// multiSink writes events to several sinks.
+type multiSink []Sink
+
+// NewMultiSink returns a Sink writing events to each of the given sinks. All
+// sinks are written to, even if some of them fail.
+func NewMultiSink(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+func (ms multiSink) Write(event Event) error {
+	var errs []error
+	for _, sink := range ms {
+		if err := sink.Write(event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ms multiSink) Close() error {
+	var errs []error
+	for _, sink := range ms {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
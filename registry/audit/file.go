@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// DefaultMaxSize is the default size in bytes after which audit log files
+	// are rotated.
+	DefaultMaxSize = 100 << 20
+
+	// DefaultMaxBackups is the default number of rotated audit log files
+	// which are kept.
+	DefaultMaxBackups = 5
+)
+
+// fileSink writes events as JSON lines to a file, rotated when it grows
+// beyond a maximum size. Rotated files are suffixed with .1, .2, ... the
+// lower the suffix, the more recent the file.
+type fileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink returns a Sink appending events as JSON lines to the file at
+// path. The file is rotated when writing an event would grow it beyond
+// maxSize bytes, keeping maxBackups rotated files. Zero values select
+// DefaultMaxSize and DefaultMaxBackups.
+func NewFileSink(path string, maxSize int64, maxBackups int) (Sink, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = DefaultMaxBackups
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("audit: could not create log directory: %v", err)
+	}
+
+	fs := &fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileSink) open() error {
+	f, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("audit: could not open log file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("audit: could not stat log file: %v", err)
+	}
+	fs.file = f
+	fs.size = fi.Size()
+	return nil
+}
+
+// rotate shifts the rotated files, moves the current file to the .1 suffix
+// and reopens an empty file.
+func (fs *fileSink) rotate() error {
+	if err := fs.file.Close(); err != nil {
+		return err
+	}
+	fs.file = nil
+
+	for i := fs.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", fs.path, i), fmt.Sprintf("%s.%d", fs.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(fs.path, fs.path+".1"); err != nil {
+		return err
+	}
+	return fs.open()
+}
+
+func (fs *fileSink) Write(event Event) error {
+	p, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	p = append(p, '\n')
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.file == nil {
+		return ErrSinkClosed
+	}
+
+	if fs.size > 0 && fs.size+int64(len(p)) > fs.maxSize {
+		if err := fs.rotate(); err != nil {
+			return fmt.Errorf("audit: could not rotate log file: %v", err)
+		}
+	}
+
+	n, err := fs.file.Write(p)
+	fs.size += int64(n)
+	return err
+}
+
+func (fs *fileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.file == nil {
+		return ErrSinkClosed
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
@@ -0,0 +1,95 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readEvents(t *testing.T, path string) []Event {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("unexpected error decoding event: %v", err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("unexpected error reading %s: %v", path, err)
+	}
+	return events
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+
+	event := Event{ID: "0", Action: ActionManifestPush, Outcome: OutcomeSuccess, Repository: "foo/bar"}
+	p, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Each file holds two events.
+	sink, err := NewFileSink(path, int64(2*(len(p)+1)), 2)
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+
+	for _, id := range []string{"0", "1", "2", "3", "4", "5", "6"} {
+		event.ID = id
+		if err := sink.Write(event); err != nil {
+			t.Fatalf("unexpected error writing event: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("unexpected error closing sink: %v", err)
+	}
+	if err := sink.Write(event); err != ErrSinkClosed {
+		t.Fatalf("expected ErrSinkClosed, got %v", err)
+	}
+
+	for suffix, expected := range map[string][]string{
+		"":   {"6"},
+		".1": {"4", "5"},
+		".2": {"2", "3"},
+	} {
+		events := readEvents(t, path+suffix)
+		if len(events) != len(expected) {
+			t.Fatalf("unexpected events in %s%s: %+v", path, suffix, events)
+		}
+		for i, event := range events {
+			if event.ID != expected[i] || event.Repository != "foo/bar" {
+				t.Fatalf("unexpected event in %s%s: %+v", path, suffix, event)
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only two rotated files to be kept, got %v", err)
+	}
+
+	// Reopening the sink appends to the current file.
+	sink, err = NewFileSink(path, int64(2*(len(p)+1)), 2)
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	defer sink.Close()
+	event.ID = "7"
+	if err := sink.Write(event); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+	if events := readEvents(t, path); len(events) != 2 || events[1].ID != "7" {
+		t.Fatalf("unexpected events after reopening: %+v", events)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"encoding/json"
+	"log/syslog"
+	"sync"
+)
+
+// syslogSink sends each event as a JSON message to syslog, with the auth
+// facility.
+type syslogSink struct {
+	mu     sync.Mutex
+	writer *syslog.Writer
+}
+
+// NewSyslogSink returns a Sink sending events to the syslog daemon at the
+// given network address, or to the local syslog daemon if network and
+// address are empty.
+func NewSyslogSink(network, address, tag string) (Sink, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (ss *syslogSink) Write(event Event) error {
+	p, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.writer == nil {
+		return ErrSinkClosed
+	}
+	return ss.writer.Notice(string(p))
+}
+
+func (ss *syslogSink) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.writer == nil {
+		return ErrSinkClosed
+	}
+	err := ss.writer.Close()
+	ss.writer = nil
+	return err
+}
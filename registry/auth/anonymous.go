@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ErrAnonymousAccessDenied is returned when the requested access is not
+// available to anonymous clients.
+var ErrAnonymousAccessDenied = errors.New("anonymous access denied")
+
+// AnonymousAccessController is an AccessController which grants anonymous
+// pull access to a set of repositories, and optionally access to the catalog.
+type AnonymousAccessController struct {
+	repositories *regexp.Regexp
+	catalog      bool
+}
+
+var _ AccessController = &AnonymousAccessController{}
+
+// NewAnonymousAccessController returns an AccessController which grants
+// anonymous pull access to the repositories whose names match one of the
+// given regular expressions, and access to the catalog if catalog is true.
+// The expressions must match the whole name. Any other access, including
+// requests which do not name any resource, is answered with a Challenge which
+// sets no header, so that the controller can terminate a chain created with
+// NewChain.
+func NewAnonymousAccessController(repositories []string, catalog bool) (*AnonymousAccessController, error) {
+	wrapped := make([]string, 0, len(repositories))
+	for _, p := range repositories {
+		if _, err := regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("invalid anonymous repository pattern %q: %v", p, err)
+		}
+		wrapped = append(wrapped, fmt.Sprintf("(?:%s)", p))
+	}
+
+	ac := &AnonymousAccessController{catalog: catalog}
+	if len(wrapped) > 0 {
+		ac.repositories = regexp.MustCompile("^(?:" + strings.Join(wrapped, "|") + ")$")
+	}
+	return ac, nil
+}
+
+// Authorized implements AccessController.
+func (ac *AnonymousAccessController) Authorized(r *http.Request, access ...Access) (*Grant, error) {
+	if len(access) == 0 {
+		return nil, anonymousChallenge{}
+	}
+
+	resources := make([]Resource, 0, len(access))
+	for _, a := range access {
+		switch {
+		case a.Type == "repository" && a.Action == "pull" && ac.AllowsRepository(a.Name):
+		case a.Type == "registry" && a.Name == "catalog" && ac.catalog:
+		default:
+			return nil, anonymousChallenge{}
+		}
+		resources = append(resources, a.Resource)
+	}
+
+	return &Grant{Resources: resources}, nil
+}
+
+// AllowsRepository returns whether the named repository can be pulled
+// anonymously.
+func (ac *AnonymousAccessController) AllowsRepository(name string) bool {
+	return ac.repositories != nil && ac.repositories.MatchString(name)
+}
+
+// anonymousChallenge implements the Challenge interface for denied anonymous
+// access.
+type anonymousChallenge struct{}
+
+var _ Challenge = anonymousChallenge{}
+
+// SetHeaders does not set any header, as there are no credentials which an
+// anonymous client could provide.
+func (anonymousChallenge) SetHeaders(r *http.Request, w http.ResponseWriter) {}
+
+func (anonymousChallenge) Error() string {
+	return ErrAnonymousAccessDenied.Error()
+}
+
+// Unwrap returns ErrAnonymousAccessDenied.
+func (anonymousChallenge) Unwrap() error {
+	return ErrAnonymousAccessDenied
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+)
+
+// chain is an AccessController which consults a list of access controllers
+// in order.
+type chain []AccessController
+
+// NewChain returns an AccessController which consults the given access
+// controllers in order. The first controller to grant access authorizes the
+// request. A controller defers to the next one by returning a Challenge. If
+// every controller defers, the returned Challenge sets the challenge headers
+// of all of them. Any other error denies the request immediately.
+func NewChain(controllers ...AccessController) AccessController {
+	return chain(controllers)
+}
+
+// Authorized implements AccessController.
+func (c chain) Authorized(r *http.Request, access ...Access) (*Grant, error) {
+	challenges := make(chainChallenge, 0, len(c))
+	for _, ac := range c {
+		grant, err := ac.Authorized(r, access...)
+		if err == nil {
+			return grant, nil
+		}
+
+		ch, ok := err.(Challenge)
+		if !ok {
+			return nil, err
+		}
+		challenges = append(challenges, ch)
+	}
+
+	if len(challenges) == 0 {
+		return nil, ErrAuthenticationFailure
+	}
+	return nil, challenges
+}
+
+// chainChallenge combines the challenges returned by each access controller
+// of a chain.
+type chainChallenge []Challenge
+
+var _ Challenge = chainChallenge{}
+
+// SetHeaders sets the headers of every challenge in the chain, in order.
+// Header values set by different challenges are accumulated, so that the
+// response lists every WWW-Authenticate challenge.
+func (cc chainChallenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	for _, ch := range cc {
+		hw := &headerWriter{header: make(http.Header)}
+		ch.SetHeaders(r, hw)
+		for k, values := range hw.header {
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+}
+
+func (cc chainChallenge) Error() string {
+	msgs := make([]string, 0, len(cc))
+	for _, ch := range cc {
+		msgs = append(msgs, ch.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors of the challenges in the chain.
+func (cc chainChallenge) Unwrap() []error {
+	errs := make([]error, 0, len(cc))
+	for _, ch := range cc {
+		errs = append(errs, ch)
+	}
+	return errs
+}
+
+// headerWriter is an http.ResponseWriter which only records headers.
+type headerWriter struct {
+	header http.Header
+}
+
+func (hw *headerWriter) Header() http.Header         { return hw.header }
+func (hw *headerWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (hw *headerWriter) WriteHeader(int)             {}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type testChallenge string
+
+func (ch testChallenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", string(ch))
+}
+
+func (ch testChallenge) Error() string {
+	return fmt.Sprintf("test challenge %q", string(ch))
+}
+
+type testAccessController struct {
+	grant *Grant
+	err   error
+}
+
+func (ac testAccessController) Authorized(r *http.Request, access ...Access) (*Grant, error) {
+	return ac.grant, ac.err
+}
+
+func TestChain(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	pull := Access{Resource: Resource{Type: "repository", Name: "public/app"}, Action: "pull"}
+
+	basic := testAccessController{err: testChallenge(`Basic realm="basic"`)}
+	bearer := testAccessController{err: testChallenge(`Bearer realm="bearer"`)}
+	granted := testAccessController{grant: &Grant{User: UserInfo{Name: "user"}}}
+	failed := testAccessController{err: errors.New("backend unavailable")}
+
+	grant, err := NewChain(basic, granted, failed).Authorized(req, pull)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grant.User.Name != "user" {
+		t.Fatalf("unexpected user %q", grant.User.Name)
+	}
+
+	if _, err := NewChain(basic, failed, granted).Authorized(req, pull); err == nil || err.Error() != "backend unavailable" {
+		t.Fatalf("expected the backend error, got %v", err)
+	}
+
+	_, err = NewChain(basic, bearer).Authorized(req, pull)
+	ch, ok := err.(Challenge)
+	if !ok {
+		t.Fatalf("expected a challenge, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	ch.SetHeaders(req, w)
+	expected := []string{`Basic realm="basic"`, `Bearer realm="bearer"`}
+	if actual := w.Header().Values("WWW-Authenticate"); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("unexpected challenge headers: %q != %q", expected, actual)
+	}
+
+	anonymous, err := NewAnonymousAccessController([]string{"public/.*"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewChain(basic, anonymous).Authorized(req, pull); err != nil {
+		t.Fatalf("expected anonymous pull to be granted, got %v", err)
+	}
+
+	push := Access{Resource: pull.Resource, Action: "push"}
+	if _, err := NewChain(basic, anonymous).Authorized(req, pull, push); !errors.Is(err, ErrAnonymousAccessDenied) {
+		t.Fatalf("expected anonymous push to be denied, got %v", err)
+	}
+	if _, err := NewChain(basic, anonymous).Authorized(req); !errors.Is(err, ErrAnonymousAccessDenied) {
+		t.Fatalf("expected anonymous access to the base route to be denied, got %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+// Package mtls provides an access controller that authenticates requests
+// using the verified TLS client certificate presented on the connection.
+//
+// The identity of the client is taken from the leaf certificate of the first
+// verified chain, either from the subject common name, a URI or email
+// subject alternative name, or a SPIFFE ID. Access to resources is then
+// granted by a list of rules matching identities to repositories and
+// actions.
+//
+// This access controller requires the registry to be configured with
+// http.tls.clientcas so that client certificates are verified during the TLS
+// handshake.
+package mtls
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	if err := auth.Register("mtls", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register mtls auth: %v", err)
+	}
+}
+
+// Errors used and exported by this package.
+var (
+	ErrCertificateRequired = errors.New("verified client certificate required")
+	ErrIdentityNotFound    = errors.New("no identity found in client certificate")
+	ErrInsufficientScope   = errors.New("insufficient scope")
+)
+
+// Identity sources which can be used to derive the user name from a client
+// certificate.
+const (
+	IdentityCommonName = "commonname"
+	IdentityURI        = "uri"
+	IdentityEmail      = "email"
+	IdentitySPIFFE     = "spiffe"
+)
+
+var defaultIdentitySources = []string{IdentityCommonName}
+
+// rule grants a set of actions on the matching repositories to the matching
+// identities.
+type rule struct {
+	identities   *regexp.Regexp
+	repositories *regexp.Regexp
+	catalog      bool
+	actions      map[string]struct{}
+}
+
+// allows returns whether the rule grants the access to the identity.
+func (r rule) allows(identity string, access auth.Access) bool {
+	if !r.identities.MatchString(identity) {
+		return false
+	}
+
+	switch access.Type {
+	case "repository":
+		if r.repositories == nil || !r.repositories.MatchString(access.Name) {
+			return false
+		}
+	case "registry":
+		if !r.catalog || access.Name != "catalog" {
+			return false
+		}
+		// catalog access is requested with the wildcard action
+		return true
+	default:
+		return false
+	}
+
+	if _, ok := r.actions["*"]; ok {
+		return true
+	}
+	_, ok := r.actions[access.Action]
+	return ok
+}
+
+type accessController struct {
+	realm   string
+	sources []string
+	rules   []rule
+}
+
+var _ auth.AccessController = &accessController{}
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	realm, present := options["realm"]
+	if _, ok := realm.(string); !present || !ok {
+		return nil, fmt.Errorf(`"realm" must be set for mtls access controller`)
+	}
+
+	sources, err := parseIdentitySources(options["identity"])
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := parseRules(options["access"])
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessController{
+		realm:   realm.(string),
+		sources: sources,
+		rules:   rules,
+	}, nil
+}
+
+// Authorized checks that the request was made over a TLS connection with a
+// verified client certificate and that the identity in the certificate is
+// granted all of the requested access.
+func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, &challenge{realm: ac.realm, err: ErrCertificateRequired}
+	}
+
+	identity := identityFromCertificate(req.TLS.VerifiedChains[0][0], ac.sources)
+	if identity == "" {
+		return nil, &challenge{realm: ac.realm, err: ErrIdentityNotFound}
+	}
+
+	resources := make([]auth.Resource, 0, len(accessRecords))
+	seen := make(map[auth.Resource]struct{}, len(accessRecords))
+	for _, access := range accessRecords {
+		if !ac.allows(identity, access) {
+			dcontext.GetLogger(req.Context()).Errorf("client certificate identity %q is not granted %s access to %s:%s", identity, access.Action, access.Type, access.Name)
+			return nil, &challenge{realm: ac.realm, err: ErrInsufficientScope}
+		}
+		if _, ok := seen[access.Resource]; !ok {
+			seen[access.Resource] = struct{}{}
+			resources = append(resources, access.Resource)
+		}
+	}
+
+	return &auth.Grant{
+		User:      auth.UserInfo{Name: identity},
+		Resources: resources,
+	}, nil
+}
+
+func (ac *accessController) allows(identity string, access auth.Access) bool {
+	for _, r := range ac.rules {
+		if r.allows(identity, access) {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders does not set any header: there is no HTTP authentication
+// scheme for client certificates, which are requested during the TLS
+// handshake instead.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("mtls authentication challenge for realm %q: %s", ch.realm, ch.err)
+}
+
+// Unwrap returns the underlying error of the challenge.
+func (ch challenge) Unwrap() error {
+	return ch.err
+}
+
+func parseIdentitySources(v interface{}) ([]string, error) {
+	if v == nil {
+		return defaultIdentitySources, nil
+	}
+
+	values, err := stringList(v)
+	if err != nil {
+		return nil, fmt.Errorf("mtls identity: %v", err)
+	}
+	for _, source := range values {
+		switch source {
+		case IdentityCommonName, IdentityURI, IdentityEmail, IdentitySPIFFE:
+		default:
+			return nil, fmt.Errorf("mtls identity: unknown identity source %q", source)
+		}
+	}
+	if len(values) == 0 {
+		return defaultIdentitySources, nil
+	}
+	return values, nil
+}
+
+func parseRules(v interface{}) ([]rule, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("mtls access must be a list of rules")
+	}
+
+	rules := make([]rule, 0, len(items))
+	for i, item := range items {
+		m, err := stringMap(item)
+		if err != nil {
+			return nil, fmt.Errorf("mtls access rule %d: %v", i, err)
+		}
+
+		var r rule
+		identities, err := stringList(m["identities"])
+		if err != nil {
+			return nil, fmt.Errorf("mtls access rule %d: identities: %v", i, err)
+		}
+		if len(identities) == 0 {
+			return nil, fmt.Errorf("mtls access rule %d: identities must be set", i)
+		}
+		if r.identities, err = compilePatterns(identities); err != nil {
+			return nil, fmt.Errorf("mtls access rule %d: identities: %v", i, err)
+		}
+
+		repositories, err := stringList(m["repositories"])
+		if err != nil {
+			return nil, fmt.Errorf("mtls access rule %d: repositories: %v", i, err)
+		}
+		if len(repositories) > 0 {
+			if r.repositories, err = compilePatterns(repositories); err != nil {
+				return nil, fmt.Errorf("mtls access rule %d: repositories: %v", i, err)
+			}
+		}
+
+		actions, err := stringList(m["actions"])
+		if err != nil {
+			return nil, fmt.Errorf("mtls access rule %d: actions: %v", i, err)
+		}
+		r.actions = make(map[string]struct{}, len(actions))
+		for _, action := range actions {
+			r.actions[action] = struct{}{}
+		}
+
+		if c, ok := m["catalog"]; ok {
+			if r.catalog, ok = c.(bool); !ok {
+				return nil, fmt.Errorf("mtls access rule %d: catalog must be a boolean", i)
+			}
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// compilePatterns compiles a list of regular expressions into a single
+// expression which must match the whole input.
+func compilePatterns(patterns []string) (*regexp.Regexp, error) {
+	wrapped := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return nil, err
+		}
+		wrapped = append(wrapped, fmt.Sprintf("(?:%s)", p))
+	}
+	return regexp.Compile("^(?:" + strings.Join(wrapped, "|") + ")$")
+}
+
+// stringMap converts a map decoded from the configuration into a map keyed
+// by strings.
+func stringMap(v interface{}) (map[string]interface{}, error) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid key %v", k)
+			}
+			res[key] = v
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("expected a map, got %T", v)
+	}
+}
+
+// stringList converts a string or a list of strings decoded from the
+// configuration into a list of strings.
+func stringList(v interface{}) ([]string, error) {
+	switch l := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{l}, nil
+	case []string:
+		return l, nil
+	case []interface{}:
+		res := make([]string, 0, len(l))
+		for _, item := range l {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string, got %T", item)
+			}
+			res = append(res, s)
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("expected a string or a list of strings, got %T", v)
+	}
+}
@@ -0,0 +1,136 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+func newTestRequest(cert *x509.Certificate) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "https://registry.example.com/v2/", nil)
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}
+	}
+	return req
+}
+
+func TestIdentityFromCertificate(t *testing.T) {
+	spiffeID, _ := url.Parse("spiffe://example.org/ci/builder")
+	otherURI, _ := url.Parse("https://example.org/workload")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "builder"},
+		URIs:           []*url.URL{otherURI, spiffeID},
+		EmailAddresses: []string{"builder@example.org"},
+	}
+
+	for _, tc := range []struct {
+		sources  []string
+		expected string
+	}{
+		{[]string{IdentityCommonName}, "builder"},
+		{[]string{IdentityURI}, "https://example.org/workload"},
+		{[]string{IdentityEmail}, "builder@example.org"},
+		{[]string{IdentitySPIFFE}, "spiffe://example.org/ci/builder"},
+		{[]string{IdentitySPIFFE, IdentityCommonName}, "spiffe://example.org/ci/builder"},
+	} {
+		if got := identityFromCertificate(cert, tc.sources); got != tc.expected {
+			t.Errorf("identity from %v: expected %q, got %q", tc.sources, tc.expected, got)
+		}
+	}
+
+	if got := identityFromCertificate(&x509.Certificate{}, []string{IdentitySPIFFE, IdentityCommonName}); got != "" {
+		t.Errorf("expected empty identity, got %q", got)
+	}
+}
+
+func TestAccessController(t *testing.T) {
+	options := map[string]interface{}{
+		"realm":    "test-realm",
+		"identity": []interface{}{"spiffe", "commonname"},
+		"access": []interface{}{
+			map[interface{}]interface{}{
+				"identities":   []interface{}{"spiffe://example.org/ci/.*"},
+				"repositories": []interface{}{"ci/.*"},
+				"actions":      []interface{}{"pull", "push"},
+			},
+			map[interface{}]interface{}{
+				"identities":   "reader",
+				"repositories": ".*",
+				"actions":      []interface{}{"pull"},
+				"catalog":      true,
+			},
+		},
+	}
+
+	ac, err := newAccessController(options)
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	spiffeID, _ := url.Parse("spiffe://example.org/ci/builder")
+	builder := &x509.Certificate{URIs: []*url.URL{spiffeID}}
+	reader := &x509.Certificate{Subject: pkix.Name{CommonName: "reader"}}
+
+	push := func(repo string) []auth.Access {
+		resource := auth.Resource{Type: "repository", Name: repo}
+		return []auth.Access{{Resource: resource, Action: "pull"}, {Resource: resource, Action: "push"}}
+	}
+	catalog := auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}
+
+	for _, tc := range []struct {
+		name     string
+		cert     *x509.Certificate
+		access   []auth.Access
+		expected error
+	}{
+		{"no certificate", nil, push("ci/app"), ErrCertificateRequired},
+		{"no identity", &x509.Certificate{}, push("ci/app"), ErrIdentityNotFound},
+		{"push allowed", builder, push("ci/app"), nil},
+		{"push other repository", builder, push("prod/app"), ErrInsufficientScope},
+		{"push without rule", reader, push("ci/app"), ErrInsufficientScope},
+		{"pull allowed", reader, push("prod/app")[:1], nil},
+		{"catalog allowed", reader, []auth.Access{catalog}, nil},
+		{"catalog denied", builder, []auth.Access{catalog}, ErrInsufficientScope},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			grant, err := ac.Authorized(newTestRequest(tc.cert), tc.access...)
+			if tc.expected != nil {
+				if !errors.Is(err, tc.expected) {
+					t.Fatalf("expected error %v, got %v", tc.expected, err)
+				}
+				if _, ok := err.(auth.Challenge); !ok {
+					t.Fatalf("expected challenge, got %T", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if grant.User.Name != identityFromCertificate(tc.cert, []string{IdentitySPIFFE, IdentityCommonName}) {
+				t.Fatalf("unexpected user name %q", grant.User.Name)
+			}
+		})
+	}
+}
+
+func TestAccessControllerOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"realm": "test-realm", "identity": "serialnumber"},
+		{"realm": "test-realm", "access": []interface{}{map[string]interface{}{"repositories": ".*"}}},
+		{"realm": "test-realm", "access": []interface{}{map[string]interface{}{"identities": "("}}},
+	} {
+		if _, err := newAccessController(options); err == nil {
+			t.Errorf("expected error for options %v", options)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"strings"
+)
+
+// identityFromCertificate returns the identity of the certificate from the
+// first source which yields a non-empty value, or the empty string if none
+// does.
+func identityFromCertificate(cert *x509.Certificate, sources []string) string {
+	for _, source := range sources {
+		switch source {
+		case IdentityCommonName:
+			if cert.Subject.CommonName != "" {
+				return cert.Subject.CommonName
+			}
+		case IdentityURI:
+			if len(cert.URIs) > 0 {
+				return cert.URIs[0].String()
+			}
+		case IdentityEmail:
+			if len(cert.EmailAddresses) > 0 {
+				return cert.EmailAddresses[0]
+			}
+		case IdentitySPIFFE:
+			// A SPIFFE X.509-SVID carries exactly one URI SAN with the spiffe
+			// scheme.
+			for _, u := range cert.URIs {
+				if strings.EqualFold(u.Scheme, "spiffe") && u.Host != "" {
+					return u.String()
+				}
+			}
+		}
+	}
+	return ""
+}
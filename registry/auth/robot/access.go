@@ -0,0 +1,108 @@
+package robot
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+// ErrInsufficientScope is returned when a robot account is not granted the
+// requested access.
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+type accessController struct {
+	realm string
+	store Store
+}
+
+var _ auth.AccessController = &accessController{}
+
+// NewAccessController returns an AccessController authenticating robot
+// accounts of the store. Requests which do not authenticate as a robot
+// account are answered with a basic challenge, so that the controller can be
+// chained with other access controllers.
+func NewAccessController(store Store, options map[string]interface{}) (auth.AccessController, error) {
+	realm, present := options["realm"]
+	if _, ok := realm.(string); !present || !ok {
+		return nil, fmt.Errorf(`"realm" must be set for robot access controller`)
+	}
+
+	return &accessController{realm: realm.(string), store: store}, nil
+}
+
+func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
+	username, token, ok := req.BasicAuth()
+	if !ok || !strings.HasPrefix(username, UsernamePrefix) {
+		return nil, &challenge{realm: ac.realm, err: auth.ErrInvalidCredential}
+	}
+	name := strings.TrimPrefix(username, UsernamePrefix)
+
+	ctx := req.Context()
+	account, err := ac.store.Get(ctx, name)
+	if err != nil {
+		if err == ErrAccountUnknown {
+			dcontext.GetLogger(ctx).Errorf("error authenticating robot account %q: %v", name, err)
+			return nil, &challenge{realm: ac.realm, err: auth.ErrAuthenticationFailure}
+		}
+		return nil, err
+	}
+
+	if !account.VerifyToken(token) {
+		dcontext.GetLogger(ctx).Errorf("error authenticating robot account %q: invalid token", name)
+		return nil, &challenge{realm: ac.realm, err: auth.ErrAuthenticationFailure}
+	}
+	if err := account.Active(time.Now()); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error authenticating robot account %q: %v", name, err)
+		return nil, &challenge{realm: ac.realm, err: err}
+	}
+
+	actions := make(map[string]struct{}, len(account.Actions))
+	for _, action := range account.Actions {
+		actions[action] = struct{}{}
+	}
+
+	resources := make([]auth.Resource, 0, len(accessRecords))
+	for _, access := range accessRecords {
+		_, allowed := actions[access.Action]
+		if _, all := actions["*"]; all {
+			allowed = true
+		}
+		if access.Type != "repository" || !allowed || !account.matchRepository(access.Name) {
+			dcontext.GetLogger(ctx).Errorf("robot account %q is not granted %s access to %s:%s", name, access.Action, access.Type, access.Name)
+			return nil, &challenge{realm: ac.realm, err: ErrInsufficientScope}
+		}
+		resources = append(resources, access.Resource)
+	}
+
+	return &auth.Grant{
+		User:      auth.UserInfo{Name: account.Username()},
+		Resources: resources,
+	}, nil
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("robot authentication challenge for realm %q: %s", ch.realm, ch.err)
+}
+
+// Unwrap returns the underlying error of the challenge.
+func (ch challenge) Unwrap() error {
+	return ch.err
+}
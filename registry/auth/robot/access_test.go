@@ -0,0 +1,158 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestAccessController(t *testing.T) {
+	ctx := context.Background()
+	store := NewDriverStore(inmemory.New())
+
+	account := &Account{
+		Name:         "ci",
+		Repositories: []string{"team/.*"},
+		Actions:      []string{"pull", "push"},
+		CreatedAt:    time.Now(),
+		ExpiresAt:    time.Now().Add(time.Hour),
+	}
+	if err := account.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	token, err := account.GenerateToken()
+	if err != nil {
+		t.Fatalf("unexpected error generating token: %v", err)
+	}
+	if err := store.Create(ctx, account); err != nil {
+		t.Fatalf("unexpected error creating account: %v", err)
+	}
+	if err := store.Create(ctx, account); err != ErrAccountExists {
+		t.Fatalf("expected ErrAccountExists, got %v", err)
+	}
+
+	ac, err := NewAccessController(store, map[string]interface{}{"realm": "robots"})
+	if err != nil {
+		t.Fatalf("unexpected error creating access controller: %v", err)
+	}
+
+	access := func(name, action string) auth.Access {
+		return auth.Access{Resource: auth.Resource{Type: "repository", Name: name}, Action: action}
+	}
+	authorize := func(username, password string, accessRecords ...auth.Access) (*auth.Grant, error) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		return ac.Authorized(req, accessRecords...)
+	}
+
+	grant, err := authorize("robot$ci", token, access("team/app", "pull"), access("team/app", "push"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grant.User.Name != "robot$ci" || len(grant.Resources) != 2 {
+		t.Fatalf("unexpected grant: %+v", grant)
+	}
+
+	for _, tc := range []struct {
+		username, password string
+		access             auth.Access
+		err                error
+	}{
+		{"", "", access("team/app", "pull"), auth.ErrInvalidCredential},
+		{"ci", token, access("team/app", "pull"), auth.ErrInvalidCredential},
+		{"robot$ci", "wrong", access("team/app", "pull"), auth.ErrAuthenticationFailure},
+		{"robot$unknown", token, access("team/app", "pull"), auth.ErrAuthenticationFailure},
+		{"robot$ci", token, access("team/app", "delete"), ErrInsufficientScope},
+		{"robot$ci", token, access("teams/app", "pull"), ErrInsufficientScope},
+		{"robot$ci", token, auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}, ErrInsufficientScope},
+	} {
+		_, err := authorize(tc.username, tc.password, tc.access)
+		if _, ok := err.(auth.Challenge); !ok || !errors.Is(err, tc.err) {
+			t.Fatalf("%s %v: expected a challenge for %v, got %v", tc.username, tc.access, tc.err, err)
+		}
+	}
+
+	revokedAt := time.Now()
+	account.RevokedAt = &revokedAt
+	if err := store.Update(ctx, account); err != nil {
+		t.Fatalf("unexpected error updating account: %v", err)
+	}
+	if _, err := authorize("robot$ci", token, access("team/app", "pull")); !errors.Is(err, ErrAccountRevoked) {
+		t.Fatalf("expected ErrAccountRevoked, got %v", err)
+	}
+
+	accounts, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing accounts: %v", err)
+	}
+	if len(accounts) != 1 || accounts[0].Name != "ci" || accounts[0].RevokedAt == nil {
+		t.Fatalf("unexpected accounts: %+v", accounts)
+	}
+}
+
+func TestAccountValidate(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour)
+	for _, account := range []Account{
+		{Name: "CI", Repositories: []string{".*"}, Actions: []string{"pull"}, ExpiresAt: expiresAt},
+		{Name: "ci", Actions: []string{"pull"}, ExpiresAt: expiresAt},
+		{Name: "ci", Repositories: []string{".*"}, ExpiresAt: expiresAt},
+		{Name: "ci", Repositories: []string{".*"}, Actions: []string{"admin"}, ExpiresAt: expiresAt},
+		{Name: "ci", Repositories: []string{"("}, Actions: []string{"pull"}, ExpiresAt: expiresAt},
+		{Name: "ci", Repositories: []string{".*"}, Actions: []string{"pull"}},
+	} {
+		if err := account.Validate(); err == nil {
+			t.Fatalf("expected account %+v to be invalid", account)
+		}
+	}
+
+	expired := Account{ExpiresAt: time.Now().Add(-time.Second)}
+	if err := expired.Active(time.Now()); err != ErrAccountExpired {
+		t.Fatalf("expected ErrAccountExpired, got %v", err)
+	}
+}
+
+func TestDriverStoreCreateConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := NewDriverStore(inmemory.New())
+
+	const creates = 8
+	errs := make(chan error, creates)
+	for i := 0; i < creates; i++ {
+		go func() {
+			account := &Account{
+				Name:         "ci",
+				Repositories: []string{"team/.*"},
+				Actions:      []string{"pull"},
+				CreatedAt:    time.Now(),
+				ExpiresAt:    time.Now().Add(time.Hour),
+			}
+			if _, err := account.GenerateToken(); err != nil {
+				errs <- err
+				return
+			}
+			errs <- store.Create(ctx, account)
+		}()
+	}
+
+	created := 0
+	for i := 0; i < creates; i++ {
+		switch err := <-errs; err {
+		case nil:
+			created++
+		case ErrAccountExists:
+		default:
+			t.Fatalf("unexpected error creating account: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("expected exactly one account to be created, got %d", created)
+	}
+}
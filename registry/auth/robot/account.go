@@ -0,0 +1,172 @@
+// Package robot provides robot accounts: long-lived API tokens managed by the
+// registry, limited to a set of repositories and actions and with an expiry.
+//
+// Robot accounts are kept in a Store, backed either by the registry storage
+// driver or by Redis. Clients authenticate with HTTP basic authentication,
+// using the "robot$" prefixed account name as username and the token as
+// password.
+package robot
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// UsernamePrefix prefixes the name of robot accounts in the username of
+// requests, setting them apart from other users.
+const UsernamePrefix = "robot$"
+
+// tokenSize is the number of random bytes of a robot token.
+const tokenSize = 32
+
+var nameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+
+// Errors used and exported by this package.
+var (
+	ErrAccountUnknown = errors.New("robot account unknown")
+	ErrAccountExists  = errors.New("robot account already exists")
+	ErrAccountRevoked = errors.New("robot account revoked")
+	ErrAccountExpired = errors.New("robot account expired")
+	ErrInvalidName    = errors.New("invalid robot account name")
+)
+
+// Account describes a robot account.
+type Account struct {
+	// Name identifies the account.
+	Name string `json:"name"`
+
+	// Description is a free-form description of the account.
+	Description string `json:"description,omitempty"`
+
+	// Repositories are regular expressions matching the whole name of the
+	// repositories the account has access to.
+	Repositories []string `json:"repositories"`
+
+	// Actions are the actions the account may perform on the repositories,
+	// such as pull, push, delete, or * for all of them.
+	Actions []string `json:"actions"`
+
+	// TokenDigest is the digest of the token of the account. The token
+	// itself is never stored.
+	TokenDigest digest.Digest `json:"tokenDigest,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+
+	// ExpiresAt is the time after which the token is not accepted anymore.
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// RevokedAt is set when the account is revoked. Revoked accounts are
+	// kept so that they can be audited.
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+	RevokedBy string     `json:"revokedBy,omitempty"`
+
+	// repositories is the compiled expression of Repositories, set when the
+	// account is loaded from a store.
+	repositories *regexp.Regexp
+}
+
+// Validate checks that the account is well formed.
+func (a *Account) Validate() error {
+	if !nameRegexp.MatchString(a.Name) {
+		return ErrInvalidName
+	}
+	if len(a.Repositories) == 0 {
+		return fmt.Errorf("robot account %s must be granted at least one repository", a.Name)
+	}
+	if len(a.Actions) == 0 {
+		return fmt.Errorf("robot account %s must be granted at least one action", a.Name)
+	}
+	for _, action := range a.Actions {
+		switch action {
+		case "pull", "push", "delete", "*":
+		default:
+			return fmt.Errorf("robot account %s: unknown action %q", a.Name, action)
+		}
+	}
+	if _, err := compilePatterns(a.Repositories); err != nil {
+		return fmt.Errorf("robot account %s: %v", a.Name, err)
+	}
+	if a.ExpiresAt.IsZero() {
+		return fmt.Errorf("robot account %s must have an expiry", a.Name)
+	}
+	return nil
+}
+
+// compile compiles the repository patterns of the account.
+func (a *Account) compile() error {
+	repositories, err := compilePatterns(a.Repositories)
+	if err != nil {
+		return fmt.Errorf("robot account %s: %v", a.Name, err)
+	}
+	a.repositories = repositories
+	return nil
+}
+
+// matchRepository returns whether the account is granted access to the
+// repository. The patterns are compiled if the account was not loaded from a
+// store.
+func (a *Account) matchRepository(name string) bool {
+	if a.repositories == nil && a.compile() != nil {
+		return false
+	}
+	return a.repositories.MatchString(name)
+}
+
+// Active returns an error if the account cannot be used at the given time.
+func (a *Account) Active(now time.Time) error {
+	if a.RevokedAt != nil {
+		return ErrAccountRevoked
+	}
+	if !now.Before(a.ExpiresAt) {
+		return ErrAccountExpired
+	}
+	return nil
+}
+
+// Username returns the username with which clients authenticate as the
+// account.
+func (a *Account) Username() string {
+	return UsernamePrefix + a.Name
+}
+
+// GenerateToken generates a new random token for the account, stores its
+// digest in the account and returns it.
+func (a *Account) GenerateToken() (string, error) {
+	var b [tokenSize]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("could not generate robot token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b[:])
+	a.TokenDigest = digest.FromString(token)
+	return token, nil
+}
+
+// VerifyToken returns whether the token is the token of the account.
+func (a *Account) VerifyToken(token string) bool {
+	if a.TokenDigest == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(a.TokenDigest), []byte(digest.FromString(token))) == 1
+}
+
+// compilePatterns compiles a list of regular expressions into a single
+// expression which must match the whole input.
+func compilePatterns(patterns []string) (*regexp.Regexp, error) {
+	wrapped := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %v", p, err)
+		}
+		wrapped = append(wrapped, fmt.Sprintf("(?:%s)", p))
+	}
+	return regexp.Compile("^(?:" + strings.Join(wrapped, "|") + ")$")
+}
@@ -0,0 +1,213 @@
+package robot
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sync"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/redis/go-redis/v9"
+)
+
+// Store persists robot accounts.
+type Store interface {
+	// Get returns the named account, or ErrAccountUnknown.
+	Get(ctx context.Context, name string) (*Account, error)
+
+	// Create stores a new account, or returns ErrAccountExists.
+	Create(ctx context.Context, account *Account) error
+
+	// Update replaces a stored account.
+	Update(ctx context.Context, account *Account) error
+
+	// List returns all the stored accounts, including revoked ones.
+	List(ctx context.Context) ([]*Account, error)
+}
+
+// driverStorePathRoot is the path under which robot accounts are stored by
+// the storage driver store, next to the repositories of the registry.
+const driverStorePathRoot = "/docker/registry/v2/robots"
+
+type driverStore struct {
+	driver storagedriver.StorageDriver
+
+	// createMu serializes the creation of accounts, which checks that the
+	// account does not exist before writing it.
+	createMu sync.Mutex
+}
+
+// NewDriverStore returns a Store keeping robot accounts as JSON files in the
+// given storage driver.
+func NewDriverStore(driver storagedriver.StorageDriver) Store {
+	return &driverStore{driver: driver}
+}
+
+// decodeAccount unmarshals a stored account and compiles its repository
+// patterns.
+func decodeAccount(p []byte) (*Account, error) {
+	var account Account
+	if err := json.Unmarshal(p, &account); err != nil {
+		return nil, err
+	}
+	if err := account.compile(); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (s *driverStore) accountPath(name string) string {
+	return path.Join(driverStorePathRoot, name, "account")
+}
+
+func (s *driverStore) Get(ctx context.Context, name string) (*Account, error) {
+	if !nameRegexp.MatchString(name) {
+		return nil, ErrAccountUnknown
+	}
+
+	p, err := s.driver.GetContent(ctx, s.accountPath(name))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, ErrAccountUnknown
+		}
+		return nil, err
+	}
+
+	return decodeAccount(p)
+}
+
+// Create checks that the account does not exist before writing it. Creations
+// are serialized within the registry instance, and the account is read back
+// once written, so that a concurrent creation by another instance overwriting
+// it is reported as a conflict rather than silently replacing its token.
+func (s *driverStore) Create(ctx context.Context, account *Account) error {
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+
+	if _, err := s.Get(ctx, account.Name); err == nil {
+		return ErrAccountExists
+	} else if err != ErrAccountUnknown {
+		return err
+	}
+	if err := s.Update(ctx, account); err != nil {
+		return err
+	}
+
+	stored, err := s.Get(ctx, account.Name)
+	if err != nil {
+		return err
+	}
+	if stored.TokenDigest != account.TokenDigest {
+		return ErrAccountExists
+	}
+	return nil
+}
+
+func (s *driverStore) Update(ctx context.Context, account *Account) error {
+	p, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	return s.driver.PutContent(ctx, s.accountPath(account.Name), p)
+}
+
+func (s *driverStore) List(ctx context.Context) ([]*Account, error) {
+	dirs, err := s.driver.List(ctx, driverStorePathRoot)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	accounts := make([]*Account, 0, len(dirs))
+	for _, dir := range dirs {
+		account, err := s.Get(ctx, path.Base(dir))
+		if err != nil {
+			if err == ErrAccountUnknown {
+				continue
+			}
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
+
+// redisStore keeps each account as JSON in a redis key, and the names of all
+// accounts in a redis set.
+type redisStore struct {
+	pool redis.UniversalClient
+}
+
+// NewRedisStore returns a Store keeping robot accounts in redis.
+func NewRedisStore(pool redis.UniversalClient) Store {
+	return &redisStore{pool: pool}
+}
+
+const redisAccountsKey = "robots"
+
+func (s *redisStore) accountKey(name string) string {
+	return "robots::" + name
+}
+
+func (s *redisStore) Get(ctx context.Context, name string) (*Account, error) {
+	p, err := s.pool.Get(ctx, s.accountKey(name)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrAccountUnknown
+		}
+		return nil, err
+	}
+
+	return decodeAccount(p)
+}
+
+func (s *redisStore) Create(ctx context.Context, account *Account) error {
+	p, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+
+	created, err := s.pool.SetNX(ctx, s.accountKey(account.Name), p, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return ErrAccountExists
+	}
+	return s.pool.SAdd(ctx, redisAccountsKey, account.Name).Err()
+}
+
+func (s *redisStore) Update(ctx context.Context, account *Account) error {
+	p, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+
+	pipe := s.pool.TxPipeline()
+	pipe.Set(ctx, s.accountKey(account.Name), p, 0)
+	pipe.SAdd(ctx, redisAccountsKey, account.Name)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisStore) List(ctx context.Context) ([]*Account, error) {
+	names, err := s.pool.SMembers(ctx, redisAccountsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make([]*Account, 0, len(names))
+	for _, name := range names {
+		account, err := s.Get(ctx, name)
+		if err != nil {
+			if err == ErrAccountUnknown {
+				continue
+			}
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// defaultAdmissionTimeout bounds the calls to webhooks configured
+	// without a timeout.
+	defaultAdmissionTimeout = 10 * time.Second
+
+	// maxAdmissionConfigSize is the size of the largest config blob sent to
+	// the webhooks.
+	maxAdmissionConfigSize = 4 << 20
+
+	// maxAdmissionResponseSize is the size of the largest response read from
+	// the webhooks.
+	maxAdmissionResponseSize = 64 << 10
+)
+
+// admissionReview is the request body posted to the webhooks.
+type admissionReview struct {
+	// Repository is the name of the repository the manifest is pushed to.
+	Repository string `json:"repository"`
+
+	// Tag is the tag the manifest is pushed by, if any.
+	Tag string `json:"tag,omitempty"`
+
+	// Digest and MediaType describe the pushed manifest.
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+
+	// Manifest is the pushed manifest.
+	Manifest json.RawMessage `json:"manifest"`
+
+	// Config is the config blob of image manifests, when it is a JSON
+	// document of at most 4MiB.
+	Config json.RawMessage `json:"config,omitempty"`
+
+	// Actor is the user pushing the manifest.
+	Actor admissionActor `json:"actor"`
+}
+
+type admissionActor struct {
+	Name string `json:"name,omitempty"`
+}
+
+// admissionResponse is the response body expected from the webhooks.
+type admissionResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// admissionWebhook is a validating webhook called with the manifests pushed
+// to the repositories it applies to.
+type admissionWebhook struct {
+	name         string
+	url          string
+	headers      http.Header
+	timeout      time.Duration
+	failOpen     bool
+	repositories *regexp.Regexp
+	client       *http.Client
+}
+
+// newAdmissionWebhooks prepares the webhooks of the admission configuration.
+func newAdmissionWebhooks(config configuration.Admission) ([]*admissionWebhook, error) {
+	var webhooks []*admissionWebhook
+	for _, wh := range config.Webhooks {
+		if wh.Name == "" {
+			return nil, fmt.Errorf("admission webhooks require a name")
+		}
+		if wh.URL == "" {
+			return nil, fmt.Errorf("admission webhook %s requires a url", wh.Name)
+		}
+		if wh.Timeout < 0 {
+			return nil, fmt.Errorf("admission webhook %s: timeout must not be negative", wh.Name)
+		}
+
+		webhook := &admissionWebhook{
+			name:     wh.Name,
+			url:      wh.URL,
+			headers:  wh.Headers,
+			timeout:  wh.Timeout,
+			failOpen: wh.FailOpen,
+			client:   &http.Client{},
+		}
+		if webhook.timeout == 0 {
+			webhook.timeout = defaultAdmissionTimeout
+		}
+
+		if len(wh.Repositories) > 0 {
+			wrapped := make([]string, 0, len(wh.Repositories))
+			for _, p := range wh.Repositories {
+				if _, err := regexp.Compile(p); err != nil {
+					return nil, fmt.Errorf("admission webhook %s: invalid repository pattern %q: %v", wh.Name, p, err)
+				}
+				wrapped = append(wrapped, fmt.Sprintf("(?:%s)", p))
+			}
+			webhook.repositories = regexp.MustCompile("^(?:" + strings.Join(wrapped, "|") + ")$")
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, nil
+}
+
+// applies returns true if the webhook applies to the repository.
+func (wh *admissionWebhook) applies(repository string) bool {
+	return wh.repositories == nil || wh.repositories.MatchString(repository)
+}
+
+// review posts the review to the webhook and returns its response.
+func (wh *admissionWebhook) review(ctx context.Context, body []byte) (*admissionResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, wh.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range wh.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var response admissionResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxAdmissionResponseSize)).Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return &response, nil
+}
+
+// admitManifest calls the webhooks applying to the repository with the
+// manifest pushed to it by the actor, and returns an error if a webhook
+// rejects it, or fails and is not configured to fail open. It is called
+// before manifests are stored, whether they are pushed or copied from
+// another repository.
+func (app *App) admitManifest(ctx context.Context, repository reference.Named, tag, actor string, manifest distribution.Manifest, desc distribution.Descriptor, payload []byte) error {
+	var webhooks []*admissionWebhook
+	for _, wh := range app.admission {
+		if wh.applies(repository.Name()) {
+			webhooks = append(webhooks, wh)
+		}
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	review := admissionReview{
+		Repository: repository.Name(),
+		Tag:        tag,
+		Digest:     desc.Digest,
+		MediaType:  desc.MediaType,
+		Manifest:   payload,
+		Actor:      admissionActor{Name: actor},
+	}
+
+	config, err := app.admissionConfig(ctx, repository, manifest)
+	if err != nil {
+		return err
+	}
+	review.Config = config
+
+	body, err := json.Marshal(review)
+	if err != nil {
+		return errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+
+	for _, wh := range webhooks {
+		response, err := wh.review(ctx, body)
+		if err != nil {
+			if wh.failOpen {
+				dcontext.GetLogger(ctx).Warnf("admission webhook %s failed, accepting manifest: %v", wh.name, err)
+				continue
+			}
+			dcontext.GetLogger(ctx).Errorf("admission webhook %s failed: %v", wh.name, err)
+			return errcode.ErrorCodeDenied.WithMessage(fmt.Sprintf("admission webhook %s failed", wh.name))
+		}
+
+		if !response.Allowed {
+			reason := response.Reason
+			if reason == "" {
+				reason = fmt.Sprintf("manifest rejected by admission webhook %s", wh.name)
+			}
+			return errcode.ErrorCodeDenied.WithMessage(reason)
+		}
+	}
+
+	return nil
+}
+
+// admissionConfig returns the config blob of image manifests, if it is a
+// JSON document small enough to be sent to the webhooks.
+func (app *App) admissionConfig(ctx context.Context, name reference.Named, manifest distribution.Manifest) (json.RawMessage, error) {
+	var config distribution.Descriptor
+	switch m := manifest.(type) {
+	case *schema2.DeserializedManifest:
+		config = m.Config
+	case *ocischema.DeserializedManifest:
+		config = m.Config
+	default:
+		return nil, nil
+	}
+	if config.Size > maxAdmissionConfigSize {
+		return nil, nil
+	}
+
+	// read the config from the registry rather than the decorated
+	// repository, to avoid reporting the read as a pull.
+	repository, err := app.registry.Repository(ctx, name)
+	if err != nil {
+		return nil, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	p, err := repository.Blobs(ctx).Get(ctx, config.Digest)
+	if err != nil {
+		if errors.Is(err, distribution.ErrBlobUnknown) {
+			// the manifest is verified, and rejected, when it is stored.
+			return nil, nil
+		}
+		return nil, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	if !json.Valid(p) {
+		return nil, nil
+	}
+	return p, nil
+}
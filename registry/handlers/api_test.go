@@ -17,6 +17,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/distribution/distribution/v3"
@@ -25,6 +26,7 @@ import (
 	"github.com/distribution/distribution/v3/manifest/schema2"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auth"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
@@ -1266,6 +1268,675 @@ func TestStartPushReadOnly(t *testing.T) {
 	checkResponse(t, "starting push in read-only mode", resp, http.StatusMethodNotAllowed)
 }
 
+// repositoryDenyingAccessController grants any access but to a set of
+// repositories.
+type repositoryDenyingAccessController struct {
+	denied map[string]struct{}
+}
+
+func (ac *repositoryDenyingAccessController) Authorized(r *http.Request, access ...auth.Access) (*auth.Grant, error) {
+	for _, a := range access {
+		if _, ok := ac.denied[a.Name]; ok {
+			return nil, fmt.Errorf("access to %s denied", a.Name)
+		}
+	}
+	return &auth.Grant{User: auth.UserInfo{Name: "test"}}, nil
+}
+
+func TestAutomaticBlobMount(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"mount":    configuration.Parameters{"automatic": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	secretName, _ := reference.WithName("secret/app")
+	sharedName, _ := reference.WithName("shared/app")
+	imageName, _ := reference.WithName("team/app")
+
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatalf("error creating random layer file: %v", err)
+	}
+	layerContent, err := io.ReadAll(layerFile)
+	if err != nil {
+		t.Fatalf("error reading layer file: %v", err)
+	}
+	// repositories are only enumerated once they hold manifests
+	createRepository(env, t, secretName.Name(), "latest")
+	createRepository(env, t, sharedName.Name(), "latest")
+
+	uploadURLBase, _ := startPushLayer(t, env, secretName)
+	pushLayer(t, env.builder, secretName, layerDigest, uploadURLBase, bytes.NewReader(layerContent))
+
+	env.app.accessController = &repositoryDenyingAccessController{
+		denied: map[string]struct{}{secretName.Name(): {}},
+	}
+
+	// the blob is only held by a repository the client cannot pull from
+	uploadURL, err := env.builder.BuildBlobUploadURL(imageName, url.Values{
+		"digest": []string{layerDigest.String()},
+	})
+	checkErr(t, err, "building upload url")
+	resp, err := http.Post(uploadURL, "", nil)
+	checkErr(t, err, "starting upload")
+	defer resp.Body.Close()
+	checkResponse(t, "starting upload of blob held by a denied repository", resp, http.StatusAccepted)
+
+	env.app.accessController = nil
+	uploadURLBase, _ = startPushLayer(t, env, sharedName)
+	pushLayer(t, env.builder, sharedName, layerDigest, uploadURLBase, bytes.NewReader(layerContent))
+	env.app.accessController = &repositoryDenyingAccessController{
+		denied: map[string]struct{}{secretName.Name(): {}},
+	}
+
+	for _, param := range []string{"digest", "mount"} {
+		uploadURL, err := env.builder.BuildBlobUploadURL(imageName, url.Values{
+			param: []string{layerDigest.String()},
+		})
+		checkErr(t, err, "building upload url")
+		resp, err := http.Post(uploadURL, "", nil)
+		checkErr(t, err, "starting upload")
+		defer resp.Body.Close()
+		checkResponse(t, "starting upload of blob with "+param, resp, http.StatusCreated)
+
+		ref, _ := reference.WithDigest(imageName, layerDigest)
+		blobURL, err := env.builder.BuildBlobURL(ref)
+		checkErr(t, err, "building blob url")
+		checkHeaders(t, resp, http.Header{
+			"Location":              []string{blobURL},
+			"Docker-Content-Digest": []string{layerDigest.String()},
+		})
+	}
+
+	// unknown blobs are uploaded
+	uploadURL, err = env.builder.BuildBlobUploadURL(imageName, url.Values{
+		"digest": []string{digest.FromString("unknown").String()},
+	})
+	checkErr(t, err, "building upload url")
+	resp, err = http.Post(uploadURL, "", nil)
+	checkErr(t, err, "starting upload")
+	defer resp.Body.Close()
+	checkResponse(t, "starting upload of unknown blob", resp, http.StatusAccepted)
+
+	// the lookup gives up after the maximum number of repositories, here the
+	// denied repository which is enumerated first
+	env.app.automaticMountMaxRepositories = 1
+	otherName, _ := reference.WithName("other/app")
+	uploadURL, err = env.builder.BuildBlobUploadURL(otherName, url.Values{
+		"digest": []string{layerDigest.String()},
+	})
+	checkErr(t, err, "building upload url")
+	resp, err = http.Post(uploadURL, "", nil)
+	checkErr(t, err, "starting upload")
+	defer resp.Body.Close()
+	checkResponse(t, "starting upload beyond the maximum repositories", resp, http.StatusAccepted)
+}
+
+// TestParallelBlobUpload pushes the chunks of a layer concurrently, as parts
+// of the upload, and checks that they are assembled on completion.
+func TestParallelBlobUpload(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/parallel")
+	layerContent := bytes.Repeat([]byte("parallel"), 600)
+	layerDigest := digest.FromBytes(layerContent)
+
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+
+	const chunkSize = 1024
+	var wg sync.WaitGroup
+	responses := make(chan *http.Response, len(layerContent)/chunkSize+1)
+	for start := 0; start < len(layerContent); start += chunkSize {
+		end := min(start+chunkSize, len(layerContent))
+		chunk := layerContent[start:end]
+		contentRange := fmt.Sprintf("%d-%d", start, end-1)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := doPushChunk(t, uploadURLBase, bytes.NewReader(chunk), chunkOptions{
+				contentRange: contentRange,
+				part:         true,
+			})
+			if err != nil {
+				t.Errorf("unexpected error pushing part %s: %v", contentRange, err)
+				return
+			}
+			responses <- resp
+		}()
+	}
+	wg.Wait()
+	close(responses)
+
+	for resp := range responses {
+		defer resp.Body.Close()
+		checkResponse(t, "pushing upload part", resp, http.StatusAccepted)
+		checkHeaders(t, resp, http.Header{
+			"Range": []string{"0-0"},
+		})
+	}
+
+	// parts must have a range matching their length
+	resp, err := doPushChunk(t, uploadURLBase, bytes.NewReader(layerContent[:10]), chunkOptions{
+		contentRange: "0-20",
+		part:         true,
+	})
+	checkErr(t, err, "pushing upload part")
+	defer resp.Body.Close()
+	checkResponse(t, "pushing upload part of invalid size", resp, http.StatusBadRequest)
+
+	finishUpload(t, env.builder, imageName, uploadURLBase, layerDigest)
+
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+	resp, err = http.Get(layerURL)
+	checkErr(t, err, "fetching layer")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching layer", resp, http.StatusOK)
+	p, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading layer")
+	if !bytes.Equal(p, layerContent) {
+		t.Fatal("unexpected layer content")
+	}
+
+	// parts leaving a gap fail the upload
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	resp, err = doPushChunk(t, uploadURLBase, bytes.NewReader(layerContent[chunkSize:]), chunkOptions{
+		contentRange: fmt.Sprintf("%d-%d", chunkSize, len(layerContent)-1),
+		part:         true,
+	})
+	checkErr(t, err, "pushing upload part")
+	defer resp.Body.Close()
+	checkResponse(t, "pushing upload part", resp, http.StatusAccepted)
+
+	resp, err = doPushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, nil)
+	checkErr(t, err, "completing upload")
+	defer resp.Body.Close()
+	checkResponse(t, "completing upload with a gap", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "completing upload with a gap", resp, errcode.ErrorCodeBlobUploadInvalid)
+}
+
+// TestContentLimits checks that blobs and manifests exceeding the configured
+// limits, or holding disallowed media types, are rejected.
+func TestContentLimits(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Limits: configuration.Limits{
+			Blobs: configuration.BlobLimits{MaxSize: 16},
+			Manifests: configuration.ManifestLimits{
+				MaxSize:         1024,
+				MaxLayers:       1,
+				MaxIndexEntries: 1,
+			},
+			MediaTypes: []configuration.MediaTypeLimits{
+				{
+					Repositories: []string{"helm/.*"},
+					Config:       []string{"application/vnd.cncf.helm.config.v1+json"},
+				},
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/limits")
+	content := []byte("seventeen bytes!!")
+
+	// blobs of known length are rejected before being written
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	resp, err := doPushLayer(t, env.builder, imageName, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+	checkErr(t, err, "pushing layer")
+	defer resp.Body.Close()
+	checkResponse(t, "pushing layer exceeding the maximum size", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "pushing layer exceeding the maximum size", resp, errcode.ErrorCodeSizeInvalid)
+
+	// streamed blobs are rejected once they exceed the limit
+	resp, err = doPushChunk(t, uploadURLBase, io.MultiReader(bytes.NewReader(content)), chunkOptions{})
+	checkErr(t, err, "pushing chunk")
+	defer resp.Body.Close()
+	checkResponse(t, "pushing chunk exceeding the maximum size", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "pushing chunk exceeding the maximum size", resp, errcode.ErrorCodeSizeInvalid)
+
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, digest.FromBytes(content[:16]), uploadURLBase, bytes.NewReader(content[:16]))
+
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	req, err := http.NewRequest(http.MethodPut, manifestURL, bytes.NewReader(bytes.Repeat([]byte(" "), 1025)))
+	checkErr(t, err, "creating request")
+	req.Header.Set("Content-Type", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "putting manifest")
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest exceeding the maximum size", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "putting manifest exceeding the maximum size", resp, errcode.ErrorCodeManifestInvalid)
+
+	layer := distribution.Descriptor{
+		Digest:    digest.FromBytes(content[:16]),
+		Size:      16,
+		MediaType: schema2.MediaTypeLayer,
+	}
+	manifest := &schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: schema2.MediaTypeManifest,
+		Config: distribution.Descriptor{
+			Digest:    layer.Digest,
+			Size:      16,
+			MediaType: schema2.MediaTypeImageConfig,
+		},
+		Layers: []distribution.Descriptor{layer, layer},
+	}
+	resp = putManifest(t, "putting manifest with too many layers", manifestURL, schema2.MediaTypeManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest with too many layers", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "putting manifest with too many layers", resp, errcode.ErrorCodeManifestInvalid)
+
+	manifestList, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{
+		{Descriptor: distribution.Descriptor{Digest: layer.Digest, Size: 16, MediaType: schema2.MediaTypeManifest}},
+		{Descriptor: distribution.Descriptor{Digest: layer.Digest, Size: 16, MediaType: schema2.MediaTypeManifest}},
+	})
+	checkErr(t, err, "creating manifest list")
+	resp = putManifest(t, "putting index with too many entries", manifestURL, manifestlist.MediaTypeManifestList, manifestList)
+	defer resp.Body.Close()
+	checkResponse(t, "putting index with too many entries", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "putting index with too many entries", resp, errcode.ErrorCodeManifestInvalid)
+
+	// the image config media type is only allowed outside of helm repositories
+	manifest.Layers = manifest.Layers[:1]
+	resp = putManifest(t, "putting manifest", manifestURL, schema2.MediaTypeManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest", resp, http.StatusCreated)
+
+	chartName, _ := reference.WithName("helm/chart")
+	uploadURLBase, _ = startPushLayer(t, env, chartName)
+	pushLayer(t, env.builder, chartName, layer.Digest, uploadURLBase, bytes.NewReader(content[:16]))
+
+	chartRef, _ := reference.WithTag(chartName, "latest")
+	chartURL, err := env.builder.BuildManifestURL(chartRef)
+	checkErr(t, err, "building manifest url")
+	resp = putManifest(t, "putting manifest with disallowed config", chartURL, schema2.MediaTypeManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest with disallowed config", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "putting manifest with disallowed config", resp, errcode.ErrorCodeDenied)
+
+	// copies are limited like pushes to the target repository
+	copyURL, err := env.builder.BuildRepositoryCopyURL(chartName, url.Values{
+		"from":      []string{imageName.Name()},
+		"reference": []string{"latest"},
+	})
+	checkErr(t, err, "building copy url")
+	resp, err = http.Post(copyURL, "", nil)
+	checkErr(t, err, "copying manifest with disallowed config")
+	defer resp.Body.Close()
+	checkResponse(t, "copying manifest with disallowed config", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "copying manifest with disallowed config", resp, errcode.ErrorCodeDenied)
+}
+
+func TestAdmissionWebhooks(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		reviews []admissionReview
+	)
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var review admissionReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		reviews = append(reviews, review)
+		mu.Unlock()
+
+		response := admissionResponse{Allowed: review.Tag != "unsigned"}
+		if !response.Allowed {
+			response.Reason = "image is not signed"
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer policy.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Admission: configuration.Admission{
+			Webhooks: []configuration.AdmissionWebhook{
+				{
+					Name:         "policy",
+					URL:          policy.URL,
+					Repositories: []string{"foo/.*"},
+				},
+				{
+					Name:     "broken-open",
+					URL:      broken.URL,
+					FailOpen: true,
+				},
+				{
+					Name:         "broken-closed",
+					URL:          broken.URL,
+					Repositories: []string{"closed/.*"},
+				},
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageConfig := []byte(`{"architecture":"amd64","os":"linux"}`)
+	layerContent := []byte("layer")
+	manifest := &schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: schema2.MediaTypeManifest,
+		Config: distribution.Descriptor{
+			Digest:    digest.FromBytes(imageConfig),
+			Size:      int64(len(imageConfig)),
+			MediaType: schema2.MediaTypeImageConfig,
+		},
+		Layers: []distribution.Descriptor{
+			{
+				Digest:    digest.FromBytes(layerContent),
+				Size:      int64(len(layerContent)),
+				MediaType: schema2.MediaTypeLayer,
+			},
+		},
+	}
+
+	pushImage := func(name reference.Named, tag string) *http.Response {
+		for _, content := range [][]byte{imageConfig, layerContent} {
+			uploadURLBase, _ := startPushLayer(t, env, name)
+			pushLayer(t, env.builder, name, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+		}
+
+		tagRef, _ := reference.WithTag(name, tag)
+		manifestURL, err := env.builder.BuildManifestURL(tagRef)
+		checkErr(t, err, "building manifest url")
+		return putManifest(t, "putting manifest", manifestURL, schema2.MediaTypeManifest, manifest)
+	}
+
+	imageName, _ := reference.WithName("foo/admission")
+	resp := pushImage(imageName, "signed")
+	defer resp.Body.Close()
+	checkResponse(t, "putting admitted manifest", resp, http.StatusCreated)
+
+	mu.Lock()
+	if len(reviews) != 1 {
+		t.Fatalf("expected 1 review, got %d", len(reviews))
+	}
+	review := reviews[0]
+	mu.Unlock()
+	if review.Repository != "foo/admission" || review.Tag != "signed" {
+		t.Fatalf("unexpected review target: %s:%s", review.Repository, review.Tag)
+	}
+	if review.Digest.String() != resp.Header.Get("Docker-Content-Digest") {
+		t.Fatalf("unexpected review digest: %s != %s", review.Digest, resp.Header.Get("Docker-Content-Digest"))
+	}
+	if review.MediaType != schema2.MediaTypeManifest || len(review.Manifest) == 0 {
+		t.Fatalf("unexpected review manifest: %s %s", review.MediaType, review.Manifest)
+	}
+	if !bytes.Equal(review.Config, imageConfig) {
+		t.Fatalf("unexpected review config: %s", review.Config)
+	}
+
+	// rejections are returned to the client
+	resp = pushImage(imageName, "unsigned")
+	defer resp.Body.Close()
+	checkResponse(t, "putting rejected manifest", resp, http.StatusForbidden)
+	errs, _, _ := checkBodyHasErrorCodes(t, "putting rejected manifest", resp, errcode.ErrorCodeDenied)
+	if errs[0].(errcode.Error).Message != "image is not signed" {
+		t.Fatalf("unexpected rejection reason: %v", errs[0])
+	}
+
+	// failing webhooks only reject pushes if they fail closed
+	otherName, _ := reference.WithName("bar/admission")
+	resp = pushImage(otherName, "latest")
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest with failing open webhook", resp, http.StatusCreated)
+
+	closedName, _ := reference.WithName("closed/admission")
+	resp = pushImage(closedName, "latest")
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest with failing closed webhook", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "putting manifest with failing closed webhook", resp, errcode.ErrorCodeDenied)
+
+	// copies are reviewed like pushes to the target repository
+	resp = pushImage(otherName, "unsigned")
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest to unfiltered repository", resp, http.StatusCreated)
+
+	copiedName, _ := reference.WithName("foo/copied")
+	copyURL, err := env.builder.BuildRepositoryCopyURL(copiedName, url.Values{
+		"from":      []string{otherName.Name()},
+		"reference": []string{"unsigned"},
+	})
+	checkErr(t, err, "building copy url")
+	resp, err = http.Post(copyURL, "", nil)
+	checkErr(t, err, "copying rejected manifest")
+	defer resp.Body.Close()
+	checkResponse(t, "copying rejected manifest", resp, http.StatusForbidden)
+	errs, _, _ = checkBodyHasErrorCodes(t, "copying rejected manifest", resp, errcode.ErrorCodeDenied)
+	if errs[0].(errcode.Error).Message != "image is not signed" {
+		t.Fatalf("unexpected rejection reason: %v", errs[0])
+	}
+
+	tagRef, _ := reference.WithTag(copiedName, "unsigned")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp, err = http.Head(manifestURL)
+	checkErr(t, err, "checking rejected copy")
+	defer resp.Body.Close()
+	checkResponse(t, "checking rejected copy", resp, http.StatusNotFound)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reviews) != 3 {
+		t.Fatalf("expected 3 reviews, got %d", len(reviews))
+	}
+	if review := reviews[2]; review.Repository != "foo/copied" || review.Tag != "unsigned" || !bytes.Equal(review.Config, imageConfig) {
+		t.Fatalf("unexpected copy review: %s:%s %s", review.Repository, review.Tag, review.Config)
+	}
+}
+
+func TestRepositoryCopy(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	dgst := createRepository(env, t, "staging/app", "latest")
+	source, _ := reference.WithName("staging/app")
+	target, _ := reference.WithName("prod/app")
+
+	copyURL, err := env.builder.BuildRepositoryCopyURL(target, url.Values{
+		"from":      []string{source.Name()},
+		"reference": []string{"latest"},
+	})
+	checkErr(t, err, "building copy url")
+
+	resp, err := http.Post(copyURL, "", nil)
+	checkErr(t, err, "copying tag")
+	defer resp.Body.Close()
+	checkResponse(t, "copying tag", resp, http.StatusCreated)
+
+	digestRef, _ := reference.WithDigest(target, dgst)
+	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{manifestDigestURL},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	tagRef, _ := reference.WithTag(target, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	req, _ := http.NewRequest(http.MethodGet, manifestURL, nil)
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching copied manifest")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching copied manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	var manifest schema2.DeserializedManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		t.Fatalf("error decoding copied manifest: %v", err)
+	}
+	for _, desc := range manifest.References() {
+		ref, _ := reference.WithDigest(target, desc.Digest)
+		blobURL, err := env.builder.BuildBlobURL(ref)
+		checkErr(t, err, "building blob url")
+		resp, err := http.Head(blobURL)
+		checkErr(t, err, "checking mounted blob")
+		defer resp.Body.Close()
+		checkResponse(t, "checking mounted blob", resp, http.StatusOK)
+	}
+
+	// copy by digest to another tag
+	copyURL, err = env.builder.BuildRepositoryCopyURL(target, url.Values{
+		"from":      []string{source.Name()},
+		"reference": []string{dgst.String()},
+		"tag":       []string{"v1"},
+	})
+	checkErr(t, err, "building copy url")
+	resp, err = http.Post(copyURL, "", nil)
+	checkErr(t, err, "copying digest")
+	defer resp.Body.Close()
+	checkResponse(t, "copying digest", resp, http.StatusCreated)
+
+	tagRef, _ = reference.WithTag(target, "v1")
+	manifestURL, err = env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp, err = http.Head(manifestURL)
+	checkErr(t, err, "checking copied tag")
+	defer resp.Body.Close()
+	checkResponse(t, "checking copied tag", resp, http.StatusOK)
+
+	// copy an unknown tag
+	copyURL, err = env.builder.BuildRepositoryCopyURL(target, url.Values{
+		"from":      []string{source.Name()},
+		"reference": []string{"unknown"},
+	})
+	checkErr(t, err, "building copy url")
+	resp, err = http.Post(copyURL, "", nil)
+	checkErr(t, err, "copying unknown tag")
+	defer resp.Body.Close()
+	checkResponse(t, "copying unknown tag", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "copying unknown tag", resp, errcode.ErrorCodeManifestUnknown)
+
+	env.app.readOnly = true
+	resp, err = http.Post(copyURL, "", nil)
+	checkErr(t, err, "copying in read-only mode")
+	defer resp.Body.Close()
+	checkResponse(t, "copying in read-only mode", resp, http.StatusMethodNotAllowed)
+}
+
+func TestRepositoryRename(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	dgst := createRepository(env, t, "old/app", "latest")
+	createRepository(env, t, "other/app", "latest")
+	source, _ := reference.WithName("old/app")
+	other, _ := reference.WithName("other/app")
+
+	renameURL, err := env.builder.BuildRepositoryRenameURL(source, url.Values{
+		"to": []string{"new/app"},
+	})
+	checkErr(t, err, "building rename url")
+
+	resp, err := http.Post(renameURL, "", nil)
+	checkErr(t, err, "renaming repository")
+	defer resp.Body.Close()
+	checkResponse(t, "renaming repository", resp, http.StatusCreated)
+
+	tagRef, _ := reference.WithTag(source, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp, err = http.Head(manifestURL)
+	checkErr(t, err, "checking renamed repository")
+	defer resp.Body.Close()
+	checkResponse(t, "checking renamed repository", resp, http.StatusNotFound)
+
+	target, _ := reference.WithName("new/app")
+	tagRef, _ = reference.WithTag(target, "latest")
+	manifestURL, err = env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	req, _ := http.NewRequest(http.MethodHead, manifestURL, nil)
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "checking new repository")
+	defer resp.Body.Close()
+	checkResponse(t, "checking new repository", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// rename to a repository holding manifests
+	renameURL, err = env.builder.BuildRepositoryRenameURL(other, url.Values{
+		"to": []string{"new/app"},
+	})
+	checkErr(t, err, "building rename url")
+	resp, err = http.Post(renameURL, "", nil)
+	checkErr(t, err, "renaming to existing repository")
+	defer resp.Body.Close()
+	checkResponse(t, "renaming to existing repository", resp, http.StatusConflict)
+	checkBodyHasErrorCodes(t, "renaming to existing repository", resp, errcode.ErrorCodeRepositoryExists)
+
+	// rename an unknown repository
+	renameURL, err = env.builder.BuildRepositoryRenameURL(source, url.Values{
+		"to": []string{"newer/app"},
+	})
+	checkErr(t, err, "building rename url")
+	resp, err = http.Post(renameURL, "", nil)
+	checkErr(t, err, "renaming unknown repository")
+	defer resp.Body.Close()
+	checkResponse(t, "renaming unknown repository", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "renaming unknown repository", resp, errcode.ErrorCodeNameUnknown)
+}
+
+func TestRepositoryRenameDeleteDisabled(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	createRepository(env, t, "old/app", "latest")
+	source, _ := reference.WithName("old/app")
+
+	renameURL, err := env.builder.BuildRepositoryRenameURL(source, url.Values{
+		"to": []string{"new/app"},
+	})
+	checkErr(t, err, "building rename url")
+	resp, err := http.Post(renameURL, "", nil)
+	checkErr(t, err, "renaming repository")
+	defer resp.Body.Close()
+	checkResponse(t, "renaming repository with delete disabled", resp, http.StatusMethodNotAllowed)
+}
+
 func httpDelete(url string) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodDelete, url, nil)
 	if err != nil {
@@ -1303,6 +1974,90 @@ func TestManifestAPI(t *testing.T) {
 	testManifestAPIManifestList(t, env2, schema2Args)
 }
 
+// TestSHA512Push pushes blobs and a manifest referenced by sha512 digests
+// and pulls the manifest back by its digest.
+func TestSHA512Push(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/sha512")
+
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	configDigest := digest.SHA512.FromBytes(config)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	resp, err := doPushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(config))
+	if err != nil {
+		t.Fatalf("unexpected error pushing config: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "pushing sha512 config", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{configDigest.String()},
+	})
+
+	manifest, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: schema2.MediaTypeManifest,
+		Config: distribution.Descriptor{
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+			MediaType: schema2.MediaTypeImageConfig,
+		},
+		Layers: []distribution.Descriptor{},
+	})
+	if err != nil {
+		t.Fatalf("could not create DeserializedManifest: %v", err)
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		t.Fatalf("could not get manifest payload: %v", err)
+	}
+	dgst := digest.SHA512.FromBytes(payload)
+
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	manifestURL, err := env.builder.BuildManifestURL(digestRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, manifestURL, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "putting sha512 manifest", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	req, err = http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "getting sha512 manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading manifest: %v", err)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Fatal("fetched payload does not match original payload")
+	}
+}
+
 func TestManifestAPI_DeleteTag(t *testing.T) {
 	env := newTestEnv(t, false)
 	defer env.Shutdown()
@@ -2457,6 +3212,9 @@ func finishUpload(t *testing.T, ub *v2.URLBuilder, name reference.Named, uploadU
 type chunkOptions struct {
 	// Content-Range header to set when pushing chunks
 	contentRange string
+
+	// part pushes the chunk as a separate part of the upload
+	part bool
 }
 
 func doPushChunk(t *testing.T, uploadURLBase string, body io.Reader, options chunkOptions) (*http.Response, error) {
@@ -2479,6 +3237,9 @@ func doPushChunk(t *testing.T, uploadURLBase string, body io.Reader, options chu
 	if options.contentRange != "" {
 		req.Header.Set("Content-Range", options.contentRange)
 	}
+	if options.part {
+		req.Header.Set("Docker-Upload-Part", "true")
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 
@@ -28,7 +28,9 @@ import (
 	"github.com/distribution/distribution/v3/notifications"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/audit"
 	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/auth/robot"
 	registrymiddleware "github.com/distribution/distribution/v3/registry/middleware/registry"
 	repositorymiddleware "github.com/distribution/distribution/v3/registry/middleware/repository"
 	"github.com/distribution/distribution/v3/registry/proxy"
@@ -43,6 +45,7 @@ import (
 	events "github.com/docker/go-events"
 	"github.com/docker/go-metrics"
 	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
 	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
@@ -55,6 +58,10 @@ const randomSecretSize = 32
 // defaultCheckInterval is the default time in between health checks
 const defaultCheckInterval = 10 * time.Second
 
+// defaultManifestCacheTTL is the default time after which the entries of the
+// manifest cache expire
+const defaultManifestCacheTTL = 5 * time.Minute
+
 // App is a global registry application object. Shared resources can be placed
 // on this object that will be accessible from all requests. Any writable
 // fields should be protected.
@@ -69,6 +76,18 @@ type App struct {
 	repoRemover      distribution.RepositoryRemover // repoRemover provides ability to delete repos
 	accessController auth.AccessController          // main access controller for application
 
+	// anonymousAccess grants access to requests without credentials, as
+	// configured in the anonymous policy.
+	anonymousAccess *auth.AnonymousAccessController
+
+	// robots holds the robot accounts when the robot auth provider is
+	// configured, along with the users allowed to manage them.
+	robots struct {
+		store     robot.Store
+		admins    map[string]struct{}
+		maxExpiry time.Duration
+	}
+
 	// httpHost is a parsed representation of the http.host parameter from
 	// the configuration. Only the Scheme and Host fields are used.
 	httpHost url.URL
@@ -81,11 +100,33 @@ type App struct {
 
 	redis redis.UniversalClient
 
+	// audit receives the audit events of the application, if the audit log
+	// is configured.
+	audit audit.Sink
+
 	// isCache is true if this registry is configured as a pull through cache
 	isCache bool
 
 	// readOnly is true if the registry is in a read-only maintenance mode
 	readOnly bool
+
+	// deleteEnabled is true if the deletion of content is enabled in the
+	// storage configuration.
+	deleteEnabled bool
+
+	// automaticMount is true if blobs are mounted from the repositories the
+	// client can pull from when it starts an upload with their digest.
+	automaticMount bool
+
+	// automaticMountMaxRepositories bounds the number of repositories
+	// looked up for each automatic mount.
+	automaticMountMaxRepositories int
+
+	// limits enforces the limits configured on pushed content.
+	limits *contentLimits
+
+	// admission holds the webhooks which approve or reject pushed manifests.
+	admission []*admissionWebhook
 }
 
 // NewApp takes a configuration and returns a configured app, ready to serve
@@ -109,6 +150,10 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	app.register(v2.RouteNameBlob, blobDispatcher)
 	app.register(v2.RouteNameBlobUpload, blobUploadDispatcher)
 	app.register(v2.RouteNameBlobUploadChunk, blobUploadDispatcher)
+	app.register(v2.RouteNameRobots, robotsDispatcher)
+	app.register(v2.RouteNameRobot, robotDispatcher)
+	app.register(v2.RouteNameRepositoryCopy, repositoryCopyDispatcher)
+	app.register(v2.RouteNameRepositoryRename, repositoryRenameDispatcher)
 
 	// override the storage driver's UA string for registry outbound HTTP requests
 	storageParams := config.Storage.Parameters()
@@ -163,6 +208,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		app.configureSecret(config)
 	}
 	app.configureEvents(config)
+	app.configureAudit(config)
 	app.configureRedis(config)
 	app.configureLogHook(config)
 
@@ -186,10 +232,16 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		if ok {
 			if deleteEnabled, ok := e.(bool); ok && deleteEnabled {
 				options = append(options, storage.EnableDelete)
+				app.deleteEnabled = true
 			}
 		}
 	}
 
+	// configure the catalog index
+	if config.Catalog.Index {
+		options = append(options, storage.EnableCatalogIndex)
+	}
+
 	// configure tag lookup concurrency limit
 	if p := config.Storage.TagParameters(); p != nil {
 		l, ok := p["concurrencylimit"]
@@ -205,6 +257,41 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
+	// configure the digest algorithms with which uploads are hashed
+	if d, ok := config.Storage["digest"]; ok {
+		if v, ok := d["algorithms"]; ok {
+			algorithms, ok := v.([]interface{})
+			if !ok {
+				panic(fmt.Sprintf("invalid digest algorithms %v: must be a list", v))
+			}
+			var digestAlgorithms []digest.Algorithm
+			for _, algorithm := range algorithms {
+				digestAlgorithms = append(digestAlgorithms, digest.Algorithm(fmt.Sprint(algorithm)))
+			}
+			options = append(options, storage.DigestAlgorithms(digestAlgorithms...))
+		}
+	}
+
+	// configure automatic cross-repository mounts
+	if mountConfig, ok := config.Storage["mount"]; ok {
+		if v, ok := mountConfig["automatic"]; ok {
+			automatic, ok := v.(bool)
+			if !ok {
+				panic(fmt.Sprintf("invalid type for mount config: %#v", mountConfig))
+			}
+			app.automaticMount = automatic
+		}
+
+		app.automaticMountMaxRepositories = defaultAutomaticMountMaxRepositories
+		if v, ok := mountConfig["maxrepositories"]; ok {
+			maxRepositories, ok := v.(int)
+			if !ok || maxRepositories <= 0 {
+				panic(fmt.Sprintf("invalid maxrepositories for mount config: %#v", v))
+			}
+			app.automaticMountMaxRepositories = maxRepositories
+		}
+	}
+
 	// configure redirects
 	var redirectDisabled bool
 	if redirectConfig, ok := config.Storage["redirect"]; ok {
@@ -274,6 +361,62 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
+	// configure limits
+	app.limits, err = newContentLimits(config.Limits)
+	if err != nil {
+		panic(fmt.Sprintf("limits: %v", err))
+	}
+	if app.limits.maxBlobSize > 0 {
+		options = append(options, storage.MaxBlobSize(app.limits.maxBlobSize))
+	}
+
+	// configure admission webhooks
+	app.admission, err = newAdmissionWebhooks(config.Admission)
+	if err != nil {
+		panic(fmt.Sprintf("admission: %v", err))
+	}
+
+	// configure the manifest cache
+	if cc, ok := config.Storage["cache"]; ok {
+		manifestTTL := defaultManifestCacheTTL
+		if v, ok := cc["manifestttl"]; ok {
+			ttl, ok := v.(string)
+			if !ok {
+				panic(fmt.Sprintf("invalid manifestttl value %v: must be a duration", v))
+			}
+			manifestTTL, err = time.ParseDuration(ttl)
+			if err != nil || manifestTTL < time.Millisecond {
+				panic(fmt.Sprintf("invalid manifestttl value %s: must be a duration of at least 1ms", ttl))
+			}
+		}
+
+		switch v := cc["manifest"]; v {
+		case "redis":
+			if app.redis == nil {
+				panic("redis configuration required to use for manifest cache")
+			}
+			if _, ok := cc["manifestsize"]; ok {
+				dcontext.GetLogger(app).Warnf("manifestsize parameter is not supported with redis cache")
+			}
+			options = append(options, storage.ManifestCacheProvider(rediscache.NewRedisManifestCacheProvider(app.redis, manifestTTL)))
+			dcontext.GetLogger(app).Infof("using redis manifest cache")
+		case "inmemory":
+			manifestSize := memorycache.DefaultSize
+			if configuredSize, ok := cc["manifestsize"]; ok {
+				// Since Parameters is not strongly typed, render to a string and convert back
+				manifestSize, err = strconv.Atoi(fmt.Sprint(configuredSize))
+				if err != nil {
+					panic(fmt.Sprintf("invalid manifestsize value %s: %s", configuredSize, err))
+				}
+			}
+			options = append(options, storage.ManifestCacheProvider(memorycache.NewInMemoryManifestCacheProvider(manifestSize, manifestTTL)))
+			dcontext.GetLogger(app).Infof("using inmemory manifest cache")
+		case nil, "":
+		default:
+			dcontext.GetLogger(app).Warnf("unknown manifest cache type %q, manifest caching disabled", v)
+		}
+	}
+
 	// configure storage caches
 	if cc, ok := config.Storage["cache"]; ok {
 		v, ok := cc["blobdescriptor"]
@@ -315,8 +458,29 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				panic("could not create registry: " + err.Error())
 			}
 			dcontext.GetLogger(app).Infof("using inmemory blob descriptor cache")
+		case "layered":
+			if app.redis == nil {
+				panic("redis configuration required to use for layered blobdescriptor cache")
+			}
+			blobDescriptorSize := memorycache.DefaultSize
+			configuredSize, ok := cc["blobdescriptorsize"]
+			if ok {
+				// Since Parameters is not strongly typed, render to a string and convert back
+				blobDescriptorSize, err = strconv.Atoi(fmt.Sprint(configuredSize))
+				if err != nil {
+					panic(fmt.Sprintf("invalid blobdescriptorsize value %s: %s", configuredSize, err))
+				}
+			}
+
+			cacheProvider := rediscache.NewLayeredBlobDescriptorCacheProvider(app, app.redis, blobDescriptorSize)
+			localOptions := append(options, storage.BlobDescriptorCacheProvider(cacheProvider))
+			app.registry, err = storage.NewRegistry(app, app.driver, localOptions...)
+			if err != nil {
+				panic("could not create registry: " + err.Error())
+			}
+			dcontext.GetLogger(app).Infof("using layered inmemory and redis blob descriptor cache")
 		default:
-			if v != "" {
+			if v != nil && v != "" {
 				dcontext.GetLogger(app).Warnf("unknown cache type %q, caching disabled", config.Storage["cache"])
 			}
 		}
@@ -335,16 +499,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		panic(err)
 	}
 
-	authType := config.Auth.Type()
-
-	if authType != "" && !strings.EqualFold(authType, "none") {
-		accessController, err := auth.GetAccessController(config.Auth.Type(), config.Auth.Parameters())
-		if err != nil {
-			panic(fmt.Sprintf("unable to configure authorization (%s): %v", authType, err))
-		}
-		app.accessController = accessController
-		dcontext.GetLogger(app).Debugf("configured %q access controller", authType)
-	}
+	app.configureAuth(config)
 
 	// configure as a pull through cache
 	if config.Proxy.RemoteURL != "" {
@@ -449,6 +604,11 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 
 // Shutdown close the underlying registry
 func (app *App) Shutdown() error {
+	if app.audit != nil {
+		if err := app.audit.Close(); err != nil {
+			dcontext.GetLogger(app).Errorf("error closing audit log: %v", err)
+		}
+	}
 	if r, ok := app.registry.(proxy.Closer); ok {
 		return r.Close()
 	}
@@ -478,6 +638,116 @@ func (app *App) register(routeName string, dispatch dispatchFunc) {
 	app.router.GetRoute(routeName).Handler(handler)
 }
 
+// configureAuth prepares the access controller of the application. When
+// several auth types are configured, their access controllers are chained
+// in the configured order.
+func (app *App) configureAuth(config *configuration.Configuration) {
+	authTypes, err := config.Auth.Types()
+	if err != nil {
+		panic(fmt.Sprintf("unable to configure authorization: %v", err))
+	}
+	if len(authTypes) == 0 || len(authTypes) == 1 && strings.EqualFold(authTypes[0], "none") {
+		return
+	}
+
+	controllers := make([]auth.AccessController, 0, len(authTypes))
+	for _, authType := range authTypes {
+		var accessController auth.AccessController
+		if authType == "robot" {
+			accessController, err = app.configureRobots(config.Auth[authType])
+		} else {
+			accessController, err = auth.GetAccessController(authType, config.Auth[authType])
+		}
+		if err != nil {
+			panic(fmt.Sprintf("unable to configure authorization (%s): %v", authType, err))
+		}
+		controllers = append(controllers, accessController)
+		dcontext.GetLogger(app).Debugf("configured %q access controller", authType)
+	}
+
+	if len(controllers) == 1 {
+		app.accessController = controllers[0]
+	} else {
+		app.accessController = auth.NewChain(controllers...)
+	}
+
+	// The anonymous repositories of the auth chain are a deprecated alias of
+	// the repositories of the anonymous policy, which grants anonymous access
+	// to the union of both.
+	anonymousPolicy := config.Policy.Anonymous
+	repositories := append([]string(nil), anonymousPolicy.Repositories...)
+	if v, ok := config.Auth.ChainParameters()["anonymous"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			panic("auth chain anonymous config key must contain a list of repository patterns")
+		}
+		for _, item := range list {
+			pattern, ok := item.(string)
+			if !ok {
+				panic("auth chain anonymous config key must contain a list of repository patterns")
+			}
+			repositories = append(repositories, pattern)
+		}
+		dcontext.GetLogger(app).Warn("auth.chain.anonymous is deprecated, use policy.anonymous.repositories instead")
+	}
+
+	if len(repositories) > 0 || anonymousPolicy.Catalog {
+		app.anonymousAccess, err = auth.NewAnonymousAccessController(repositories, anonymousPolicy.Catalog)
+		if err != nil {
+			panic(fmt.Sprintf("policy.anonymous: %v", err))
+		}
+		dcontext.GetLogger(app).Infof("anonymous pull access policy enabled for %v", repositories)
+	}
+}
+
+// configureRobots prepares the robot account store and returns the access
+// controller authenticating robot accounts. Unlike other auth providers, the
+// robot provider is not looked up in the auth registry, as its accounts are
+// kept in the storage driver or in redis.
+func (app *App) configureRobots(params configuration.Parameters) (auth.AccessController, error) {
+	store, _ := params["store"].(string)
+	switch store {
+	case "", "storage":
+		app.robots.store = robot.NewDriverStore(app.driver)
+	case "redis":
+		if app.redis == nil {
+			return nil, fmt.Errorf("redis configuration required to store robot accounts in redis")
+		}
+		app.robots.store = robot.NewRedisStore(app.redis)
+	default:
+		return nil, fmt.Errorf("unknown robot account store %q", store)
+	}
+
+	app.robots.admins = make(map[string]struct{})
+	if v, ok := params["admins"]; ok {
+		admins, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("admins must be a list of user names")
+		}
+		for _, admin := range admins {
+			name, ok := admin.(string)
+			if !ok {
+				return nil, fmt.Errorf("admins must be a list of user names")
+			}
+			app.robots.admins[name] = struct{}{}
+		}
+	}
+
+	if v, ok := params["maxexpiry"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("maxexpiry must be a duration")
+		}
+		maxExpiry, err := time.ParseDuration(s)
+		if err != nil || maxExpiry <= 0 {
+			return nil, fmt.Errorf("maxexpiry must be a positive duration: %q", s)
+		}
+		app.robots.maxExpiry = maxExpiry
+	}
+
+	return robot.NewAccessController(app.robots.store, params)
+}
+
 // configureEvents prepares the event sink for action.
 func (app *App) configureEvents(configuration *configuration.Configuration) {
 	// Configure all of the endpoint sinks.
@@ -672,6 +942,7 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 		}
 
 		context := app.context(w, r)
+		authorized := false
 
 		defer func() {
 			// Automated error response handling here. Handlers may return their
@@ -683,12 +954,16 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 			} else if status, ok := context.Value("http.response.status").(int); ok && status >= 200 && status <= 399 {
 				dcontext.GetResponseLogger(context).Infof("response completed")
 			}
+			if authorized {
+				app.auditRequest(context, w, r)
+			}
 		}()
 
 		if err := app.authorized(w, r, context); err != nil {
 			dcontext.GetLogger(context).Warnf("error authorizing context: %v", err)
 			return
 		}
+		authorized = true
 
 		// Add username to request logging
 		context.Context = dcontext.WithLogger(context.Context, dcontext.GetLogger(context.Context, userNameKey))
@@ -836,6 +1111,14 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			// access to the source repository.
 			accessRecords = appendAccessRecords(accessRecords, http.MethodGet, fromRepo)
 		}
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == v2.RouteNameRepositoryRename {
+			// renaming a repository deletes it and pushes its content to
+			// the new name.
+			accessRecords = appendAccessRecords(accessRecords, http.MethodDelete, repo)
+			if toRepo := r.FormValue("to"); toRepo != "" {
+				accessRecords = appendAccessRecords(accessRecords, http.MethodPost, toRepo)
+			}
+		}
 	} else {
 		// Only allow the name not to be set on the base route.
 		if app.nameRequired(r) {
@@ -850,10 +1133,26 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			}
 			return fmt.Errorf("forbidden: no repository name")
 		}
-		accessRecords = appendCatalogAccessRecord(accessRecords, r)
+		accessRecords = appendRegistryAccessRecord(accessRecords, r)
 	}
 
-	grant, err := app.accessController.Authorized(r.WithContext(context.Context), accessRecords...)
+	var (
+		grant     *auth.Grant
+		err       error
+		anonymous bool
+	)
+
+	// Requests without credentials are granted the access allowed by the
+	// anonymous policy without consulting the access controller, so that
+	// clients get the content without a challenge.
+	if app.anonymousAccess != nil && !hasCredentials(r) {
+		grant, err = app.anonymousAccess.Authorized(r.WithContext(context.Context), accessRecords...)
+		anonymous = err == nil
+	}
+
+	if !anonymous {
+		grant, err = app.accessController.Authorized(r.WithContext(context.Context), accessRecords...)
+	}
 	if err != nil {
 		switch err := err.(type) {
 		case auth.Challenge:
@@ -863,6 +1162,7 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			if err := errcode.ServeJSON(w, errcode.ErrorCodeUnauthorized.WithDetail(accessRecords)); err != nil {
 				dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
 			}
+			app.auditAuthFailure(context, r, audit.OutcomeDenied, err)
 		default:
 			// This condition is a potential security problem either in
 			// the configuration or whatever is backing the access
@@ -870,6 +1170,7 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			// to avoid exposure. The request should not proceed.
 			dcontext.GetLogger(context).Errorf("error checking authorization: %v", err)
 			w.WriteHeader(http.StatusBadRequest)
+			app.auditAuthFailure(context, r, audit.OutcomeFailure, err)
 		}
 
 		return err
@@ -881,7 +1182,12 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 	ctx := withUser(context.Context, grant.User)
 	ctx = withResources(ctx, grant.Resources)
 
-	dcontext.GetLogger(ctx, userNameKey).Info("authorized request")
+	if anonymous {
+		ctx = withAnonymous(ctx)
+		dcontext.GetLogger(ctx).Info("authorized anonymous request")
+	} else {
+		dcontext.GetLogger(ctx, userNameKey).Info("authorized request")
+	}
 	// TODO(stevvooe): This pattern needs to be cleaned up a bit. One context
 	// should be replaced by another, rather than replacing the context on a
 	// mutable object.
@@ -889,6 +1195,31 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 	return nil
 }
 
+// pullAuthorized returns whether the client of an authorized request may also
+// pull from the named repository, with the same credentials.
+func (app *App) pullAuthorized(ctx *Context, r *http.Request, repo string) bool {
+	if app.accessController == nil {
+		return true
+	}
+
+	accessRecords := appendAccessRecords(nil, http.MethodGet, repo)
+	if isAnonymous(ctx) {
+		_, err := app.anonymousAccess.Authorized(r.WithContext(ctx.Context), accessRecords...)
+		return err == nil
+	}
+	_, err := app.accessController.Authorized(r.WithContext(ctx.Context), accessRecords...)
+	return err == nil
+}
+
+// hasCredentials returns whether the request carries credentials, either in
+// the Authorization header or as a verified TLS client certificate.
+func hasCredentials(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
 // eventBridge returns a bridge for the current request, configured with the
 // correct actor and source.
 func (app *App) eventBridge(ctx *Context, r *http.Request) notifications.Listener {
@@ -907,7 +1238,11 @@ func (app *App) nameRequired(r *http.Request) bool {
 		return true
 	}
 	routeName := route.GetName()
-	return routeName != v2.RouteNameBase && routeName != v2.RouteNameCatalog
+	switch routeName {
+	case v2.RouteNameBase, v2.RouteNameCatalog, v2.RouteNameRobots, v2.RouteNameRobot:
+		return false
+	}
+	return true
 }
 
 // apiBase implements a simple yes-man for doing overall checks against the
@@ -955,24 +1290,30 @@ func appendAccessRecords(records []auth.Access, method string, repo string) []au
 	return records
 }
 
-// Add the access record for the catalog if it's our current route
-func appendCatalogAccessRecord(accessRecords []auth.Access, r *http.Request) []auth.Access {
+// appendRegistryAccessRecord adds the access record for the registry wide
+// resource of the current route, such as the catalog or the robot accounts.
+func appendRegistryAccessRecord(accessRecords []auth.Access, r *http.Request) []auth.Access {
 	route := mux.CurrentRoute(r)
 	routeName := route.GetName()
 
-	if routeName == v2.RouteNameCatalog {
-		resource := auth.Resource{
-			Type: "registry",
-			Name: "catalog",
-		}
-
-		accessRecords = append(accessRecords,
-			auth.Access{
-				Resource: resource,
-				Action:   "*",
-			})
+	var name string
+	switch routeName {
+	case v2.RouteNameCatalog:
+		name = "catalog"
+	case v2.RouteNameRobots, v2.RouteNameRobot:
+		name = "robots"
+	default:
+		return accessRecords
 	}
-	return accessRecords
+
+	return append(accessRecords,
+		auth.Access{
+			Resource: auth.Resource{
+				Type: "registry",
+				Name: name,
+			},
+			Action: "*",
+		})
 }
 
 // applyRegistryMiddleware wraps a registry instance with the configured middlewares
@@ -5,18 +5,26 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
 	"github.com/distribution/distribution/v3/registry/auth"
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
 	_ "github.com/distribution/distribution/v3/registry/auth/silly"
 	"github.com/distribution/distribution/v3/registry/storage"
 	memorycache "github.com/distribution/distribution/v3/registry/storage/cache/memory"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // TestAppDispatcher builds an application with a test dispatcher and ensures
@@ -30,16 +38,18 @@ func TestAppDispatcher(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error creating registry: %v", err)
 	}
+	// Use a private router: binding the shared routes to this server's host
+	// would break URL building in the other tests of this package.
+	router := v2.RouterWithPrefix("")
 	app := &App{
 		Config:   &configuration.Configuration{},
 		Context:  ctx,
-		router:   v2.Router(),
+		router:   router,
 		driver:   driver,
 		registry: registry,
 	}
 	server := httptest.NewServer(app)
 	defer server.Close()
-	router := v2.Router()
 
 	serverURL, err := url.Parse(server.URL)
 	if err != nil {
@@ -211,6 +221,250 @@ func TestNewApp(t *testing.T) {
 	}
 }
 
+// TestNewAppAuthChain covers the creation of an application with chained
+// access controllers and anonymous pull access.
+func TestNewAppAuthChain(t *testing.T) {
+	ctx := dcontext.Background()
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+			"htpasswd": {
+				"realm": "basic-realm",
+				"path":  filepath.Join(t.TempDir(), "htpasswd"),
+			},
+			"chain": {
+				"order":     []interface{}{"htpasswd", "silly"},
+				"anonymous": []interface{}{"public/.*"},
+			},
+		},
+	}
+
+	app := NewApp(ctx, &config)
+
+	server := httptest.NewServer(app)
+	defer server.Close()
+	builder, err := v2.NewURLBuilderFromString(server.URL, false)
+	if err != nil {
+		t.Fatalf("error creating urlbuilder: %v", err)
+	}
+
+	baseURL, err := builder.BuildBaseURL()
+	if err != nil {
+		t.Fatalf("error creating baseURL: %v", err)
+	}
+
+	resp, err := http.Get(baseURL)
+	if err != nil {
+		t.Fatalf("unexpected error during GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code: %v != %v", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	expectedAuthHeaders := []string{
+		`Basic realm="basic-realm"`,
+		`Bearer realm="realm-test",service="service-test"`,
+	}
+	if e, a := expectedAuthHeaders, resp.Header.Values("WWW-Authenticate"); !reflect.DeepEqual(e, a) {
+		t.Fatalf("unexpected WWW-Authenticate headers: %q != %q", e, a)
+	}
+
+	// The second controller in the chain authorizes the request.
+	req, err := http.NewRequest(http.MethodGet, baseURL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer anything")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error during GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %v != %v", resp.StatusCode, http.StatusOK)
+	}
+
+	// Public repositories can be pulled anonymously, but not pushed.
+	for _, tc := range []struct {
+		name   string
+		method string
+		status int
+	}{
+		{"public/app", http.MethodGet, http.StatusNotFound},
+		{"public/app", http.MethodDelete, http.StatusUnauthorized},
+		{"private/app", http.MethodGet, http.StatusUnauthorized},
+	} {
+		named, err := reference.WithName(tc.name)
+		if err != nil {
+			t.Fatalf("unexpected error parsing name: %v", err)
+		}
+		tagsURL := buildTagsURL(server.URL, named)
+		req, err := http.NewRequest(tc.method, tagsURL, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error during %s: %v", tc.method, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Fatalf("unexpected status code for %s %s: %v != %v", tc.method, tc.name, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+// TestAnonymousPolicy covers anonymous access granted by the anonymous
+// policy, whichever access controller is configured.
+func TestAnonymousPolicy(t *testing.T) {
+	ctx := dcontext.Background()
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+	config.Policy.Anonymous.Repositories = []string{"public/.*"}
+	config.Policy.Anonymous.Catalog = true
+	config.Catalog.MaxEntries = 100
+
+	app := NewApp(ctx, &config)
+
+	for _, name := range []string{"private/app", "public/app", "secret/app"} {
+		named, err := reference.WithName(name)
+		if err != nil {
+			t.Fatalf("unexpected error parsing name: %v", err)
+		}
+		repo, err := app.registry.Repository(ctx, named)
+		if err != nil {
+			t.Fatalf("unexpected error getting repository: %v", err)
+		}
+		if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: digest.FromString(name)}); err != nil {
+			t.Fatalf("unexpected error tagging: %v", err)
+		}
+	}
+
+	server := httptest.NewServer(app)
+	defer server.Close()
+	builder, err := v2.NewURLBuilderFromString(server.URL, false)
+	if err != nil {
+		t.Fatalf("error creating urlbuilder: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"public/app", "", http.StatusOK},
+		{"private/app", "", http.StatusUnauthorized},
+		{"private/app", "Bearer anything", http.StatusOK},
+	} {
+		named, err := reference.WithName(tc.name)
+		if err != nil {
+			t.Fatalf("unexpected error parsing name: %v", err)
+		}
+		tagsURL := buildTagsURL(server.URL, named)
+		req, err := http.NewRequest(http.MethodGet, tagsURL, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error during GET: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Fatalf("unexpected status code for %s: %v != %v", tc.name, resp.StatusCode, tc.status)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("expected a challenge for %s", tc.name)
+		}
+	}
+
+	catalogURL, err := builder.BuildCatalogURL()
+	if err != nil {
+		t.Fatalf("unexpected error building catalog url: %v", err)
+	}
+	resp, err := http.Get(catalogURL)
+	if err != nil {
+		t.Fatalf("unexpected error during GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %v != %v", resp.StatusCode, http.StatusOK)
+	}
+	var ctlg catalogAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ctlg); err != nil {
+		t.Fatalf("error decoding catalog response: %v", err)
+	}
+	if !reflect.DeepEqual(ctlg.Repositories, []string{"public/app"}) {
+		t.Fatalf("unexpected anonymous catalog: %v", ctlg.Repositories)
+	}
+
+	// paginated catalogs only link to the repositories anonymous clients
+	// can pull.
+	for _, tc := range []struct {
+		last         string
+		repositories []string
+		link         string
+	}{
+		{"", []string{"public/app"}, "last=public%2Fapp"},
+		{"public/app", []string{}, ""},
+	} {
+		values := url.Values{"n": []string{"1"}}
+		if tc.last != "" {
+			values.Set("last", tc.last)
+		}
+		catalogURL, err := builder.BuildCatalogURL(values)
+		if err != nil {
+			t.Fatalf("unexpected error building catalog url: %v", err)
+		}
+		resp, err := http.Get(catalogURL)
+		if err != nil {
+			t.Fatalf("unexpected error during GET: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var ctlg catalogAPIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&ctlg); err != nil {
+			t.Fatalf("error decoding catalog response: %v", err)
+		}
+		if !reflect.DeepEqual(ctlg.Repositories, tc.repositories) {
+			t.Fatalf("unexpected anonymous catalog page after %q: %v", tc.last, ctlg.Repositories)
+		}
+		if link := resp.Header.Get("Link"); !strings.Contains(link, tc.link) || (tc.link == "" && link != "") {
+			t.Fatalf("unexpected anonymous catalog link after %q: %q", tc.last, link)
+		}
+	}
+}
+
 // Test the access record accumulator
 func TestAppendAccessRecords(t *testing.T) {
 	repo := "testRepo"
@@ -275,3 +529,165 @@ func TestAppendAccessRecords(t *testing.T) {
 		t.Fatalf("Actual access record differs from expected")
 	}
 }
+
+// buildTagsURL builds the tags URL of the named repository on the server.
+// URL builders share the routes of v2.Router, which TestAppDispatcher binds
+// to its own server, so repository URLs are not built with them.
+func buildTagsURL(serverURL string, named reference.Named) string {
+	return serverURL + "/v2/" + named.Name() + "/tags/list"
+}
+
+// TestRobotAccounts covers the management of robot accounts by the configured
+// administrators, and their use to access repositories.
+func TestRobotAccounts(t *testing.T) {
+	ctx := dcontext.Background()
+	hashed, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("unexpected error hashing password: %v", err)
+	}
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswdPath, []byte("admin:"+string(hashed)+"\nuser:"+string(hashed)+"\n"), 0o600); err != nil {
+		t.Fatalf("unexpected error writing htpasswd: %v", err)
+	}
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"htpasswd": {
+				"realm": "basic-realm",
+				"path":  htpasswdPath,
+			},
+			"robot": {
+				"realm":     "basic-realm",
+				"admins":    []interface{}{"admin"},
+				"maxexpiry": "24h",
+			},
+			"chain": {
+				"order": []interface{}{"htpasswd", "robot"},
+			},
+		},
+	}
+
+	app := NewApp(ctx, &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+	builder, err := v2.NewURLBuilderFromString(server.URL, false)
+	if err != nil {
+		t.Fatalf("error creating urlbuilder: %v", err)
+	}
+
+	do := func(method, u, username, password, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, u, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.SetBasicAuth(username, password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error during %s: %v", method, err)
+		}
+		return resp
+	}
+
+	robotsURL, err := builder.BuildRobotsURL()
+	if err != nil {
+		t.Fatalf("unexpected error building robots url: %v", err)
+	}
+	create := `{"name": "ci", "repositories": ["team/.*"], "actions": ["pull", "push"], "expiresIn": "1h"}`
+
+	resp := do(http.MethodPost, robotsURL, "user", "secret", create)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected non-admin users to be denied, got %v", resp.StatusCode)
+	}
+
+	resp = do(http.MethodPost, robotsURL, "admin", "secret", `{"name": "ci", "repositories": ["team/.*"], "actions": ["pull"], "expiresIn": "48h"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected an expiry above the maximum to be rejected, got %v", resp.StatusCode)
+	}
+
+	resp = do(http.MethodPost, robotsURL, "admin", "secret", create)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code creating robot: %v", resp.StatusCode)
+	}
+	var created robotCreateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	if created.Username != "robot$ci" || created.Token == "" || created.Robot.TokenDigest != "" {
+		t.Fatalf("unexpected created robot: %+v", created)
+	}
+
+	resp = do(http.MethodPost, robotsURL, "admin", "secret", create)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected a duplicate robot to be rejected, got %v", resp.StatusCode)
+	}
+
+	tagsURL := func(name string) string {
+		named, err := reference.WithName(name)
+		if err != nil {
+			t.Fatalf("unexpected error parsing name: %v", err)
+		}
+		return buildTagsURL(server.URL, named)
+	}
+
+	for _, tc := range []struct {
+		method   string
+		u        string
+		password string
+		status   int
+	}{
+		{http.MethodGet, tagsURL("team/app"), created.Token, http.StatusNotFound},
+		{http.MethodGet, tagsURL("team/app"), "wrong", http.StatusUnauthorized},
+		{http.MethodDelete, tagsURL("team/app"), created.Token, http.StatusUnauthorized},
+		{http.MethodGet, tagsURL("other/app"), created.Token, http.StatusUnauthorized},
+		{http.MethodGet, robotsURL, created.Token, http.StatusUnauthorized},
+	} {
+		resp := do(tc.method, tc.u, created.Username, tc.password, "")
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("unexpected status code for robot %s %s: %v != %v", tc.method, tc.u, resp.StatusCode, tc.status)
+		}
+	}
+
+	robotURL, err := builder.BuildRobotURL("ci")
+	if err != nil {
+		t.Fatalf("unexpected error building robot url: %v", err)
+	}
+	resp = do(http.MethodDelete, robotURL, "admin", "secret", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status code revoking robot: %v", resp.StatusCode)
+	}
+
+	resp = do(http.MethodGet, tagsURL("team/app"), created.Username, created.Token, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected revoked robot to be denied, got %v", resp.StatusCode)
+	}
+
+	resp = do(http.MethodGet, robotsURL, "admin", "secret", "")
+	defer resp.Body.Close()
+	var list robotsAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	if len(list.Robots) != 1 || list.Robots[0].RevokedBy != "admin" || list.Robots[0].CreatedBy != "admin" {
+		t.Fatalf("unexpected robot list: %+v", list.Robots)
+	}
+
+	resp = do(http.MethodGet, robotURL+"x", "admin", "secret", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown robot to be not found, got %v", resp.StatusCode)
+	}
+}
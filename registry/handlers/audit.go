@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/internal/requestutil"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/audit"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+)
+
+// configureAudit prepares the audit log sinks.
+func (app *App) configureAudit(config *configuration.Configuration) {
+	var sinks []audit.Sink
+
+	if fileConfig := config.Audit.File; fileConfig.Path != "" {
+		sink, err := audit.NewFileSink(fileConfig.Path, fileConfig.MaxSize, fileConfig.MaxBackups)
+		if err != nil {
+			panic(err)
+		}
+		sinks = append(sinks, sink)
+		dcontext.GetLogger(app).Infof("writing audit log to %s", fileConfig.Path)
+	}
+
+	if syslogConfig := config.Audit.Syslog; syslogConfig.Enabled {
+		sink, err := audit.NewSyslogSink(syslogConfig.Network, syslogConfig.Address, syslogConfig.Tag)
+		if err != nil {
+			panic("unable to configure syslog audit sink: " + err.Error())
+		}
+		sinks = append(sinks, sink)
+		dcontext.GetLogger(app).Infof("sending audit log to syslog")
+	}
+
+	switch len(sinks) {
+	case 0:
+	case 1:
+		app.audit = sinks[0]
+	default:
+		app.audit = audit.NewMultiSink(sinks...)
+	}
+}
+
+// auditAction returns the audited action of the request, if any. Reads are
+// not audited.
+func auditAction(ctx *Context, r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+
+	switch route.GetName() {
+	case v2.RouteNameManifest:
+		switch r.Method {
+		case http.MethodPut:
+			return audit.ActionManifestPush
+		case http.MethodDelete:
+			if _, err := digest.Parse(getReference(ctx)); err != nil {
+				return audit.ActionTagDelete
+			}
+			return audit.ActionManifestDelete
+		}
+	case v2.RouteNameBlob:
+		if r.Method == http.MethodDelete {
+			return audit.ActionBlobDelete
+		}
+	case v2.RouteNameBlobUpload:
+		// Blobs are mounted when requested, or automatically when the
+		// upload of a blob held by another repository is started.
+		if r.Method == http.MethodPost && ctx.mountFrom != "" {
+			return audit.ActionBlobMount
+		}
+	case v2.RouteNameBlobUploadChunk:
+		switch r.Method {
+		case http.MethodPut:
+			return audit.ActionBlobPush
+		case http.MethodDelete:
+			return audit.ActionBlobUploadCancel
+		}
+	case v2.RouteNameRepositoryCopy:
+		if r.Method == http.MethodPost {
+			return audit.ActionRepositoryCopy
+		}
+	case v2.RouteNameRepositoryRename:
+		if r.Method == http.MethodPost {
+			return audit.ActionRepositoryRename
+		}
+	case v2.RouteNameRobots:
+		if r.Method == http.MethodPost {
+			return audit.ActionRobotCreate
+		}
+	case v2.RouteNameRobot:
+		if r.Method == http.MethodDelete {
+			return audit.ActionRobotRevoke
+		}
+	}
+	return ""
+}
+
+// newAuditEvent returns an audit event describing the request, without its
+// outcome.
+func newAuditEvent(ctx *Context, r *http.Request, action string) audit.Event {
+	return audit.Event{
+		ID:         uuid.NewString(),
+		Timestamp:  time.Now().UTC(),
+		Action:     action,
+		Repository: getName(ctx),
+		Actor: audit.Actor{
+			Name:      getUserName(ctx, r),
+			Anonymous: isAnonymous(ctx),
+		},
+		Request: audit.Request{
+			ID:        dcontext.GetRequestID(ctx),
+			ClientIP:  requestutil.RemoteIP(r),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			UserAgent: r.UserAgent(),
+		},
+	}
+}
+
+// auditRequest records the outcome of an authorized request in the audit
+// log, if the request is audited.
+func (app *App) auditRequest(ctx *Context, w http.ResponseWriter, r *http.Request) {
+	if app.audit == nil {
+		return
+	}
+	action := auditAction(ctx, r)
+	if action == "" {
+		return
+	}
+
+	event := newAuditEvent(ctx, r, action)
+	event.Status, _ = ctx.Value("http.response.status").(int)
+
+	switch action {
+	case audit.ActionManifestPush, audit.ActionManifestDelete, audit.ActionTagDelete:
+		if dgst, err := digest.Parse(getReference(ctx)); err == nil {
+			event.Digest = dgst
+		} else {
+			event.Tag = getReference(ctx)
+		}
+	case audit.ActionBlobDelete:
+		event.Digest = digest.Digest(dcontext.GetStringValue(ctx, "vars.digest"))
+	case audit.ActionBlobMount:
+		event.Digest = ctx.mountDigest
+		event.FromRepository = ctx.mountFrom
+	case audit.ActionBlobPush:
+		event.Digest = digest.Digest(r.FormValue("digest"))
+	case audit.ActionRepositoryCopy:
+		event.FromRepository = r.FormValue("from")
+		event.Tag = r.FormValue("tag")
+		if dgst, err := digest.Parse(r.FormValue("reference")); err == nil {
+			event.Digest = dgst
+		} else if event.Tag == "" {
+			// copies by tag keep the tag
+			event.Tag = r.FormValue("reference")
+		}
+	case audit.ActionRepositoryRename:
+		event.Target = r.FormValue("to")
+	case audit.ActionRobotCreate:
+		if location := w.Header().Get("Location"); location != "" {
+			event.Target = path.Base(location)
+		}
+	case audit.ActionRobotRevoke:
+		event.Target = dcontext.GetStringValue(ctx, "vars.robot")
+	}
+	if event.Digest == "" {
+		event.Digest = digest.Digest(w.Header().Get("Docker-Content-Digest"))
+	}
+
+	switch {
+	case ctx.Errors.Len() > 0:
+		event.Outcome = audit.OutcomeFailure
+		event.Error = ctx.Errors.Error()
+	case event.Status >= http.StatusBadRequest:
+		event.Outcome = audit.OutcomeFailure
+	case action == audit.ActionBlobMount && event.Status != http.StatusCreated:
+		// The mount failed and an upload was started instead.
+		event.Outcome = audit.OutcomeFailure
+		event.Error = "blob could not be mounted"
+	default:
+		event.Outcome = audit.OutcomeSuccess
+	}
+
+	app.writeAuditEvent(ctx, event)
+}
+
+// auditAuthFailure records a failed authorization in the audit log. Only
+// requests carrying credentials are recorded, as requests without credentials
+// are challenged as part of the normal authentication flow.
+func (app *App) auditAuthFailure(ctx *Context, r *http.Request, outcome string, err error) {
+	if app.audit == nil || !hasCredentials(r) {
+		return
+	}
+
+	event := newAuditEvent(ctx, r, audit.ActionAuth)
+	event.Outcome = outcome
+	event.Error = err.Error()
+	event.Status, _ = ctx.Value("http.response.status").(int)
+	app.writeAuditEvent(ctx, event)
+}
+
+func (app *App) writeAuditEvent(ctx *Context, event audit.Event) {
+	if err := app.audit.Write(event); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error writing audit event %s: %v", event.ID, err)
+	}
+}
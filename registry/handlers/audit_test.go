@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/audit"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestAuditLog covers the events recorded in the audit log for writes and
+// authentication failures.
+func TestAuditLog(t *testing.T) {
+	ctx := dcontext.Background()
+	dir := t.TempDir()
+	hashed, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("unexpected error hashing password: %v", err)
+	}
+	htpasswdPath := filepath.Join(dir, "htpasswd")
+	if err := os.WriteFile(htpasswdPath, []byte("user:"+string(hashed)+"\n"), 0o600); err != nil {
+		t.Fatalf("unexpected error writing htpasswd: %v", err)
+	}
+	auditPath := filepath.Join(dir, "audit.log")
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"htpasswd": {
+				"realm": "basic-realm",
+				"path":  htpasswdPath,
+			},
+		},
+		Audit: configuration.Audit{
+			File: configuration.AuditFile{Path: auditPath},
+		},
+	}
+
+	app := NewApp(ctx, &config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	do := func(method, u, password string, body []byte) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.SetBasicAuth("user", password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error during %s: %v", method, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Push a blob, which is recorded once the upload completes.
+	content := []byte("audited layer")
+	dgst := digest.FromBytes(content)
+	resp := do(http.MethodPost, server.URL+"/v2/foo/blobs/uploads/", "secret", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status code starting upload: %v", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing location: %v", err)
+	}
+	q := location.Query()
+	q.Set("digest", dgst.String())
+	location.RawQuery = q.Encode()
+	if resp := do(http.MethodPut, server.URL+location.RequestURI(), "secret", content); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code completing upload: %v", resp.StatusCode)
+	}
+
+	// Mount the blob in another repository.
+	if resp := do(http.MethodPost, server.URL+"/v2/bar/blobs/uploads/?from=foo&mount="+dgst.String(), "secret", nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code mounting blob: %v", resp.StatusCode)
+	}
+
+	// Reads are not audited.
+	if resp := do(http.MethodHead, server.URL+"/v2/bar/blobs/"+dgst.String(), "secret", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code fetching blob: %v", resp.StatusCode)
+	}
+
+	// The tag is unknown, so its deletion fails.
+	do(http.MethodDelete, server.URL+"/v2/foo/manifests/latest", "secret", nil)
+
+	// Authentication failures are recorded with the presented username.
+	if resp := do(http.MethodGet, server.URL+"/v2/foo/tags/list", "wrong", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code with a wrong password: %v", resp.StatusCode)
+	}
+
+	if err := app.Shutdown(); err != nil {
+		t.Fatalf("unexpected error shutting down: %v", err)
+	}
+
+	events := readAuditEvents(t, auditPath)
+	expected := []audit.Event{
+		{Action: audit.ActionBlobPush, Outcome: audit.OutcomeSuccess, Repository: "foo", Digest: dgst, Status: http.StatusCreated},
+		{Action: audit.ActionBlobMount, Outcome: audit.OutcomeSuccess, Repository: "bar", FromRepository: "foo", Digest: dgst, Status: http.StatusCreated},
+		{Action: audit.ActionTagDelete, Outcome: audit.OutcomeFailure, Repository: "foo", Tag: "latest", Status: http.StatusNotFound},
+		{Action: audit.ActionAuth, Outcome: audit.OutcomeDenied, Repository: "foo", Status: http.StatusUnauthorized},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected audit events: %+v", events)
+	}
+	for i, event := range events {
+		e := expected[i]
+		if event.Action != e.Action || event.Outcome != e.Outcome || event.Repository != e.Repository ||
+			event.FromRepository != e.FromRepository || event.Digest != e.Digest || event.Tag != e.Tag || event.Status != e.Status {
+			t.Fatalf("unexpected audit event %d: %+v != %+v", i, event, e)
+		}
+		if event.ID == "" || event.Timestamp.IsZero() || event.Actor.Name != "user" || event.Request.ID == "" || event.Request.ClientIP != "127.0.0.1" {
+			t.Fatalf("incomplete audit event %d: %+v", i, event)
+		}
+	}
+	if events[2].Error == "" || events[3].Error == "" {
+		t.Fatalf("expected failures to describe the error: %+v", events)
+	}
+}
+
+// TestAuditLogAutomaticMount checks that blobs mounted automatically are
+// recorded with the repository they were mounted from.
+func TestAuditLogAutomaticMount(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"mount":    configuration.Parameters{"automatic": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Audit: configuration.Audit{
+			File: configuration.AuditFile{Path: auditPath},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	// repositories are only enumerated once they hold manifests
+	createRepository(env, t, "shared/app", "latest")
+	sharedName, _ := reference.WithName("shared/app")
+	content := []byte("automatically mounted layer")
+	dgst := digest.FromBytes(content)
+	uploadURLBase, _ := startPushLayer(t, env, sharedName)
+	pushLayer(t, env.builder, sharedName, dgst, uploadURLBase, bytes.NewReader(content))
+
+	imageName, _ := reference.WithName("team/app")
+	uploadURL, err := env.builder.BuildBlobUploadURL(imageName, url.Values{
+		"digest": []string{dgst.String()},
+	})
+	checkErr(t, err, "building upload url")
+	resp, err := http.Post(uploadURL, "", nil)
+	checkErr(t, err, "starting upload")
+	defer resp.Body.Close()
+	checkResponse(t, "starting upload of blob held by another repository", resp, http.StatusCreated)
+
+	if err := env.app.Shutdown(); err != nil {
+		t.Fatalf("unexpected error shutting down: %v", err)
+	}
+
+	var mounts []audit.Event
+	for _, event := range readAuditEvents(t, auditPath) {
+		if event.Action == audit.ActionBlobMount {
+			mounts = append(mounts, event)
+		}
+	}
+	if len(mounts) != 1 {
+		t.Fatalf("unexpected mount events: %+v", mounts)
+	}
+	if mount := mounts[0]; mount.Outcome != audit.OutcomeSuccess || mount.Repository != "team/app" ||
+		mount.FromRepository != "shared/app" || mount.Digest != dgst || mount.Status != http.StatusCreated {
+		t.Fatalf("unexpected mount event: %+v", mount)
+	}
+}
+
+// TestAuditLogRepositoryCopy checks that repository copies and renames are
+// recorded.
+func TestAuditLogRepositoryCopy(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Audit: configuration.Audit{
+			File: configuration.AuditFile{Path: auditPath},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	dgst := createRepository(env, t, "staging/app", "latest")
+
+	target, _ := reference.WithName("prod/app")
+	copyURL, err := env.builder.BuildRepositoryCopyURL(target, url.Values{
+		"from":      []string{"staging/app"},
+		"reference": []string{"latest"},
+	})
+	checkErr(t, err, "building copy url")
+	resp, err := http.Post(copyURL, "", nil)
+	checkErr(t, err, "copying tag")
+	defer resp.Body.Close()
+	checkResponse(t, "copying tag", resp, http.StatusCreated)
+
+	renameURL, err := env.builder.BuildRepositoryRenameURL(target, url.Values{
+		"to": []string{"release/app"},
+	})
+	checkErr(t, err, "building rename url")
+	resp, err = http.Post(renameURL, "", nil)
+	checkErr(t, err, "renaming repository")
+	defer resp.Body.Close()
+	checkResponse(t, "renaming repository", resp, http.StatusCreated)
+
+	if err := env.app.Shutdown(); err != nil {
+		t.Fatalf("unexpected error shutting down: %v", err)
+	}
+
+	var events []audit.Event
+	for _, event := range readAuditEvents(t, auditPath) {
+		if event.Action == audit.ActionRepositoryCopy || event.Action == audit.ActionRepositoryRename {
+			events = append(events, event)
+		}
+	}
+	expected := []audit.Event{
+		{Action: audit.ActionRepositoryCopy, Outcome: audit.OutcomeSuccess, Repository: "prod/app", FromRepository: "staging/app", Digest: dgst, Tag: "latest", Status: http.StatusCreated},
+		{Action: audit.ActionRepositoryRename, Outcome: audit.OutcomeSuccess, Repository: "prod/app", Target: "release/app", Status: http.StatusCreated},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected audit events: %+v", events)
+	}
+	for i, event := range events {
+		e := expected[i]
+		if event.Action != e.Action || event.Outcome != e.Outcome || event.Repository != e.Repository ||
+			event.FromRepository != e.FromRepository || event.Digest != e.Digest || event.Tag != e.Tag ||
+			event.Target != e.Target || event.Status != e.Status {
+			t.Fatalf("unexpected audit event %d: %+v != %+v", i, event, e)
+		}
+	}
+}
+
+// readAuditEvents reads the events of an audit log file.
+func readAuditEvents(t *testing.T, path string) []audit.Event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening audit log: %v", err)
+	}
+	defer f.Close()
+	var events []audit.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event audit.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("unexpected error decoding audit event: %v", err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
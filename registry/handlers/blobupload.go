@@ -10,11 +10,16 @@ import (
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/reference"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
 )
 
+// uploadPartHeader marks a PATCH request whose chunk is written as a separate
+// part of the upload, at the offset of its Content-Range.
+const uploadPartHeader = "Docker-Upload-Part"
+
 // blobUploadDispatcher constructs and returns the blob upload handler for the
 // given request context.
 func blobUploadDispatcher(ctx *Context, r *http.Request) http.Handler {
@@ -73,6 +78,20 @@ func (buh *blobUploadHandler) StartBlobUpload(w http.ResponseWriter, r *http.Req
 		opt, err := buh.createBlobMountOption(fromRepo, mountDigest)
 		if opt != nil && err == nil {
 			options = append(options, opt)
+			buh.mountFrom, buh.mountDigest = fromRepo, digest.Digest(mountDigest)
+		}
+	} else if buh.automaticMount && !buh.isCache {
+		if mountDigest == "" {
+			mountDigest = r.FormValue("digest")
+		}
+		if mountDigest != "" {
+			opt, from, err := buh.createAutomaticBlobMountOption(r, mountDigest)
+			if err != nil {
+				dcontext.GetLogger(buh).Errorf("error looking up repositories holding blob %s: %v", mountDigest, err)
+			} else if opt != nil {
+				options = append(options, opt)
+				buh.mountFrom, buh.mountDigest = from, digest.Digest(mountDigest)
+			}
 		}
 	}
 
@@ -141,6 +160,11 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if r.Header.Get(uploadPartHeader) == "true" {
+		buh.patchBlobPart(w, r)
+		return
+	}
+
 	cr := r.Header.Get("Content-Range")
 	cl := r.Header.Get("Content-Length")
 	if cr != "" && cl != "" {
@@ -165,10 +189,86 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
+	if buh.exceedsMaxBlobSize(buh.Upload.Size(), r.ContentLength) {
+		buh.Errors = append(buh.Errors, buh.limits.blobTooLarge())
+		return
+	}
+
 	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PATCH"); err != nil {
+		buh.Errors = append(buh.Errors, buh.payloadError(err))
+		return
+	}
+
+	if err := buh.blobUploadResponse(w, r); err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// patchBlobPart writes the chunk of the request as a separate part of the
+// upload, at the offset given by its Content-Range. Parts may be written
+// concurrently and in any order, and are assembled after the data written
+// sequentially when the upload is completed, so the upload offset is left
+// unchanged.
+func (buh *blobUploadHandler) patchBlobPart(w http.ResponseWriter, r *http.Request) {
+	pw, ok := buh.Upload.(distribution.BlobPartWriter)
+	if !ok {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+
+	cr := r.Header.Get("Content-Range")
+	cl := r.Header.Get("Content-Length")
+	if cr == "" || cl == "" {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeRangeInvalid.WithDetail("upload parts require Content-Range and Content-Length"))
+		return
+	}
+
+	start, end, err := parseContentRange(cr)
+	if err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		return
+	}
+	if start > end || start < buh.Upload.Size() {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeRangeInvalid)
+		return
+	}
+
+	clInt, err := strconv.ParseInt(cl, 10, 64)
+	if err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
 		return
 	}
+	if clInt != (end-start)+1 {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeSizeInvalid)
+		return
+	}
+
+	if buh.exceedsMaxBlobSize(start, clInt) {
+		buh.Errors = append(buh.Errors, buh.limits.blobTooLarge())
+		return
+	}
+
+	n, err := pw.WritePart(buh, start, r.Body)
+	if err != nil {
+		switch err {
+		case distribution.ErrUnsupported:
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnsupported)
+		case distribution.ErrBlobTooLarge:
+			buh.Errors = append(buh.Errors, buh.limits.blobTooLarge())
+		default:
+			dcontext.GetLogger(buh).Errorf("unknown error writing upload part: %v", err)
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+	if n != clInt {
+		// The part is overwritten when the client writes it again.
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeSizeInvalid)
+		return
+	}
 
 	if err := buh.blobUploadResponse(w, r); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
@@ -205,8 +305,13 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 		return
 	}
 
+	if buh.exceedsMaxBlobSize(buh.Upload.Size(), r.ContentLength) {
+		buh.Errors = append(buh.Errors, buh.limits.blobTooLarge())
+		return
+	}
+
 	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PUT"); err != nil {
-		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		buh.Errors = append(buh.Errors, buh.payloadError(err))
 		return
 	}
 
@@ -229,7 +334,7 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 				buh.Errors = append(buh.Errors, errcode.ErrorCodeDenied)
 			case distribution.ErrUnsupported:
 				buh.Errors = append(buh.Errors, errcode.ErrorCodeUnsupported)
-			case distribution.ErrBlobInvalidLength, distribution.ErrBlobDigestUnsupported:
+			case distribution.ErrBlobInvalidLength, distribution.ErrBlobDigestUnsupported, distribution.ErrBlobUploadPartsInvalid:
 				buh.Errors = append(buh.Errors, errcode.ErrorCodeBlobUploadInvalid.WithDetail(err))
 			default:
 				dcontext.GetLogger(buh).Errorf("unknown error completing upload: %v", err)
@@ -318,6 +423,22 @@ func (buh *blobUploadHandler) ResumeBlobUpload(ctx *Context, r *http.Request) ht
 	return nil
 }
 
+// exceedsMaxBlobSize returns true if length bytes written at offset would
+// exceed the maximum size of blobs. Unknown lengths are negative, and only
+// checked as the content is written.
+func (buh *blobUploadHandler) exceedsMaxBlobSize(offset, length int64) bool {
+	return buh.limits.maxBlobSize > 0 && length > 0 && offset+length > buh.limits.maxBlobSize
+}
+
+// payloadError returns the error reported for a failure to write the payload
+// of a request to the upload.
+func (buh *blobUploadHandler) payloadError(err error) error {
+	if err == distribution.ErrBlobTooLarge {
+		return buh.limits.blobTooLarge()
+	}
+	return errcode.ErrorCodeUnknown.WithDetail(err.Error())
+}
+
 // blobUploadResponse provides a standard request for uploading blobs and
 // chunk responses. This sets the correct headers but the response status is
 // left to the caller.
@@ -381,6 +502,86 @@ func (buh *blobUploadHandler) createBlobMountOption(fromRepo, mountDigest string
 	return storage.WithMountFrom(canonical), nil
 }
 
+// defaultAutomaticMountMaxRepositories is the number of repositories looked
+// up for each automatic mount, unless configured otherwise.
+const defaultAutomaticMountMaxRepositories = 100
+
+// createAutomaticBlobMountOption looks for a repository holding the blob which
+// the client is authorized to pull from, and returns an option mounting the
+// blob from it, along with the name of the repository. No option is returned
+// if the blob is unknown to the registry or if the client cannot pull it from
+// any repository. As the lookup enumerates the repositories of the registry,
+// it gives up after the configured number of repositories, so that the cost
+// of a request is bounded whatever the size of the registry.
+func (buh *blobUploadHandler) createAutomaticBlobMountOption(r *http.Request, mountDigest string) (distribution.BlobCreateOption, string, error) {
+	dgst, err := digest.Parse(mountDigest)
+	if err != nil {
+		return nil, "", nil
+	}
+
+	if _, err := buh.registry.BlobStatter().Stat(buh, dgst); err != nil {
+		if err == distribution.ErrBlobUnknown {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	// the blob is linked again if the repository already holds it
+	name := buh.Repository.Named().Name()
+	if _, err := buh.Repository.Blobs(buh).Stat(buh, dgst); err == nil {
+		opt, err := buh.createBlobMountOption(name, mountDigest)
+		return opt, name, err
+	}
+
+	enumerator, ok := buh.registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, "", nil
+	}
+
+	var (
+		fromRepo string
+		checked  int
+	)
+	err = enumerator.Enumerate(buh, func(repo string) error {
+		if repo == name {
+			return nil
+		}
+		if checked == buh.automaticMountMaxRepositories {
+			return storagedriver.ErrFilledBuffer
+		}
+		checked++
+
+		named, err := reference.WithName(repo)
+		if err != nil {
+			return nil
+		}
+		repository, err := buh.registry.Repository(buh, named)
+		if err != nil {
+			return err
+		}
+		if _, err := repository.Blobs(buh).Stat(buh, dgst); err != nil {
+			if err == distribution.ErrBlobUnknown {
+				return nil
+			}
+			return err
+		}
+		if !buh.pullAuthorized(buh.Context, r, repo) {
+			return nil
+		}
+		fromRepo = repo
+		return storagedriver.ErrFilledBuffer
+	})
+	if err != nil && err != storagedriver.ErrFilledBuffer {
+		return nil, "", err
+	}
+	if fromRepo == "" {
+		return nil, "", nil
+	}
+
+	opt, err := buh.createBlobMountOption(fromRepo, mountDigest)
+	return opt, fromRepo, err
+}
+
 // writeBlobCreatedHeaders writes the standard headers describing a newly
 // created blob. A 201 Created is written as well as the canonical URL and
 // blob digest.
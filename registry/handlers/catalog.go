@@ -64,31 +64,53 @@ func (ch *catalogHandler) GetCatalog(w http.ResponseWriter, r *http.Request) {
 		entries = maximumConfiguredEntries
 	}
 
-	repos := make([]string, entries)
-	filled := 0
+	repos := make([]string, 0, entries)
+
+	// Anonymous clients may only discover the repositories they can pull.
+	// Pages are read until enough of them are found, and the link header
+	// refers to the last one returned, so that the names of the other
+	// repositories are never disclosed.
+	anonymous := isAnonymous(ch)
 
 	// entries is guaranteed to be >= 0 and < maximumConfiguredEntries
 	if entries == 0 {
 		moreEntries = false
 	} else {
-		returnedRepositories, err := ch.App.registry.Repositories(ch.Context, repos, lastEntry)
-		if err != nil {
-			_, pathNotFound := err.(driver.PathNotFoundError)
-			if err != io.EOF && !pathNotFound {
-				ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
-				return
+		page := make([]string, entries)
+		for moreEntries && len(repos) < entries {
+			filled, err := ch.App.registry.Repositories(ch.Context, page, lastEntry)
+			if err != nil {
+				_, pathNotFound := err.(driver.PathNotFoundError)
+				if err != io.EOF && !pathNotFound {
+					ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+					return
+				}
+				// err is either io.EOF or not PathNotFoundError
+				moreEntries = false
+			}
+			if filled == 0 {
+				moreEntries = false
+			}
+
+			for i, repo := range page[:filled] {
+				lastEntry = repo
+				if anonymous && !ch.App.anonymousAccess.AllowsRepository(repo) {
+					continue
+				}
+				repos = append(repos, repo)
+				if len(repos) == entries {
+					// the rest of the page is left for the next request
+					moreEntries = moreEntries || i < filled-1
+					break
+				}
 			}
-			// err is either io.EOF or not PathNotFoundError
-			moreEntries = false
 		}
-		filled = returnedRepositories
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Add a link header if there are more entries to retrieve
 	if moreEntries {
-		lastEntry = repos[filled-1]
 		urlStr, err := createLinkEntry(r.URL.String(), entries, lastEntry)
 		if err != nil {
 			ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
@@ -99,7 +121,7 @@ func (ch *catalogHandler) GetCatalog(w http.ResponseWriter, r *http.Request) {
 
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(catalogAPIResponse{
-		Repositories: repos[0:filled],
+		Repositories: repos,
 	}); err != nil {
 		ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
@@ -35,6 +35,11 @@ type Context struct {
 
 	urlBuilder *v2.URLBuilder
 
+	// mountFrom and mountDigest describe the blob mounted by the request,
+	// explicitly or automatically, for the audit log.
+	mountFrom   string
+	mountDigest digest.Digest
+
 	// TODO(stevvooe): The goal is too completely factor this context and
 	// dispatching out of the web application. Ideally, we should lean on
 	// context.Context for injection of these resources.
@@ -160,3 +165,18 @@ func authorizedResources(ctx context.Context) []auth.Resource {
 
 	return nil
 }
+
+// withAnonymous returns a context marking the request as authorized by the
+// anonymous access policy.
+func withAnonymous(ctx context.Context) context.Context {
+	return context.WithValue(ctx, anonymousKey{}, true)
+}
+
+type anonymousKey struct{}
+
+// isAnonymous returns whether the request has been authorized by the
+// anonymous access policy.
+func isAnonymous(ctx context.Context) bool {
+	anonymous, _ := ctx.Value(anonymousKey{}).(bool)
+	return anonymous
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+)
+
+// contentLimits enforces the limits configured on pushed blobs and
+// manifests.
+type contentLimits struct {
+	maxBlobSize     int64
+	maxManifestSize int64
+	maxLayers       int
+	maxIndexEntries int
+	mediaTypes      []mediaTypeLimits
+}
+
+// mediaTypeLimits holds the media types allowed in the manifests of the
+// repositories matching a pattern. A nil set allows any media type.
+type mediaTypeLimits struct {
+	repositories *regexp.Regexp
+	config       map[string]struct{}
+	layers       map[string]struct{}
+}
+
+// newContentLimits compiles the limits configuration.
+func newContentLimits(config configuration.Limits) (*contentLimits, error) {
+	limits := &contentLimits{
+		maxBlobSize:     config.Blobs.MaxSize,
+		maxManifestSize: config.Manifests.MaxSize,
+		maxLayers:       config.Manifests.MaxLayers,
+		maxIndexEntries: config.Manifests.MaxIndexEntries,
+	}
+	if limits.maxBlobSize < 0 || limits.maxManifestSize < 0 || limits.maxLayers < 0 || limits.maxIndexEntries < 0 {
+		return nil, fmt.Errorf("limits must not be negative")
+	}
+	if limits.maxManifestSize == 0 {
+		limits.maxManifestSize = maxManifestBodySize
+	}
+
+	for _, mt := range config.MediaTypes {
+		if len(mt.Repositories) == 0 {
+			return nil, fmt.Errorf("media type limits require repositories")
+		}
+
+		wrapped := make([]string, 0, len(mt.Repositories))
+		for _, p := range mt.Repositories {
+			if _, err := regexp.Compile(p); err != nil {
+				return nil, fmt.Errorf("invalid repository pattern %q: %v", p, err)
+			}
+			wrapped = append(wrapped, fmt.Sprintf("(?:%s)", p))
+		}
+
+		limits.mediaTypes = append(limits.mediaTypes, mediaTypeLimits{
+			repositories: regexp.MustCompile("^(?:" + strings.Join(wrapped, "|") + ")$"),
+			config:       mediaTypeSet(mt.Config),
+			layers:       mediaTypeSet(mt.Layers),
+		})
+	}
+
+	return limits, nil
+}
+
+func mediaTypeSet(mediaTypes []string) map[string]struct{} {
+	if len(mediaTypes) == 0 {
+		return nil
+	}
+
+	set := make(map[string]struct{}, len(mediaTypes))
+	for _, mediaType := range mediaTypes {
+		set[mediaType] = struct{}{}
+	}
+	return set
+}
+
+// checkManifest returns an error if the manifest pushed to the repository
+// exceeds the limits, or holds disallowed media types.
+func (limits *contentLimits) checkManifest(repository string, manifest distribution.Manifest) error {
+	var config distribution.Descriptor
+	var layers []distribution.Descriptor
+	switch m := manifest.(type) {
+	case *schema2.DeserializedManifest:
+		config, layers = m.Config, m.Layers
+	case *ocischema.DeserializedManifest:
+		config, layers = m.Config, m.Layers
+	case *manifestlist.DeserializedManifestList:
+		return limits.checkIndexEntries(len(m.Manifests))
+	case *ocischema.DeserializedImageIndex:
+		return limits.checkIndexEntries(len(m.Manifests))
+	default:
+		return nil
+	}
+
+	if limits.maxLayers > 0 && len(layers) > limits.maxLayers {
+		return errcode.ErrorCodeManifestInvalid.WithDetail(fmt.Sprintf("manifest has %d layers, more than the maximum of %d", len(layers), limits.maxLayers))
+	}
+
+	for _, mt := range limits.mediaTypes {
+		if !mt.repositories.MatchString(repository) {
+			continue
+		}
+
+		if _, ok := mt.config[config.MediaType]; mt.config != nil && !ok {
+			return errcode.ErrorCodeDenied.WithMessage(fmt.Sprintf("config media type %s not allowed in repository", config.MediaType))
+		}
+		for _, layer := range layers {
+			if _, ok := mt.layers[layer.MediaType]; mt.layers != nil && !ok {
+				return errcode.ErrorCodeDenied.WithMessage(fmt.Sprintf("layer media type %s not allowed in repository", layer.MediaType))
+			}
+		}
+		break
+	}
+
+	return nil
+}
+
+func (limits *contentLimits) checkIndexEntries(entries int) error {
+	if limits.maxIndexEntries > 0 && entries > limits.maxIndexEntries {
+		return errcode.ErrorCodeManifestInvalid.WithDetail(fmt.Sprintf("index has %d manifests, more than the maximum of %d", entries, limits.maxIndexEntries))
+	}
+	return nil
+}
+
+// blobTooLarge returns the error of blob uploads exceeding the maximum size.
+func (limits *contentLimits) blobTooLarge() errcode.Error {
+	return errcode.ErrorCodeSizeInvalid.WithDetail(fmt.Sprintf("blob exceeds the maximum size of %d bytes", limits.maxBlobSize))
+}
@@ -237,14 +237,25 @@ func etagMatch(r *http.Request, etag string) bool {
 // PutManifest validates and stores a manifest in the registry.
 func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(imh).Debug("PutImageManifest")
-	manifests, err := imh.Repository.Manifests(imh)
+	var manifestOptions []distribution.ManifestServiceOption
+	if imh.Digest != "" && imh.Digest.Algorithm() != digest.Canonical {
+		// store the manifest under the digest it is referenced by
+		manifestOptions = append(manifestOptions, storage.WithDigestAlgorithm(imh.Digest.Algorithm()))
+	}
+	manifests, err := imh.Repository.Manifests(imh, manifestOptions...)
 	if err != nil {
 		imh.Errors = append(imh.Errors, err)
 		return
 	}
 
+	maxSize := imh.limits.maxManifestSize
+	if r.ContentLength > maxSize {
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithDetail(fmt.Sprintf("manifest exceeds the maximum size of %d bytes", maxSize)))
+		return
+	}
+
 	var jsonBuf bytes.Buffer
-	if err := copyFullPayload(imh, w, r, &jsonBuf, maxManifestBodySize, "image manifest PUT"); err != nil {
+	if err := copyFullPayload(imh, w, r, &jsonBuf, maxSize, "image manifest PUT"); err != nil {
 		// copyFullPayload reports the error if necessary
 		imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithDetail(err.Error()))
 		return
@@ -258,6 +269,9 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 	}
 
 	if imh.Digest != "" {
+		if imh.Digest.Algorithm() != desc.Digest.Algorithm() {
+			desc.Digest = imh.Digest.Algorithm().FromBytes(jsonBuf.Bytes())
+		}
 		if desc.Digest != imh.Digest {
 			dcontext.GetLogger(imh).Errorf("payload digest does not match: %q != %q", desc.Digest, imh.Digest)
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeDigestInvalid)
@@ -283,11 +297,21 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		options = append(options, distribution.WithTag(imh.Tag))
 	}
 
+	if err := imh.limits.checkManifest(imh.Repository.Named().Name(), manifest); err != nil {
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+
 	if err := imh.applyResourcePolicy(manifest); err != nil {
 		imh.Errors = append(imh.Errors, err)
 		return
 	}
 
+	if err := imh.admitManifest(imh, imh.Repository.Named(), imh.Tag, getUserName(imh, r), manifest, desc, jsonBuf.Bytes()); err != nil {
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+
 	_, err = manifests.Put(imh, manifest, options...)
 	if err != nil {
 		// TODO(stevvooe): These error handling switches really need to be
@@ -458,6 +482,15 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// look up the tags of the manifest before deleting it, which removes
+	// the index of its tags.
+	tagService := imh.Repository.Tags(imh)
+	referencedTags, err := tagService.Lookup(imh, distribution.Descriptor{Digest: imh.Digest})
+	if err != nil {
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+
 	err = manifests.Delete(imh, imh.Digest)
 	if err != nil {
 		switch err {
@@ -477,13 +510,6 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	tagService := imh.Repository.Tags(imh)
-	referencedTags, err := tagService.Lookup(imh, distribution.Descriptor{Digest: imh.Digest})
-	if err != nil {
-		imh.Errors = append(imh.Errors, err)
-		return
-	}
-
 	var (
 		errs []error
 		mu   sync.Mutex
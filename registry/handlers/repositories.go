@@ -0,0 +1,497 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+)
+
+// repositoryCopyDispatcher constructs the handler copying manifests between
+// repositories.
+func repositoryCopyDispatcher(ctx *Context, r *http.Request) http.Handler {
+	repositoryHandler := &repositoryHandler{
+		Context: ctx,
+	}
+
+	handler := handlers.MethodHandler{}
+	if !ctx.readOnly {
+		handler[http.MethodPost] = http.HandlerFunc(repositoryHandler.CopyManifest)
+	}
+	return handler
+}
+
+// repositoryRenameDispatcher constructs the handler renaming repositories.
+func repositoryRenameDispatcher(ctx *Context, r *http.Request) http.Handler {
+	repositoryHandler := &repositoryHandler{
+		Context: ctx,
+	}
+
+	handler := handlers.MethodHandler{}
+	if !ctx.readOnly {
+		handler[http.MethodPost] = http.HandlerFunc(repositoryHandler.RenameRepository)
+	}
+	return handler
+}
+
+// repositoryHandler handles requests copying content between repositories.
+// The repository of the request is the target of copies and the source of
+// renames.
+type repositoryHandler struct {
+	*Context
+}
+
+// CopyManifest copies the manifest identified by the reference parameter in
+// the repository of the from parameter to the repository of the request,
+// optionally tagging it.
+func (rh *repositoryHandler) CopyManifest(w http.ResponseWriter, r *http.Request) {
+	if rh.isCache {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+
+	fromName, err := reference.WithName(r.FormValue("from"))
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeNameInvalid.WithDetail(err))
+		return
+	}
+	source, err := rh.registry.Repository(rh, fromName)
+	if err != nil {
+		rh.Errors = append(rh.Errors, repositoryCopyError(err))
+		return
+	}
+
+	tag := r.FormValue("tag")
+	if tag != "" {
+		if _, err := reference.WithTag(rh.Repository.Named(), tag); err != nil {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeTagInvalid.WithDetail(err))
+			return
+		}
+	}
+
+	ref := r.FormValue("reference")
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		if _, err := reference.WithTag(fromName, ref); err != nil {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeTagInvalid.WithDetail(err))
+			return
+		}
+		desc, err := source.Tags(rh).Get(rh, ref)
+		if err != nil {
+			rh.Errors = append(rh.Errors, repositoryCopyError(err))
+			return
+		}
+		dgst = desc.Digest
+		if tag == "" {
+			tag = ref
+		}
+	}
+
+	copier := newRepositoryCopier(rh, source, rh.Repository, rh.manifestCheck(r, rh.Repository.Named()))
+	desc, err := copier.copyManifest(dgst, tag)
+	if err != nil {
+		rh.Errors = append(rh.Errors, repositoryCopyError(err))
+		return
+	}
+
+	if tag != "" {
+		if err := rh.Repository.Tags(rh).Tag(rh, tag, desc); err != nil {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+	}
+
+	canonical, err := reference.WithDigest(rh.Repository.Named(), dgst)
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	location, err := rh.urlBuilder.BuildManifestURL(canonical)
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Length", "0")
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// RenameRepository renames the repository of the request to the name of the
+// to parameter. The blobs, manifests and tags of the repository are linked
+// into the new repository before they are unlinked from the repository of
+// the request, which is then removed. A failed rename leaves the repository
+// of the request untouched, but may leave content in the new repository.
+func (rh *repositoryHandler) RenameRepository(w http.ResponseWriter, r *http.Request) {
+	if rh.isCache || !rh.deleteEnabled || rh.RepositoryRemover == nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+
+	toName, err := reference.WithName(r.FormValue("to"))
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeNameInvalid.WithDetail(err))
+		return
+	}
+	if toName.Name() == rh.Repository.Named().Name() {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeNameInvalid.WithDetail("cannot rename a repository to its own name"))
+		return
+	}
+
+	// The content of the repositories is enumerated without the event bridge
+	// and the repository middlewares, which do not expose the enumerators.
+	source, err := rh.registry.Repository(rh, rh.Repository.Named())
+	if err != nil {
+		rh.Errors = append(rh.Errors, repositoryCopyError(err))
+		return
+	}
+	manifests, err := enumerateManifests(rh, source)
+	if err != nil {
+		rh.Errors = append(rh.Errors, repositoryCopyError(err))
+		return
+	}
+	if len(manifests) == 0 {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": source.Named().Name()}))
+		return
+	}
+
+	existing, err := rh.registry.Repository(rh, toName)
+	if err != nil {
+		rh.Errors = append(rh.Errors, repositoryCopyError(err))
+		return
+	}
+	if found, err := enumerateManifests(rh, existing); err != nil {
+		rh.Errors = append(rh.Errors, repositoryCopyError(err))
+		return
+	} else if len(found) > 0 {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeRepositoryExists.WithDetail(map[string]string{"name": toName.Name()}))
+		return
+	}
+
+	target, err := rh.openRepository(r, toName)
+	if err != nil {
+		rh.Errors = append(rh.Errors, repositoryCopyError(err))
+		return
+	}
+
+	blobs, err := enumerateBlobs(rh, source)
+	if err != nil {
+		rh.Errors = append(rh.Errors, repositoryCopyError(err))
+		return
+	}
+
+	copier := newRepositoryCopier(rh, source, target, rh.manifestCheck(r, toName))
+	for _, dgst := range blobs {
+		// blobs may be linked to the repository without being referenced
+		// by any of its manifests.
+		if err := copier.mountBlob(distribution.Descriptor{Digest: dgst}); err != nil {
+			rh.Errors = append(rh.Errors, repositoryCopyError(err))
+			return
+		}
+	}
+	for _, dgst := range manifests {
+		if _, err := copier.copyManifest(dgst, ""); err != nil {
+			rh.Errors = append(rh.Errors, repositoryCopyError(err))
+			return
+		}
+	}
+
+	tags, err := source.Tags(rh).All(rh)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+	}
+	for _, tag := range tags {
+		desc, err := source.Tags(rh).Get(rh, tag)
+		if err != nil {
+			rh.Errors = append(rh.Errors, repositoryCopyError(err))
+			return
+		}
+		if err := target.Tags(rh).Tag(rh, tag, desc); err != nil {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+	}
+
+	if err := unlinkRepository(rh, source, tags, manifests, blobs); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	if err := rh.RepositoryRemover.Remove(rh, source.Named()); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	location, err := rh.urlBuilder.BuildTagsURL(toName)
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// openRepository opens the named repository, decorated with the event bridge
+// and the repository middlewares like the repository of the request.
+func (rh *repositoryHandler) openRepository(r *http.Request, name reference.Named) (distribution.Repository, error) {
+	repository, err := rh.registry.Repository(rh, name)
+	if err != nil {
+		return nil, err
+	}
+	repository, _ = notifications.Listen(repository, rh.repoRemover, rh.eventBridge(rh.Context, r))
+	return applyRepoMiddleware(rh, repository, rh.Config.Middleware["repository"])
+}
+
+// manifestCheck returns the check of the manifests copied to the target
+// repository, which applies the limits and the admission webhooks of pushed
+// manifests, with the user of the request as the actor.
+func (rh *repositoryHandler) manifestCheck(r *http.Request, target reference.Named) manifestCheckFunc {
+	actor := getUserName(rh, r)
+	return func(manifest distribution.Manifest, desc distribution.Descriptor, payload []byte, tag string) error {
+		if err := rh.limits.checkManifest(target.Name(), manifest); err != nil {
+			return err
+		}
+		return rh.admitManifest(rh, target, tag, actor, manifest, desc, payload)
+	}
+}
+
+// manifestCheckFunc returns an error if the manifest may not be copied to the
+// target repository.
+type manifestCheckFunc func(manifest distribution.Manifest, desc distribution.Descriptor, payload []byte, tag string) error
+
+// repositoryCopier copies manifests, along with the manifests and blobs they
+// reference, from one repository to another. Blobs are mounted rather than
+// copied.
+type repositoryCopier struct {
+	ctx    context.Context
+	source distribution.Repository
+	target distribution.Repository
+
+	// check is called with each manifest before it is stored in the target
+	// repository.
+	check manifestCheckFunc
+
+	// copied holds the digests of the manifests and blobs already copied.
+	copied map[digest.Digest]struct{}
+}
+
+func newRepositoryCopier(ctx context.Context, source, target distribution.Repository, check manifestCheckFunc) *repositoryCopier {
+	return &repositoryCopier{
+		ctx:    ctx,
+		source: source,
+		target: target,
+		check:  check,
+		copied: make(map[digest.Digest]struct{}),
+	}
+}
+
+// copyManifest copies the manifest to the target repository after the
+// manifests and blobs it references, returning its descriptor. The tag is
+// only reported in the push event of the manifest, it is not set.
+func (rc *repositoryCopier) copyManifest(dgst digest.Digest, tag string) (distribution.Descriptor, error) {
+	sourceManifests, err := rc.source.Manifests(rc.ctx)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	manifest, err := sourceManifests.Get(rc.ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	desc := distribution.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(payload)),
+	}
+	if _, ok := rc.copied[dgst]; ok && tag == "" {
+		return desc, nil
+	}
+
+	for _, ref := range manifest.References() {
+		if _, ok := rc.copied[ref.Digest]; ok {
+			continue
+		}
+		exists, err := sourceManifests.Exists(rc.ctx, ref.Digest)
+		if err != nil {
+			return distribution.Descriptor{}, err
+		}
+		if exists {
+			_, err = rc.copyManifest(ref.Digest, "")
+		} else {
+			err = rc.mountBlob(ref)
+		}
+		if err != nil {
+			return distribution.Descriptor{}, err
+		}
+	}
+
+	if err := rc.check(manifest, desc, payload, tag); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	var manifestOptions []distribution.ManifestServiceOption
+	if dgst.Algorithm() != digest.Canonical {
+		// store the manifest under the digest it is referenced by
+		manifestOptions = append(manifestOptions, storage.WithDigestAlgorithm(dgst.Algorithm()))
+	}
+	targetManifests, err := rc.target.Manifests(rc.ctx, manifestOptions...)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	var options []distribution.ManifestServiceOption
+	if tag != "" {
+		options = append(options, distribution.WithTag(tag))
+	}
+	if _, err := targetManifests.Put(rc.ctx, manifest, options...); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	rc.copied[dgst] = struct{}{}
+	return desc, nil
+}
+
+// mountBlob links the blob of the source repository into the target
+// repository. Foreign blobs, which are not stored in the registry, are
+// skipped.
+func (rc *repositoryCopier) mountBlob(desc distribution.Descriptor) error {
+	if _, ok := rc.copied[desc.Digest]; ok {
+		return nil
+	}
+
+	canonical, err := reference.WithDigest(rc.source.Named(), desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	upload, err := rc.target.Blobs(rc.ctx).Create(rc.ctx, storage.WithMountFrom(canonical))
+	if err != nil {
+		if _, ok := err.(distribution.ErrBlobMounted); ok {
+			rc.copied[desc.Digest] = struct{}{}
+			return nil
+		}
+		return err
+	}
+
+	// The blob could not be mounted, which starts a regular upload.
+	if err := upload.Cancel(rc.ctx); err != nil {
+		dcontext.GetLogger(rc.ctx).Errorf("error canceling upload of unmounted blob %s: %v", desc.Digest, err)
+	}
+	if len(desc.URLs) > 0 {
+		return nil
+	}
+	return errcode.ErrorCodeBlobUnknown.WithDetail(desc.Digest)
+}
+
+// enumerateManifests returns the digests of the manifests of the repository.
+func enumerateManifests(ctx context.Context, repository distribution.Repository) ([]digest.Digest, error) {
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	enumerator, ok := manifests.(distribution.ManifestEnumerator)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+
+	var digests []digest.Digest
+	err = enumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+		digests = append(digests, dgst)
+		return nil
+	})
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		err = nil
+	}
+	return digests, err
+}
+
+// enumerateBlobs returns the digests of the blobs linked to the repository.
+func enumerateBlobs(ctx context.Context, repository distribution.Repository) ([]digest.Digest, error) {
+	enumerator, ok := repository.Blobs(ctx).(distribution.BlobEnumerator)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+
+	var digests []digest.Digest
+	err := enumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+		digests = append(digests, dgst)
+		return nil
+	})
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		err = nil
+	}
+	return digests, err
+}
+
+// unlinkRepository removes the tags, manifests and blobs of a renamed
+// repository through its stores, so that they are evicted from the caches,
+// before the repository is removed.
+func unlinkRepository(ctx context.Context, repository distribution.Repository, tags []string, manifests, blobs []digest.Digest) error {
+	for _, tag := range tags {
+		if err := repository.Tags(ctx).Untag(ctx, tag); err != nil {
+			return fmt.Errorf("failed to untag %s: %v", tag, err)
+		}
+	}
+
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	for _, dgst := range manifests {
+		if err := manifestService.Delete(ctx, dgst); err != nil && err != distribution.ErrBlobUnknown {
+			return fmt.Errorf("failed to delete manifest %s: %v", dgst, err)
+		}
+	}
+
+	blobStore := repository.Blobs(ctx)
+	for _, dgst := range blobs {
+		if err := blobStore.Delete(ctx, dgst); err != nil && err != distribution.ErrBlobUnknown {
+			return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
+		}
+	}
+	return nil
+}
+
+// repositoryCopyError maps the errors of copies and renames to the errors
+// returned to the client.
+func repositoryCopyError(err error) error {
+	switch err := err.(type) {
+	case errcode.Error:
+		return err
+	case distribution.ErrRepositoryUnknown:
+		return errcode.ErrorCodeNameUnknown.WithDetail(err)
+	case distribution.ErrRepositoryNameInvalid:
+		return errcode.ErrorCodeNameInvalid.WithDetail(err)
+	case distribution.ErrTagUnknown, distribution.ErrManifestUnknown, distribution.ErrManifestUnknownRevision:
+		return errcode.ErrorCodeManifestUnknown.WithDetail(err)
+	case distribution.ErrManifestVerification:
+		return errcode.ErrorCodeManifestInvalid.WithDetail(err)
+	}
+
+	switch err {
+	case distribution.ErrUnsupported:
+		return errcode.ErrorCodeUnsupported
+	case distribution.ErrAccessDenied:
+		return errcode.ErrorCodeDenied
+	case distribution.ErrBlobUnknown:
+		return errcode.ErrorCodeBlobUnknown
+	}
+	return errcode.ErrorCodeUnknown.WithDetail(err)
+}
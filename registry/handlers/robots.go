@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth/robot"
+	"github.com/gorilla/handlers"
+)
+
+// robotsDispatcher constructs the handler listing and creating robot
+// accounts.
+func robotsDispatcher(ctx *Context, r *http.Request) http.Handler {
+	robotHandler := &robotHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet:  robotHandler.admin(robotHandler.GetRobots),
+		http.MethodPost: robotHandler.admin(robotHandler.CreateRobot),
+	}
+}
+
+// robotDispatcher constructs the handler fetching and revoking a robot
+// account.
+func robotDispatcher(ctx *Context, r *http.Request) http.Handler {
+	robotHandler := &robotHandler{
+		Context: ctx,
+		Name:    dcontext.GetStringValue(ctx, "vars.robot"),
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet:    robotHandler.admin(robotHandler.GetRobot),
+		http.MethodDelete: robotHandler.admin(robotHandler.RevokeRobot),
+	}
+}
+
+// robotHandler handles requests managing robot accounts.
+type robotHandler struct {
+	*Context
+
+	// Name is the name of the robot account of the request, if any.
+	Name string
+}
+
+type robotsAPIResponse struct {
+	Robots []*robot.Account `json:"robots"`
+}
+
+type robotCreateRequest struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	Repositories []string `json:"repositories"`
+	Actions      []string `json:"actions"`
+	ExpiresIn    string   `json:"expiresIn,omitempty"`
+}
+
+type robotCreateResponse struct {
+	Robot    *robot.Account `json:"robot"`
+	Username string         `json:"username"`
+	Token    string         `json:"token"`
+}
+
+// admin wraps handler so that it is only served when robot accounts are
+// configured, to the configured administrators. Robot accounts can never
+// manage robot accounts.
+func (rh *robotHandler) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rh.App.robots.store == nil {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnsupported.WithMessage("robot accounts are not configured"))
+			return
+		}
+
+		user := getUserName(rh, r)
+		if _, ok := rh.App.robots.admins[user]; !ok || strings.HasPrefix(user, robot.UsernamePrefix) {
+			dcontext.GetLogger(rh).Warnf("user %q is not allowed to manage robot accounts", user)
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeDenied)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// GetRobots returns the list of robot accounts, sorted by name.
+func (rh *robotHandler) GetRobots(w http.ResponseWriter, r *http.Request) {
+	accounts, err := rh.App.robots.store.List(rh)
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Name < accounts[j].Name
+	})
+	for i, account := range accounts {
+		accounts[i] = redactRobot(account)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(robotsAPIResponse{Robots: accounts}); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// CreateRobot creates a robot account and returns its token, which is not
+// available afterwards.
+func (rh *robotHandler) CreateRobot(w http.ResponseWriter, r *http.Request) {
+	var req robotCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeRobotInvalid.WithDetail(err))
+		return
+	}
+
+	expiresIn := rh.App.robots.maxExpiry
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeRobotInvalid.WithDetail(fmt.Sprintf("invalid expiry %q", req.ExpiresIn)))
+			return
+		}
+		if rh.App.robots.maxExpiry > 0 && d > rh.App.robots.maxExpiry {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeRobotInvalid.WithDetail(fmt.Sprintf("expiry %s exceeds the maximum of %s", d, rh.App.robots.maxExpiry)))
+			return
+		}
+		expiresIn = d
+	}
+	if expiresIn == 0 {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeRobotInvalid.WithDetail("an expiry is required"))
+		return
+	}
+
+	now := time.Now().UTC()
+	account := &robot.Account{
+		Name:         req.Name,
+		Description:  req.Description,
+		Repositories: req.Repositories,
+		Actions:      req.Actions,
+		CreatedAt:    now,
+		CreatedBy:    getUserName(rh, r),
+		ExpiresAt:    now.Add(expiresIn),
+	}
+	if err := account.Validate(); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeRobotInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	token, err := account.GenerateToken()
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	if err := rh.App.robots.store.Create(rh, account); err != nil {
+		if err == robot.ErrAccountExists {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeRobotExists.WithDetail(map[string]string{"name": account.Name}))
+		} else {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+	dcontext.GetLogger(rh).Infof("created robot account %q expiring at %s", account.Name, account.ExpiresAt)
+
+	location, err := rh.urlBuilder.BuildRobotURL(account.Name)
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(robotCreateResponse{
+		Robot:    redactRobot(account),
+		Username: account.Username(),
+		Token:    token,
+	}); err != nil {
+		dcontext.GetLogger(rh).Errorf("error encoding robot account: %v", err)
+	}
+}
+
+// GetRobot returns the robot account of the request.
+func (rh *robotHandler) GetRobot(w http.ResponseWriter, r *http.Request) {
+	account, ok := rh.getRobot()
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(redactRobot(account)); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// RevokeRobot revokes the robot account of the request. The account is kept
+// so that it can still be audited.
+func (rh *robotHandler) RevokeRobot(w http.ResponseWriter, r *http.Request) {
+	account, ok := rh.getRobot()
+	if !ok {
+		return
+	}
+
+	if account.RevokedAt == nil {
+		now := time.Now().UTC()
+		account.RevokedAt = &now
+		account.RevokedBy = getUserName(rh, r)
+		if err := rh.App.robots.store.Update(rh, account); err != nil {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		dcontext.GetLogger(rh).Infof("revoked robot account %q", account.Name)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// getRobot fetches the robot account of the request, recording the error of
+// the request if it cannot be fetched.
+func (rh *robotHandler) getRobot() (*robot.Account, bool) {
+	account, err := rh.App.robots.store.Get(rh, rh.Name)
+	if err != nil {
+		if err == robot.ErrAccountUnknown {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeRobotUnknown.WithDetail(map[string]string{"name": rh.Name}))
+		} else {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return nil, false
+	}
+	return account, true
+}
+
+// redactRobot returns a copy of the account without its token digest.
+func redactRobot(account *robot.Account) *robot.Account {
+	redacted := *account
+	redacted.TokenDigest = ""
+	return &redacted
+}
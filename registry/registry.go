@@ -79,6 +79,14 @@ var tlsVersions = map[string]uint16{
 	"tls1.3": tls.VersionTLS13,
 }
 
+const defaultClientAuthStr = "require-and-verify-client-cert"
+
+// clientAuthTypes maps user-specified values to client certificate policies.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"require-and-verify-client-cert": tls.RequireAndVerifyClientCert,
+	"verify-client-cert-if-given":    tls.VerifyClientCertIfGiven,
+}
+
 // defaultLogFormatter is the default formatter to use for logs.
 const defaultLogFormatter = "text"
 
@@ -298,7 +306,15 @@ func (registry *Registry) ListenAndServe() error {
 				dcontext.GetLogger(registry.app).Debugf("CA Subject: %s", string(subj))
 			}
 
-			tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+			if config.HTTP.TLS.ClientAuth == "" {
+				config.HTTP.TLS.ClientAuth = defaultClientAuthStr
+			}
+			clientAuth, ok := clientAuthTypes[config.HTTP.TLS.ClientAuth]
+			if !ok {
+				return fmt.Errorf("unknown client auth policy '%s' specified for http.tls.clientauth", config.HTTP.TLS.ClientAuth)
+			}
+
+			tlsConf.ClientAuth = clientAuth
 			tlsConf.ClientCAs = pool
 		}
 
@@ -1,12 +1,18 @@
 package registry
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
 	"github.com/distribution/distribution/v3/version"
 	"github.com/spf13/cobra"
 )
@@ -18,6 +24,23 @@ func init() {
 	RootCmd.AddCommand(GCCmd)
 	GCCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "do everything except remove the blobs")
 	GCCmd.Flags().BoolVarP(&removeUntagged, "delete-untagged", "m", false, "delete manifests that are not currently referenced via tag")
+	RootCmd.AddCommand(MigrateStorageCmd)
+	MigrateStorageCmd.Flags().BoolVarP(&migrateDryRun, "dry-run", "d", false, "list the files to copy without copying them")
+	MigrateStorageCmd.Flags().IntVarP(&migrateConcurrency, "concurrency", "c", 8, "number of files copied concurrently")
+	RootCmd.AddCommand(FsckCmd)
+	FsckCmd.Flags().BoolVarP(&fsckRepair, "repair", "r", false, "remove dangling links and quarantine corrupted blobs")
+	FsckCmd.Flags().StringVar(&fsckReport, "report", "", "write a JSON report of the issues found to this file")
+	RootCmd.AddCommand(ExportCmd)
+	ExportCmd.Flags().StringSliceVar(&exportInclude, "include", nil, "export the repositories or repository:tag references matching these patterns")
+	ExportCmd.Flags().StringSliceVar(&exportExclude, "exclude", nil, "do not export the repositories or repository:tag references matching these patterns")
+	RootCmd.AddCommand(ImportCmd)
+	ImportCmd.Flags().StringSliceVar(&importInclude, "include", nil, "import the repositories or repository:tag references matching these patterns")
+	ImportCmd.Flags().StringSliceVar(&importExclude, "exclude", nil, "do not import the repositories or repository:tag references matching these patterns")
+	ImportCmd.Flags().StringVar(&importRepository, "repository", "", "repository of the images of the archive which do not name one")
+	RootCmd.AddCommand(TagsCmd)
+	TagsCmd.AddCommand(RebuildTagsCmd)
+	RootCmd.AddCommand(CatalogCmd)
+	CatalogCmd.AddCommand(RebuildCatalogCmd)
 	RootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "show the version and exit")
 }
 
@@ -68,7 +91,7 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		registry, err := storage.NewRegistry(ctx, driver)
+		registry, err := newRegistry(ctx, driver, config)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
 			os.Exit(1)
@@ -84,3 +107,379 @@ var GCCmd = &cobra.Command{
 		}
 	},
 }
+
+var (
+	migrateDryRun      bool
+	migrateConcurrency int
+)
+
+// MigrateStorageCmd is the cobra command that corresponds to the migrate-storage subcommand
+var MigrateStorageCmd = &cobra.Command{
+	Use:   "migrate-storage <source-config> <destination-config>",
+	Short: "`migrate-storage` copies the content of the registry between storage drivers",
+	Long: "`migrate-storage` copies the content of the registry from the storage driver of the source configuration " +
+		"to the storage driver of the destination configuration. Blob data already present in the destination with " +
+		"the same size, and other files with the same content, are skipped, so that an interrupted migration can " +
+		"be resumed by running it again.",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		sourceConfig, err := resolveConfiguration(args[:1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "source configuration error: %v\n", err)
+			os.Exit(1)
+		}
+		destinationConfig, err := resolveConfiguration(args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "destination configuration error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, sourceConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		source, err := newStorageDriver(ctx, sourceConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct source driver: %v", err)
+			os.Exit(1)
+		}
+		destination, err := newStorageDriver(ctx, destinationConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct destination driver: %v", err)
+			os.Exit(1)
+		}
+
+		stats, err := storage.Migrate(ctx, source, destination, storage.MigrateOpts{
+			DryRun:      migrateDryRun,
+			Concurrency: migrateConcurrency,
+		})
+		fmt.Printf("%d files: %d copied (%d bytes), %d skipped, %d failed\n", stats.Files, stats.Copied, stats.Bytes, stats.Skipped, stats.Failed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to migrate storage: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var (
+	fsckRepair bool
+	fsckReport string
+)
+
+// FsckCmd is the cobra command that corresponds to the fsck subcommand
+var FsckCmd = &cobra.Command{
+	Use:   "fsck <config>",
+	Short: "`fsck` checks the integrity of registry data",
+	Long: "`fsck` verifies that blob data matches its digest, that links point at valid blobs and that manifests " +
+		"only reference valid blobs. With --repair, dangling links are removed and corrupted blobs are quarantined.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driver, err := newStorageDriver(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct driver: %v", err)
+			os.Exit(1)
+		}
+
+		registry, err := newRegistry(ctx, driver, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		report, err := storage.Fsck(ctx, driver, registry, storage.FsckOpts{Repair: fsckRepair})
+		if fsckReport != "" {
+			content, merr := json.MarshalIndent(report, "", "  ")
+			if merr == nil {
+				merr = os.WriteFile(fsckReport, content, 0o644)
+			}
+			if merr != nil {
+				fmt.Fprintf(os.Stderr, "failed to write report: %v\n", merr)
+			}
+		}
+		fmt.Printf("%d blobs, %d links, %d manifests checked: %d issues, %d unrepaired\n",
+			report.Blobs, report.Links, report.Manifests, len(report.Issues), report.Unrepaired())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to check registry: %v", err)
+			os.Exit(1)
+		}
+		if report.Unrepaired() > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var (
+	exportInclude []string
+	exportExclude []string
+)
+
+// ExportCmd is the cobra command that corresponds to the export subcommand
+var ExportCmd = &cobra.Command{
+	Use:   "export <config> <archive>",
+	Short: "`export` writes repositories to an OCI image layout archive",
+	Long: "`export` writes the selected tags of the repositories of the registry, with the manifests, blobs and " +
+		"referrers they reference, to an OCI image layout tar archive, or to the standard output if the archive is -.",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args[:1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driver, err := newStorageDriver(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct driver: %v", err)
+			os.Exit(1)
+		}
+
+		registry, err := newRegistry(ctx, driver, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		out := os.Stdout
+		if args[1] != "-" {
+			out, err = os.Create(args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to create archive: %v", err)
+				os.Exit(1)
+			}
+		}
+
+		stats, err := storage.Export(ctx, registry, out, storage.ExportOpts{
+			Include: exportInclude,
+			Exclude: exportExclude,
+		})
+		if out != os.Stdout {
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+		}
+		// The archive may be written to the standard output.
+		fmt.Fprintf(os.Stderr, "%d repositories, %d tags: %d manifests, %d blobs (%d bytes) exported\n",
+			stats.Repositories, stats.Tags, stats.Manifests, stats.Blobs, stats.Bytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var (
+	importInclude    []string
+	importExclude    []string
+	importRepository string
+)
+
+// ImportCmd is the cobra command that corresponds to the import subcommand
+var ImportCmd = &cobra.Command{
+	Use:   "import <config> <archive>",
+	Short: "`import` reads repositories from an OCI image layout archive",
+	Long: "`import` pushes the tagged images of an OCI image layout tar archive, or of the standard input if the " +
+		"archive is -, to the repositories of the registry, preserving their digests and tags. Manifests and blobs " +
+		"already present in a repository are skipped.",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args[:1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driver, err := newStorageDriver(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct driver: %v", err)
+			os.Exit(1)
+		}
+
+		registry, err := newRegistry(ctx, driver, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		in := os.Stdin
+		if args[1] != "-" {
+			in, err = os.Open(args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to open archive: %v", err)
+				os.Exit(1)
+			}
+			defer in.Close()
+		}
+
+		stats, err := storage.Import(ctx, registry, in, storage.ImportOpts{
+			Include:    importInclude,
+			Exclude:    importExclude,
+			Repository: importRepository,
+		})
+		fmt.Printf("%d repositories, %d tags: %d manifests, %d blobs (%d bytes) imported, %d skipped\n",
+			stats.Repositories, stats.Tags, stats.Manifests, stats.Blobs, stats.Bytes, stats.Skipped)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to import: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// TagsCmd is the cobra command that groups the subcommands managing tags
+var TagsCmd = &cobra.Command{
+	Use:   "tags",
+	Short: "`tags` manages the tags of the repositories",
+	Long:  "`tags` manages the tags of the repositories",
+}
+
+// RebuildTagsCmd is the cobra command that corresponds to the tags rebuild subcommand
+var RebuildTagsCmd = &cobra.Command{
+	Use:   "rebuild <config>",
+	Short: "`rebuild` rebuilds the index of the tags of each manifest",
+	Long: "`rebuild` rebuilds the index of the tags of each manifest from the current tags of the repositories, " +
+		"so that looking up the tags of a manifest, when deleting it or collecting garbage with --delete-untagged, " +
+		"no longer reads every tag of the repositories tagged by earlier versions of the registry. " +
+		"The registry must not accept pushes while the index is rebuilt.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driver, err := newStorageDriver(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct driver: %v", err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		stats, err := storage.RebuildTags(ctx, registry)
+		fmt.Printf("%d repositories, %d tags indexed\n", stats.Repositories, stats.Tags)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rebuild tags: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// CatalogCmd is the cobra command that groups the subcommands managing the catalog
+var CatalogCmd = &cobra.Command{
+	Use:   "catalog",
+	Short: "`catalog` manages the catalog of the repositories",
+	Long:  "`catalog` manages the catalog of the repositories",
+}
+
+// RebuildCatalogCmd is the cobra command that corresponds to the catalog rebuild subcommand
+var RebuildCatalogCmd = &cobra.Command{
+	Use:   "rebuild <config>",
+	Short: "`rebuild` rebuilds the catalog index",
+	Long: "`rebuild` rebuilds the catalog index from the repositories of the registry, " +
+		"so that the catalog and the repositories collected by garbage-collect are listed from it " +
+		"rather than by walking the repositories, when the catalog index is enabled.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driver, err := newStorageDriver(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct driver: %v", err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		stats, err := storage.RebuildCatalog(ctx, registry)
+		fmt.Printf("%d repositories indexed, %d removed\n", stats.Repositories, stats.Removed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rebuild catalog: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// newStorageDriver constructs the storage driver of the configuration,
+// wrapped with its storage middlewares, e.g. to encrypt content.
+func newStorageDriver(ctx context.Context, config *configuration.Configuration) (storagedriver.StorageDriver, error) {
+	driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct %s driver: %v", config.Storage.Type(), err)
+	}
+	for _, mw := range config.Middleware["storage"] {
+		driver, err = storagemiddleware.Get(ctx, mw.Name, mw.Options, driver)
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure storage middleware (%s): %v", mw.Name, err)
+		}
+	}
+	return driver, nil
+}
+
+// newRegistry constructs the registry of the configuration on the storage
+// driver, maintaining the catalog index if it is enabled.
+func newRegistry(ctx context.Context, driver storagedriver.StorageDriver, config *configuration.Configuration) (distribution.Namespace, error) {
+	var options []storage.RegistryOption
+	if config.Catalog.Index {
+		options = append(options, storage.EnableCatalogIndex)
+	}
+	return storage.NewRegistry(ctx, driver, options...)
+}
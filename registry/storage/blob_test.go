@@ -12,6 +12,7 @@ import (
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/distribution/reference"
@@ -529,6 +530,95 @@ func TestLayerUploadZeroLength(t *testing.T) {
 	simpleUpload(t, bs, []byte{}, digestSha256Empty)
 }
 
+// TestSHA512BlobUpload uploads blobs in resumed chunks and completes them
+// with sha512 digests, with and without hashing uploads with sha512.
+func TestSHA512BlobUpload(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options []RegistryOption
+	}{
+		{name: "rehash"},
+		{name: "hashed", options: []RegistryOption{DigestAlgorithms(digest.SHA512)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			imageName, _ := reference.WithName("foo/bar")
+			driver := inmemory.New()
+			registry, err := NewRegistry(ctx, driver, tc.options...)
+			if err != nil {
+				t.Fatalf("error creating registry: %v", err)
+			}
+			repository, err := registry.Repository(ctx, imageName)
+			if err != nil {
+				t.Fatalf("unexpected error getting repo: %v", err)
+			}
+			bs := repository.Blobs(ctx)
+
+			for _, content := range [][]byte{[]byte("hello, sha512"), {}} {
+				dgst := digest.SHA512.FromBytes(content)
+				half := len(content) / 2
+
+				wr, err := bs.Create(ctx)
+				if err != nil {
+					t.Fatalf("unexpected error starting upload: %v", err)
+				}
+				if _, err := wr.Write(content[:half]); err != nil {
+					t.Fatalf("unexpected error writing chunk: %v", err)
+				}
+				if err := wr.Close(); err != nil {
+					t.Fatalf("unexpected error closing upload: %v", err)
+				}
+
+				wr, err = bs.Resume(ctx, wr.ID())
+				if err != nil {
+					t.Fatalf("unexpected error resuming upload: %v", err)
+				}
+				if _, err := wr.Write(content[half:]); err != nil {
+					t.Fatalf("unexpected error writing chunk: %v", err)
+				}
+
+				desc, err := wr.Commit(ctx, distribution.Descriptor{Digest: dgst})
+				if err != nil {
+					t.Fatalf("unexpected error committing upload: %v", err)
+				}
+				if desc.Digest != dgst {
+					t.Fatalf("unexpected digest: %v != %v", desc.Digest, dgst)
+				}
+
+				// the blob is stored natively under its sha512 digest
+				for d, exists := range map[digest.Digest]bool{dgst: true, digest.FromBytes(content): false} {
+					blobPath, err := pathFor(blobDataPathSpec{digest: d})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, err := driver.Stat(ctx, blobPath); (err == nil) != exists {
+						t.Fatalf("unexpected presence of %v: %v", d, err)
+					}
+				}
+
+				p, err := bs.Get(ctx, dgst)
+				if err != nil {
+					t.Fatalf("unexpected error getting blob: %v", err)
+				}
+				if !bytes.Equal(p, content) {
+					t.Fatalf("unexpected content: %q != %q", p, content)
+				}
+			}
+
+			wr, err := bs.Create(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error starting upload: %v", err)
+			}
+			if _, err := wr.Write([]byte("hello, sha512")); err != nil {
+				t.Fatalf("unexpected error writing: %v", err)
+			}
+			if _, err := wr.Commit(ctx, distribution.Descriptor{Digest: digest.SHA512.FromString("other")}); err == nil {
+				t.Fatal("expected error committing upload with mismatched digest")
+			}
+		})
+	}
+}
+
 func simpleUpload(t *testing.T, bs distribution.BlobIngester, blob []byte, expectedDigest digest.Digest) {
 	ctx := context.Background()
 	wr, err := bs.Create(ctx)
@@ -609,3 +699,173 @@ func addBlob(ctx context.Context, bs distribution.BlobIngester, desc distributio
 
 	return wr.Commit(ctx, desc)
 }
+
+// composingDriver implements storagedriver.Composer by concatenating the
+// content of the sources, unless compositions are unsupported.
+type composingDriver struct {
+	storagedriver.StorageDriver
+	unsupported bool
+	composed    int
+}
+
+func (d *composingDriver) Compose(ctx context.Context, destPath string, sourcePaths []string) error {
+	if d.unsupported {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+
+	var content []byte
+	for _, sourcePath := range sourcePaths {
+		p, err := d.GetContent(ctx, sourcePath)
+		if err != nil {
+			return err
+		}
+		content = append(content, p...)
+	}
+	d.composed++
+	return d.PutContent(ctx, destPath, content)
+}
+
+// TestBlobUploadParts writes uploads as parts out of order, and checks that
+// they are assembled on commit, whether the driver composes them or not.
+func TestBlobUploadParts(t *testing.T) {
+	content := []byte("hello, parallel uploads")
+	dgst := digest.FromBytes(content)
+
+	for _, tc := range []struct {
+		name        string
+		sequential  int
+		unsupported bool
+		composed    int
+	}{
+		{name: "streamed", sequential: 5},
+		{name: "composed", composed: 1},
+		{name: "unsupported", unsupported: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			imageName, _ := reference.WithName("foo/bar")
+			driver := &composingDriver{StorageDriver: inmemory.New(), unsupported: tc.unsupported}
+			registry, err := NewRegistry(ctx, driver)
+			if err != nil {
+				t.Fatalf("error creating registry: %v", err)
+			}
+			repository, err := registry.Repository(ctx, imageName)
+			if err != nil {
+				t.Fatalf("unexpected error getting repo: %v", err)
+			}
+			bs := repository.Blobs(ctx)
+
+			wr, err := bs.Create(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error starting upload: %v", err)
+			}
+			if _, err := wr.Write(content[:tc.sequential]); err != nil {
+				t.Fatalf("unexpected error writing: %v", err)
+			}
+
+			pw, ok := wr.(distribution.BlobPartWriter)
+			if !ok {
+				t.Fatalf("upload does not accept parts: %T", wr)
+			}
+			// the parts are written in reverse order
+			for _, part := range [][2]int{{15, len(content)}, {tc.sequential, 15}} {
+				if _, err := pw.WritePart(ctx, int64(part[0]), bytes.NewReader(content[part[0]:part[1]])); err != nil {
+					t.Fatalf("unexpected error writing part at %d: %v", part[0], err)
+				}
+			}
+			if err := wr.Close(); err != nil {
+				t.Fatalf("unexpected error closing upload: %v", err)
+			}
+
+			wr, err = bs.Resume(ctx, wr.ID())
+			if err != nil {
+				t.Fatalf("unexpected error resuming upload: %v", err)
+			}
+			desc, err := wr.Commit(ctx, distribution.Descriptor{Digest: dgst})
+			if err != nil {
+				t.Fatalf("unexpected error committing upload: %v", err)
+			}
+			if desc.Digest != dgst || desc.Size != int64(len(content)) {
+				t.Fatalf("unexpected descriptor: %v", desc)
+			}
+			if driver.composed != tc.composed {
+				t.Fatalf("unexpected number of compositions: %d != %d", driver.composed, tc.composed)
+			}
+
+			p, err := bs.Get(ctx, dgst)
+			if err != nil {
+				t.Fatalf("unexpected error getting blob: %v", err)
+			}
+			if !bytes.Equal(p, content) {
+				t.Fatalf("unexpected content: %q != %q", p, content)
+			}
+
+			// parts leaving a gap are rejected
+			wr, err = bs.Create(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error starting upload: %v", err)
+			}
+			if _, err := wr.(distribution.BlobPartWriter).WritePart(ctx, 5, bytes.NewReader(content[5:])); err != nil {
+				t.Fatalf("unexpected error writing part: %v", err)
+			}
+			if _, err := wr.Commit(ctx, distribution.Descriptor{Digest: dgst}); err != distribution.ErrBlobUploadPartsInvalid {
+				t.Fatalf("expected invalid parts error, got: %v", err)
+			}
+		})
+	}
+}
+
+// TestBlobUploadMaxSize checks that writes beyond the maximum size of blobs
+// fail, whether written sequentially or as parts.
+func TestBlobUploadMaxSize(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	registry, err := NewRegistry(ctx, inmemory.New(), MaxBlobSize(16))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	content := []byte("seventeen bytes!!")
+
+	wr, err := bs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	if _, err := wr.ReadFrom(bytes.NewReader(content[:16])); err != nil {
+		t.Fatalf("unexpected error writing blob of maximum size: %v", err)
+	}
+	if err := wr.Close(); err != nil {
+		t.Fatalf("unexpected error closing upload: %v", err)
+	}
+
+	wr, err = bs.Resume(ctx, wr.ID())
+	if err != nil {
+		t.Fatalf("unexpected error resuming upload: %v", err)
+	}
+	if _, err := wr.Write(content[16:]); err != distribution.ErrBlobTooLarge {
+		t.Fatalf("expected blob too large error, got: %v", err)
+	}
+	if err := wr.Cancel(ctx); err != nil {
+		t.Fatalf("unexpected error canceling upload: %v", err)
+	}
+
+	wr, err = bs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	if _, err := wr.ReadFrom(bytes.NewReader(content)); err != distribution.ErrBlobTooLarge {
+		t.Fatalf("expected blob too large error, got: %v", err)
+	}
+	pw := wr.(distribution.BlobPartWriter)
+	if _, err := pw.WritePart(ctx, 8, bytes.NewReader(content[8:])); err != distribution.ErrBlobTooLarge {
+		t.Fatalf("expected blob too large error, got: %v", err)
+	}
+	if _, err := pw.WritePart(ctx, 16, bytes.NewReader(content[16:])); err != distribution.ErrBlobTooLarge {
+		t.Fatalf("expected blob too large error, got: %v", err)
+	}
+}
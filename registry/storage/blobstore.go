@@ -60,7 +60,12 @@ func (bs *blobStore) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekC
 // content is already present, only the digest will be returned. This should
 // only be used for small objects, such as manifests. This implemented as a convenience for other Put implementations
 func (bs *blobStore) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
-	dgst := digest.FromBytes(p)
+	return bs.put(ctx, digest.FromBytes(p), mediaType, p)
+}
+
+// put stores the content p in the blob store under dgst, which the caller
+// must have calculated from p.
+func (bs *blobStore) put(ctx context.Context, dgst digest.Digest, mediaType string, p []byte) (distribution.Descriptor, error) {
 	desc, err := bs.statter.Stat(ctx, dgst)
 	if err == nil {
 		// content already present
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"path"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/distribution/distribution/v3"
@@ -30,8 +32,8 @@ type blobWriter struct {
 
 	id        string
 	startedAt time.Time
-	digester  digest.Digester
-	written   int64 // track the write to digester
+	digesters map[digest.Algorithm]digest.Digester
+	written   int64 // track the write to digesters
 
 	fileWriter storagedriver.FileWriter
 	driver     storagedriver.StorageDriver
@@ -39,9 +41,15 @@ type blobWriter struct {
 
 	resumableDigestEnabled bool
 	committed              bool
+
+	// maxSize limits the size of the upload, unless zero.
+	maxSize int64
 }
 
-var _ distribution.BlobWriter = &blobWriter{}
+var (
+	_ distribution.BlobWriter     = &blobWriter{}
+	_ distribution.BlobPartWriter = &blobWriter{}
+)
 
 // ID returns the identifier for this upload.
 func (bw *blobWriter) ID() string {
@@ -57,6 +65,10 @@ func (bw *blobWriter) StartedAt() time.Time {
 func (bw *blobWriter) Commit(ctx context.Context, desc distribution.Descriptor) (distribution.Descriptor, error) {
 	dcontext.GetLogger(ctx).Debug("(*blobWriter).Commit")
 
+	if err := bw.assembleParts(ctx); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
 	if err := bw.fileWriter.Commit(ctx); err != nil {
 		return distribution.Descriptor{}, err
 	}
@@ -117,12 +129,16 @@ func (bw *blobWriter) Write(p []byte) (int, error) {
 		return 0, err
 	}
 
+	if bw.maxSize > 0 && bw.fileWriter.Size()+int64(len(p)) > bw.maxSize {
+		return 0, distribution.ErrBlobTooLarge
+	}
+
 	_, err := bw.fileWriter.Write(p)
 	if err != nil {
 		return 0, err
 	}
 
-	n, err := bw.digester.Hash().Write(p)
+	n, err := bw.hashes().Write(p)
 	bw.written += int64(n)
 
 	return n, err
@@ -136,16 +152,220 @@ func (bw *blobWriter) ReadFrom(r io.Reader) (n int64, err error) {
 		return 0, err
 	}
 
+	if bw.maxSize > 0 {
+		r = &maxSizeReader{r: r, remaining: bw.maxSize - bw.fileWriter.Size()}
+	}
+
 	// Using a TeeReader instead of MultiWriter ensures Copy returns
-	// the amount written to the digester as well as ensuring that we
+	// the amount written to the digesters as well as ensuring that we
 	// write to the fileWriter first
 	tee := io.TeeReader(r, bw.fileWriter)
-	nn, err := io.Copy(bw.digester.Hash(), tee)
+	nn, err := io.Copy(bw.hashes(), tee)
 	bw.written += nn
 
 	return nn, err
 }
 
+// WritePart stores the content of r as the part of the blob at offset. Parts
+// are kept apart from the upload data until they are assembled on commit, so
+// that they may be written concurrently and in any order. Writing a part at
+// the offset of an existing part replaces it.
+func (bw *blobWriter) WritePart(ctx context.Context, offset int64, r io.Reader) (int64, error) {
+	if offset < 0 {
+		return 0, distribution.ErrBlobUploadPartsInvalid
+	}
+	if bw.maxSize > 0 {
+		if offset >= bw.maxSize {
+			return 0, distribution.ErrBlobTooLarge
+		}
+		r = &maxSizeReader{r: r, remaining: bw.maxSize - offset}
+	}
+
+	partPath, err := pathFor(uploadPartPathSpec{
+		name:   bw.blobStore.repository.Named().Name(),
+		id:     bw.id,
+		offset: offset,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	fw, err := bw.driver.Writer(ctx, partPath, false)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(fw, r)
+	if err == nil {
+		err = fw.Commit(ctx)
+	}
+	if err != nil {
+		if err := fw.Cancel(ctx); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error canceling upload part %q: %v", partPath, err)
+		}
+		return n, err
+	}
+
+	return n, fw.Close()
+}
+
+// assembleParts appends the parts written with WritePart to the upload data,
+// in offset order. The parts must follow the data written so far without
+// gaps or overlaps. When the upload holds no other data, the parts are
+// composed by the storage driver if it supports it and the digest is computed
+// from the stored data on validation. Otherwise the parts are read back and
+// written through the digesters.
+func (bw *blobWriter) assembleParts(ctx context.Context) error {
+	partsPath, err := pathFor(uploadPartPathSpec{
+		name: bw.blobStore.repository.Named().Name(),
+		id:   bw.id,
+		list: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	partPaths, err := bw.driver.List(ctx, partsPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil // no parts
+		}
+		return err
+	}
+	if len(partPaths) == 0 {
+		return nil
+	}
+
+	// The offsets are zero padded, so the parts sort in offset order.
+	sort.Strings(partPaths)
+
+	size := bw.fileWriter.Size()
+	for _, partPath := range partPaths {
+		offset, err := strconv.ParseInt(path.Base(partPath), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unable to parse offset from upload part path %q: %v", partPath, err)
+		}
+		if offset != size {
+			return distribution.ErrBlobUploadPartsInvalid
+		}
+
+		fi, err := bw.driver.Stat(ctx, partPath)
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+	}
+
+	if composer, ok := bw.driver.(storagedriver.Composer); ok && bw.fileWriter.Size() == 0 {
+		// The empty upload data is discarded, so that the parts can be
+		// composed in its place.
+		// Until the upload data is written again, anything stored at its
+		// path is left to be removed with the other upload resources.
+		if err := bw.fileWriter.Cancel(ctx); err != nil {
+			return err
+		}
+		bw.fileWriter = &composedFileWriter{}
+
+		err := composer.Compose(ctx, bw.path, partPaths)
+		if err == nil {
+			bw.fileWriter = &composedFileWriter{size: size}
+			return nil
+		}
+		if _, ok := err.(storagedriver.ErrUnsupportedMethod); !ok {
+			return err
+		}
+
+		if bw.fileWriter, err = bw.driver.Writer(ctx, bw.path, false); err != nil {
+			return err
+		}
+	}
+
+	// The parts are written at once, as the size of the file writer may
+	// only account for its content once flushed.
+	pr := &partsReader{ctx: ctx, driver: bw.driver, paths: partPaths}
+	defer pr.Close()
+
+	_, err = bw.ReadFrom(pr)
+	return err
+}
+
+// partsReader reads the parts stored at paths one after the other, opening
+// each part only once the previous one is read.
+type partsReader struct {
+	ctx     context.Context
+	driver  storagedriver.StorageDriver
+	paths   []string
+	current io.ReadCloser
+}
+
+func (pr *partsReader) Read(p []byte) (int, error) {
+	for {
+		if pr.current == nil {
+			if len(pr.paths) == 0 {
+				return 0, io.EOF
+			}
+
+			rc, err := pr.driver.Reader(pr.ctx, pr.paths[0], 0)
+			if err != nil {
+				return 0, err
+			}
+			pr.current, pr.paths = rc, pr.paths[1:]
+		}
+
+		n, err := pr.current.Read(p)
+		if err == io.EOF {
+			err = pr.current.Close()
+			pr.current = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (pr *partsReader) Close() error {
+	if pr.current == nil {
+		return nil
+	}
+	return pr.current.Close()
+}
+
+// maxSizeReader reads from r until the remaining size is exhausted, failing
+// with distribution.ErrBlobTooLarge if r holds more content.
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (mr *maxSizeReader) Read(p []byte) (int, error) {
+	if mr.remaining <= 0 {
+		var b [1]byte
+		n, err := mr.r.Read(b[:])
+		if n > 0 {
+			return 0, distribution.ErrBlobTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > mr.remaining {
+		p = p[:mr.remaining]
+	}
+	n, err := mr.r.Read(p)
+	mr.remaining -= int64(n)
+	return n, err
+}
+
+// hashes returns a writer to the hashes of all the digesters.
+func (bw *blobWriter) hashes() io.Writer {
+	writers := make([]io.Writer, 0, len(bw.digesters))
+	for _, digester := range bw.digesters {
+		writers = append(writers, digester.Hash())
+	}
+	return io.MultiWriter(writers...)
+}
+
 func (bw *blobWriter) Close() error {
 	if bw.committed {
 		return errors.New("blobwriter close after commit")
@@ -209,12 +429,22 @@ func (bw *blobWriter) validateBlob(ctx context.Context, desc distribution.Descri
 	// TODO(stevvooe): This section is very meandering. Need to be broken down
 	// to be a lot more clear.
 
-	if err := bw.resumeDigest(ctx); err == nil {
-		canonical = bw.digester.Digest()
+	// The blob is stored under the digest provided by the client, so that
+	// content pushed with any available algorithm is addressed natively.
+	algorithm := desc.Digest.Algorithm()
+	if !algorithm.Available() {
+		return distribution.Descriptor{}, distribution.ErrBlobInvalidDigest{
+			Digest: desc.Digest,
+			Reason: fmt.Errorf("unsupported digest algorithm %q", algorithm),
+		}
+	}
+	digester, hashed := bw.digesters[algorithm]
 
-		if canonical.Algorithm() == desc.Digest.Algorithm() {
-			// Common case: client and server prefer the same canonical digest
-			// algorithm - currently SHA256.
+	if err := bw.resumeDigest(ctx); err == nil {
+		if hashed {
+			// Common case: the upload was hashed with the algorithm of the
+			// client as it was written.
+			canonical = digester.Digest()
 			verified = desc.Digest == canonical
 		} else {
 			// The client wants to use a different digest algorithm. They'll just
@@ -234,8 +464,8 @@ func (bw *blobWriter) validateBlob(ctx context.Context, desc distribution.Descri
 		// the same, we don't need to read the data from the backend. This is
 		// because we've written the entire file in the lifecycle of the
 		// current instance.
-		if bw.written == size && digest.Canonical == desc.Digest.Algorithm() {
-			canonical = bw.digester.Digest()
+		if hashed && bw.written == size {
+			canonical = digester.Digest()
 			verified = desc.Digest == canonical
 		}
 
@@ -243,8 +473,7 @@ func (bw *blobWriter) validateBlob(ctx context.Context, desc distribution.Descri
 		// paths. We may be able to make the size-based check a stronger
 		// guarantee, so this may be defensive.
 		if !verified {
-			digester := digest.Canonical.Digester()
-			verifier := desc.Digest.Verifier()
+			digester := algorithm.Digester()
 
 			// Read the file from the backend driver and validate it.
 			fr, err := newFileReader(ctx, bw.driver, bw.path, desc.Size)
@@ -253,14 +482,12 @@ func (bw *blobWriter) validateBlob(ctx context.Context, desc distribution.Descri
 			}
 			defer fr.Close()
 
-			tr := io.TeeReader(fr, digester.Hash())
-
-			if _, err := io.Copy(verifier, tr); err != nil {
+			if _, err := io.Copy(digester.Hash(), fr); err != nil {
 				return distribution.Descriptor{}, err
 			}
 
 			canonical = digester.Digest()
-			verified = verifier.Verified()
+			verified = desc.Digest == canonical
 		}
 	}
 
@@ -326,7 +553,7 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc distribution.Descriptor
 			// a zero-length blob into a nonzero-length blob location. To
 			// prevent this horrid thing, we employ the hack of only allowing
 			// to this happen for the digest of an empty blob.
-			if desc.Digest == digestSha256Empty {
+			if desc.Digest == desc.Digest.Algorithm().FromBytes(nil) {
 				return bw.blobStore.driver.PutContent(ctx, blobPath, []byte{})
 			}
 
@@ -400,3 +627,32 @@ func (bw *blobWriter) Reader() (io.ReadCloser, error) {
 
 	return readCloser, nil
 }
+
+// composedFileWriter stands in for the file writer of an upload whose data
+// was composed from its parts by the storage driver. The data is already
+// stored in full, so there is nothing left to write, commit or close.
+type composedFileWriter struct {
+	size int64
+}
+
+func (fw *composedFileWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("upload data already composed")
+}
+
+func (fw *composedFileWriter) Size() int64 {
+	return fw.size
+}
+
+func (fw *composedFileWriter) Close() error {
+	return nil
+}
+
+// Cancel leaves the composed data in place, to be removed along with the
+// other upload resources.
+func (fw *composedFileWriter) Cancel(ctx context.Context) error {
+	return nil
+}
+
+func (fw *composedFileWriter) Commit(ctx context.Context) error {
+	return nil
+}
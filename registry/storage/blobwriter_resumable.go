@@ -12,56 +12,68 @@ import (
 	"strconv"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
 )
 
-// resumeDigest attempts to restore the state of the internal hash function
-// by loading the most recent saved hash state equal to the current size of the blob.
+// resumeDigest attempts to restore the state of the internal hash functions
+// by loading the most recent saved hash states equal to the current size of
+// the blob.
 func (bw *blobWriter) resumeDigest(ctx context.Context) error {
 	if !bw.resumableDigestEnabled {
 		return errResumableDigestNotAvailable
 	}
 
-	h, ok := bw.digester.Hash().(encoding.BinaryUnmarshaler)
-	if !ok {
-		return errResumableDigestNotAvailable
+	hashes := make(map[digest.Algorithm]encoding.BinaryUnmarshaler, len(bw.digesters))
+	for algorithm, digester := range bw.digesters {
+		h, ok := digester.Hash().(encoding.BinaryUnmarshaler)
+		if !ok {
+			return errResumableDigestNotAvailable
+		}
+		hashes[algorithm] = h
 	}
 
 	offset := bw.fileWriter.Size()
 	if offset == bw.written {
-		// State of digester is already at the requested offset.
+		// State of digesters is already at the requested offset.
 		return nil
 	}
 
-	// List hash states from storage backend.
-	var hashStateMatch hashStateEntry
-	hashStates, err := bw.getStoredHashStates(ctx)
-	if err != nil {
-		return fmt.Errorf("unable to get stored hash states with offset %d: %s", offset, err)
-	}
+	// Find the stored hashState of every algorithm with offset equal to the
+	// requested offset. The states can only be restored if all are found.
+	hashStateMatches := make(map[digest.Algorithm]hashStateEntry, len(hashes))
+	for algorithm := range hashes {
+		// List hash states from storage backend.
+		hashStates, err := bw.getStoredHashStates(ctx, algorithm)
+		if err != nil {
+			return fmt.Errorf("unable to get stored hash states with offset %d: %s", offset, err)
+		}
 
-	// Find the highest stored hashState with offset equal to
-	// the requested offset.
-	for _, hashState := range hashStates {
-		if hashState.offset == offset {
-			hashStateMatch = hashState
-			break // Found an exact offset match.
+		for _, hashState := range hashStates {
+			if hashState.offset == offset {
+				hashStateMatches[algorithm] = hashState
+				break // Found an exact offset match.
+			}
 		}
 	}
 
-	if hashStateMatch.offset == 0 {
-		// No need to load any state, just reset the hasher.
-		h.(hash.Hash).Reset()
-	} else {
-		storedState, err := bw.driver.GetContent(ctx, hashStateMatch.path)
-		if err != nil {
-			return err
+	if len(hashStateMatches) < len(hashes) || offset == 0 {
+		// No need to load any state, just reset the hashers.
+		for _, h := range hashes {
+			h.(hash.Hash).Reset()
 		}
-
-		if err = h.UnmarshalBinary(storedState); err != nil {
-			return err
+	} else {
+		for algorithm, h := range hashes {
+			storedState, err := bw.driver.GetContent(ctx, hashStateMatches[algorithm].path)
+			if err != nil {
+				return err
+			}
+
+			if err = h.UnmarshalBinary(storedState); err != nil {
+				return err
+			}
 		}
-		bw.written = hashStateMatch.offset
+		bw.written = offset
 	}
 
 	// Mind the gap.
@@ -77,12 +89,13 @@ type hashStateEntry struct {
 	path   string
 }
 
-// getStoredHashStates returns a slice of hashStateEntries for this upload.
-func (bw *blobWriter) getStoredHashStates(ctx context.Context) ([]hashStateEntry, error) {
+// getStoredHashStates returns a slice of hashStateEntries of the algorithm
+// for this upload.
+func (bw *blobWriter) getStoredHashStates(ctx context.Context, algorithm digest.Algorithm) ([]hashStateEntry, error) {
 	uploadHashStatePathPrefix, err := pathFor(uploadHashStatePathSpec{
 		name: bw.blobStore.repository.Named().String(),
 		id:   bw.id,
-		alg:  bw.digester.Digest().Algorithm(),
+		alg:  algorithm,
 		list: true,
 	})
 	if err != nil {
@@ -119,25 +132,34 @@ func (bw *blobWriter) storeHashState(ctx context.Context) error {
 		return errResumableDigestNotAvailable
 	}
 
-	h, ok := bw.digester.Hash().(encoding.BinaryMarshaler)
-	if !ok {
-		return errResumableDigestNotAvailable
-	}
+	states := make(map[digest.Algorithm][]byte, len(bw.digesters))
+	for algorithm, digester := range bw.digesters {
+		h, ok := digester.Hash().(encoding.BinaryMarshaler)
+		if !ok {
+			return errResumableDigestNotAvailable
+		}
 
-	state, err := h.MarshalBinary()
-	if err != nil {
-		return err
+		state, err := h.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		states[algorithm] = state
 	}
 
-	uploadHashStatePath, err := pathFor(uploadHashStatePathSpec{
-		name:   bw.blobStore.repository.Named().String(),
-		id:     bw.id,
-		alg:    bw.digester.Digest().Algorithm(),
-		offset: bw.written,
-	})
-	if err != nil {
-		return err
-	}
+	for algorithm, state := range states {
+		uploadHashStatePath, err := pathFor(uploadHashStatePathSpec{
+			name:   bw.blobStore.repository.Named().String(),
+			id:     bw.id,
+			alg:    algorithm,
+			offset: bw.written,
+		})
+		if err != nil {
+			return err
+		}
 
-	return bw.driver.PutContent(ctx, uploadHashStatePath, state)
+		if err := bw.driver.PutContent(ctx, uploadHashStatePath, state); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -3,9 +3,11 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
 )
 
 // BlobDescriptorCacheProvider provides repository scoped
@@ -16,6 +18,45 @@ type BlobDescriptorCacheProvider interface {
 	RepositoryScoped(repo string) (distribution.BlobDescriptorService, error)
 }
 
+// ManifestCacheProvider provides repository scoped ManifestCache instances.
+type ManifestCacheProvider interface {
+	RepositoryScoped(repo string) (ManifestCache, error)
+}
+
+// ManifestCache caches the digests of the manifests of the tags of a
+// repository, and the payloads of its manifests, so that they are not read
+// from the storage backend on every manifest request.
+type ManifestCache interface {
+	// ResolveTag returns the digest of the manifest of the tag, or
+	// distribution.ErrTagUnknown if it is not cached.
+	ResolveTag(ctx context.Context, tag string) (digest.Digest, error)
+
+	// TagGeneration returns the generation of the tag in the cache, which
+	// changes whenever the tag is cleared. It is read before the tag is
+	// resolved from the storage backend, and passed to SetTag.
+	TagGeneration(ctx context.Context, tag string) (int64, error)
+
+	// SetTag caches the digest of the manifest of the tag, resolved after
+	// TagGeneration returned generation. The digest is not cached if the tag
+	// was cleared since, nor does it replace a digest already cached, so
+	// that a slow request does not cache the revision a tag pointed at
+	// before it was moved.
+	SetTag(ctx context.Context, tag string, dgst digest.Digest, generation int64) error
+
+	// ClearTag removes the tag from the cache, and changes its generation.
+	ClearTag(ctx context.Context, tag string) error
+
+	// Manifest returns the payload of the manifest, or
+	// distribution.ErrManifestUnknownRevision if it is not cached.
+	Manifest(ctx context.Context, dgst digest.Digest) ([]byte, error)
+
+	// SetManifest caches the payload of the manifest.
+	SetManifest(ctx context.Context, dgst digest.Digest, payload []byte) error
+
+	// ClearManifest removes the manifest from the cache.
+	ClearManifest(ctx context.Context, dgst digest.Digest) error
+}
+
 // ValidateDescriptor provides a helper function to ensure that caches have
 // common criteria for admitting descriptors.
 func ValidateDescriptor(desc distribution.Descriptor) error {
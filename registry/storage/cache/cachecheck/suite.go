@@ -185,3 +185,145 @@ func checkBlobDescriptorCacheClear(ctx context.Context, t *testing.T, provider c
 		t.Fatalf("expected error statting deleted blob: %v", err)
 	}
 }
+
+// CheckManifestCache takes a manifest cache implementation through a common
+// set of operations. If adding new tests, please add them here so new
+// implementations get the benefit. This should be used for unit tests.
+func CheckManifestCache(t *testing.T, provider cache.ManifestCacheProvider) {
+	ctx := context.Background()
+
+	checkManifestCacheTags(ctx, t, provider)
+	checkManifestCacheManifests(ctx, t, provider)
+}
+
+func checkManifestCacheTags(ctx context.Context, t *testing.T, provider cache.ManifestCacheProvider) {
+	dgst := digest.Digest("sha256:abc1111111111111111111111111111111111111111111111111111111111111")
+	moved := digest.Digest("sha256:abc2222222222222222222222222222222222222222222222222222222222222")
+
+	if _, err := provider.RepositoryScoped(""); err == nil {
+		t.Fatalf("expected an error when asking for invalid repo")
+	}
+
+	cache, err := provider.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+	other, err := provider.RepositoryScoped("foo/baz")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+
+	if _, err := cache.ResolveTag(ctx, "latest"); err != (distribution.ErrTagUnknown{Tag: "latest"}) {
+		t.Fatalf("expected unknown tag error with empty cache: %v", err)
+	}
+
+	generation, err := cache.TagGeneration(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error getting tag generation: %v", err)
+	}
+
+	if err := cache.SetTag(ctx, "latest", "", generation); err != digest.ErrDigestInvalidFormat {
+		t.Fatalf("expected error with invalid digest: %v", err)
+	}
+
+	if err := cache.SetTag(ctx, "latest", dgst, generation); err != nil {
+		t.Fatalf("unexpected error setting tag: %v", err)
+	}
+
+	resolved, err := cache.ResolveTag(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error resolving tag: %v", err)
+	}
+	if resolved != dgst {
+		t.Fatalf("unexpected digest: %v != %v", resolved, dgst)
+	}
+
+	if _, err := other.ResolveTag(ctx, "latest"); err != (distribution.ErrTagUnknown{Tag: "latest"}) {
+		t.Fatalf("expected unknown tag error in other repository: %v", err)
+	}
+
+	if err := cache.ClearTag(ctx, "latest"); err != nil {
+		t.Fatalf("unexpected error clearing tag: %v", err)
+	}
+
+	if _, err := cache.ResolveTag(ctx, "latest"); err != (distribution.ErrTagUnknown{Tag: "latest"}) {
+		t.Fatalf("expected unknown tag error after clearing: %v", err)
+	}
+
+	// a digest resolved before the tag was cleared is not cached
+	if err := cache.SetTag(ctx, "latest", dgst, generation); err != nil {
+		t.Fatalf("unexpected error setting tag: %v", err)
+	}
+	if _, err := cache.ResolveTag(ctx, "latest"); err != (distribution.ErrTagUnknown{Tag: "latest"}) {
+		t.Fatalf("expected unknown tag error setting tag with previous generation: %v", err)
+	}
+
+	// nor does it replace a digest cached since
+	generation, err = cache.TagGeneration(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error getting tag generation: %v", err)
+	}
+	if err := cache.SetTag(ctx, "latest", moved, generation); err != nil {
+		t.Fatalf("unexpected error setting tag: %v", err)
+	}
+	if err := cache.SetTag(ctx, "latest", dgst, generation); err != nil {
+		t.Fatalf("unexpected error setting tag: %v", err)
+	}
+	resolved, err = cache.ResolveTag(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error resolving tag: %v", err)
+	}
+	if resolved != moved {
+		t.Fatalf("unexpected digest: %v != %v", resolved, moved)
+	}
+
+	if err := cache.ClearTag(ctx, "latest"); err != nil {
+		t.Fatalf("unexpected error clearing tag: %v", err)
+	}
+}
+
+func checkManifestCacheManifests(ctx context.Context, t *testing.T, provider cache.ManifestCacheProvider) {
+	dgst := digest.Digest("sha256:def1111111111111111111111111111111111111111111111111111111111111")
+	payload := []byte(`{"schemaVersion":2}`)
+
+	cache, err := provider.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+	other, err := provider.RepositoryScoped("foo/baz")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+
+	if _, err := cache.Manifest(ctx, ""); err != digest.ErrDigestInvalidFormat {
+		t.Fatalf("expected error getting manifest with empty digest: %v", err)
+	}
+
+	if _, err := cache.Manifest(ctx, dgst); err != (distribution.ErrManifestUnknownRevision{Name: "foo/bar", Revision: dgst}) {
+		t.Fatalf("expected unknown manifest error with empty cache: %v", err)
+	}
+
+	if err := cache.SetManifest(ctx, dgst, payload); err != nil {
+		t.Fatalf("unexpected error setting manifest: %v", err)
+	}
+
+	cached, err := cache.Manifest(ctx, dgst)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
+	}
+	if !reflect.DeepEqual(cached, payload) {
+		t.Fatalf("unexpected payload: %q != %q", cached, payload)
+	}
+
+	if _, err := other.Manifest(ctx, dgst); err != (distribution.ErrManifestUnknownRevision{Name: "foo/baz", Revision: dgst}) {
+		t.Fatalf("expected unknown manifest error in other repository: %v", err)
+	}
+
+	if err := cache.ClearManifest(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error clearing manifest: %v", err)
+	}
+
+	if _, err := cache.Manifest(ctx, dgst); err == nil {
+		t.Fatalf("expected error getting cleared manifest")
+	}
+}
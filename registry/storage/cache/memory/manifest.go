@@ -0,0 +1,173 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/distribution/distribution/v3/registry/storage/cache/metrics"
+	"github.com/distribution/reference"
+	"github.com/hashicorp/golang-lru/arc/v2"
+	"github.com/opencontainers/go-digest"
+)
+
+type manifestCacheKey struct {
+	repo   string
+	tag    string
+	digest digest.Digest
+}
+
+type manifestCacheEntry struct {
+	digest  digest.Digest
+	payload []byte
+	expires time.Time
+}
+
+type inMemoryManifestCacheProvider struct {
+	lru *arc.ARCCache[manifestCacheKey, manifestCacheEntry]
+	ttl time.Duration
+
+	// mu serializes the tags set and cleared, so that a tag is not set
+	// after it is cleared with the generation read before.
+	mu sync.Mutex
+	// generation is incremented whenever a tag is cleared. It is shared by
+	// all tags, which only makes concurrent requests miss the cache more.
+	generation int64
+}
+
+// NewInMemoryManifestCacheProvider returns a new cache of the tags and
+// manifests of the repositories, holding up to size tags and manifests.
+// Entries expire after ttl, which must be positive.
+//
+// The cache is local to the process: it is only invalidated by the tags
+// moved and the manifests deleted through the same registry instance, so it
+// must not be used by registries sharing their storage backend with others.
+func NewInMemoryManifestCacheProvider(size int, ttl time.Duration) cache.ManifestCacheProvider {
+	if size <= 0 {
+		size = UnlimitedSize
+	}
+	if ttl <= 0 {
+		panic(fmt.Sprintf("invalid manifest cache ttl %v: must be positive", ttl))
+	}
+	lruCache, err := arc.NewARC[manifestCacheKey, manifestCacheEntry](size)
+	if err != nil {
+		// NewARC can only fail if size is <= 0, so this unreachable
+		panic(err)
+	}
+	return metrics.NewPrometheusManifestCacheProvider(&inMemoryManifestCacheProvider{
+		lru: lruCache,
+		ttl: ttl,
+	})
+}
+
+func (immcp *inMemoryManifestCacheProvider) RepositoryScoped(repo string) (cache.ManifestCache, error) {
+	if _, err := reference.ParseNormalizedNamed(repo); err != nil {
+		if err == reference.ErrNameTooLong {
+			return nil, distribution.ErrRepositoryNameInvalid{
+				Name:   repo,
+				Reason: reference.ErrNameTooLong,
+			}
+		}
+		return nil, err
+	}
+
+	return &repositoryScopedInMemoryManifestCache{
+		repo:   repo,
+		parent: immcp,
+	}, nil
+}
+
+func (immcp *inMemoryManifestCacheProvider) get(key manifestCacheKey) (manifestCacheEntry, bool) {
+	entry, ok := immcp.lru.Get(key)
+	if !ok {
+		return manifestCacheEntry{}, false
+	}
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		immcp.lru.Remove(key)
+		return manifestCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (immcp *inMemoryManifestCacheProvider) add(key manifestCacheKey, entry manifestCacheEntry) {
+	entry.expires = time.Now().Add(immcp.ttl)
+	immcp.lru.Add(key, entry)
+}
+
+// repositoryScopedInMemoryManifestCache provides the request scoped
+// repository cache. Instances are not thread-safe but the delegated
+// operations are.
+type repositoryScopedInMemoryManifestCache struct {
+	repo   string
+	parent *inMemoryManifestCacheProvider
+}
+
+func (rsimmc *repositoryScopedInMemoryManifestCache) ResolveTag(ctx context.Context, tag string) (digest.Digest, error) {
+	entry, ok := rsimmc.parent.get(manifestCacheKey{repo: rsimmc.repo, tag: tag})
+	if !ok {
+		return "", distribution.ErrTagUnknown{Tag: tag}
+	}
+	return entry.digest, nil
+}
+
+func (rsimmc *repositoryScopedInMemoryManifestCache) TagGeneration(ctx context.Context, tag string) (int64, error) {
+	rsimmc.parent.mu.Lock()
+	defer rsimmc.parent.mu.Unlock()
+	return rsimmc.parent.generation, nil
+}
+
+func (rsimmc *repositoryScopedInMemoryManifestCache) SetTag(ctx context.Context, tag string, dgst digest.Digest, generation int64) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	rsimmc.parent.mu.Lock()
+	defer rsimmc.parent.mu.Unlock()
+	if generation != rsimmc.parent.generation {
+		return nil
+	}
+	key := manifestCacheKey{repo: rsimmc.repo, tag: tag}
+	if _, ok := rsimmc.parent.get(key); ok {
+		return nil
+	}
+	rsimmc.parent.add(key, manifestCacheEntry{digest: dgst})
+	return nil
+}
+
+func (rsimmc *repositoryScopedInMemoryManifestCache) ClearTag(ctx context.Context, tag string) error {
+	rsimmc.parent.mu.Lock()
+	defer rsimmc.parent.mu.Unlock()
+	rsimmc.parent.generation++
+	rsimmc.parent.lru.Remove(manifestCacheKey{repo: rsimmc.repo, tag: tag})
+	return nil
+}
+
+func (rsimmc *repositoryScopedInMemoryManifestCache) Manifest(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	entry, ok := rsimmc.parent.get(manifestCacheKey{repo: rsimmc.repo, digest: dgst})
+	if !ok {
+		return nil, distribution.ErrManifestUnknownRevision{Name: rsimmc.repo, Revision: dgst}
+	}
+	return entry.payload, nil
+}
+
+func (rsimmc *repositoryScopedInMemoryManifestCache) SetManifest(ctx context.Context, dgst digest.Digest, payload []byte) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	rsimmc.parent.add(manifestCacheKey{repo: rsimmc.repo, digest: dgst}, manifestCacheEntry{payload: payload})
+	return nil
+}
+
+func (rsimmc *repositoryScopedInMemoryManifestCache) ClearManifest(ctx context.Context, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	rsimmc.parent.lru.Remove(manifestCacheKey{repo: rsimmc.repo, digest: dgst})
+	return nil
+}
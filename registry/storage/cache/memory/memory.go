@@ -85,6 +85,17 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) Clear(ctx context.Context, dg
 	return nil
 }
 
+// ClearAll removes the descriptor from the global cache and from the caches
+// of all the repositories.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) ClearAll(ctx context.Context, dgst digest.Digest) error {
+	for _, key := range imbdcp.lru.Keys() {
+		if key.digest == dgst {
+			imbdcp.lru.Remove(key)
+		}
+	}
+	return nil
+}
+
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
 	_, err := imbdcp.Stat(ctx, dgst)
 	if err == distribution.ErrBlobUnknown {
@@ -1,9 +1,13 @@
 package memory
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/opencontainers/go-digest"
 )
 
 // TestInMemoryBlobInfoCache checks the in memory implementation is working
@@ -11,3 +15,65 @@ import (
 func TestInMemoryBlobInfoCache(t *testing.T) {
 	cachecheck.CheckBlobDescriptorCache(t, NewInMemoryBlobDescriptorCacheProvider(UnlimitedSize))
 }
+
+// TestInMemoryBlobInfoCacheClearAll checks that clearing a descriptor from
+// all the caches removes it from the caches of the repositories.
+func TestInMemoryBlobInfoCacheClearAll(t *testing.T) {
+	ctx := context.Background()
+	provider := NewInMemoryBlobDescriptorCacheProvider(UnlimitedSize).(*inMemoryBlobDescriptorCacheProvider)
+	scoped, err := provider.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+
+	dgst := digest.Digest("sha256:abc1111111111111111111111111111111111111111111111111111111111111")
+	other := digest.Digest("sha256:abc2222222222222222222222222222222222222222222222222222222222222")
+	for _, d := range []digest.Digest{dgst, other} {
+		desc := distribution.Descriptor{Digest: d, Size: 10, MediaType: "application/octet-stream"}
+		if err := scoped.SetDescriptor(ctx, d, desc); err != nil {
+			t.Fatalf("unexpected error setting descriptor: %v", err)
+		}
+	}
+
+	if err := provider.ClearAll(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error clearing descriptor: %v", err)
+	}
+	if _, err := scoped.Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected descriptor to be cleared from the repository: %v", err)
+	}
+	if _, err := provider.Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected descriptor to be cleared from the global cache: %v", err)
+	}
+	if _, err := scoped.Stat(ctx, other); err != nil {
+		t.Fatalf("unexpected error statting other descriptor: %v", err)
+	}
+}
+
+// TestInMemoryManifestCache checks the in memory manifest cache is working
+// correctly.
+func TestInMemoryManifestCache(t *testing.T) {
+	cachecheck.CheckManifestCache(t, NewInMemoryManifestCacheProvider(UnlimitedSize, time.Hour))
+}
+
+// TestInMemoryManifestCacheExpiry checks that the entries of the in memory
+// manifest cache expire.
+func TestInMemoryManifestCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewInMemoryManifestCacheProvider(UnlimitedSize, 50*time.Millisecond).RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+
+	dgst := digest.Digest("sha256:abc1111111111111111111111111111111111111111111111111111111111111")
+	if err := cache.SetTag(ctx, "latest", dgst, 0); err != nil {
+		t.Fatalf("unexpected error setting tag: %v", err)
+	}
+	if _, err := cache.ResolveTag(ctx, "latest"); err != nil {
+		t.Fatalf("unexpected error resolving tag: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := cache.ResolveTag(ctx, "latest"); err != (distribution.ErrTagUnknown{Tag: "latest"}) {
+		t.Fatalf("expected unknown tag error after expiry: %v", err)
+	}
+}
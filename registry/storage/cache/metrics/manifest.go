@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/distribution/distribution/v3"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	// manifestCacheRequests is the number of manifest cache lookups.
+	manifestCacheRequests = prometheus.StorageNamespace.NewLabeledCounter("manifest_cache_requests", "The number of manifest cache requests received", "type")
+	// manifestCacheHits is the number of manifest cache lookups found in the cache.
+	manifestCacheHits = prometheus.StorageNamespace.NewLabeledCounter("manifest_cache_hits", "The number of manifest cache hits", "type")
+	// manifestCacheMisses is the number of manifest cache lookups not found in the cache.
+	manifestCacheMisses = prometheus.StorageNamespace.NewLabeledCounter("manifest_cache_misses", "The number of manifest cache misses", "type")
+	// manifestCacheErrors is the number of manifest cache lookup errors.
+	manifestCacheErrors = prometheus.StorageNamespace.NewLabeledCounter("manifest_cache_errors", "The number of manifest cache request errors", "type")
+)
+
+type prometheusManifestCacheProvider struct {
+	cache.ManifestCacheProvider
+}
+
+// NewPrometheusManifestCacheProvider counts the hits and misses of the
+// lookups of the tags and manifests of a manifest cache.
+func NewPrometheusManifestCacheProvider(wrap cache.ManifestCacheProvider) cache.ManifestCacheProvider {
+	return &prometheusManifestCacheProvider{wrap}
+}
+
+func (p *prometheusManifestCacheProvider) RepositoryScoped(repo string) (cache.ManifestCache, error) {
+	c, err := p.ManifestCacheProvider.RepositoryScoped(repo)
+	if err != nil {
+		return nil, err
+	}
+	return &prometheusManifestCache{c}, nil
+}
+
+type prometheusManifestCache struct {
+	cache.ManifestCache
+}
+
+func (p *prometheusManifestCache) ResolveTag(ctx context.Context, tag string) (digest.Digest, error) {
+	dgst, err := p.ManifestCache.ResolveTag(ctx, tag)
+	_, miss := err.(distribution.ErrTagUnknown)
+	count("tag", err, miss)
+	return dgst, err
+}
+
+func (p *prometheusManifestCache) Manifest(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	payload, err := p.ManifestCache.Manifest(ctx, dgst)
+	_, miss := err.(distribution.ErrManifestUnknownRevision)
+	count("manifest", err, miss)
+	return payload, err
+}
+
+func count(kind string, err error, miss bool) {
+	manifestCacheRequests.WithValues(kind).Inc(1)
+	switch {
+	case err == nil:
+		manifestCacheHits.WithValues(kind).Inc(1)
+	case miss:
+		manifestCacheMisses.WithValues(kind).Inc(1)
+	default:
+		manifestCacheErrors.WithValues(kind).Inc(1)
+	}
+}
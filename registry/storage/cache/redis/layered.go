@@ -0,0 +1,319 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/redis/go-redis/v9"
+)
+
+// invalidationChannel is the redis pub/sub channel on which the layered
+// caches of all the instances of the registry publish the descriptors they
+// clear.
+const invalidationChannel = "blobs::invalidations"
+
+// invalidation is the message published on the invalidation channel. Repo is
+// empty when the descriptor was cleared from the global cache.
+type invalidation struct {
+	Repo   string        `json:"repo,omitempty"`
+	Digest digest.Digest `json:"digest"`
+}
+
+// layeredBlobDescriptorService provides an implementation of
+// BlobDescriptorCacheProvider which consults a local in-memory cache before
+// redis. Descriptors found in redis are added to the local cache, and
+// descriptors cleared on any instance are evicted from the local caches of
+// all the instances through redis pub/sub.
+type layeredBlobDescriptorService struct {
+	pool   redis.UniversalClient
+	size   int
+	local  atomic.Pointer[cache.BlobDescriptorCacheProvider]
+	remote cache.BlobDescriptorCacheProvider
+
+	// mu guards epoch, the number of evictions from the local cache, so
+	// that descriptors read from redis before an eviction are not added to
+	// the local cache after it.
+	mu    sync.Mutex
+	epoch uint64
+}
+
+var _ distribution.BlobDescriptorService = &layeredBlobDescriptorService{}
+
+// NewLayeredBlobDescriptorCacheProvider returns a new BlobDescriptorCacheProvider
+// holding up to size descriptors in memory in front of the provided redis
+// connection pool. It listens for invalidations from the other instances
+// until ctx is done.
+func NewLayeredBlobDescriptorCacheProvider(ctx context.Context, pool redis.UniversalClient, size int) cache.BlobDescriptorCacheProvider {
+	lbds := &layeredBlobDescriptorService{
+		pool:   pool,
+		size:   size,
+		remote: NewRedisBlobDescriptorCacheProvider(pool),
+	}
+	lbds.purge()
+
+	pubsub := pool.Subscribe(ctx, invalidationChannel)
+	go lbds.listen(ctx, pubsub)
+
+	return lbds
+}
+
+// listen evicts the descriptors cleared by the other instances from the
+// local cache until ctx is done.
+func (lbds *layeredBlobDescriptorService) listen(ctx context.Context, pubsub *redis.PubSub) {
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			dcontext.GetLogger(ctx).WithError(err).Error("error receiving blob descriptor cache invalidations")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			// Invalidations published while the subscription was down are
+			// lost, so start over with an empty local cache.
+			if msg.Kind == "subscribe" {
+				lbds.purge()
+			}
+		case *redis.Message:
+			var inv invalidation
+			if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+				dcontext.GetLogger(ctx).WithError(err).Error("invalid blob descriptor cache invalidation")
+				continue
+			}
+			lbds.evict(ctx, inv.Repo, inv.Digest)
+		}
+	}
+}
+
+// purge replaces the local cache with an empty one.
+func (lbds *layeredBlobDescriptorService) purge() {
+	local := memory.NewInMemoryBlobDescriptorCacheProvider(lbds.size)
+	lbds.local.Store(&local)
+}
+
+func (lbds *layeredBlobDescriptorService) localCache() cache.BlobDescriptorCacheProvider {
+	return *lbds.local.Load()
+}
+
+// allClearer is implemented by the local cache to remove a descriptor from
+// the caches of all the repositories.
+type allClearer interface {
+	ClearAll(ctx context.Context, dgst digest.Digest) error
+}
+
+// evict removes the descriptor from the local cache, both from the cache of
+// the repository, if any, and from the global cache. A descriptor cleared
+// from the global cache is removed from the caches of all the repositories,
+// as redis answers them from the global cache.
+func (lbds *layeredBlobDescriptorService) evict(ctx context.Context, repo string, dgst digest.Digest) {
+	lbds.mu.Lock()
+	defer lbds.mu.Unlock()
+	lbds.epoch++
+
+	local := lbds.localCache()
+	if repo == "" {
+		if clearer, ok := local.(allClearer); ok {
+			_ = clearer.ClearAll(ctx, dgst)
+			return
+		}
+	} else if scoped, err := local.RepositoryScoped(repo); err == nil {
+		_ = scoped.Clear(ctx, dgst)
+	}
+	_ = local.Clear(ctx, dgst)
+}
+
+// currentEpoch returns the number of evictions from the local cache, to be
+// read before reading a descriptor from redis.
+func (lbds *layeredBlobDescriptorService) currentEpoch() uint64 {
+	lbds.mu.Lock()
+	defer lbds.mu.Unlock()
+	return lbds.epoch
+}
+
+// setLocal adds a descriptor read from redis to the local cache, unless a
+// descriptor was evicted since epoch, as it may have been read before it was
+// cleared.
+func (lbds *layeredBlobDescriptorService) setLocal(ctx context.Context, local distribution.BlobDescriptorService, epoch uint64, dgst digest.Digest, desc distribution.Descriptor) error {
+	lbds.mu.Lock()
+	defer lbds.mu.Unlock()
+	if lbds.epoch != epoch {
+		return nil
+	}
+	return local.SetDescriptor(ctx, dgst, desc)
+}
+
+// invalidate evicts the descriptor from the local cache of this instance and
+// publishes the invalidation to the other instances.
+func (lbds *layeredBlobDescriptorService) invalidate(ctx context.Context, repo string, dgst digest.Digest) error {
+	lbds.evict(ctx, repo, dgst)
+
+	payload, err := json.Marshal(invalidation{Repo: repo, Digest: dgst})
+	if err != nil {
+		return err
+	}
+	return lbds.pool.Publish(ctx, invalidationChannel, payload).Err()
+}
+
+// RepositoryScoped returns the scoped cache.
+func (lbds *layeredBlobDescriptorService) RepositoryScoped(repo string) (distribution.BlobDescriptorService, error) {
+	if _, err := reference.ParseNormalizedNamed(repo); err != nil {
+		if err == reference.ErrNameTooLong {
+			return nil, distribution.ErrRepositoryNameInvalid{
+				Name:   repo,
+				Reason: reference.ErrNameTooLong,
+			}
+		}
+		return nil, err
+	}
+
+	return &repositoryScopedLayeredBlobDescriptorService{
+		repo:     repo,
+		upstream: lbds,
+	}, nil
+}
+
+// Stat retrieves the descriptor from the local cache, or from redis on a
+// local miss.
+func (lbds *layeredBlobDescriptorService) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	epoch := lbds.currentEpoch()
+	local := lbds.localCache()
+	desc, err := local.Stat(ctx, dgst)
+	if err != distribution.ErrBlobUnknown {
+		return desc, err
+	}
+
+	desc, err = lbds.remote.Stat(ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	if err := lbds.setLocal(ctx, local, epoch, dgst, desc); err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// Clear removes the descriptor from redis and from the local caches of all
+// the instances.
+func (lbds *layeredBlobDescriptorService) Clear(ctx context.Context, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	err := lbds.remote.Clear(ctx, dgst)
+	if err != nil && err != distribution.ErrBlobUnknown {
+		return err
+	}
+	// the descriptor may still be cached locally if it was evicted from redis
+	if err := lbds.invalidate(ctx, "", dgst); err != nil {
+		return err
+	}
+	return err
+}
+
+// SetDescriptor sets the descriptor in redis, then in the local cache.
+func (lbds *layeredBlobDescriptorService) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+	if err := lbds.remote.SetDescriptor(ctx, dgst, desc); err != nil {
+		return err
+	}
+	return lbds.localCache().SetDescriptor(ctx, dgst, desc)
+}
+
+type repositoryScopedLayeredBlobDescriptorService struct {
+	repo     string
+	upstream *layeredBlobDescriptorService
+}
+
+var _ distribution.BlobDescriptorService = &repositoryScopedLayeredBlobDescriptorService{}
+
+// Stat retrieves the descriptor from the local cache of the repository, or
+// from redis on a local miss.
+func (rslbds *repositoryScopedLayeredBlobDescriptorService) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	epoch := rslbds.upstream.currentEpoch()
+	local, remote, err := rslbds.scoped()
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	desc, err := local.Stat(ctx, dgst)
+	if err != distribution.ErrBlobUnknown {
+		return desc, err
+	}
+
+	desc, err = remote.Stat(ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	if err := rslbds.upstream.setLocal(ctx, local, epoch, dgst, desc); err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// Clear removes the descriptor from redis and from the local caches of all
+// the instances. As in redis, the descriptor is removed from the global cache
+// along with the cache of the repository.
+func (rslbds *repositoryScopedLayeredBlobDescriptorService) Clear(ctx context.Context, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	_, remote, err := rslbds.scoped()
+	if err != nil {
+		return err
+	}
+
+	err = remote.Clear(ctx, dgst)
+	if err != nil && err != distribution.ErrBlobUnknown {
+		return err
+	}
+	// the descriptor may still be cached locally if it was evicted from redis
+	if err := rslbds.upstream.invalidate(ctx, rslbds.repo, dgst); err != nil {
+		return err
+	}
+	return err
+}
+
+// SetDescriptor sets the descriptor in redis, then in the local cache.
+func (rslbds *repositoryScopedLayeredBlobDescriptorService) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+	local, remote, err := rslbds.scoped()
+	if err != nil {
+		return err
+	}
+
+	if err := remote.SetDescriptor(ctx, dgst, desc); err != nil {
+		return err
+	}
+	return local.SetDescriptor(ctx, dgst, desc)
+}
+
+// scoped returns the local and redis caches of the repository.
+func (rslbds *repositoryScopedLayeredBlobDescriptorService) scoped() (distribution.BlobDescriptorService, distribution.BlobDescriptorService, error) {
+	local, err := rslbds.upstream.localCache().RepositoryScoped(rslbds.repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	remote, err := rslbds.upstream.remote.RepositoryScoped(rslbds.repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	return local, remote, nil
+}
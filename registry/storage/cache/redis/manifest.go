@@ -0,0 +1,161 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/distribution/distribution/v3/registry/storage/cache/metrics"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/redis/go-redis/v9"
+)
+
+// setTagScript sets the tag key KEYS[1] to the digest ARGV[1] for ARGV[3]
+// milliseconds, unless it is already set or the generation key KEYS[2] no
+// longer holds the generation ARGV[2].
+var setTagScript = redis.NewScript(`
+local generation = redis.call('GET', KEYS[2]) or '0'
+if generation ~= ARGV[2] then
+	return 0
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[3]) then
+	return 1
+end
+return 0
+`)
+
+// redisManifestCacheProvider provides an implementation of
+// ManifestCacheProvider based on redis. The digest of the manifest of each
+// tag and the payload of each manifest are stored as strings under keys
+// scoped by repository, which expire after the ttl of the provider. The
+// generation of each tag is a counter incremented when the tag is cleared.
+type redisManifestCacheProvider struct {
+	pool redis.UniversalClient
+	ttl  time.Duration
+}
+
+// NewRedisManifestCacheProvider returns a new redis-based
+// ManifestCacheProvider using the provided redis connection pool. Entries
+// expire after ttl, which must be positive.
+func NewRedisManifestCacheProvider(pool redis.UniversalClient, ttl time.Duration) cache.ManifestCacheProvider {
+	if ttl < time.Millisecond {
+		panic(fmt.Sprintf("invalid manifest cache ttl %v: must be at least 1ms", ttl))
+	}
+	return metrics.NewPrometheusManifestCacheProvider(&redisManifestCacheProvider{
+		pool: pool,
+		ttl:  ttl,
+	})
+}
+
+// RepositoryScoped returns the scoped cache.
+func (rmcp *redisManifestCacheProvider) RepositoryScoped(repo string) (cache.ManifestCache, error) {
+	if _, err := reference.ParseNormalizedNamed(repo); err != nil {
+		if err == reference.ErrNameTooLong {
+			return nil, distribution.ErrRepositoryNameInvalid{
+				Name:   repo,
+				Reason: reference.ErrNameTooLong,
+			}
+		}
+		return nil, err
+	}
+
+	return &repositoryScopedRedisManifestCache{
+		repo:     repo,
+		upstream: rmcp,
+	}, nil
+}
+
+type repositoryScopedRedisManifestCache struct {
+	repo     string
+	upstream *redisManifestCacheProvider
+}
+
+var _ cache.ManifestCache = &repositoryScopedRedisManifestCache{}
+
+func (rsrmc *repositoryScopedRedisManifestCache) ResolveTag(ctx context.Context, tag string) (digest.Digest, error) {
+	reply, err := rsrmc.upstream.pool.Get(ctx, rsrmc.tagKey(tag)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", distribution.ErrTagUnknown{Tag: tag}
+		}
+		return "", err
+	}
+	return digest.Digest(reply), nil
+}
+
+func (rsrmc *repositoryScopedRedisManifestCache) TagGeneration(ctx context.Context, tag string) (int64, error) {
+	generation, err := rsrmc.upstream.pool.Get(ctx, rsrmc.tagGenerationKey(tag)).Int64()
+	if err != nil {
+		if err == redis.Nil {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return generation, nil
+}
+
+func (rsrmc *repositoryScopedRedisManifestCache) SetTag(ctx context.Context, tag string, dgst digest.Digest, generation int64) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	keys := []string{rsrmc.tagKey(tag), rsrmc.tagGenerationKey(tag)}
+	return setTagScript.Run(ctx, rsrmc.upstream.pool, keys, dgst.String(), strconv.FormatInt(generation, 10), rsrmc.upstream.ttl.Milliseconds()).Err()
+}
+
+func (rsrmc *repositoryScopedRedisManifestCache) ClearTag(ctx context.Context, tag string) error {
+	// the generation expires after the ttl, by which time the requests
+	// that read the previous generation have completed.
+	_, err := rsrmc.upstream.pool.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, rsrmc.tagGenerationKey(tag))
+		pipe.PExpire(ctx, rsrmc.tagGenerationKey(tag), rsrmc.upstream.ttl)
+		pipe.Del(ctx, rsrmc.tagKey(tag))
+		return nil
+	})
+	return err
+}
+
+func (rsrmc *repositoryScopedRedisManifestCache) Manifest(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	reply, err := rsrmc.upstream.pool.Get(ctx, rsrmc.manifestKey(dgst)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, distribution.ErrManifestUnknownRevision{Name: rsrmc.repo, Revision: dgst}
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (rsrmc *repositoryScopedRedisManifestCache) SetManifest(ctx context.Context, dgst digest.Digest, payload []byte) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	return rsrmc.upstream.pool.Set(ctx, rsrmc.manifestKey(dgst), payload, rsrmc.upstream.ttl).Err()
+}
+
+func (rsrmc *repositoryScopedRedisManifestCache) ClearManifest(ctx context.Context, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	return rsrmc.upstream.pool.Del(ctx, rsrmc.manifestKey(dgst)).Err()
+}
+
+// tagKey returns the key of the tag. The repository and tag are the hash tag
+// of the key, so that it is in the same cluster slot as the generation key.
+func (rsrmc *repositoryScopedRedisManifestCache) tagKey(tag string) string {
+	return "repository::{" + rsrmc.repo + "::tags::" + tag + "}"
+}
+
+func (rsrmc *repositoryScopedRedisManifestCache) tagGenerationKey(tag string) string {
+	return rsrmc.tagKey(tag) + "::generation"
+}
+
+func (rsrmc *repositoryScopedRedisManifestCache) manifestKey(dgst digest.Digest) string {
+	return "repository::" + rsrmc.repo + "::manifests::" + dgst.String()
+}
@@ -5,8 +5,13 @@ import (
 	"flag"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
 	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	"github.com/opencontainers/go-digest"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -19,6 +24,163 @@ func init() {
 // TestRedisLayerInfoCache exercises a live redis instance using the cache
 // implementation.
 func TestRedisBlobDescriptorCacheProvider(t *testing.T) {
+	pool := newTestPool(t)
+
+	cachecheck.CheckBlobDescriptorCache(t, NewRedisBlobDescriptorCacheProvider(pool))
+	cachecheck.CheckManifestCache(t, NewRedisManifestCacheProvider(pool, time.Hour))
+}
+
+// TestLayeredBlobDescriptorCacheProvider exercises a live redis instance
+// using the layered cache implementation, and checks that clearing a
+// descriptor on one instance evicts it from the local cache of another.
+func TestLayeredBlobDescriptorCacheProvider(t *testing.T) {
+	pool := newTestPool(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cachecheck.CheckBlobDescriptorCache(t, NewLayeredBlobDescriptorCacheProvider(ctx, pool, 100))
+
+	dgst := digest.Digest("sha256:fed1111111111111111111111111111111111111111111111111111111111111")
+	desc := distribution.Descriptor{
+		Digest:    dgst,
+		Size:      10,
+		MediaType: "application/octet-stream",
+	}
+
+	first, err := NewLayeredBlobDescriptorCacheProvider(ctx, pool, 100).RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+	second, err := NewLayeredBlobDescriptorCacheProvider(ctx, pool, 100).RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+
+	if err := first.SetDescriptor(ctx, dgst, desc); err != nil {
+		t.Fatalf("unexpected error setting descriptor: %v", err)
+	}
+	// populate the local cache of the second instance
+	if _, err := second.Stat(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error statting descriptor: %v", err)
+	}
+
+	if err := first.Clear(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error clearing descriptor: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := second.Stat(ctx, dgst)
+		if err == distribution.ErrBlobUnknown {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected descriptor to be evicted from the other instance: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestLayeredBlobDescriptorCacheProviderGlobalClear checks that clearing a
+// descriptor from the global cache evicts it from the local caches of the
+// repositories, which redis answers from the global cache.
+func TestLayeredBlobDescriptorCacheProviderGlobalClear(t *testing.T) {
+	pool := newTestPool(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dgst := digest.Digest("sha256:fed2222222222222222222222222222222222222222222222222222222222222")
+	desc := distribution.Descriptor{
+		Digest:    dgst,
+		Size:      10,
+		MediaType: "application/octet-stream",
+	}
+
+	provider := NewLayeredBlobDescriptorCacheProvider(ctx, pool, 100)
+	scoped, err := provider.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+	if err := scoped.SetDescriptor(ctx, dgst, desc); err != nil {
+		t.Fatalf("unexpected error setting descriptor: %v", err)
+	}
+
+	if err := provider.Clear(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error clearing descriptor: %v", err)
+	}
+	if _, err := scoped.Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected descriptor to be evicted from the repository: %v", err)
+	}
+}
+
+// racingBlobDescriptorService runs race before returning the descriptors it
+// reads, to clear them while they are read.
+type racingBlobDescriptorService struct {
+	distribution.BlobDescriptorService
+	race func()
+}
+
+func (r racingBlobDescriptorService) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	desc, err := r.BlobDescriptorService.Stat(ctx, dgst)
+	r.race()
+	return desc, err
+}
+
+type racingBlobDescriptorCacheProvider struct {
+	racingBlobDescriptorService
+	provider cache.BlobDescriptorCacheProvider
+}
+
+func (r racingBlobDescriptorCacheProvider) RepositoryScoped(repo string) (distribution.BlobDescriptorService, error) {
+	scoped, err := r.provider.RepositoryScoped(repo)
+	return racingBlobDescriptorService{scoped, r.race}, err
+}
+
+// TestLayeredBlobDescriptorCacheProviderConcurrentClear checks that a
+// descriptor read from redis while it is cleared is not added to the local
+// cache.
+func TestLayeredBlobDescriptorCacheProviderConcurrentClear(t *testing.T) {
+	ctx := context.Background()
+	dgst := digest.Digest("sha256:fed3333333333333333333333333333333333333333333333333333333333333")
+	desc := distribution.Descriptor{
+		Digest:    dgst,
+		Size:      10,
+		MediaType: "application/octet-stream",
+	}
+
+	remote := memory.NewInMemoryBlobDescriptorCacheProvider(100)
+	lbds := &layeredBlobDescriptorService{size: 100}
+	lbds.remote = racingBlobDescriptorCacheProvider{
+		racingBlobDescriptorService: racingBlobDescriptorService{remote, func() {
+			_ = remote.(allClearer).ClearAll(ctx, dgst)
+			lbds.evict(ctx, "", dgst)
+		}},
+		provider: remote,
+	}
+	lbds.purge()
+
+	scoped, err := lbds.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+	remoteScoped, err := remote.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+	for bds, remote := range map[distribution.BlobDescriptorService]distribution.BlobDescriptorService{lbds: remote, scoped: remoteScoped} {
+		if err := remote.SetDescriptor(ctx, dgst, desc); err != nil {
+			t.Fatalf("unexpected error setting descriptor: %v", err)
+		}
+		if _, err := bds.Stat(ctx, dgst); err != nil {
+			t.Fatalf("unexpected error getting descriptor: %v", err)
+		}
+		if _, err := bds.Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+			t.Fatalf("expected cleared descriptor not to be cached locally: %v", err)
+		}
+	}
+}
+
+func newTestPool(t *testing.T) redis.UniversalClient {
 	if redisAddr == "" {
 		// fallback to an environment variable
 		redisAddr = os.Getenv("TEST_REGISTRY_STORAGE_CACHE_REDIS_ADDR")
@@ -45,6 +207,5 @@ func TestRedisBlobDescriptorCacheProvider(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error flushing redis db: %v", err)
 	}
-
-	cachecheck.CheckBlobDescriptorCache(t, NewRedisBlobDescriptorCacheProvider(pool))
+	return pool
 }
@@ -22,6 +22,25 @@ func (reg *registry) Repositories(ctx context.Context, repos []string, last stri
 		return 0, errors.New("Attempted to list 0 repositories")
 	}
 
+	names, indexed, err := reg.indexedRepositories(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if indexed {
+		for _, name := range names {
+			if !lessPath(last, name) {
+				continue
+			}
+			if foundRepos == len(repos) {
+				// There are more repositories to list
+				return foundRepos, nil
+			}
+			repos[foundRepos] = name
+			foundRepos++
+		}
+		return foundRepos, io.EOF
+	}
+
 	root, err := pathFor(repositoriesRootPathSpec{})
 	if err != nil {
 		return 0, err
@@ -69,6 +88,31 @@ func (reg *registry) Repositories(ctx context.Context, repos []string, last stri
 
 // Enumerate applies ingester to each repository
 func (reg *registry) Enumerate(ctx context.Context, ingester func(string) error) error {
+	names, indexed, err := reg.indexedRepositories(ctx)
+	if err != nil {
+		return err
+	}
+	if indexed {
+		for _, name := range names {
+			// skip the entries of repositories removed while the index
+			// was rebuilt
+			manifestsPath, err := pathFor(manifestsPathSpec{name: name})
+			if err != nil {
+				return err
+			}
+			if _, err := reg.driver.Stat(ctx, manifestsPath); err != nil {
+				if _, ok := err.(driver.PathNotFoundError); ok {
+					continue
+				}
+				return err
+			}
+			if err := ingester(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	root, err := pathFor(repositoriesRootPathSpec{})
 	if err != nil {
 		return err
@@ -88,7 +132,18 @@ func (reg *registry) Remove(ctx context.Context, name reference.Named) error {
 		return err
 	}
 	repoDir := path.Join(root, name.Name())
-	return reg.driver.Delete(ctx, repoDir)
+	err = reg.driver.Delete(ctx, repoDir)
+	if _, ok := err.(driver.PathNotFoundError); err != nil && !ok {
+		return err
+	}
+	if reg.catalogIndex != nil {
+		if err := reg.catalogIndex.remove(ctx, name.Name()); err != nil {
+			return err
+		}
+	} else if err := (&catalogIndex{driver: reg.driver}).invalidate(ctx, name.Name(), false); err != nil {
+		return err
+	}
+	return err
 }
 
 // lessPath returns true if one path a is less than path b.
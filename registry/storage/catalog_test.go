@@ -197,6 +197,114 @@ func TestCatalogEnumerate(t *testing.T) {
 	}
 }
 
+func TestCatalogIndex(t *testing.T) {
+	env := setupFS(t)
+
+	registry, err := NewRegistry(env.ctx, env.driver, EnableCatalogIndex, EnableDelete)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	// an entry of a repository which no longer exists
+	stalePath, err := pathFor(catalogEntryPathSpec{name: "gone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.driver.PutContent(env.ctx, stalePath, []byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the repositories are walked until the index is rebuilt
+	p := make([]string, 50)
+	numFilled, err := registry.Repositories(env.ctx, p, "")
+	if err != io.EOF || !testEq(p, env.expected, numFilled) || numFilled != len(env.expected) {
+		t.Fatalf("unexpected catalog before rebuild: %v, %v", p[:numFilled], err)
+	}
+
+	stats, err := RebuildCatalog(env.ctx, registry)
+	if err != nil {
+		t.Fatalf("unexpected error rebuilding catalog: %v", err)
+	}
+	if stats.Repositories != len(env.expected) || stats.Removed != 1 {
+		t.Fatalf("unexpected rebuild stats: %+v", stats)
+	}
+
+	makeRepo(env.ctx, t, "foo/c", registry)
+	named, err := reference.WithName("bar/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.(distribution.RepositoryRemover).Remove(env.ctx, named); err != nil {
+		t.Fatalf("unexpected error removing repository: %v", err)
+	}
+	expected := []string{"bar/c", "bar/e", "foo/a", "foo/b", "foo/c", "foo/d/in", "foo-bar/a", "foo-bar/b", "test"}
+
+	// the catalog is listed from the index
+	var repos []string
+	last := ""
+	for {
+		p := make([]string, 4)
+		numFilled, err := registry.Repositories(env.ctx, p, last)
+		repos = append(repos, p[:numFilled]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error listing catalog: %v", err)
+		}
+		last = p[numFilled-1]
+	}
+	if len(repos) != len(expected) || !testEq(repos, expected, len(expected)) {
+		t.Fatalf("unexpected catalog %v, expected %v", repos, expected)
+	}
+
+	repos = nil
+	err = registry.(distribution.RepositoryEnumerator).Enumerate(env.ctx, func(repoName string) error {
+		repos = append(repos, repoName)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error enumerating repositories: %v", err)
+	}
+	if len(repos) != len(expected) || !testEq(repos, expected, len(expected)) {
+		t.Fatalf("unexpected repositories enumerated %v, expected %v", repos, expected)
+	}
+
+	// pushing indexed repositories without the index keeps the index valid
+	makeRepo(env.ctx, t, "foo/c", env.registry)
+	ci := &catalogIndex{driver: env.driver}
+	indexed, err := ci.indexed(env.ctx)
+	if err != nil || !indexed {
+		t.Fatalf("expected the index to stay valid: %v, %v", indexed, err)
+	}
+
+	// repositories pushed without the index invalidate it, and the
+	// repositories are walked until the next rebuild
+	makeRepo(env.ctx, t, "foo/e", env.registry)
+	p = make([]string, 50)
+	numFilled, err = registry.Repositories(env.ctx, p, "foo/d/in")
+	if err != io.EOF || !testEq(p, []string{"foo/e", "foo-bar/a", "foo-bar/b", "test"}, numFilled) || numFilled != 4 {
+		t.Fatalf("unexpected catalog: %v, %v", p[:numFilled], err)
+	}
+
+	if _, err := RebuildCatalog(env.ctx, registry); err != nil {
+		t.Fatalf("unexpected error rebuilding catalog: %v", err)
+	}
+
+	// so are repositories removed without the index
+	named, err = reference.WithName("foo/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.registry.(distribution.RepositoryRemover).Remove(env.ctx, named); err != nil {
+		t.Fatalf("unexpected error removing repository: %v", err)
+	}
+	indexed, err = ci.indexed(env.ctx)
+	if err != nil || indexed {
+		t.Fatalf("expected the index to be invalidated: %v, %v", indexed, err)
+	}
+}
+
 func testEq(a, b []string, size int) bool {
 	for cnt := 0; cnt < size-1; cnt++ {
 		if a[cnt] != b[cnt] {
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+)
+
+// catalogIndex lists the repositories of the registry from an entry written
+// on the first push of each repository, rather than by walking the
+// repositories. The entries are only read once the index is marked as
+// holding all the repositories, which is done by rebuilding it.
+type catalogIndex struct {
+	driver storagedriver.StorageDriver
+}
+
+// add adds the entry of a repository, unless it is already present.
+func (ci *catalogIndex) add(ctx context.Context, name string) error {
+	entryPath, err := pathFor(catalogEntryPathSpec{name: name})
+	if err != nil {
+		return err
+	}
+	if _, err := ci.driver.Stat(ctx, entryPath); err == nil {
+		return nil
+	} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		return err
+	}
+	return ci.driver.PutContent(ctx, entryPath, []byte(name))
+}
+
+// remove removes the entry of a repository.
+func (ci *catalogIndex) remove(ctx context.Context, name string) error {
+	entryPath, err := pathFor(catalogEntryPathSpec{name: name})
+	if err != nil {
+		return err
+	}
+	err = ci.driver.Delete(ctx, entryPath)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// invalidate is called by registries without the index when a repository is
+// pushed or removed. If the index is marked as holding all the repositories
+// but the entry of the repository does not reflect whether it exists, the
+// marker is removed, so that the repositories are walked again until the
+// index is rebuilt.
+func (ci *catalogIndex) invalidate(ctx context.Context, name string, exists bool) error {
+	indexed, err := ci.indexed(ctx)
+	if err != nil || !indexed {
+		return err
+	}
+
+	entryPath, err := pathFor(catalogEntryPathSpec{name: name})
+	if err != nil {
+		return err
+	}
+	_, err = ci.driver.Stat(ctx, entryPath)
+	switch err.(type) {
+	case nil:
+		if exists {
+			return nil
+		}
+	case storagedriver.PathNotFoundError:
+		if !exists {
+			return nil
+		}
+	default:
+		return err
+	}
+
+	dcontext.GetLogger(ctx).Warnf("catalog index is out of date for %s, walking the repositories until it is rebuilt", name)
+	markerPath, err := pathFor(catalogIndexedPathSpec{})
+	if err != nil {
+		return err
+	}
+	err = ci.driver.Delete(ctx, markerPath)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+func (ci *catalogIndex) indexed(ctx context.Context) (bool, error) {
+	markerPath, err := pathFor(catalogIndexedPathSpec{})
+	if err != nil {
+		return false, err
+	}
+	_, err = ci.driver.Stat(ctx, markerPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (ci *catalogIndex) markIndexed(ctx context.Context) error {
+	markerPath, err := pathFor(catalogIndexedPathSpec{})
+	if err != nil {
+		return err
+	}
+	return ci.driver.PutContent(ctx, markerPath, []byte("1"))
+}
+
+// entries returns the names of the repositories of the index, sorted as
+// they are walked.
+func (ci *catalogIndex) entries(ctx context.Context) ([]string, error) {
+	entriesPath, err := pathFor(catalogEntriesPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	entryPaths, err := ci.driver.List(ctx, entriesPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entryPaths))
+	for _, entryPath := range entryPaths {
+		name := strings.ReplaceAll(path.Base(entryPath), catalogEntrySeparator, "/")
+		if _, err := reference.WithName(name); err != nil {
+			dcontext.GetLogger(ctx).Warnf("ignoring invalid catalog entry %s: %v", entryPath, err)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return lessPath(names[i], names[j])
+	})
+	return names, nil
+}
+
+// indexedRepositories returns the names of the repositories of the catalog
+// index, or false if the index is disabled or does not hold all the
+// repositories yet.
+func (reg *registry) indexedRepositories(ctx context.Context) ([]string, bool, error) {
+	if reg.catalogIndex == nil {
+		return nil, false, nil
+	}
+	indexed, err := reg.catalogIndex.indexed(ctx)
+	if err != nil || !indexed {
+		return nil, false, err
+	}
+	names, err := reg.catalogIndex.entries(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return names, true, nil
+}
+
+// RebuildCatalogStats summarizes a rebuild of the catalog index
+type RebuildCatalogStats struct {
+	Repositories int
+	Removed      int
+}
+
+// RebuildCatalog rebuilds the catalog index from a walk of the repositories
+// of the registry, removing the entries of the repositories which no longer
+// exist, and marks it as holding all the repositories so that the catalog
+// and its enumeration are read from it. It can be run while the registry
+// serves requests, although a repository removed during the rebuild may be
+// listed until the next one.
+func RebuildCatalog(ctx context.Context, namespace distribution.Namespace) (RebuildCatalogStats, error) {
+	var stats RebuildCatalogStats
+
+	reg, ok := namespace.(*registry)
+	if !ok {
+		return stats, fmt.Errorf("unable to convert Namespace to registry")
+	}
+	ci := &catalogIndex{driver: reg.driver}
+
+	existing, err := ci.entries(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("failed to read catalog index: %v", err)
+	}
+	stale := make(map[string]struct{}, len(existing))
+	for _, name := range existing {
+		stale[name] = struct{}{}
+	}
+
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return stats, err
+	}
+	err = reg.driver.Walk(ctx, root, func(fileInfo storagedriver.FileInfo) error {
+		return handleRepository(fileInfo, root, "", func(repoName string) error {
+			delete(stale, repoName)
+			if err := ci.add(ctx, repoName); err != nil {
+				return fmt.Errorf("failed to add %s to catalog index: %v", repoName, err)
+			}
+			stats.Repositories++
+			return nil
+		})
+	})
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return stats, err
+		}
+	}
+
+	for name := range stale {
+		// keep the repositories pushed since they were walked
+		manifestsPath, err := pathFor(manifestsPathSpec{name: name})
+		if err != nil {
+			return stats, err
+		}
+		if _, err := reg.driver.Stat(ctx, manifestsPath); err == nil {
+			continue
+		} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return stats, err
+		}
+		dcontext.GetLogger(ctx).Infof("removing %s from catalog index", name)
+		if err := ci.remove(ctx, name); err != nil {
+			return stats, fmt.Errorf("failed to remove %s from catalog index: %v", name, err)
+		}
+		stats.Removed++
+	}
+
+	return stats, ci.markIndexed(ctx)
+}
@@ -265,6 +265,44 @@ func (base *Base) Move(ctx context.Context, sourcePath string, destPath string)
 	return err
 }
 
+// Compose wraps Compose of underlying storage driver, if it implements
+// storagedriver.Composer.
+func (base *Base) Compose(ctx context.Context, destPath string, sourcePaths []string) error {
+	attrs := []attribute.KeyValue{
+		attribute.String(tracing.AttributePrefix+"storage.driver.name", base.Name()),
+		attribute.String(tracing.AttributePrefix+"storage.dest.path", destPath),
+		attribute.Int(tracing.AttributePrefix+"storage.source.count", len(sourcePaths)),
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		"Compose",
+		trace.WithAttributes(attrs...))
+
+	defer span.End()
+
+	ctx, done := dcontext.WithTrace(ctx)
+	defer done("%s.Compose(%q, %d sources)", base.Name(), destPath, len(sourcePaths))
+
+	if !storagedriver.PathRegexp.MatchString(destPath) {
+		return storagedriver.InvalidPathError{Path: destPath, DriverName: base.StorageDriver.Name()}
+	}
+	for _, sourcePath := range sourcePaths {
+		if !storagedriver.PathRegexp.MatchString(sourcePath) {
+			return storagedriver.InvalidPathError{Path: sourcePath, DriverName: base.StorageDriver.Name()}
+		}
+	}
+
+	composer, ok := base.StorageDriver.(storagedriver.Composer)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{DriverName: base.StorageDriver.Name()}
+	}
+
+	start := time.Now()
+	err := base.setDriverName(composer.Compose(ctx, destPath, sourcePaths))
+	storageAction.WithValues(base.Name(), "Compose").UpdateSince(start)
+	return err
+}
+
 // Delete wraps Delete of underlying storage driver.
 func (base *Base) Delete(ctx context.Context, path string) error {
 	attrs := []attribute.KeyValue{
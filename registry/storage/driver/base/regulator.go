@@ -165,6 +165,20 @@ func (r *regulator) Move(ctx context.Context, sourcePath string, destPath string
 	return r.StorageDriver.Move(ctx, sourcePath, destPath)
 }
 
+// Compose stores at destPath the concatenation of the objects stored at
+// sourcePaths, if the underlying driver implements storagedriver.Composer.
+func (r *regulator) Compose(ctx context.Context, destPath string, sourcePaths []string) error {
+	composer, ok := r.StorageDriver.(storagedriver.Composer)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+
+	r.enter()
+	defer r.exit()
+
+	return composer.Compose(ctx, destPath, sourcePaths)
+}
+
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 func (r *regulator) Delete(ctx context.Context, path string) error {
 	r.enter()
@@ -718,6 +718,40 @@ func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) e
 	return nil
 }
 
+// maxComposeSources is the maximum number of source objects of a single
+// GCS compose request.
+const maxComposeSources = 32
+
+// Compose stores at destPath the concatenation of the objects stored at
+// sourcePaths. GCS composes at most maxComposeSources objects at once, so
+// larger sets are composed in batches, each appended to the result of the
+// previous one.
+func (d *driver) Compose(ctx context.Context, destPath string, sourcePaths []string) error {
+	dstKey := d.pathToKey(destPath)
+	dst := d.bucket.Object(dstKey)
+
+	for start := 0; start < len(sourcePaths); {
+		srcs := make([]*storage.ObjectHandle, 0, maxComposeSources)
+		if start > 0 {
+			srcs = append(srcs, dst)
+		}
+		for ; start < len(sourcePaths) && len(srcs) < maxComposeSources; start++ {
+			srcs = append(srcs, d.bucket.Object(d.pathToKey(sourcePaths[start])))
+		}
+
+		composer := dst.ComposerFrom(srcs...)
+		composer.ContentType = blobContentType
+		if _, err := composer.Run(ctx); err != nil {
+			var status *googleapi.Error
+			if errors.As(err, &status) && status.Code == http.StatusNotFound {
+				return storagedriver.PathNotFoundError{Path: destPath}
+			}
+			return fmt.Errorf("compose %q: %v", dstKey, err)
+		}
+	}
+	return nil
+}
+
 // listAll recursively lists all names of objects stored at "prefix" and its subpaths.
 func (d *driver) listAll(ctx context.Context, prefix string) ([]string, error) {
 	objects := d.bucket.Objects(ctx, &storage.Query{
@@ -18,3 +18,7 @@ func TestInMemoryDriverSuite(t *testing.T) {
 func BenchmarkInMemoryDriverSuite(b *testing.B) {
 	testsuites.BenchDriver(b, newDriverConstructor)
 }
+
+func TestInMemoryDriverFaultsSuite(t *testing.T) {
+	testsuites.Faults(t, newDriverConstructor, nil)
+}
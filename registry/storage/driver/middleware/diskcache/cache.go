@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"container/list"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// cache is a size bounded cache of blob data on the local filesystem.
+// Entries are named after the digest of their content, which is verified
+// before an entry is added, and are evicted in least recently used order.
+type cache struct {
+	root    string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[digest.Digest]*list.Element
+	lru     *list.List // of *entry, most recently used first
+	filling map[digest.Digest]struct{}
+
+	// generation is incremented each time entries are invalidated, so that
+	// fills started before an invalidation are not added to the cache.
+	generation uint64
+}
+
+type entry struct {
+	dgst digest.Digest
+	size int64
+}
+
+// newCache returns a cache stored under root, indexing the entries left by
+// a previous instance.
+func newCache(root string, maxSize int64) (*cache, error) {
+	c := &cache{
+		root:    root,
+		maxSize: maxSize,
+		entries: make(map[digest.Digest]*list.Element),
+		lru:     list.New(),
+		filling: make(map[digest.Digest]struct{}),
+	}
+
+	// Fills interrupted by a restart cannot be resumed.
+	if err := os.RemoveAll(c.tmpDir()); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{c.tmpDir(), c.dataDir()} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	type existing struct {
+		entry
+		modTime time.Time
+	}
+	var found []existing
+	err := filepath.WalkDir(c.dataDir(), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(c.dataDir(), p)
+		if err != nil {
+			return err
+		}
+		alg, hex := filepath.Split(rel)
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Clean(alg)), hex)
+		if dgst.Validate() != nil {
+			return os.Remove(p)
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		found = append(found, existing{entry: entry{dgst: dgst, size: fi.Size()}, modTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to index cache directory %s: %v", root, err)
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.Before(found[j].modTime) })
+	for _, e := range found {
+		c.insert(e.entry)
+	}
+	return c, nil
+}
+
+func (c *cache) dataDir() string {
+	return filepath.Join(c.root, "data")
+}
+
+func (c *cache) tmpDir() string {
+	return filepath.Join(c.root, "tmp")
+}
+
+func (c *cache) path(dgst digest.Digest) string {
+	return filepath.Join(c.dataDir(), dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// open returns the cached content of the blob, or nil if it is not cached.
+func (c *cache) open(dgst digest.Digest) *os.File {
+	c.mu.Lock()
+	el, ok := c.entries[dgst]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	f, err := os.Open(c.path(dgst))
+	if err != nil {
+		// The entry was evicted meanwhile, or removed from the disk.
+		c.mu.Lock()
+		if current, ok := c.entries[dgst]; ok && current == el && os.IsNotExist(err) {
+			c.remove(el)
+		}
+		c.mu.Unlock()
+		return nil
+	}
+	return f
+}
+
+// fill returns a filler adding the blob to the cache, or nil if the blob is
+// already cached or being added.
+func (c *cache) fill(dgst digest.Digest) (*filler, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[dgst]; ok {
+		return nil, nil
+	}
+	if _, ok := c.filling[dgst]; ok {
+		return nil, nil
+	}
+
+	f, err := os.CreateTemp(c.tmpDir(), "fill-")
+	if err != nil {
+		return nil, err
+	}
+	c.filling[dgst] = struct{}{}
+	return &filler{
+		cache:      c,
+		dgst:       dgst,
+		file:       f,
+		verifier:   dgst.Verifier(),
+		generation: c.generation,
+	}, nil
+}
+
+// insert adds an entry, evicting the least recently used entries until the
+// cache fits in its maximum size. c.mu must be held or the cache not shared.
+func (c *cache) insert(e entry) {
+	if el, ok := c.entries[e.dgst]; ok {
+		c.remove(el)
+	}
+	c.entries[e.dgst] = c.lru.PushFront(&e)
+	c.size += e.size
+
+	for c.size > c.maxSize {
+		c.evict(c.lru.Back())
+	}
+}
+
+func (c *cache) evict(el *list.Element) {
+	os.Remove(c.path(el.Value.(*entry).dgst))
+	c.remove(el)
+}
+
+func (c *cache) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	c.lru.Remove(el)
+	delete(c.entries, e.dgst)
+	c.size -= e.size
+}
+
+// invalidate evicts the entries for which match returns true.
+func (c *cache) invalidate(match func(digest.Digest) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for dgst, el := range c.entries {
+		if match(dgst) {
+			c.evict(el)
+		}
+	}
+}
+
+// filler writes the content of a blob to a temporary file, and adds it to
+// the cache once the whole content has been written and verified.
+type filler struct {
+	cache      *cache
+	dgst       digest.Digest
+	file       *os.File
+	verifier   digest.Verifier
+	written    int64
+	generation uint64
+}
+
+func (f *filler) Write(p []byte) (int, error) {
+	if f.written+int64(len(p)) > f.cache.maxSize {
+		return 0, fmt.Errorf("blob %s is larger than the cache", f.dgst)
+	}
+	n, err := f.file.Write(p)
+	f.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return f.verifier.Write(p[:n])
+}
+
+// commit adds the written content to the cache.
+func (f *filler) commit() error {
+	defer f.done()
+
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if !f.verifier.Verified() {
+		return fmt.Errorf("content of blob %s does not match its digest", f.dgst)
+	}
+
+	dest := f.cache.path(f.dgst)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+	if f.generation != f.cache.generation {
+		return nil
+	}
+	if err := os.Rename(f.file.Name(), dest); err != nil {
+		return err
+	}
+	f.cache.insert(entry{dgst: f.dgst, size: f.written})
+	return nil
+}
+
+// abort discards the written content.
+func (f *filler) abort() {
+	f.file.Close()
+	f.done()
+}
+
+func (f *filler) done() {
+	os.Remove(f.file.Name())
+
+	f.cache.mu.Lock()
+	delete(f.cache.filling, f.dgst)
+	f.cache.mu.Unlock()
+}
@@ -0,0 +1,250 @@
+// Package middleware provides a storage middleware caching blob data on the
+// local filesystem.
+//
+// Blob data is immutable and addressed by its digest, so it can be served
+// from a local copy instead of the underlying driver once it has been read.
+// The content of a blob is added to the cache when it is read in full, after
+// its digest has been verified. The cache is bounded in size and evicts the
+// least recently used blobs. Any other path, such as links and uploads, is
+// passed through to the underlying driver.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultMaxSize is the default maximum size of the cache.
+const defaultMaxSize = 10 << 30
+
+// blobsPrefix is the path under which blobs are stored by the registry.
+const blobsPrefix = "/docker/registry/v2/blobs"
+
+// blobDataRegexp matches the data path of a blob and captures the algorithm,
+// the first two characters of the encoded digest and the encoded digest.
+var blobDataRegexp = regexp.MustCompile(`^` + blobsPrefix + `/([a-z0-9]+)/([a-f0-9]{2})/([a-f0-9]+)/data$`)
+
+func init() {
+	if err := storagemiddleware.Register("diskcache", newDiskCacheStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register diskcache storage middleware: %v", err)
+	}
+}
+
+type diskCacheStorageMiddleware struct {
+	storagedriver.StorageDriver
+	cache *cache
+}
+
+var _ storagedriver.StorageDriver = &diskCacheStorageMiddleware{}
+
+func newDiskCacheStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	root, ok := options["rootdirectory"].(string)
+	if !ok || root == "" {
+		return nil, fmt.Errorf("no rootdirectory provided")
+	}
+
+	maxSize := int64(defaultMaxSize)
+	switch v := options["maxsize"].(type) {
+	case nil:
+	case string:
+		s, err := strconv.ParseInt(v, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("maxsize must be an integer, %v invalid", v)
+		}
+		maxSize = s
+	case int, uint, int32, uint32, int64, uint64:
+		maxSize = reflect.ValueOf(v).Convert(reflect.TypeOf(maxSize)).Int()
+	default:
+		return nil, fmt.Errorf("invalid value for maxsize: %#v", v)
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("maxsize must be positive")
+	}
+
+	c, err := newCache(root, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &diskCacheStorageMiddleware{StorageDriver: sd, cache: c}, nil
+}
+
+// blobDigest returns the digest of the blob whose data is stored at path.
+func blobDigest(path string) (digest.Digest, bool) {
+	m := blobDataRegexp.FindStringSubmatch(path)
+	if m == nil || !strings.HasPrefix(m[3], m[2]) {
+		return "", false
+	}
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(m[1]), m[3])
+	if dgst.Validate() != nil {
+		return "", false
+	}
+	return dgst, true
+}
+
+// GetContent retrieves the content of blobs from the cache, adding them to
+// the cache on a miss.
+func (d *diskCacheStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	dgst, ok := blobDigest(path)
+	if !ok {
+		return d.StorageDriver.GetContent(ctx, path)
+	}
+
+	if f := d.cache.open(dgst); f != nil {
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+
+	content, err := d.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if fl := d.fill(ctx, dgst); fl != nil {
+		if _, err := fl.Write(content); err != nil {
+			fl.abort()
+		} else if err := fl.commit(); err != nil {
+			dcontext.GetLogger(ctx).WithError(err).Warnf("unable to cache blob %s", dgst)
+		}
+	}
+	return content, nil
+}
+
+// Reader serves blobs from the cache. On a miss, the blob is added to the
+// cache as it is read from the start to the end.
+func (d *diskCacheStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	dgst, ok := blobDigest(path)
+	if !ok {
+		return d.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	if f := d.cache.open(dgst); f != nil {
+		pos, err := f.Seek(offset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if pos > fi.Size() {
+			f.Close()
+			return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: d.Name()}
+		}
+		return f, nil
+	}
+
+	rc, err := d.StorageDriver.Reader(ctx, path, offset)
+	if err != nil || offset != 0 {
+		return rc, err
+	}
+	fl := d.fill(ctx, dgst)
+	if fl == nil {
+		return rc, nil
+	}
+	return &fillReader{ctx: ctx, ReadCloser: rc, filler: fl}, nil
+}
+
+// fill starts adding a blob to the cache, logging failures as the content
+// can still be served from the underlying driver.
+func (d *diskCacheStorageMiddleware) fill(ctx context.Context, dgst digest.Digest) *filler {
+	fl, err := d.cache.fill(dgst)
+	if err != nil {
+		dcontext.GetLogger(ctx).WithError(err).Warnf("unable to cache blob %s", dgst)
+		return nil
+	}
+	return fl
+}
+
+func (d *diskCacheStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	d.invalidate(path)
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+func (d *diskCacheStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	d.invalidate(path)
+	return d.StorageDriver.Writer(ctx, path, append)
+}
+
+func (d *diskCacheStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	d.invalidate(sourcePath)
+	d.invalidate(destPath)
+	return d.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+func (d *diskCacheStorageMiddleware) Delete(ctx context.Context, path string) error {
+	d.invalidate(path)
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+// invalidate evicts the cached blobs stored at or under path.
+func (d *diskCacheStorageMiddleware) invalidate(path string) {
+	if dgst, ok := blobDigest(path); ok {
+		d.cache.invalidate(func(cached digest.Digest) bool { return cached == dgst })
+		return
+	}
+	if path != "/" && path != blobsPrefix && !strings.HasPrefix(blobsPrefix, path+"/") && !strings.HasPrefix(path, blobsPrefix+"/") {
+		return
+	}
+	d.cache.invalidate(func(cached digest.Digest) bool {
+		p := blobsPrefix + "/" + cached.Algorithm().String() + "/" + cached.Encoded()[:2] + "/" + cached.Encoded() + "/data"
+		return path == "/" || strings.HasPrefix(p, path+"/")
+	})
+}
+
+// fillReader adds the content read from the underlying driver to the cache
+// once it has been read in full. As readers are not always read until EOF,
+// the content is also added on close if it matches the digest of the blob.
+type fillReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	filler *filler
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.filler == nil {
+		return n, err
+	}
+	if n > 0 {
+		if _, werr := r.filler.Write(p[:n]); werr != nil {
+			r.filler.abort()
+			r.filler = nil
+			return n, err
+		}
+	}
+	if err == io.EOF {
+		r.commit()
+	}
+	return n, err
+}
+
+func (r *fillReader) commit() {
+	if err := r.filler.commit(); err != nil {
+		dcontext.GetLogger(r.ctx).WithError(err).Warnf("unable to cache blob %s", r.filler.dgst)
+	}
+	r.filler = nil
+}
+
+func (r *fillReader) Close() error {
+	if r.filler != nil {
+		if r.filler.verifier.Verified() {
+			r.commit()
+		} else {
+			r.filler.abort()
+			r.filler = nil
+		}
+	}
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,227 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+// countingDriver counts the content reads made to the underlying driver.
+type countingDriver struct {
+	storagedriver.StorageDriver
+	reads atomic.Int64
+}
+
+func (d *countingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	d.reads.Add(1)
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *countingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.reads.Add(1)
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func newTestMiddleware(t *testing.T, root string, maxSize int) (*diskCacheStorageMiddleware, *countingDriver) {
+	backend := &countingDriver{StorageDriver: inmemory.New()}
+	d, err := newDiskCacheStorageMiddleware(context.Background(), backend, map[string]interface{}{
+		"rootdirectory": root,
+		"maxsize":       maxSize,
+	})
+	require.NoError(t, err)
+	return d.(*diskCacheStorageMiddleware), backend
+}
+
+func blobPath(dgst digest.Digest) string {
+	return fmt.Sprintf("%s/%s/%s/%s/data", blobsPrefix, dgst.Algorithm(), dgst.Encoded()[:2], dgst.Encoded())
+}
+
+func putBlob(t *testing.T, d storagedriver.StorageDriver, content string) (digest.Digest, string) {
+	dgst := digest.FromString(content)
+	p := blobPath(dgst)
+	require.NoError(t, d.PutContent(context.Background(), p, []byte(content)))
+	return dgst, p
+}
+
+func readAll(t *testing.T, d storagedriver.StorageDriver, path string, offset int64) string {
+	rc, err := d.Reader(context.Background(), path, offset)
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestDiskCacheFaultsSuite(t *testing.T) {
+	testsuites.Faults(t, func() (storagedriver.StorageDriver, error) {
+		return inmemory.New(), nil
+	}, func(sd storagedriver.StorageDriver) (storagedriver.StorageDriver, error) {
+		return newDiskCacheStorageMiddleware(context.Background(), sd, map[string]interface{}{"rootdirectory": t.TempDir()})
+	})
+}
+
+func TestOptions(t *testing.T) {
+	_, err := newDiskCacheStorageMiddleware(context.Background(), inmemory.New(), map[string]interface{}{})
+	require.ErrorContains(t, err, "no rootdirectory provided")
+
+	_, err = newDiskCacheStorageMiddleware(context.Background(), inmemory.New(), map[string]interface{}{
+		"rootdirectory": t.TempDir(),
+		"maxsize":       "lots",
+	})
+	require.ErrorContains(t, err, "maxsize must be an integer")
+
+	_, err = newDiskCacheStorageMiddleware(context.Background(), inmemory.New(), map[string]interface{}{
+		"rootdirectory": t.TempDir(),
+		"maxsize":       0,
+	})
+	require.ErrorContains(t, err, "maxsize must be positive")
+}
+
+func TestBlobDigest(t *testing.T) {
+	dgst := digest.FromString("content")
+	for p, expected := range map[string]bool{
+		blobPath(dgst): true,
+		strings.TrimSuffix(blobPath(dgst), "/data"):                                       false,
+		blobsPrefix + "/sha256/00/" + dgst.Encoded() + "/data":                            false,
+		blobsPrefix + "/sha256/ab/abcd/data":                                              false,
+		"/docker/registry/v2/repositories/foo/_layers/sha256/" + dgst.Encoded() + "/link": false,
+		"/docker/registry/v2/repositories/foo/_uploads/" + dgst.Encoded() + "/data":       false,
+	} {
+		_, ok := blobDigest(p)
+		require.Equal(t, expected, ok, p)
+	}
+}
+
+func TestReadThrough(t *testing.T) {
+	ctx := context.Background()
+	d, backend := newTestMiddleware(t, t.TempDir(), 1<<20)
+
+	_, p := putBlob(t, d, "layer content")
+
+	// Reads at an offset are not cached.
+	require.Equal(t, "content", readAll(t, d, p, 6))
+	require.Equal(t, "content", readAll(t, d, p, 6))
+	require.Equal(t, int64(2), backend.reads.Load())
+
+	// A partial read from the start is not cached either.
+	rc, err := d.Reader(ctx, p, 0)
+	require.NoError(t, err)
+	_, err = rc.Read(make([]byte, 5))
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, int64(3), backend.reads.Load())
+
+	// A full read fills the cache, which then serves all the reads.
+	require.Equal(t, "layer content", readAll(t, d, p, 0))
+	require.Equal(t, int64(4), backend.reads.Load())
+	require.Equal(t, "layer content", readAll(t, d, p, 0))
+	require.Equal(t, "content", readAll(t, d, p, 6))
+	require.Equal(t, "", readAll(t, d, p, 13))
+	content, err := d.GetContent(ctx, p)
+	require.NoError(t, err)
+	require.Equal(t, "layer content", string(content))
+	require.Equal(t, int64(4), backend.reads.Load())
+
+	_, err = d.Reader(ctx, p, 14)
+	require.IsType(t, storagedriver.InvalidOffsetError{}, err)
+
+	// Links are always read from the underlying driver.
+	link := "/docker/registry/v2/repositories/foo/_layers/sha256/abcd/link"
+	require.NoError(t, d.PutContent(ctx, link, []byte("sha256:abcd")))
+	for i := 0; i < 2; i++ {
+		_, err := d.GetContent(ctx, link)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(6), backend.reads.Load())
+}
+
+func TestCorruptedContentNotCached(t *testing.T) {
+	ctx := context.Background()
+	d, backend := newTestMiddleware(t, t.TempDir(), 1<<20)
+
+	p := blobPath(digest.FromString("expected content"))
+	require.NoError(t, d.PutContent(ctx, p, []byte("other content")))
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, "other content", readAll(t, d, p, 0))
+	}
+	require.Equal(t, int64(2), backend.reads.Load())
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	d, backend := newTestMiddleware(t, root, 30)
+
+	_, first := putBlob(t, d, "first blob content")
+	_, second := putBlob(t, d, "second blob")
+	_, third := putBlob(t, d, "third blob")
+	_, large := putBlob(t, d, "a blob larger than the whole cache")
+
+	readAll(t, d, first, 0)
+	readAll(t, d, second, 0)
+	require.Equal(t, int64(29), d.cache.size)
+
+	// Reading the third blob evicts the least recently used one.
+	readAll(t, d, third, 0)
+	require.Equal(t, int64(21), d.cache.size)
+	backend.reads.Store(0)
+	readAll(t, d, second, 0)
+	readAll(t, d, third, 0)
+	require.Equal(t, int64(0), backend.reads.Load())
+	readAll(t, d, first, 0)
+	require.Equal(t, int64(1), backend.reads.Load())
+
+	// Blobs larger than the cache are never cached.
+	for i := 0; i < 2; i++ {
+		content, err := d.GetContent(ctx, large)
+		require.NoError(t, err)
+		require.Equal(t, "a blob larger than the whole cache", string(content))
+	}
+	require.Equal(t, int64(3), backend.reads.Load())
+
+	// The cache is indexed again on restart.
+	restarted, backend := newTestMiddleware(t, root, 30)
+	require.Equal(t, d.cache.size, restarted.cache.size)
+	require.Len(t, restarted.cache.entries, len(d.cache.entries))
+}
+
+func TestInvalidation(t *testing.T) {
+	ctx := context.Background()
+	d, backend := newTestMiddleware(t, t.TempDir(), 1<<20)
+
+	dgst, p := putBlob(t, d, "deleted content")
+	readAll(t, d, p, 0)
+	require.Contains(t, d.cache.entries, dgst)
+
+	// Deleting the blob directory evicts its data.
+	require.NoError(t, d.Delete(ctx, strings.TrimSuffix(p, "/data")))
+	require.NotContains(t, d.cache.entries, dgst)
+	_, err := d.Reader(ctx, p, 0)
+	require.IsType(t, storagedriver.PathNotFoundError{}, err)
+
+	// Moving an upload to the blob path evicts the previous data.
+	dgst, p = putBlob(t, d, "moved content")
+	readAll(t, d, p, 0)
+	upload := "/docker/registry/v2/repositories/foo/_uploads/id/data"
+	require.NoError(t, d.PutContent(ctx, upload, []byte("moved content")))
+	require.NoError(t, d.Move(ctx, upload, p))
+	require.NotContains(t, d.cache.entries, dgst)
+
+	backend.reads.Store(0)
+	require.Equal(t, "moved content", readAll(t, d, p, 0))
+	require.Equal(t, int64(1), backend.reads.Load())
+
+	// Deleting a parent directory evicts everything under it.
+	require.NoError(t, d.Delete(ctx, "/docker"))
+	require.Empty(t, d.cache.entries)
+}
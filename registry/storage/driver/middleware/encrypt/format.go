@@ -0,0 +1,284 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted files are made of a fixed size header followed by chunks of
+// plaintext sealed with AES-256-GCM, using a data key unique to the file:
+//
+//	magic (4) | version (1) | key ID length (1) | key ID (32, zero padded) |
+//	nonce prefix (7) | data key nonce (12) | wrapped data key (48) |
+//	sealed chunk 0 | sealed chunk 1 | ... | sealed final chunk
+//
+// The data key is wrapped with the keyring key identified in the header. Each
+// chunk holds chunkSize bytes of plaintext, except the final chunk which
+// holds less. The nonce of a chunk is made of the nonce prefix, the index of
+// the chunk and a flag set for the final chunk, so that chunks cannot be
+// reordered and the content cannot be truncated without failing decryption.
+// As chunks have a fixed size, the chunk holding any plaintext offset is
+// found without reading the preceding chunks.
+//
+// Files written by a FileWriter which has not been committed yet have no
+// final chunk: the plaintext which does not fill a chunk is kept sealed in a
+// sidecar file until more content is appended or the writer is committed.
+const (
+	chunkSize       = 64 << 10
+	tagSize         = 16
+	sealedChunkSize = chunkSize + tagSize
+
+	formatVersion   = 1
+	noncePrefixSize = 7
+	nonceSize       = 12
+	wrappedKeySize  = keySize + tagSize
+
+	magicSize     = 4
+	headerAADSize = magicSize + 1 + 1 + maxKeyIDLength + noncePrefixSize
+	headerSize    = headerAADSize + nonceSize + wrappedKeySize
+
+	// sidecarSuffix is appended to the path of a file to name its sidecar.
+	sidecarSuffix = ".encpartial"
+
+	finalChunkFlag = 1
+)
+
+var magic = [magicSize]byte{'D', 'E', 'N', 'C'}
+
+var errCorrupted = errors.New("encrypted content is corrupted")
+
+// header is the header of an encrypted file.
+type header struct {
+	keyID       string
+	noncePrefix [noncePrefixSize]byte
+	keyNonce    [nonceSize]byte
+	wrappedKey  [wrappedKeySize]byte
+}
+
+// newHeader generates a data key, wraps it with the primary key of the
+// keyring and returns the header and the cipher of the new file.
+func newHeader(kr *keyring) (*header, cipher.AEAD, error) {
+	keyID, kek, err := kr.primaryKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := &header{keyID: keyID}
+	dataKey := make([]byte, keySize)
+	for _, b := range [][]byte{dataKey, h.noncePrefix[:], h.keyNonce[:]} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("could not generate data key: %v", err)
+		}
+	}
+
+	wrap, err := newAEAD(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(h.wrappedKey[:], wrap.Seal(nil, h.keyNonce[:], dataKey, h.aad()))
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, aead, nil
+}
+
+// parseHeader parses the header at the start of p.
+func parseHeader(p []byte) (*header, error) {
+	if len(p) < headerSize || !bytes.Equal(p[:len(magic)], magic[:]) {
+		return nil, errCorrupted
+	}
+	p = p[len(magic):]
+	if p[0] != formatVersion {
+		return nil, fmt.Errorf("unsupported encryption format version %d", p[0])
+	}
+	idLength := int(p[1])
+	if idLength == 0 || idLength > maxKeyIDLength {
+		return nil, errCorrupted
+	}
+	p = p[2:]
+
+	h := &header{keyID: string(p[:idLength])}
+	p = p[maxKeyIDLength:]
+	p = p[copy(h.noncePrefix[:], p):]
+	p = p[copy(h.keyNonce[:], p):]
+	copy(h.wrappedKey[:], p)
+	return h, nil
+}
+
+// aad returns the header fields authenticated along with the data key.
+func (h *header) aad() []byte {
+	aad := make([]byte, 0, headerAADSize)
+	aad = append(aad, magic[:]...)
+	aad = append(aad, formatVersion, byte(len(h.keyID)))
+	aad = append(aad, h.keyID...)
+	aad = append(aad, make([]byte, maxKeyIDLength-len(h.keyID))...)
+	return append(aad, h.noncePrefix[:]...)
+}
+
+func (h *header) marshal() []byte {
+	p := make([]byte, 0, headerSize)
+	p = append(p, h.aad()...)
+	p = append(p, h.keyNonce[:]...)
+	return append(p, h.wrappedKey[:]...)
+}
+
+// open unwraps the data key of the file and returns its cipher.
+func (h *header) open(kr *keyring) (cipher.AEAD, error) {
+	kek, err := kr.key(h.keyID)
+	if err != nil {
+		return nil, err
+	}
+	wrap, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := wrap.Open(nil, h.keyNonce[:], h.wrappedKey[:], h.aad())
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key with key %q: %v", h.keyID, err)
+	}
+	return newAEAD(dataKey)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix [noncePrefixSize]byte, index uint32, final bool) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, prefix[:])
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if final {
+		nonce[nonceSize-1] = finalChunkFlag
+	}
+	return nonce
+}
+
+func sealChunk(aead cipher.AEAD, h *header, index uint32, final bool, dst, plaintext []byte) []byte {
+	return aead.Seal(dst, chunkNonce(h.noncePrefix, index, final), plaintext, nil)
+}
+
+func openChunk(aead cipher.AEAD, h *header, index uint32, final bool, sealed []byte) ([]byte, error) {
+	plaintext, err := aead.Open(nil, chunkNonce(h.noncePrefix, index, final), sealed, nil)
+	if err != nil {
+		return nil, errCorrupted
+	}
+	return plaintext, nil
+}
+
+// sealSidecar seals the plaintext of the sidecar of a file. As the sidecar
+// is rewritten each time the writer of the file is closed, it is sealed with
+// a random nonce rather than a chunk nonce.
+func sealSidecar(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(sidecarSuffix)), nil
+}
+
+func openSidecar(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < nonceSize {
+		return nil, errCorrupted
+	}
+	plaintext, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(sidecarSuffix))
+	if err != nil {
+		return nil, errCorrupted
+	}
+	return plaintext, nil
+}
+
+// layout describes the chunks of an encrypted file of the given size.
+type layout struct {
+	// chunks is the number of sealed chunks in the file.
+	chunks int64
+
+	// committed is set when the file ends with a final chunk.
+	committed bool
+
+	// finalSize is the size of the sealed final chunk.
+	finalSize int64
+}
+
+func newLayout(size int64) (layout, error) {
+	if size < headerSize {
+		return layout{}, errCorrupted
+	}
+	body := size - headerSize
+	l := layout{
+		chunks:    body / sealedChunkSize,
+		finalSize: body % sealedChunkSize,
+	}
+	if l.finalSize > 0 {
+		if l.finalSize < tagSize {
+			return layout{}, errCorrupted
+		}
+		l.chunks++
+		l.committed = true
+	}
+	return l, nil
+}
+
+// plaintextSize returns the size of the plaintext of an encrypted file of the
+// given size. The content of the sidecar of uncommitted files is not
+// accounted for.
+func plaintextSize(size int64) int64 {
+	if size < headerSize {
+		return 0
+	}
+	body := size - headerSize
+	chunks := (body + sealedChunkSize - 1) / sealedChunkSize
+	return body - chunks*tagSize
+}
+
+// encrypt returns the encrypted content of a file holding plaintext.
+func encrypt(kr *keyring, plaintext []byte) ([]byte, error) {
+	h, aead, err := newHeader(kr)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := len(plaintext)/chunkSize + 1
+	p := make([]byte, 0, headerSize+len(plaintext)+chunks*tagSize)
+	p = append(p, h.marshal()...)
+	for index := 0; index < chunks; index++ {
+		chunk := plaintext[index*chunkSize:]
+		final := index == chunks-1
+		if !final {
+			chunk = chunk[:chunkSize]
+		}
+		p = sealChunk(aead, h, uint32(index), final, p, chunk)
+	}
+	return p, nil
+}
+
+// readHeader reads and opens the header of an encrypted file.
+func readHeader(r io.Reader, kr *keyring) (*header, cipher.AEAD, error) {
+	p := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, p); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, errCorrupted
+		}
+		return nil, nil, err
+	}
+	h, err := parseHeader(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := h.open(kr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, aead, nil
+}
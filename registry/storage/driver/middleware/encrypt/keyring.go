@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// keySize is the size of the keys of the keyring and of the data keys,
+	// selecting AES-256.
+	keySize = 32
+
+	// maxKeyIDLength is the maximum length of the ID of a key, which is
+	// stored in the header of encrypted files.
+	maxKeyIDLength = 32
+)
+
+// keyringFile is the format of the keyring file.
+type keyringFile struct {
+	// Primary is the ID of the key used to encrypt new files.
+	Primary string `yaml:"primary"`
+
+	// Keys maps key IDs to base64 encoded 256-bit keys. Keys which are not
+	// the primary key anymore must be kept as long as files encrypted with
+	// them remain.
+	Keys map[string]string `yaml:"keys"`
+}
+
+// keyring holds the key encryption keys, loaded from a file which is
+// reloaded when it changes so that keys can be rotated without restarting
+// the registry.
+type keyring struct {
+	path    string
+	refresh time.Duration
+
+	mu      sync.RWMutex
+	primary string
+	keys    map[string][]byte
+	modTime time.Time
+	checked time.Time
+}
+
+func newKeyring(path string, refresh time.Duration) (*keyring, error) {
+	kr := &keyring{path: path, refresh: refresh}
+	if err := kr.load(); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// load reads the keyring file. The current keys are kept if the file is
+// invalid.
+func (kr *keyring) load() error {
+	fi, err := os.Stat(kr.path)
+	if err != nil {
+		return fmt.Errorf("could not read keyring: %v", err)
+	}
+	p, err := os.ReadFile(kr.path)
+	if err != nil {
+		return fmt.Errorf("could not read keyring: %v", err)
+	}
+
+	var kf keyringFile
+	if err := yaml.Unmarshal(p, &kf); err != nil {
+		return fmt.Errorf("could not parse keyring %s: %v", kr.path, err)
+	}
+	keys := make(map[string][]byte, len(kf.Keys))
+	for id, encoded := range kf.Keys {
+		if id == "" || len(id) > maxKeyIDLength {
+			return fmt.Errorf("keyring %s: key IDs must be between 1 and %d bytes long: %q", kr.path, maxKeyIDLength, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("keyring %s: key %q is not base64 encoded: %v", kr.path, id, err)
+		}
+		if len(key) != keySize {
+			return fmt.Errorf("keyring %s: key %q must be %d bytes long", kr.path, id, keySize)
+		}
+		keys[id] = key
+	}
+	if _, ok := keys[kf.Primary]; !ok {
+		return fmt.Errorf("keyring %s: primary key %q is not in the keyring", kr.path, kf.Primary)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.primary = kf.Primary
+	kr.keys = keys
+	kr.modTime = fi.ModTime()
+	kr.checked = time.Now()
+	return nil
+}
+
+// maybeReload reloads the keyring file if it was modified, checking at most
+// once per refresh interval unless force is set.
+func (kr *keyring) maybeReload(force bool) error {
+	kr.mu.RLock()
+	due := force || (kr.refresh > 0 && time.Since(kr.checked) >= kr.refresh)
+	modTime := kr.modTime
+	kr.mu.RUnlock()
+	if !due {
+		return nil
+	}
+
+	fi, err := os.Stat(kr.path)
+	if err != nil {
+		return fmt.Errorf("could not read keyring: %v", err)
+	}
+	if fi.ModTime().Equal(modTime) {
+		kr.mu.Lock()
+		kr.checked = time.Now()
+		kr.mu.Unlock()
+		return nil
+	}
+	return kr.load()
+}
+
+// primaryKey returns the key with which new data keys are wrapped.
+func (kr *keyring) primaryKey() (string, []byte, error) {
+	if err := kr.maybeReload(false); err != nil {
+		return "", nil, err
+	}
+
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.primary, kr.keys[kr.primary], nil
+}
+
+// key returns the key with the given ID. The keyring is reloaded when the
+// key is unknown, in case it was added since the last reload.
+func (kr *keyring) key(id string) ([]byte, error) {
+	if err := kr.maybeReload(false); err != nil {
+		return nil, err
+	}
+
+	kr.mu.RLock()
+	key, ok := kr.keys[id]
+	kr.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if err := kr.maybeReload(true); err != nil {
+		return nil, err
+	}
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if key, ok := kr.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key %q is not in the keyring", id)
+}
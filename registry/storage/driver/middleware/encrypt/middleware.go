@@ -0,0 +1,430 @@
+// Package middleware provides a storage middleware encrypting content at rest.
+//
+// Content is encrypted with a data key unique to each file, itself wrapped
+// with a key of a local keyring. The keyring is a YAML file listing base64
+// encoded 256-bit keys and the ID of the primary key, used to wrap the data
+// keys of new files:
+//
+//	primary: 2024-06
+//	keys:
+//	  2024-01: <base64 encoded key>
+//	  2024-06: <base64 encoded key>
+//
+// Keys are rotated by adding a new key and making it the primary key. The
+// keyring is reloaded when the file changes. Previous keys must be kept as
+// long as files encrypted with them remain.
+//
+// As the content stored by the underlying driver cannot be read by clients,
+// RedirectURL is disabled for encrypted paths.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRefresh is the default interval at which the keyring file is
+// checked for changes.
+const defaultRefresh = time.Minute
+
+func init() {
+	if err := storagemiddleware.Register("encrypt", newEncryptStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register encrypt storage middleware: %v", err)
+	}
+}
+
+type encryptStorageMiddleware struct {
+	storagedriver.StorageDriver
+	keyring *keyring
+	paths   []string
+}
+
+var _ storagedriver.StorageDriver = &encryptStorageMiddleware{}
+
+func newEncryptStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	keyringPath, ok := options["keyring"].(string)
+	if !ok || keyringPath == "" {
+		return nil, fmt.Errorf("no keyring provided")
+	}
+
+	refresh := defaultRefresh
+	if o, ok := options["refresh"]; ok {
+		s, ok := o.(string)
+		if !ok {
+			return nil, fmt.Errorf("refresh must be a duration")
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse refresh: %v", err)
+		}
+		refresh = d
+	}
+
+	paths := []string{"/"}
+	if o, ok := options["paths"]; ok {
+		list, ok := o.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("paths must be a list of paths")
+		}
+		paths = paths[:0]
+		for _, item := range list {
+			p, ok := item.(string)
+			if !ok || !storagedriver.PathRegexp.MatchString(p) {
+				return nil, fmt.Errorf("paths must be a list of absolute paths: %v", item)
+			}
+			paths = append(paths, path.Clean(p))
+		}
+	}
+
+	kr, err := newKeyring(keyringPath, refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptStorageMiddleware{StorageDriver: sd, keyring: kr, paths: paths}, nil
+}
+
+// encrypted returns whether the content at path is encrypted.
+func (d *encryptStorageMiddleware) encrypted(p string) bool {
+	for _, prefix := range d.paths {
+		if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isSidecar returns whether the path is the sidecar of an encrypted file.
+func (d *encryptStorageMiddleware) isSidecar(p string) bool {
+	return strings.HasSuffix(p, sidecarSuffix) && d.encrypted(p)
+}
+
+func (d *encryptStorageMiddleware) corrupted(p string, err error) error {
+	return storagedriver.Error{
+		DriverName: d.Name(),
+		Detail:     fmt.Errorf("%s: %v", p, err),
+	}
+}
+
+func (d *encryptStorageMiddleware) GetContent(ctx context.Context, p string) ([]byte, error) {
+	content, err := d.StorageDriver.GetContent(ctx, p)
+	if err != nil || !d.encrypted(p) || len(content) == 0 {
+		return content, err
+	}
+
+	r, err := d.newReader(ctx, p, io.NopCloser(bytes.NewReader(content)), int64(len(content)), 0)
+	if err != nil {
+		return nil, d.corrupted(p, err)
+	}
+	defer r.Close()
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, d.corrupted(p, err)
+	}
+	return plaintext, nil
+}
+
+func (d *encryptStorageMiddleware) PutContent(ctx context.Context, p string, content []byte) error {
+	if !d.encrypted(p) {
+		return d.StorageDriver.PutContent(ctx, p, content)
+	}
+
+	ciphertext, err := encrypt(d.keyring, content)
+	if err != nil {
+		return err
+	}
+	return d.StorageDriver.PutContent(ctx, p, ciphertext)
+}
+
+func (d *encryptStorageMiddleware) Reader(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	if !d.encrypted(p) {
+		return d.StorageDriver.Reader(ctx, p, offset)
+	}
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: p, Offset: offset, DriverName: d.Name()}
+	}
+
+	fi, err := d.StorageDriver.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	rc, err := d.StorageDriver.Reader(ctx, p, 0)
+	if err != nil {
+		return nil, err
+	}
+	r, err := d.newReader(ctx, p, rc, fi.Size(), offset)
+	if err != nil {
+		rc.Close()
+		return nil, d.corrupted(p, err)
+	}
+	return r, nil
+}
+
+// newReader returns a reader decrypting the file at path, of the given
+// encrypted size, from the plaintext offset. rc must be positioned at the
+// start of the file.
+func (d *encryptStorageMiddleware) newReader(ctx context.Context, p string, rc io.ReadCloser, size, offset int64) (*reader, error) {
+	l, err := newLayout(size)
+	if err != nil {
+		return nil, err
+	}
+	h, aead, err := readHeader(rc, d.keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reader{
+		rc:     rc,
+		aead:   aead,
+		header: h,
+		layout: l,
+		next:   min(offset/chunkSize, l.chunks),
+		partial: func() ([]byte, error) {
+			return d.readSidecar(ctx, p, aead)
+		},
+	}
+	r.skip = offset - r.next*chunkSize
+
+	if r.next > 0 {
+		// Reopen the file at the chunk holding the offset.
+		rc.Close()
+		r.rc, err = d.StorageDriver.Reader(ctx, p, headerSize+r.next*sealedChunkSize)
+		if err != nil {
+			r.rc = io.NopCloser(bytes.NewReader(nil))
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// readSidecar returns the plaintext kept in the sidecar of an uncommitted
+// file.
+func (d *encryptStorageMiddleware) readSidecar(ctx context.Context, p string, aead cipher.AEAD) ([]byte, error) {
+	sealed, err := d.StorageDriver.GetContent(ctx, p+sidecarSuffix)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return openSidecar(aead, sealed)
+}
+
+func (d *encryptStorageMiddleware) deleteSidecar(ctx context.Context, p string) error {
+	err := d.StorageDriver.Delete(ctx, p+sidecarSuffix)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+func (d *encryptStorageMiddleware) Writer(ctx context.Context, p string, append bool) (storagedriver.FileWriter, error) {
+	if !d.encrypted(p) {
+		return d.StorageDriver.Writer(ctx, p, append)
+	}
+
+	w := &writer{
+		ctx:    ctx,
+		driver: d,
+		path:   p,
+		buf:    make([]byte, 0, chunkSize),
+	}
+
+	if append {
+		resumed, err := d.resumeWriter(ctx, w)
+		if err != nil {
+			return nil, err
+		}
+		if resumed {
+			return w, nil
+		}
+	}
+
+	var err error
+	w.header, w.aead, err = newHeader(d.keyring)
+	if err != nil {
+		return nil, err
+	}
+	w.fw, err = d.StorageDriver.Writer(ctx, p, false)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// resumeWriter prepares w to append to the existing uncommitted file at its
+// path. It returns false if the file does not exist or is empty, in which
+// case a new file must be written.
+func (d *encryptStorageMiddleware) resumeWriter(ctx context.Context, w *writer) (bool, error) {
+	fi, err := d.StorageDriver.Stat(ctx, w.path)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	if fi.Size() == 0 {
+		return false, nil
+	}
+
+	l, err := newLayout(fi.Size())
+	if err != nil {
+		return false, d.corrupted(w.path, err)
+	}
+	if l.committed {
+		if plaintextSize(fi.Size()) == 0 {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: cannot append to committed encrypted content: %s", d.Name(), w.path)
+	}
+
+	rc, err := d.StorageDriver.Reader(ctx, w.path, 0)
+	if err != nil {
+		return false, err
+	}
+	w.header, w.aead, err = readHeader(rc, d.keyring)
+	rc.Close()
+	if err != nil {
+		return false, d.corrupted(w.path, err)
+	}
+
+	partial, err := d.readSidecar(ctx, w.path, w.aead)
+	if err != nil {
+		return false, d.corrupted(w.path, err)
+	}
+
+	w.fw, err = d.StorageDriver.Writer(ctx, w.path, true)
+	if err != nil {
+		return false, err
+	}
+	w.headerWritten = true
+	w.next = uint32(l.chunks)
+	w.buf = append(w.buf, partial...)
+	w.size = l.chunks*chunkSize + int64(len(partial))
+	return true, nil
+}
+
+func (d *encryptStorageMiddleware) Stat(ctx context.Context, p string) (storagedriver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, p)
+	if err != nil || !d.encrypted(p) || fi.IsDir() {
+		return fi, err
+	}
+	return fileInfo{FileInfo: fi}, nil
+}
+
+func (d *encryptStorageMiddleware) List(ctx context.Context, p string) ([]string, error) {
+	children, err := d.StorageDriver.List(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := children[:0]
+	for _, child := range children {
+		if !d.isSidecar(child) {
+			filtered = append(filtered, child)
+		}
+	}
+	return filtered, nil
+}
+
+func (d *encryptStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if d.encrypted(sourcePath) != d.encrypted(destPath) {
+		return d.copyMove(ctx, sourcePath, destPath)
+	}
+
+	if err := d.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+	if !d.encrypted(sourcePath) {
+		return nil
+	}
+
+	err := d.StorageDriver.Move(ctx, sourcePath+sidecarSuffix, destPath+sidecarSuffix)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return d.deleteSidecar(ctx, destPath)
+	}
+	return err
+}
+
+// copyMove moves content between an encrypted path and a path which is not
+// encrypted, by copying it through the middleware.
+func (d *encryptStorageMiddleware) copyMove(ctx context.Context, sourcePath string, destPath string) error {
+	r, err := d.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := d.Writer(ctx, destPath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Cancel(ctx)
+		w.Close()
+		return err
+	}
+	if err := w.Commit(ctx); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return d.Delete(ctx, sourcePath)
+}
+
+func (d *encryptStorageMiddleware) Delete(ctx context.Context, p string) error {
+	if err := d.StorageDriver.Delete(ctx, p); err != nil {
+		return err
+	}
+	if !d.encrypted(p) {
+		return nil
+	}
+	return d.deleteSidecar(ctx, p)
+}
+
+// RedirectURL disables redirects for encrypted paths, as the content stored
+// by the underlying driver cannot be read by clients.
+func (d *encryptStorageMiddleware) RedirectURL(r *http.Request, p string) (string, error) {
+	if d.encrypted(p) {
+		return "", nil
+	}
+	return d.StorageDriver.RedirectURL(r, p)
+}
+
+func (d *encryptStorageMiddleware) Walk(ctx context.Context, p string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return d.StorageDriver.Walk(ctx, p, func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() || !d.encrypted(fi.Path()) {
+			return f(fi)
+		}
+		if d.isSidecar(fi.Path()) {
+			return nil
+		}
+		return f(fileInfo{FileInfo: fi})
+	}, options...)
+}
+
+// fileInfo reports the plaintext size of encrypted files.
+type fileInfo struct {
+	storagedriver.FileInfo
+}
+
+func (fi fileInfo) Size() int64 {
+	return plaintextSize(fi.FileInfo.Size())
+}
@@ -0,0 +1,259 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/stretchr/testify/require"
+)
+
+func randomKey(t testing.TB) string {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// writeKeyring writes a keyring with the given keys, the last one being the
+// primary key.
+func writeKeyring(t testing.TB, path string, keys map[string]string, primary string) {
+	content := fmt.Sprintf("primary: %s\nkeys:\n", primary)
+	for id, key := range keys {
+		content += fmt.Sprintf("  %s: %s\n", id, key)
+	}
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func newTestMiddleware(t testing.TB, sd storagedriver.StorageDriver, options map[string]interface{}) (*encryptStorageMiddleware, string) {
+	keyringPath := filepath.Join(t.TempDir(), "keyring.yaml")
+	writeKeyring(t, keyringPath, map[string]string{"first": randomKey(t)}, "first")
+
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	options["keyring"] = keyringPath
+	d, err := newEncryptStorageMiddleware(context.Background(), sd, options)
+	require.NoError(t, err)
+	return d.(*encryptStorageMiddleware), keyringPath
+}
+
+func TestEncryptDriverSuite(t *testing.T) {
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		d, _ := newTestMiddleware(t, inmemory.New(), nil)
+		return d, nil
+	})
+}
+
+func TestEncryptFaultsSuite(t *testing.T) {
+	testsuites.Faults(t, func() (storagedriver.StorageDriver, error) {
+		return inmemory.New(), nil
+	}, func(sd storagedriver.StorageDriver) (storagedriver.StorageDriver, error) {
+		d, _ := newTestMiddleware(t, sd, nil)
+		return d, nil
+	})
+}
+
+func TestOptions(t *testing.T) {
+	_, err := newEncryptStorageMiddleware(context.Background(), inmemory.New(), map[string]interface{}{})
+	require.ErrorContains(t, err, "no keyring provided")
+
+	keyringPath := filepath.Join(t.TempDir(), "keyring.yaml")
+	writeKeyring(t, keyringPath, map[string]string{"first": randomKey(t)}, "second")
+	_, err = newEncryptStorageMiddleware(context.Background(), inmemory.New(), map[string]interface{}{"keyring": keyringPath})
+	require.ErrorContains(t, err, `primary key "second" is not in the keyring`)
+
+	writeKeyring(t, keyringPath, map[string]string{"first": base64.StdEncoding.EncodeToString([]byte("short"))}, "first")
+	_, err = newEncryptStorageMiddleware(context.Background(), inmemory.New(), map[string]interface{}{"keyring": keyringPath})
+	require.ErrorContains(t, err, "must be 32 bytes long")
+
+	writeKeyring(t, keyringPath, map[string]string{"first": randomKey(t)}, "first")
+	_, err = newEncryptStorageMiddleware(context.Background(), inmemory.New(), map[string]interface{}{"keyring": keyringPath, "paths": []interface{}{"relative"}})
+	require.ErrorContains(t, err, "paths must be a list of absolute paths")
+}
+
+func TestEncryptedAtRest(t *testing.T) {
+	ctx := context.Background()
+	sd := inmemory.New()
+	d, _ := newTestMiddleware(t, sd, map[string]interface{}{
+		"paths": []interface{}{"/docker/registry/v2/blobs"},
+	})
+
+	content := bytes.Repeat([]byte("regulated content "), 10000)
+	blobPath := "/docker/registry/v2/blobs/sha256/ab/abcd/data"
+	require.NoError(t, d.PutContent(ctx, blobPath, content))
+
+	stored, err := sd.GetContent(ctx, blobPath)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(stored, []byte("regulated")))
+
+	fi, err := d.Stat(ctx, blobPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), fi.Size())
+
+	// Paths out of the configured prefixes are stored as is, and can still be
+	// redirected.
+	linkPath := "/docker/registry/v2/repositories/foo/_layers/sha256/abcd/link"
+	require.NoError(t, d.PutContent(ctx, linkPath, []byte("sha256:abcd")))
+	stored, err = sd.GetContent(ctx, linkPath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("sha256:abcd"), stored)
+
+	u, err := d.RedirectURL(nil, blobPath)
+	require.NoError(t, err)
+	require.Empty(t, u)
+
+	// Tampering with the stored content fails decryption.
+	stored, err = sd.GetContent(ctx, blobPath)
+	require.NoError(t, err)
+	stored[headerSize+10] ^= 1
+	require.NoError(t, sd.PutContent(ctx, blobPath, stored))
+	_, err = d.GetContent(ctx, blobPath)
+	require.ErrorContains(t, err, errCorrupted.Error())
+
+	// Truncating the content at a chunk boundary is detected as well.
+	require.NoError(t, d.PutContent(ctx, blobPath, content))
+	stored, err = sd.GetContent(ctx, blobPath)
+	require.NoError(t, err)
+	require.NoError(t, sd.PutContent(ctx, blobPath, stored[:headerSize+sealedChunkSize+tagSize]))
+	_, err = d.GetContent(ctx, blobPath)
+	require.ErrorContains(t, err, errCorrupted.Error())
+}
+
+func TestReaderOffsets(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestMiddleware(t, inmemory.New(), nil)
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		content := make([]byte, size)
+		_, err := rand.Read(content)
+		require.NoError(t, err)
+
+		p := fmt.Sprintf("/content/%d", size)
+		require.NoError(t, d.PutContent(ctx, p, content))
+
+		for _, offset := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 5, 2*chunkSize + 3, size - 1, size, size + 10} {
+			if offset < 0 {
+				continue
+			}
+			r, err := d.Reader(ctx, p, int64(offset))
+			require.NoError(t, err)
+			read, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+
+			expected := []byte{}
+			if offset < size {
+				expected = content[offset:]
+			}
+			require.Equal(t, expected, append([]byte{}, read...), "size %d, offset %d", size, offset)
+		}
+	}
+}
+
+func TestResumeUncommittedWriter(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestMiddleware(t, inmemory.New(), nil)
+	p := "/uploads/data"
+
+	content := make([]byte, 2*chunkSize+100)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	// Write the content over several writers, closing them before they are
+	// committed as resumable uploads do.
+	offsets := []int{0, 10, chunkSize + 20, chunkSize + 30, len(content)}
+	for i := 0; i < len(offsets)-1; i++ {
+		w, err := d.Writer(ctx, p, i > 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(offsets[i]), w.Size())
+		_, err = w.Write(content[offsets[i]:offsets[i+1]])
+		require.NoError(t, err)
+
+		if i < len(offsets)-2 {
+			require.NoError(t, w.Close())
+
+			// The content written so far can be read back before the
+			// upload is committed.
+			r, err := d.Reader(ctx, p, 5)
+			require.NoError(t, err)
+			read, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, content[5:offsets[i+1]], read)
+
+			// The sidecar is hidden.
+			children, err := d.List(ctx, "/uploads")
+			require.NoError(t, err)
+			require.Equal(t, []string{p}, children)
+			continue
+		}
+
+		require.NoError(t, w.Commit(ctx))
+		require.NoError(t, w.Close())
+	}
+
+	read, err := d.GetContent(ctx, p)
+	require.NoError(t, err)
+	require.Equal(t, content, read)
+
+	_, err = d.StorageDriver.Stat(ctx, p+sidecarSuffix)
+	require.IsType(t, storagedriver.PathNotFoundError{}, err)
+
+	// Committed content is moved along with its encryption.
+	require.NoError(t, d.Move(ctx, p, "/blobs/data"))
+	read, err = d.GetContent(ctx, "/blobs/data")
+	require.NoError(t, err)
+	require.Equal(t, content, read)
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	sd := inmemory.New()
+	d, keyringPath := newTestMiddleware(t, sd, map[string]interface{}{"refresh": "1ns"})
+
+	first, err := os.ReadFile(keyringPath)
+	require.NoError(t, err)
+	require.NoError(t, d.PutContent(ctx, "/old", []byte("encrypted with the first key")))
+
+	// Rotate to a second key, keeping the first one to read existing content.
+	second := randomKey(t)
+	content := string(first) + "  second: " + second + "\n"
+	content = "primary: second\n" + content[len("primary: first\n"):]
+	require.NoError(t, os.WriteFile(keyringPath, []byte(content), 0o600))
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(keyringPath, later, later))
+
+	require.NoError(t, d.PutContent(ctx, "/new", []byte("encrypted with the second key")))
+	stored, err := sd.GetContent(ctx, "/new")
+	require.NoError(t, err)
+	h, err := parseHeader(stored)
+	require.NoError(t, err)
+	require.Equal(t, "second", h.keyID)
+
+	for p, expected := range map[string]string{
+		"/old": "encrypted with the first key",
+		"/new": "encrypted with the second key",
+	} {
+		read, err := d.GetContent(ctx, p)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(read))
+	}
+
+	// Content cannot be decrypted once its key is removed.
+	writeKeyring(t, keyringPath, map[string]string{"second": second}, "second")
+	later = later.Add(time.Second)
+	require.NoError(t, os.Chtimes(keyringPath, later, later))
+	_, err = d.GetContent(ctx, "/old")
+	require.ErrorContains(t, err, `key "first" is not in the keyring`)
+}
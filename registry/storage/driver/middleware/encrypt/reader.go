@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"crypto/cipher"
+	"io"
+)
+
+// reader decrypts the chunks of an encrypted file, starting at a plaintext
+// offset.
+type reader struct {
+	rc     io.ReadCloser // positioned at the chunk of index next
+	aead   cipher.AEAD
+	header *header
+	layout layout
+
+	next   int64 // index of the next chunk to read
+	skip   int64 // plaintext bytes to skip before returning content
+	buf    []byte
+	sealed []byte
+
+	// partial returns the plaintext of the sidecar of uncommitted files.
+	partial     func() ([]byte, error)
+	partialRead bool
+
+	err error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.buf, r.err = r.fill()
+		if r.skip > 0 {
+			n := min(r.skip, int64(len(r.buf)))
+			r.buf = r.buf[n:]
+			r.skip -= n
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fill returns the plaintext of the next chunk.
+func (r *reader) fill() ([]byte, error) {
+	if r.next < r.layout.chunks {
+		final := r.layout.committed && r.next == r.layout.chunks-1
+		size := int64(sealedChunkSize)
+		if final {
+			size = r.layout.finalSize
+		}
+		if r.sealed == nil {
+			r.sealed = make([]byte, sealedChunkSize)
+		}
+		if _, err := io.ReadFull(r.rc, r.sealed[:size]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		plaintext, err := openChunk(r.aead, r.header, uint32(r.next), final, r.sealed[:size])
+		if err != nil {
+			return nil, err
+		}
+		r.next++
+		return plaintext, nil
+	}
+
+	if !r.layout.committed && !r.partialRead {
+		r.partialRead = true
+		plaintext, err := r.partial()
+		if err != nil {
+			return nil, err
+		}
+		return plaintext, nil
+	}
+	return nil, io.EOF
+}
+
+func (r *reader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"context"
+	"crypto/cipher"
+	"fmt"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// writer encrypts the content written to it, sealing a chunk each time
+// chunkSize bytes are buffered. The final chunk is sealed on commit, while
+// the buffered plaintext is kept in the sidecar of the file when the writer
+// is closed without being committed.
+type writer struct {
+	ctx    context.Context
+	driver *encryptStorageMiddleware
+	path   string
+	fw     storagedriver.FileWriter
+	header *header
+	aead   cipher.AEAD
+
+	headerWritten bool
+	next          uint32 // index of the next chunk
+	buf           []byte
+	sealed        []byte
+	size          int64
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+var _ storagedriver.FileWriter = &writer{}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		w.size += int64(n)
+
+		if len(w.buf) == chunkSize {
+			if err := w.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// writeChunk seals the buffered plaintext as the next chunk.
+func (w *writer) writeChunk(final bool) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.sealed = sealChunk(w.aead, w.header, w.next, final, w.sealed[:0], w.buf)
+	if _, err := w.fw.Write(w.sealed); err != nil {
+		return err
+	}
+	w.next++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *writer) writeHeader() error {
+	if w.headerWritten {
+		return nil
+	}
+	if _, err := w.fw.Write(w.header.marshal()); err != nil {
+		return err
+	}
+	w.headerWritten = true
+	return nil
+}
+
+func (w *writer) Size() int64 {
+	return w.size
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+
+	if !w.committed && !w.cancelled {
+		if err := w.writeHeader(); err != nil {
+			w.fw.Close()
+			return err
+		}
+		sealed, err := sealSidecar(w.aead, w.buf)
+		if err != nil {
+			w.fw.Close()
+			return err
+		}
+		if err := w.driver.StorageDriver.PutContent(w.ctx, w.path+sidecarSuffix, sealed); err != nil {
+			w.fw.Close()
+			return err
+		}
+	}
+	return w.fw.Close()
+}
+
+func (w *writer) Cancel(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+
+	if err := w.driver.deleteSidecar(ctx, w.path); err != nil {
+		return err
+	}
+	return w.fw.Cancel(ctx)
+}
+
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+
+	if err := w.writeChunk(true); err != nil {
+		return err
+	}
+	if err := w.fw.Commit(ctx); err != nil {
+		return err
+	}
+	w.committed = true
+	return w.driver.deleteSidecar(ctx, w.path)
+}
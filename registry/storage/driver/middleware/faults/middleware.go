@@ -0,0 +1,426 @@
+// Package middleware provides a storage middleware injecting faults in the
+// operations of a storage driver, to test how the registry and its clients
+// behave when the storage backend misbehaves.
+//
+// Faults are configured as a list of rules, each one selecting operations
+// and paths, and the faults injected in them: latency, errors, not found
+// errors and partial reads. The rules matching an operation are applied in
+// order, and the first injected error is returned without calling the
+// underlying driver.
+//
+// The middleware must not be used in production.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+// Operations in which faults can be injected.
+const (
+	OpGetContent  = "GetContent"
+	OpPutContent  = "PutContent"
+	OpReader      = "Reader"
+	OpWriter      = "Writer"
+	OpStat        = "Stat"
+	OpList        = "List"
+	OpMove        = "Move"
+	OpDelete      = "Delete"
+	OpRedirectURL = "RedirectURL"
+	OpWalk        = "Walk"
+)
+
+var operations = map[string]struct{}{
+	OpGetContent: {}, OpPutContent: {}, OpReader: {}, OpWriter: {}, OpStat: {},
+	OpList: {}, OpMove: {}, OpDelete: {}, OpRedirectURL: {}, OpWalk: {},
+}
+
+func init() {
+	if err := storagemiddleware.Register("faults", newFaultsStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register faults storage middleware: %v", err)
+	}
+}
+
+// Rule selects operations and paths, and the faults injected in them.
+type Rule struct {
+	// Paths is a regular expression matching the paths of the operations
+	// the rule applies to. An empty expression matches all the paths.
+	Paths string
+	// Operations are the operations the rule applies to. The rule applies
+	// to all the operations when empty.
+	Operations []string
+
+	// Latency is added to the operations.
+	Latency time.Duration
+	// ErrorRate is the probability of the operations to fail with an
+	// InjectedError.
+	ErrorRate float64
+	// NotFoundRate is the probability of the operations to fail with a
+	// storagedriver.PathNotFoundError.
+	NotFoundRate float64
+	// PartialReadRate is the probability of the readers opened by the
+	// operations to fail with io.ErrUnexpectedEOF before the end of the
+	// content.
+	PartialReadRate float64
+}
+
+// Config configures the faults injected by the middleware.
+type Config struct {
+	// Seed seeds the random decisions of the middleware, to make them
+	// reproducible. A random seed is used when zero.
+	Seed  int64
+	Rules []Rule
+}
+
+// InjectedError is the error returned by operations failing because of an
+// injected fault. It reports itself as a timeout, as transient errors of
+// remote storage backends do.
+type InjectedError struct {
+	Op   string
+	Path string
+}
+
+func (e InjectedError) Error() string {
+	return fmt.Sprintf("injected fault in %s %s", e.Op, e.Path)
+}
+
+// Timeout implements net.Error.
+func (e InjectedError) Timeout() bool {
+	return true
+}
+
+// Temporary implements net.Error.
+func (e InjectedError) Temporary() bool {
+	return true
+}
+
+type rule struct {
+	Rule
+	paths      *regexp.Regexp
+	operations map[string]struct{}
+}
+
+// Driver is a storage driver injecting faults in the operations of the
+// driver it wraps.
+type Driver struct {
+	storagedriver.StorageDriver
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	rules []rule
+}
+
+var _ storagedriver.StorageDriver = &Driver{}
+
+// New returns a driver injecting the configured faults in sd.
+func New(sd storagedriver.StorageDriver, config Config) (*Driver, error) {
+	d := &Driver{StorageDriver: sd}
+	if err := d.SetConfig(config); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// SetConfig replaces the faults injected by the driver.
+func (d *Driver) SetConfig(config Config) error {
+	rules := make([]rule, 0, len(config.Rules))
+	for i, r := range config.Rules {
+		compiled := rule{Rule: r, operations: make(map[string]struct{})}
+		if r.Paths != "" {
+			re, err := regexp.Compile(r.Paths)
+			if err != nil {
+				return fmt.Errorf("invalid paths of rule %d: %v", i, err)
+			}
+			compiled.paths = re
+		}
+		for _, op := range r.Operations {
+			if _, ok := operations[op]; !ok {
+				return fmt.Errorf("unknown operation %q in rule %d", op, i)
+			}
+			compiled.operations[op] = struct{}{}
+		}
+		for name, rate := range map[string]float64{"errorrate": r.ErrorRate, "notfoundrate": r.NotFoundRate, "partialreadrate": r.PartialReadRate} {
+			if rate < 0 || rate > 1 {
+				return fmt.Errorf("%s of rule %d must be between 0 and 1", name, i)
+			}
+		}
+		if r.Latency < 0 {
+			return fmt.Errorf("latency of rule %d must not be negative", i)
+		}
+		rules = append(rules, compiled)
+	}
+
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rand = rand.New(rand.NewSource(seed))
+	d.rules = rules
+	return nil
+}
+
+func newFaultsStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	var config Config
+	switch v := options["seed"].(type) {
+	case nil:
+	case string:
+		seed, err := strconv.ParseInt(v, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("seed must be an integer, %v invalid", v)
+		}
+		config.Seed = seed
+	case int, uint, int32, uint32, int64, uint64:
+		config.Seed = reflect.ValueOf(v).Convert(reflect.TypeOf(config.Seed)).Int()
+	default:
+		return nil, fmt.Errorf("invalid value for seed: %#v", v)
+	}
+
+	rules, ok := options["rules"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("rules must be a list of fault rules")
+	}
+	for i, o := range rules {
+		r, err := parseRule(o)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %d: %v", i, err)
+		}
+		config.Rules = append(config.Rules, r)
+	}
+
+	return New(sd, config)
+}
+
+func parseRule(o interface{}) (Rule, error) {
+	options := make(map[string]interface{})
+	switch v := o.(type) {
+	case map[string]interface{}:
+		options = v
+	case map[interface{}]interface{}:
+		for k, v := range v {
+			options[fmt.Sprint(k)] = v
+		}
+	default:
+		return Rule{}, fmt.Errorf("a rule must be a map")
+	}
+
+	var r Rule
+	if o, ok := options["paths"]; ok {
+		s, ok := o.(string)
+		if !ok {
+			return Rule{}, fmt.Errorf("paths must be a regular expression")
+		}
+		r.Paths = s
+	}
+	if o, ok := options["operations"]; ok {
+		list, ok := o.([]interface{})
+		if !ok {
+			return Rule{}, fmt.Errorf("operations must be a list of operations")
+		}
+		for _, item := range list {
+			r.Operations = append(r.Operations, fmt.Sprint(item))
+		}
+	}
+	if o, ok := options["latency"]; ok {
+		s, ok := o.(string)
+		if !ok {
+			return Rule{}, fmt.Errorf("latency must be a duration")
+		}
+		latency, err := time.ParseDuration(s)
+		if err != nil {
+			return Rule{}, fmt.Errorf("unable to parse latency: %v", err)
+		}
+		r.Latency = latency
+	}
+	for name, rate := range map[string]*float64{
+		"errorrate":       &r.ErrorRate,
+		"notfoundrate":    &r.NotFoundRate,
+		"partialreadrate": &r.PartialReadRate,
+	} {
+		switch v := options[name].(type) {
+		case nil:
+		case float64:
+			*rate = v
+		case int:
+			*rate = float64(v)
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return Rule{}, fmt.Errorf("%s must be a number, %v invalid", name, v)
+			}
+			*rate = f
+		default:
+			return Rule{}, fmt.Errorf("invalid value for %s: %#v", name, v)
+		}
+	}
+	return r, nil
+}
+
+// fault is the outcome of the rules matching an operation.
+type fault struct {
+	latency     time.Duration
+	err         error
+	partialRead bool
+}
+
+func (d *Driver) decide(op, path string) fault {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var f fault
+	for _, r := range d.rules {
+		if _, ok := r.operations[op]; len(r.operations) > 0 && !ok {
+			continue
+		}
+		if r.paths != nil && !r.paths.MatchString(path) {
+			continue
+		}
+		f.latency += r.Latency
+		if f.err == nil && r.ErrorRate > 0 && d.rand.Float64() < r.ErrorRate {
+			f.err = storagedriver.Error{DriverName: d.StorageDriver.Name(), Detail: InjectedError{Op: op, Path: path}}
+		}
+		if f.err == nil && r.NotFoundRate > 0 && d.rand.Float64() < r.NotFoundRate {
+			f.err = storagedriver.PathNotFoundError{Path: path, DriverName: d.StorageDriver.Name()}
+		}
+		if r.PartialReadRate > 0 && d.rand.Float64() < r.PartialReadRate {
+			f.partialRead = true
+		}
+	}
+	return f
+}
+
+// inject applies the faults of an operation, returning the injected error.
+func (d *Driver) inject(ctx context.Context, op, path string) (fault, error) {
+	f := d.decide(op, path)
+	if f.latency > 0 {
+		t := time.NewTimer(f.latency)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return f, ctx.Err()
+		}
+	}
+	return f, f.err
+}
+
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	f, err := d.inject(ctx, OpGetContent, path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := d.StorageDriver.GetContent(ctx, path)
+	if err == nil && f.partialRead && len(content) > 0 {
+		return nil, storagedriver.Error{DriverName: d.StorageDriver.Name(), Detail: io.ErrUnexpectedEOF}
+	}
+	return content, err
+}
+
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte) error {
+	if _, err := d.inject(ctx, OpPutContent, path); err != nil {
+		return err
+	}
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	f, err := d.inject(ctx, OpReader, path)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := d.StorageDriver.Reader(ctx, path, offset)
+	if err != nil || !f.partialRead {
+		return rc, err
+	}
+
+	d.mu.Lock()
+	limit := d.rand.Int63n(4096)
+	d.mu.Unlock()
+	return &partialReader{ReadCloser: rc, remaining: limit}, nil
+}
+
+func (d *Driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if _, err := d.inject(ctx, OpWriter, path); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.Writer(ctx, path, append)
+}
+
+func (d *Driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if _, err := d.inject(ctx, OpStat, path); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
+	if _, err := d.inject(ctx, OpList, path); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.List(ctx, path)
+}
+
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if _, err := d.inject(ctx, OpMove, sourcePath); err != nil {
+		return err
+	}
+	return d.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	if _, err := d.inject(ctx, OpDelete, path); err != nil {
+		return err
+	}
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	if _, err := d.inject(ctx, OpRedirectURL, path); err != nil {
+		return "", err
+	}
+	return d.StorageDriver.RedirectURL(r, path)
+}
+
+func (d *Driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	if _, err := d.inject(ctx, OpWalk, path); err != nil {
+		return err
+	}
+	return d.StorageDriver.Walk(ctx, path, f, options...)
+}
+
+// partialReader fails with io.ErrUnexpectedEOF once remaining bytes have
+// been read, unless the content ends before.
+type partialReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *partialReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptions(t *testing.T) {
+	for _, tc := range []struct {
+		options map[string]interface{}
+		err     string
+	}{
+		{map[string]interface{}{}, "rules must be a list of fault rules"},
+		{map[string]interface{}{"rules": []interface{}{"latency"}}, "a rule must be a map"},
+		{map[string]interface{}{"seed": "random", "rules": []interface{}{}}, "seed must be an integer"},
+		{map[string]interface{}{"rules": []interface{}{map[interface{}]interface{}{"paths": "("}}}, "invalid paths of rule 0"},
+		{map[string]interface{}{"rules": []interface{}{map[interface{}]interface{}{"operations": []interface{}{"Read"}}}}, `unknown operation "Read" in rule 0`},
+		{map[string]interface{}{"rules": []interface{}{map[interface{}]interface{}{"latency": "soon"}}}, "unable to parse latency"},
+		{map[string]interface{}{"rules": []interface{}{map[interface{}]interface{}{"errorrate": 2}}}, "errorrate of rule 0 must be between 0 and 1"},
+		{map[string]interface{}{"rules": []interface{}{map[interface{}]interface{}{"notfoundrate": "often"}}}, "notfoundrate must be a number"},
+	} {
+		_, err := newFaultsStorageMiddleware(context.Background(), inmemory.New(), tc.options)
+		require.ErrorContains(t, err, tc.err)
+	}
+
+	d, err := newFaultsStorageMiddleware(context.Background(), inmemory.New(), map[string]interface{}{
+		"seed": 42,
+		"rules": []interface{}{
+			map[interface{}]interface{}{
+				"paths":           "^/docker/registry/v2/blobs/",
+				"operations":      []interface{}{"Reader", "GetContent"},
+				"latency":         "50ms",
+				"errorrate":       0.1,
+				"partialreadrate": "0.05",
+			},
+		},
+	})
+	require.NoError(t, err)
+	rules := d.(*Driver).rules
+	require.Len(t, rules, 1)
+	require.Equal(t, 50*time.Millisecond, rules[0].Latency)
+	require.Equal(t, 0.1, rules[0].ErrorRate)
+	require.Equal(t, 0.05, rules[0].PartialReadRate)
+	require.Len(t, rules[0].operations, 2)
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	require.NoError(t, backend.PutContent(ctx, "/blobs/a", []byte(strings.Repeat("a", 8192))))
+	require.NoError(t, backend.PutContent(ctx, "/tags/latest", []byte("a")))
+
+	d, err := New(backend, Config{Seed: 1, Rules: []Rule{
+		{Paths: "^/blobs/", Operations: []string{OpGetContent}, ErrorRate: 1},
+		{Paths: "^/blobs/", Operations: []string{OpStat}, NotFoundRate: 1},
+		{Paths: "^/blobs/", Operations: []string{OpReader}, PartialReadRate: 1},
+	}})
+	require.NoError(t, err)
+
+	// Injected errors are transient errors of the driver.
+	_, err = d.GetContent(ctx, "/blobs/a")
+	require.IsType(t, storagedriver.Error{}, err)
+	var ne net.Error
+	require.True(t, errors.As(err.(storagedriver.Error).Detail, &ne))
+	require.True(t, ne.Timeout())
+
+	_, err = d.Stat(ctx, "/blobs/a")
+	require.IsType(t, storagedriver.PathNotFoundError{}, err)
+
+	rc, err := d.Reader(ctx, "/blobs/a", 0)
+	require.NoError(t, err)
+	content, err := io.ReadAll(rc)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Less(t, len(content), 8192)
+	require.NoError(t, rc.Close())
+
+	// Paths and operations not selected by the rules are not affected.
+	content, err = d.GetContent(ctx, "/tags/latest")
+	require.NoError(t, err)
+	require.Equal(t, "a", string(content))
+	require.NoError(t, d.PutContent(ctx, "/blobs/b", []byte("b")))
+
+	// Faults can be removed.
+	require.NoError(t, d.SetConfig(Config{}))
+	content, err = d.GetContent(ctx, "/blobs/a")
+	require.NoError(t, err)
+	require.Len(t, content, 8192)
+}
+
+func TestErrorRate(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	require.NoError(t, backend.PutContent(ctx, "/a", []byte("a")))
+
+	failures := func(seed int64) []bool {
+		d, err := New(backend, Config{Seed: seed, Rules: []Rule{{ErrorRate: 0.25}}})
+		require.NoError(t, err)
+		var failed []bool
+		for i := 0; i < 1000; i++ {
+			_, err := d.GetContent(ctx, "/a")
+			failed = append(failed, err != nil)
+		}
+		return failed
+	}
+
+	// The faults are reproducible for a given seed.
+	first := failures(7)
+	require.Equal(t, first, failures(7))
+	count := 0
+	for _, failed := range first {
+		if failed {
+			count++
+		}
+	}
+	require.InDelta(t, 250, count, 60)
+}
+
+func TestLatency(t *testing.T) {
+	d, err := New(inmemory.New(), Config{Rules: []Rule{
+		{Operations: []string{OpList}, Latency: 20 * time.Millisecond},
+		{Latency: 10 * time.Millisecond},
+	}})
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = d.List(context.Background(), "/")
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+
+	// Latency is cut short by the cancellation of the operation.
+	require.NoError(t, d.SetConfig(Config{Rules: []Rule{{Latency: time.Hour}}}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = d.List(ctx, "/")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
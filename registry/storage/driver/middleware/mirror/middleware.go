@@ -0,0 +1,319 @@
+// Package middleware provides a storage middleware mirroring the content of
+// the registry to a secondary storage driver, to migrate the registry from a
+// storage backend to another without downtime.
+//
+// The storage driver wrapped by the middleware is the primary driver, the
+// backend the registry is migrated to, while the secondary driver is the
+// backend it is migrated from. Writes go to both drivers, reads are served by
+// the primary driver and fall back to the secondary driver for content which
+// has not been copied yet. A background reconciler copies the content of the
+// secondary driver missing from the primary driver. Once it has completed,
+// the middleware can be removed to cut over to the primary driver.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultReconcileInterval is the default interval between the runs of the
+// reconciler.
+const defaultReconcileInterval = 24 * time.Hour
+
+func init() {
+	if err := storagemiddleware.Register("mirror", newMirrorStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register mirror storage middleware: %v", err)
+	}
+}
+
+type mirrorStorageMiddleware struct {
+	storagedriver.StorageDriver
+	secondary storagedriver.StorageDriver
+}
+
+var _ storagedriver.StorageDriver = &mirrorStorageMiddleware{}
+
+func newMirrorStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	secondary, err := createSecondary(ctx, options["secondary"])
+	if err != nil {
+		return nil, err
+	}
+
+	reconcile := false
+	switch v := options["reconcile"].(type) {
+	case nil:
+	case bool:
+		reconcile = v
+	default:
+		return nil, fmt.Errorf("reconcile must be a boolean")
+	}
+
+	interval := defaultReconcileInterval
+	if o, ok := options["reconcileinterval"]; ok {
+		s, ok := o.(string)
+		if !ok {
+			return nil, fmt.Errorf("reconcileinterval must be a duration")
+		}
+		interval, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse reconcileinterval: %v", err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("reconcileinterval must be positive")
+		}
+	}
+
+	d := &mirrorStorageMiddleware{StorageDriver: sd, secondary: secondary}
+	if reconcile {
+		// The reconciler stops when the context of the registry is canceled.
+		go d.reconcileLoop(ctx, interval)
+	}
+	return d, nil
+}
+
+// createSecondary creates the secondary driver from its configuration, a map
+// holding the parameters of the driver under its name.
+func createSecondary(ctx context.Context, o interface{}) (storagedriver.StorageDriver, error) {
+	config := make(map[string]interface{})
+	switch v := o.(type) {
+	case nil:
+		return nil, fmt.Errorf("no secondary storage driver provided")
+	case map[string]interface{}:
+		config = v
+	case map[interface{}]interface{}:
+		for k, v := range v {
+			config[fmt.Sprint(k)] = v
+		}
+	default:
+		return nil, fmt.Errorf("secondary must be a map of a storage driver name to its parameters")
+	}
+	if len(config) != 1 {
+		return nil, fmt.Errorf("secondary must configure exactly one storage driver")
+	}
+
+	for name, p := range config {
+		params := make(map[string]interface{})
+		switch v := p.(type) {
+		case nil:
+		case map[string]interface{}:
+			params = v
+		case map[interface{}]interface{}:
+			for k, v := range v {
+				params[fmt.Sprint(k)] = v
+			}
+		default:
+			return nil, fmt.Errorf("parameters of secondary storage driver %s must be a map", name)
+		}
+
+		secondary, err := factory.Create(ctx, name, params)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create secondary storage driver: %v", err)
+		}
+		return secondary, nil
+	}
+	return nil, nil
+}
+
+// secondaryFailed logs a failure to mirror an operation to the secondary
+// driver. Such failures do not fail the operation, as the primary driver
+// holds the content served by the registry.
+func (d *mirrorStorageMiddleware) secondaryFailed(ctx context.Context, op, path string, err error) {
+	dcontext.GetLogger(ctx).WithError(err).WithField("path", path).Warnf("mirror: unable to %s on secondary storage driver %s", op, d.secondary.Name())
+}
+
+func isPathNotFound(err error) bool {
+	_, ok := err.(storagedriver.PathNotFoundError)
+	return ok
+}
+
+func (d *mirrorStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := d.StorageDriver.GetContent(ctx, path)
+	if isPathNotFound(err) {
+		if content, serr := d.secondary.GetContent(ctx, path); serr == nil {
+			return content, nil
+		}
+	}
+	return content, err
+}
+
+func (d *mirrorStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := d.StorageDriver.PutContent(ctx, path, content); err != nil {
+		return err
+	}
+	if err := d.secondary.PutContent(ctx, path, content); err != nil {
+		d.secondaryFailed(ctx, "put content", path, err)
+	}
+	return nil
+}
+
+func (d *mirrorStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	rc, err := d.StorageDriver.Reader(ctx, path, offset)
+	if isPathNotFound(err) {
+		if rc, serr := d.secondary.Reader(ctx, path, offset); serr == nil {
+			return rc, nil
+		}
+	}
+	return rc, err
+}
+
+// Writer writes to both drivers. Writing to the secondary driver stops at
+// the first failure, and the content is copied when the file is moved to its
+// final path.
+func (d *mirrorStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := d.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &writer{FileWriter: fw, ctx: ctx, driver: d, path: path}
+	sw, err := d.secondary.Writer(ctx, path, append)
+	switch {
+	case err != nil:
+		d.secondaryFailed(ctx, "open writer", path, err)
+	case sw.Size() != fw.Size():
+		sw.Close()
+	default:
+		w.secondary = sw
+	}
+	return w, nil
+}
+
+func (d *mirrorStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if isPathNotFound(err) {
+		if fi, serr := d.secondary.Stat(ctx, path); serr == nil {
+			return fi, nil
+		}
+	}
+	return fi, err
+}
+
+// List returns the union of the children of path in both drivers.
+func (d *mirrorStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	children, err := d.StorageDriver.List(ctx, path)
+	if err != nil && !isPathNotFound(err) {
+		return nil, err
+	}
+	secondaryChildren, serr := d.secondary.List(ctx, path)
+	if serr != nil {
+		if err != nil {
+			return nil, err
+		}
+		if !isPathNotFound(serr) {
+			d.secondaryFailed(ctx, "list", path, serr)
+		}
+		return children, nil
+	}
+
+	seen := make(map[string]struct{}, len(children))
+	for _, child := range children {
+		seen[child] = struct{}{}
+	}
+	for _, child := range secondaryChildren {
+		if _, ok := seen[child]; !ok {
+			children = append(children, child)
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+// Move moves the file in both drivers. When the source only exists in the
+// secondary driver, it is only moved there.
+func (d *mirrorStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	err := d.StorageDriver.Move(ctx, sourcePath, destPath)
+	if isPathNotFound(err) {
+		if serr := d.secondary.Move(ctx, sourcePath, destPath); serr == nil {
+			return nil
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	// Copy the file from the primary driver if the secondary driver does not
+	// hold the same file, e.g. when one of the writes failed.
+	serr := d.secondary.Move(ctx, sourcePath, destPath)
+	if serr == nil {
+		fi, err := d.StorageDriver.Stat(ctx, destPath)
+		sfi, serr := d.secondary.Stat(ctx, destPath)
+		if err == nil && serr == nil && fi.Size() == sfi.Size() {
+			return nil
+		}
+	}
+	if _, err := copyFile(ctx, d.StorageDriver, d.secondary, destPath); err != nil {
+		d.secondaryFailed(ctx, "copy", destPath, err)
+	}
+	return nil
+}
+
+// Delete deletes the path in both drivers. A PathNotFoundError is only
+// returned when the path exists in neither of them. The path is deleted from
+// the secondary driver first, and a failure to do so fails the deletion, so
+// that the reconciler does not copy the path back to the primary driver.
+func (d *mirrorStorageMiddleware) Delete(ctx context.Context, path string) error {
+	serr := d.secondary.Delete(ctx, path)
+	if serr != nil && !isPathNotFound(serr) {
+		return serr
+	}
+	err := d.StorageDriver.Delete(ctx, path)
+	if isPathNotFound(err) && serr == nil {
+		return nil
+	}
+	return err
+}
+
+// RedirectURL redirects to the driver holding the content.
+func (d *mirrorStorageMiddleware) RedirectURL(r *http.Request, path string) (string, error) {
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	if _, err := d.StorageDriver.Stat(ctx, path); isPathNotFound(err) {
+		if _, serr := d.secondary.Stat(ctx, path); serr == nil {
+			return d.secondary.RedirectURL(r, path)
+		}
+	}
+	return d.StorageDriver.RedirectURL(r, path)
+}
+
+// Walk walks the union of the content of both drivers.
+func (d *mirrorStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// copyFile copies the file at path from a driver to another, returning the
+// number of bytes copied.
+func copyFile(ctx context.Context, from, to storagedriver.StorageDriver, path string) (int64, error) {
+	rc, err := from.Reader(ctx, path, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	fw, err := to.Writer(ctx, path, false)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(fw, rc)
+	if err != nil {
+		fw.Cancel(ctx)
+		fw.Close()
+		return n, err
+	}
+	if err := fw.Commit(ctx); err != nil {
+		fw.Close()
+		return n, err
+	}
+	return n, fw.Close()
+}
@@ -0,0 +1,237 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMiddleware(t *testing.T) (*mirrorStorageMiddleware, storagedriver.StorageDriver, storagedriver.StorageDriver) {
+	primary := inmemory.New()
+	d, err := newMirrorStorageMiddleware(context.Background(), primary, map[string]interface{}{
+		"secondary": map[interface{}]interface{}{"inmemory": nil},
+	})
+	require.NoError(t, err)
+	m := d.(*mirrorStorageMiddleware)
+	return m, primary, m.secondary
+}
+
+func requireContent(t *testing.T, d storagedriver.StorageDriver, path, expected string) {
+	content, err := d.GetContent(context.Background(), path)
+	require.NoError(t, err, path)
+	require.Equal(t, expected, string(content), path)
+}
+
+func requireNotFound(t *testing.T, d storagedriver.StorageDriver, path string) {
+	_, err := d.Stat(context.Background(), path)
+	require.IsType(t, storagedriver.PathNotFoundError{}, err, path)
+}
+
+func TestMirrorDriverSuite(t *testing.T) {
+	// Streams are written to two in-memory drivers, which is too slow for the
+	// large stream tests.
+	testsuites.DriverWithoutLargeStreams(t, func() (storagedriver.StorageDriver, error) {
+		d, _, _ := newTestMiddleware(t)
+		return d, nil
+	})
+}
+
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		options map[string]interface{}
+		err     string
+	}{
+		{map[string]interface{}{}, "no secondary storage driver provided"},
+		{map[string]interface{}{"secondary": "inmemory"}, "secondary must be a map"},
+		{map[string]interface{}{"secondary": map[interface{}]interface{}{}}, "exactly one storage driver"},
+		{map[string]interface{}{"secondary": map[interface{}]interface{}{"unknown": nil}}, "StorageDriver not registered: unknown"},
+		{map[string]interface{}{"secondary": map[interface{}]interface{}{"inmemory": nil}, "reconcile": "yes"}, "reconcile must be a boolean"},
+		{map[string]interface{}{"secondary": map[interface{}]interface{}{"inmemory": nil}, "reconcileinterval": "-1h"}, "reconcileinterval must be positive"},
+	} {
+		_, err := newMirrorStorageMiddleware(ctx, inmemory.New(), tc.options)
+		require.ErrorContains(t, err, tc.err)
+	}
+}
+
+func TestDualWrite(t *testing.T) {
+	ctx := context.Background()
+	d, primary, secondary := newTestMiddleware(t)
+
+	require.NoError(t, d.PutContent(ctx, "/a/link", []byte("link")))
+
+	fw, err := d.Writer(ctx, "/uploads/data", false)
+	require.NoError(t, err)
+	_, err = fw.Write([]byte("upload "))
+	require.NoError(t, err)
+	require.NoError(t, fw.Close())
+
+	// Resume the upload, and move it to its final path once committed.
+	fw, err = d.Writer(ctx, "/uploads/data", true)
+	require.NoError(t, err)
+	_, err = fw.Write([]byte("content"))
+	require.NoError(t, err)
+	require.NoError(t, fw.Commit(ctx))
+	require.NoError(t, fw.Close())
+	require.NoError(t, d.Move(ctx, "/uploads/data", "/a/data"))
+
+	for _, sd := range []storagedriver.StorageDriver{primary, secondary} {
+		requireContent(t, sd, "/a/link", "link")
+		requireContent(t, sd, "/a/data", "upload content")
+		requireNotFound(t, sd, "/uploads/data")
+	}
+
+	require.NoError(t, d.Delete(ctx, "/a"))
+	for _, sd := range []storagedriver.StorageDriver{primary, secondary} {
+		requireNotFound(t, sd, "/a")
+	}
+	require.IsType(t, storagedriver.PathNotFoundError{}, d.Delete(ctx, "/a"))
+}
+
+func TestReadFallback(t *testing.T) {
+	ctx := context.Background()
+	d, primary, secondary := newTestMiddleware(t)
+
+	require.NoError(t, primary.PutContent(ctx, "/repo/a", []byte("primary")))
+	require.NoError(t, secondary.PutContent(ctx, "/repo/a", []byte("stale")))
+	require.NoError(t, secondary.PutContent(ctx, "/repo/b", []byte("secondary")))
+
+	requireContent(t, d, "/repo/a", "primary")
+	requireContent(t, d, "/repo/b", "secondary")
+
+	rc, err := d.Reader(ctx, "/repo/b", 3)
+	require.NoError(t, err)
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, "ondary", string(content))
+
+	fi, err := d.Stat(ctx, "/repo/b")
+	require.NoError(t, err)
+	require.Equal(t, int64(len("secondary")), fi.Size())
+
+	children, err := d.List(ctx, "/repo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/repo/a", "/repo/b"}, children)
+
+	var walked []string
+	require.NoError(t, d.Walk(ctx, "/", func(fi storagedriver.FileInfo) error {
+		walked = append(walked, fi.Path())
+		return nil
+	}))
+	require.Equal(t, []string{"/repo", "/repo/a", "/repo/b"}, walked)
+
+	_, err = d.GetContent(ctx, "/repo/c")
+	require.IsType(t, storagedriver.PathNotFoundError{}, err)
+
+	// Files only found in the secondary driver are moved and deleted there.
+	require.NoError(t, d.Move(ctx, "/repo/b", "/repo/c"))
+	requireContent(t, d, "/repo/c", "secondary")
+	requireNotFound(t, primary, "/repo/c")
+	require.NoError(t, d.Delete(ctx, "/repo/c"))
+	requireNotFound(t, secondary, "/repo/c")
+}
+
+// failingDriver fails all the writes.
+type failingDriver struct {
+	storagedriver.StorageDriver
+}
+
+var errFailed = errors.New("failed")
+
+func (d failingDriver) PutContent(context.Context, string, []byte) error {
+	return errFailed
+}
+
+func (d failingDriver) Writer(context.Context, string, bool) (storagedriver.FileWriter, error) {
+	return nil, errFailed
+}
+
+func (d failingDriver) Delete(context.Context, string) error {
+	return errFailed
+}
+
+func TestSecondaryFailures(t *testing.T) {
+	ctx := context.Background()
+	d, primary, secondary := newTestMiddleware(t)
+	d.secondary = failingDriver{secondary}
+
+	// Writes succeed as long as the primary driver succeeds.
+	require.NoError(t, d.PutContent(ctx, "/link", []byte("link")))
+	fw, err := d.Writer(ctx, "/uploads/data", false)
+	require.NoError(t, err)
+	_, err = fw.Write([]byte("content"))
+	require.NoError(t, err)
+	require.NoError(t, fw.Commit(ctx))
+	require.NoError(t, fw.Close())
+
+	requireContent(t, primary, "/link", "link")
+	requireNotFound(t, secondary, "/link")
+	requireNotFound(t, secondary, "/uploads/data")
+
+	// Deletions fail instead of leaving a file the reconciler would copy
+	// back to the primary driver.
+	require.NoError(t, secondary.PutContent(ctx, "/old", []byte("old")))
+	require.ErrorIs(t, d.Delete(ctx, "/old"), errFailed)
+	requireContent(t, secondary, "/old", "old")
+
+	// The file is copied once the secondary driver recovers.
+	d.secondary = secondary
+	require.NoError(t, d.Move(ctx, "/uploads/data", "/data"))
+	requireContent(t, secondary, "/data", "content")
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	d, primary, secondary := newTestMiddleware(t)
+
+	require.NoError(t, secondary.PutContent(ctx, "/repo/a", []byte("a")))
+	require.NoError(t, secondary.PutContent(ctx, "/repo/b/c", []byte("bc")))
+	require.NoError(t, d.PutContent(ctx, "/repo/d", []byte("d")))
+
+	stats, err := d.reconcile(ctx)
+	require.NoError(t, err)
+	require.Equal(t, reconcileStats{Files: 3, Copied: 2, Bytes: 3}, stats)
+	requireContent(t, primary, "/repo/a", "a")
+	requireContent(t, primary, "/repo/b/c", "bc")
+
+	stats, err = d.reconcile(ctx)
+	require.NoError(t, err)
+	require.Equal(t, reconcileStats{Files: 3}, stats)
+
+	// An empty secondary driver has nothing to reconcile.
+	empty, _, _ := newTestMiddleware(t)
+	stats, err = empty.reconcile(ctx)
+	require.NoError(t, err)
+	require.Equal(t, reconcileStats{}, stats)
+}
+
+func TestReconcileLoopStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d, primary, secondary := newTestMiddleware(t)
+	require.NoError(t, secondary.PutContent(ctx, "/repo/a", []byte("a")))
+
+	done := make(chan struct{})
+	go func() {
+		d.reconcileLoop(ctx, time.Hour)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		_, err := primary.Stat(ctx, "/repo/a")
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reconciler did not stop after its context was canceled")
+	}
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// reconcileStats summarizes a run of the reconciler.
+type reconcileStats struct {
+	// Files is the number of files found in the secondary driver.
+	Files int
+	// Copied is the number of files copied to the primary driver.
+	Copied int
+	// Bytes is the number of bytes copied to the primary driver.
+	Bytes int64
+	// Errors is the number of files which could not be copied.
+	Errors int
+}
+
+// reconcileLoop runs the reconciler every interval until ctx is canceled.
+func (d *mirrorStorageMiddleware) reconcileLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		stats, err := d.reconcile(ctx)
+		logger := dcontext.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+			"files":    stats.Files,
+			"copied":   stats.Copied,
+			"bytes":    stats.Bytes,
+			"errors":   stats.Errors,
+			"duration": time.Since(start),
+		})
+		if err != nil {
+			logger.WithError(err).Error("mirror: reconciliation failed")
+		} else {
+			logger.Info("mirror: reconciliation completed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile copies the files of the secondary driver which are missing from
+// the primary driver. Failures to copy a file are logged and counted, and do
+// not stop the reconciliation.
+func (d *mirrorStorageMiddleware) reconcile(ctx context.Context) (reconcileStats, error) {
+	var stats reconcileStats
+	err := d.secondary.Walk(ctx, "/", func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() {
+			return nil
+		}
+		stats.Files++
+
+		p := fi.Path()
+		_, err := d.StorageDriver.Stat(ctx, p)
+		if err == nil {
+			return nil
+		} else if !isPathNotFound(err) {
+			stats.Errors++
+			dcontext.GetLogger(ctx).WithError(err).WithField("path", p).Warn("mirror: unable to stat file on primary storage driver")
+			return nil
+		}
+
+		n, err := copyFile(ctx, d.secondary, d.StorageDriver, p)
+		if err != nil {
+			if isPathNotFound(err) {
+				// The file was deleted since it was listed.
+				return nil
+			}
+			stats.Errors++
+			dcontext.GetLogger(ctx).WithError(err).WithField("path", p).Warn("mirror: unable to copy file to primary storage driver")
+			return nil
+		}
+
+		// Do not resurrect a file deleted from both drivers while it was
+		// being copied.
+		if _, err := d.secondary.Stat(ctx, p); isPathNotFound(err) {
+			d.StorageDriver.Delete(ctx, p)
+			return nil
+		}
+		stats.Copied++
+		stats.Bytes += n
+		return nil
+	})
+	if isPathNotFound(err) {
+		err = nil
+	}
+	return stats, err
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// writer writes to the primary driver and mirrors the writes to the
+// secondary driver until one of them fails.
+type writer struct {
+	storagedriver.FileWriter
+	secondary storagedriver.FileWriter
+
+	ctx    context.Context
+	driver *mirrorStorageMiddleware
+	path   string
+}
+
+var _ storagedriver.FileWriter = &writer{}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.FileWriter.Write(p)
+	if n > 0 && w.secondary != nil {
+		if _, serr := w.secondary.Write(p[:n]); serr != nil {
+			w.abandon("write", serr)
+		}
+	}
+	return n, err
+}
+
+// abandon stops mirroring the writes to the secondary driver.
+func (w *writer) abandon(op string, err error) {
+	w.driver.secondaryFailed(w.ctx, op, w.path, err)
+	w.secondary.Close()
+	w.secondary = nil
+}
+
+func (w *writer) Close() error {
+	if w.secondary != nil {
+		if err := w.secondary.Close(); err != nil {
+			w.driver.secondaryFailed(w.ctx, "close writer", w.path, err)
+		}
+		w.secondary = nil
+	}
+	return w.FileWriter.Close()
+}
+
+func (w *writer) Cancel(ctx context.Context) error {
+	if w.secondary != nil {
+		if err := w.secondary.Cancel(ctx); err != nil {
+			w.driver.secondaryFailed(ctx, "cancel writer", w.path, err)
+		}
+	}
+	return w.FileWriter.Cancel(ctx)
+}
+
+func (w *writer) Commit(ctx context.Context) error {
+	if err := w.FileWriter.Commit(ctx); err != nil {
+		return err
+	}
+	if w.secondary != nil {
+		if err := w.secondary.Commit(ctx); err != nil {
+			w.abandon("commit writer", err)
+		}
+	}
+	return nil
+}
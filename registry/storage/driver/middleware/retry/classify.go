@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"google.golang.org/api/googleapi"
+)
+
+// classifier reports whether an error returned by a storage driver is
+// transient, and whether it recognized the error at all.
+type classifier func(err error) (retryable bool, known bool)
+
+// classifiers holds the classifiers of the errors specific to each storage
+// driver, by driver name.
+var classifiers = map[string]classifier{
+	"s3aws": classifyS3,
+	"gcs":   classifyGCS,
+	"azure": classifyAzure,
+}
+
+// retryableStatus reports whether an HTTP status code returned by an object
+// storage service is transient.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func classifyS3(err error) (bool, bool) {
+	var rf awserr.RequestFailure
+	if errors.As(err, &rf) {
+		return retryableStatus(rf.StatusCode()), true
+	}
+	var ae awserr.Error
+	if errors.As(err, &ae) {
+		switch ae.Code() {
+		case "RequestError", "RequestTimeout", "RequestTimeoutException", "SlowDown",
+			"Throttling", "ThrottlingException", "InternalError", "ServiceUnavailable":
+			return true, true
+		}
+		// Request errors wrap the network error which caused them.
+		if ae.OrigErr() != nil {
+			return retryableNetworkError(ae.OrigErr()), true
+		}
+		return false, true
+	}
+	return false, false
+}
+
+func classifyGCS(err error) (bool, bool) {
+	var ge *googleapi.Error
+	if errors.As(err, &ge) {
+		return retryableStatus(ge.Code), true
+	}
+	return false, false
+}
+
+func classifyAzure(err error) (bool, bool) {
+	var re *azcore.ResponseError
+	if errors.As(err, &re) {
+		return retryableStatus(re.StatusCode), true
+	}
+	return false, false
+}
+
+// retryable reports whether an error returned by the named storage driver is
+// transient, so that the operation which returned it can be retried.
+func retryable(driverName string, err error) bool {
+	switch actual := err.(type) {
+	case nil:
+		return false
+	case storagedriver.PathNotFoundError, storagedriver.InvalidPathError,
+		storagedriver.InvalidOffsetError, storagedriver.ErrUnsupportedMethod:
+		return false
+	case storagedriver.Error:
+		// Errors of the drivers are wrapped by base.Base.
+		if actual.Detail != nil {
+			err = actual.Detail
+		}
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if classify, ok := classifiers[driverName]; ok {
+		if retryable, known := classify(err); known {
+			return retryable
+		}
+	}
+	return retryableNetworkError(err)
+}
+
+// retryableNetworkError reports whether an error is a transient network
+// error, common to all the drivers talking to a remote service.
+func retryableNetworkError(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,218 @@
+// Package middleware provides a storage middleware retrying the idempotent
+// operations of a storage driver which fail with transient errors, such as
+// the 503 responses object storage services return under load.
+//
+// GetContent, Stat, List, Delete and the opening of readers are retried with
+// an exponential backoff and full jitter. Errors are classified as transient
+// by driver: HTTP status codes of the s3aws, gcs and azure drivers, and
+// network errors for all the drivers. Writes are not retried, as they are
+// not idempotent when a failed attempt has partially succeeded.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+)
+
+var (
+	// retryCount is the number of retries of storage driver operations.
+	retryCount = prometheus.StorageNamespace.NewLabeledCounter("retries", "The number of retries of storage driver operations", "driver", "operation")
+	// retryExhaustedCount is the number of operations which failed after
+	// all their attempts.
+	retryExhaustedCount = prometheus.StorageNamespace.NewLabeledCounter("retries_exhausted", "The number of storage driver operations failing after all their attempts", "driver", "operation")
+)
+
+func init() {
+	if err := storagemiddleware.Register("retry", newRetryStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register retry storage middleware: %v", err)
+	}
+}
+
+type retryStorageMiddleware struct {
+	storagedriver.StorageDriver
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	// sleep waits for the given duration, unless the context is done.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+var _ storagedriver.StorageDriver = &retryStorageMiddleware{}
+
+func newRetryStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	d := &retryStorageMiddleware{
+		StorageDriver:  sd,
+		maxAttempts:    defaultMaxAttempts,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+		sleep:          sleep,
+	}
+
+	switch v := options["maxattempts"].(type) {
+	case nil:
+	case string:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("maxattempts must be an integer, %v invalid", v)
+		}
+		d.maxAttempts = n
+	case int, uint, int32, uint32, int64, uint64:
+		d.maxAttempts = int(reflect.ValueOf(v).Convert(reflect.TypeOf(int64(0))).Int())
+	default:
+		return nil, fmt.Errorf("invalid value for maxattempts: %#v", v)
+	}
+	if d.maxAttempts < 1 {
+		return nil, fmt.Errorf("maxattempts must be at least 1")
+	}
+
+	for name, value := range map[string]*time.Duration{
+		"initialbackoff": &d.initialBackoff,
+		"maxbackoff":     &d.maxBackoff,
+	} {
+		o, ok := options[name]
+		if !ok {
+			continue
+		}
+		s, ok := o.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a duration", name)
+		}
+		duration, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", name, err)
+		}
+		if duration <= 0 {
+			return nil, fmt.Errorf("%s must be positive", name)
+		}
+		*value = duration
+	}
+	if d.maxBackoff < d.initialBackoff {
+		return nil, fmt.Errorf("maxbackoff must not be lower than initialbackoff")
+	}
+
+	return d, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backoff returns the delay before the given retry, starting at 1: a random
+// duration up to the exponential backoff of the retry.
+func (d *retryStorageMiddleware) backoff(retry int) time.Duration {
+	backoff := d.maxBackoff
+	if retry < 32 {
+		if b := d.initialBackoff << (retry - 1); b > 0 && b < backoff {
+			backoff = b
+		}
+	}
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+// do calls op until it succeeds, fails with an error which is not transient
+// or has been attempted maxAttempts times.
+func (d *retryStorageMiddleware) do(ctx context.Context, operation, path string, op func() error) error {
+	driverName := d.Name()
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if !retryable(driverName, err) {
+			return err
+		}
+		if attempt == d.maxAttempts {
+			retryExhaustedCount.WithValues(driverName, operation).Inc(1)
+			return err
+		}
+
+		backoff := d.backoff(attempt)
+		dcontext.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+			"operation": operation,
+			"path":      path,
+			"attempt":   attempt,
+			"backoff":   backoff,
+		}).WithError(err).Warn("retrying storage driver operation")
+		retryCount.WithValues(driverName, operation).Inc(1)
+		if serr := d.sleep(ctx, backoff); serr != nil {
+			return err
+		}
+	}
+}
+
+func (d *retryStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	var content []byte
+	err := d.do(ctx, "GetContent", path, func() error {
+		var err error
+		content, err = d.StorageDriver.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+func (d *retryStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := d.do(ctx, "Reader", path, func() error {
+		var err error
+		rc, err = d.StorageDriver.Reader(ctx, path, offset)
+		return err
+	})
+	return rc, err
+}
+
+func (d *retryStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	var fi storagedriver.FileInfo
+	err := d.do(ctx, "Stat", path, func() error {
+		var err error
+		fi, err = d.StorageDriver.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+func (d *retryStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	var children []string
+	err := d.do(ctx, "List", path, func() error {
+		var err error
+		children, err = d.StorageDriver.List(ctx, path)
+		return err
+	})
+	return children, err
+}
+
+// Delete retries deletions. A retry failing because the path does not exist
+// anymore is considered successful, as the failed attempt may have deleted
+// it.
+func (d *retryStorageMiddleware) Delete(ctx context.Context, path string) error {
+	attempted := false
+	return d.do(ctx, "Delete", path, func() error {
+		err := d.StorageDriver.Delete(ctx, path)
+		if _, ok := err.(storagedriver.PathNotFoundError); ok && attempted {
+			return nil
+		}
+		attempted = true
+		return err
+	})
+}
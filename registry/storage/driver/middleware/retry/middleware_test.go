@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+// flakyDriver fails the operations with err until failures is exhausted.
+type flakyDriver struct {
+	storagedriver.StorageDriver
+	name     string
+	err      error
+	failures int
+	calls    int
+}
+
+func (d *flakyDriver) Name() string {
+	return d.name
+}
+
+func (d *flakyDriver) fail() error {
+	d.calls++
+	if d.failures > 0 {
+		d.failures--
+		return storagedriver.Error{DriverName: d.name, Detail: d.err}
+	}
+	return nil
+}
+
+func (d *flakyDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *flakyDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func (d *flakyDriver) Delete(ctx context.Context, path string) error {
+	// The failed attempts delete the content before failing.
+	err := d.StorageDriver.Delete(ctx, path)
+	if ferr := d.fail(); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+func newTestMiddleware(t *testing.T, sd storagedriver.StorageDriver, options map[string]interface{}) (*retryStorageMiddleware, *[]time.Duration) {
+	d, err := newRetryStorageMiddleware(context.Background(), sd, options)
+	require.NoError(t, err)
+	m := d.(*retryStorageMiddleware)
+
+	var backoffs []time.Duration
+	m.sleep = func(_ context.Context, d time.Duration) error {
+		backoffs = append(backoffs, d)
+		return nil
+	}
+	return m, &backoffs
+}
+
+func TestOptions(t *testing.T) {
+	for _, tc := range []struct {
+		options map[string]interface{}
+		err     string
+	}{
+		{map[string]interface{}{"maxattempts": 0}, "maxattempts must be at least 1"},
+		{map[string]interface{}{"maxattempts": "many"}, "maxattempts must be an integer"},
+		{map[string]interface{}{"initialbackoff": "soon"}, "unable to parse initialbackoff"},
+		{map[string]interface{}{"maxbackoff": 5}, "maxbackoff must be a duration"},
+		{map[string]interface{}{"initialbackoff": "1s", "maxbackoff": "100ms"}, "maxbackoff must not be lower than initialbackoff"},
+	} {
+		_, err := newRetryStorageMiddleware(context.Background(), inmemory.New(), tc.options)
+		require.ErrorContains(t, err, tc.err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyDriver{
+		StorageDriver: inmemory.New(),
+		name:          "s3aws",
+		err:           awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "slow down", nil), http.StatusServiceUnavailable, "id"),
+	}
+	require.NoError(t, backend.PutContent(ctx, "/content", []byte("content")))
+
+	d, backoffs := newTestMiddleware(t, backend, map[string]interface{}{
+		"maxattempts":    4,
+		"initialbackoff": "100ms",
+		"maxbackoff":     "250ms",
+	})
+
+	// Transient errors are retried until the operation succeeds.
+	backend.failures = 3
+	content, err := d.GetContent(ctx, "/content")
+	require.NoError(t, err)
+	require.Equal(t, "content", string(content))
+	require.Equal(t, 4, backend.calls)
+	require.Len(t, *backoffs, 3)
+	for i, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond} {
+		require.LessOrEqual(t, (*backoffs)[i], max)
+		require.Greater(t, (*backoffs)[i], time.Duration(0))
+	}
+
+	// The last error is returned once all the attempts have failed.
+	backend.calls, backend.failures = 0, 10
+	_, err = d.Reader(ctx, "/content", 0)
+	require.Error(t, err)
+	require.IsType(t, storagedriver.Error{}, err)
+	require.Equal(t, 4, backend.calls)
+
+	// Errors which are not transient are not retried.
+	backend.calls, backend.failures = 0, 0
+	_, err = d.GetContent(ctx, "/missing")
+	require.IsType(t, storagedriver.PathNotFoundError{}, err)
+	require.Equal(t, 1, backend.calls)
+
+	backend.calls, backend.failures = 0, 1
+	backend.err = awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), http.StatusForbidden, "id")
+	_, err = d.GetContent(ctx, "/content")
+	require.Error(t, err)
+	require.Equal(t, 1, backend.calls)
+
+	// A retried deletion succeeds when the failed attempt deleted the path.
+	backend.calls, backend.failures = 0, 1
+	backend.err = awserr.New("RequestError", "send request failed", syscall.ECONNRESET)
+	require.NoError(t, d.Delete(ctx, "/content"))
+	require.Equal(t, 2, backend.calls)
+	backend.calls = 0
+	require.IsType(t, storagedriver.PathNotFoundError{}, d.Delete(ctx, "/content"))
+	require.Equal(t, 1, backend.calls)
+}
+
+func TestRetryFaultsSuite(t *testing.T) {
+	testsuites.Faults(t, func() (storagedriver.StorageDriver, error) {
+		return inmemory.New(), nil
+	}, func(sd storagedriver.StorageDriver) (storagedriver.StorageDriver, error) {
+		return newRetryStorageMiddleware(context.Background(), sd, map[string]interface{}{
+			"maxattempts":    10,
+			"initialbackoff": "1ms",
+			"maxbackoff":     "10ms",
+		})
+	})
+}
+
+func TestRetryCancelled(t *testing.T) {
+	backend := &flakyDriver{
+		StorageDriver: inmemory.New(),
+		name:          "gcs",
+		err:           &googleapi.Error{Code: http.StatusTooManyRequests},
+		failures:      10,
+	}
+	d, err := newRetryStorageMiddleware(context.Background(), backend, map[string]interface{}{"initialbackoff": "1h", "maxbackoff": "1h"})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = d.GetContent(ctx, "/content")
+	require.Error(t, err)
+	require.Equal(t, 1, backend.calls)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		driver    string
+		err       error
+		retryable bool
+	}{
+		{"s3aws", awserr.NewRequestFailure(awserr.New("InternalError", "", nil), http.StatusInternalServerError, ""), true},
+		{"s3aws", awserr.NewRequestFailure(awserr.New("NoSuchBucket", "", nil), http.StatusNotFound, ""), false},
+		{"s3aws", awserr.New("SlowDown", "", nil), true},
+		{"s3aws", awserr.New("RequestError", "", timeoutError{}), true},
+		{"s3aws", awserr.New("SerializationError", "", errors.New("invalid")), false},
+		{"gcs", &googleapi.Error{Code: http.StatusBadGateway}, true},
+		{"gcs", &googleapi.Error{Code: http.StatusPreconditionFailed}, false},
+		{"azure", &azcore.ResponseError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"azure", &azcore.ResponseError{StatusCode: http.StatusConflict}, false},
+		{"filesystem", fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{"filesystem", timeoutError{}, true},
+		{"filesystem", errors.New("disk full"), false},
+		{"filesystem", context.Canceled, false},
+		{"s3aws", storagedriver.PathNotFoundError{Path: "/"}, false},
+		{"s3aws", storagedriver.Error{DriverName: "s3aws", Detail: &googleapi.Error{Code: http.StatusServiceUnavailable}}, false},
+		{"gcs", storagedriver.Error{DriverName: "gcs", Detail: &googleapi.Error{Code: http.StatusServiceUnavailable}}, true},
+	} {
+		require.Equal(t, tc.retryable, retryable(tc.driver, tc.err), "%s: %v", tc.driver, tc.err)
+	}
+}
@@ -0,0 +1,749 @@
+// Package ocilayout provides a storage driver serving OCI image layout
+// directories through the registry API.
+//
+// The root directory of the driver holds OCI image layouts, each layout
+// being a repository named after its path relative to the root directory. The
+// driver maps the paths of the registry storage onto the layouts: blobs are
+// read from the blobs directory of the layouts, layer links are synthesized
+// from the blobs of the layout of the repository, and manifest revisions and
+// tags from its index.json, tags being the
+// org.opencontainers.image.ref.name annotations of the manifests.
+//
+// The driver is read-only by default. When writes are enabled, pushed blobs
+// are stored in the layout of the repository they are pushed to, and
+// index.json is updated when manifests are pushed, tagged or deleted. Uploads
+// in progress and blobs which are not linked to a repository yet are stored in
+// the hidden .registry directory of the root directory.
+package ocilayout
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	driverName = "ocilayout"
+
+	// rootPath is the root of the registry storage paths.
+	rootPath = "/docker/registry/v2"
+
+	// scratchDirectory is the directory of the root directory holding the
+	// uploads and the blobs which are not linked to a repository yet.
+	scratchDirectory = ".registry"
+
+	// layoutsTTL is the time the layouts found under the root directory are
+	// cached for, after which the layouts added or removed by other
+	// processes are found.
+	layoutsTTL = 10 * time.Second
+)
+
+// errReadOnly is returned by the write operations of read-only drivers.
+var errReadOnly = errors.New("the OCI layouts are served read-only")
+
+// errReferencedManifest is returned when deleting a manifest still referenced
+// by an index of the layout.
+var errReferencedManifest = errors.New("the manifest is referenced by an index of the OCI layout")
+
+// DriverParameters represents all configuration options available for the
+// ocilayout driver
+type DriverParameters struct {
+	RootDirectory string
+	ReadOnly      bool
+}
+
+func init() {
+	factory.Register(driverName, &ocilayoutDriverFactory{})
+}
+
+// ocilayoutDriverFactory implements the factory.StorageDriverFactory interface
+type ocilayoutDriverFactory struct{}
+
+func (factory *ocilayoutDriverFactory) Create(ctx context.Context, parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+type driver struct {
+	rootDirectory string
+	readOnly      bool
+
+	// scratch stores the uploads and the blobs which are not linked to a
+	// repository yet.
+	scratch storagedriver.StorageDriver
+
+	// mu serializes the updates of the layouts.
+	mu sync.Mutex
+	// blobs caches the filesystem paths of the blobs found in the
+	// layouts, by digest.
+	blobs sync.Map
+
+	// layoutsMu guards the cached names of the layouts, scanned at
+	// layoutsScanned.
+	layoutsMu      sync.Mutex
+	layoutNames    []string
+	layoutsScanned time.Time
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// Driver is a storagedriver.StorageDriver implementation serving the OCI
+// image layouts of a local directory.
+type Driver struct {
+	baseEmbed
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - rootdirectory
+// Optional Parameters:
+// - readonly
+func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	params := DriverParameters{ReadOnly: true}
+
+	rootDirectory, ok := parameters["rootdirectory"]
+	if !ok || fmt.Sprint(rootDirectory) == "" {
+		return nil, fmt.Errorf("no rootdirectory parameter provided")
+	}
+	params.RootDirectory = fmt.Sprint(rootDirectory)
+
+	switch readOnly := parameters["readonly"].(type) {
+	case string:
+		b, err := strconv.ParseBool(readOnly)
+		if err != nil {
+			return nil, fmt.Errorf("the readonly parameter should be a boolean")
+		}
+		params.ReadOnly = b
+	case bool:
+		params.ReadOnly = readOnly
+	case nil:
+		// do nothing
+	default:
+		return nil, fmt.Errorf("the readonly parameter should be a boolean")
+	}
+
+	return New(params)
+}
+
+// New constructs a new Driver serving the layouts of params.RootDirectory
+func New(params DriverParameters) (*Driver, error) {
+	fi, err := os.Stat(params.RootDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access rootdirectory: %v", err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("rootdirectory %s is not a directory", params.RootDirectory)
+	}
+
+	d := &driver{
+		rootDirectory: params.RootDirectory,
+		readOnly:      params.ReadOnly,
+		scratch: filesystem.New(filesystem.DriverParameters{
+			RootDirectory: filepath.Join(params.RootDirectory, scratchDirectory),
+			MaxThreads:    100,
+		}),
+	}
+
+	return &Driver{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: d,
+			},
+		},
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if scratchPath, ok := uploadPath(path); ok {
+		return d.scratch.GetContent(ctx, scratchPath)
+	}
+
+	rc, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	if d.readOnly {
+		return errReadOnly
+	}
+	if scratchPath, ok := uploadPath(path); ok {
+		return d.scratch.PutContent(ctx, scratchPath, contents)
+	}
+
+	p := parsePath(path)
+	switch p.kind {
+	case kindBlobData:
+		return d.scratch.PutContent(ctx, pendingPath(p.dgst), contents)
+	case kindLayerLink, kindRevisionLink, kindTagCurrentLink, kindTagIndexLink:
+		dgst, err := digest.Parse(string(contents))
+		if err != nil {
+			return fmt.Errorf("invalid link content: %v", err)
+		}
+		switch p.kind {
+		case kindLayerLink:
+			return d.linkBlob(p.repository, dgst)
+		case kindRevisionLink:
+			if err := d.linkBlob(p.repository, dgst); err != nil {
+				return err
+			}
+			return d.addManifest(p.repository, dgst)
+		case kindTagCurrentLink:
+			return d.setTag(p.repository, p.tag, dgst)
+		}
+		// Tag index entries are derived from the current tags.
+		return nil
+	case kindRevisionTag:
+		// The tags of the revisions are not stored, so that the tags are
+		// looked up from their current links.
+		return nil
+	case kindCatalog:
+		// The catalog index is not stored, so that the repositories are
+		// listed from the layout.
+		return nil
+	}
+	return storagedriver.InvalidPathError{Path: path, DriverName: driverName}
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if scratchPath, ok := uploadPath(path); ok {
+		return d.scratch.Reader(ctx, scratchPath, offset)
+	}
+
+	n, err := d.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if n.dir {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+
+	if n.file == "" {
+		if offset > int64(len(n.content)) {
+			return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+		}
+		return io.NopCloser(bytes.NewReader(n.content[offset:])), nil
+	}
+
+	file, err := os.Open(n.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, storagedriver.PathNotFoundError{Path: path}
+		}
+		return nil, err
+	}
+	seekPos, err := file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	} else if seekPos < offset {
+		file.Close()
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	}
+	return file, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit. Only the
+// uploads are written with writers.
+func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if d.readOnly {
+		return nil, errReadOnly
+	}
+	if scratchPath, ok := uploadPath(path); ok {
+		return d.scratch.Writer(ctx, scratchPath, append)
+	}
+	return nil, storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if scratchPath, ok := uploadPath(path); ok {
+		fi, err := d.scratch.Stat(ctx, scratchPath)
+		if err != nil {
+			return nil, err
+		}
+		return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+			Path:    path,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			IsDir:   fi.IsDir(),
+		}}, nil
+	}
+
+	n, err := d.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi := storagedriver.FileInfoFields{
+		Path:    path,
+		Size:    int64(len(n.content)),
+		ModTime: n.modTime,
+		IsDir:   n.dir,
+	}
+	if n.file != "" {
+		osfi, err := os.Stat(n.file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, storagedriver.PathNotFoundError{Path: path}
+			}
+			return nil, err
+		}
+		fi.Size = osfi.Size()
+		fi.ModTime = osfi.ModTime()
+	}
+	if n.dir {
+		fi.Size = 0
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the given
+// path.
+func (d *driver) List(ctx context.Context, subPath string) ([]string, error) {
+	if scratchPath, ok := uploadPath(subPath); ok {
+		children, err := d.scratch.List(ctx, scratchPath)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(children))
+		for _, child := range children {
+			keys = append(keys, path.Join(subPath, path.Base(child)))
+		}
+		return keys, nil
+	}
+
+	n, err := d.resolve(subPath)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, storagedriver.PathNotFoundError{Path: subPath}
+	}
+
+	keys := make([]string, 0, len(n.children))
+	for _, child := range n.children {
+		keys = append(keys, path.Join(subPath, child))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the original
+// object. Only uploads can be moved, to other uploads or to blobs.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if d.readOnly {
+		return errReadOnly
+	}
+	source, ok := uploadPath(sourcePath)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	}
+
+	dest, ok := uploadPath(destPath)
+	if !ok {
+		p := parsePath(destPath)
+		if p.kind != kindBlobData {
+			return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+		}
+		dest = pendingPath(p.dgst)
+	}
+	return d.scratch.Move(ctx, source, dest)
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, subPath string) error {
+	if d.readOnly {
+		return errReadOnly
+	}
+	if scratchPath, ok := uploadPath(subPath); ok {
+		return d.scratch.Delete(ctx, scratchPath)
+	}
+
+	p := parsePath(subPath)
+	switch p.kind {
+	case kindBlob, kindBlobData:
+		return d.deleteBlob(ctx, subPath, p.dgst)
+	case kindLayer, kindLayerLink:
+		if !d.isLayout(p.repository) {
+			return storagedriver.PathNotFoundError{Path: subPath}
+		}
+		err := os.Remove(d.layoutBlobPath(p.repository, p.dgst))
+		if os.IsNotExist(err) {
+			return storagedriver.PathNotFoundError{Path: subPath}
+		}
+		return err
+	case kindRevision, kindRevisionLink:
+		return d.removeManifest(subPath, p.repository, p.dgst)
+	case kindTag, kindTagCurrent:
+		return d.removeTag(subPath, p.repository, p.tag)
+	case kindTagIndexEntry, kindTagIndexLink, kindRevisionTag, kindCatalog:
+		// Tag index entries are derived from the current tags, and the
+		// catalog from the repositories of the layout.
+		return nil
+	case kindRepositoryDirectory:
+		return d.deleteRepository(ctx, subPath, p.repository)
+	}
+	return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+}
+
+// RedirectURL returns an empty URL, as the layouts are served by the
+// registry.
+func (d *driver) RedirectURL(*http.Request, string) (string, error) {
+	return "", nil
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file and directory
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// node is a file or a directory of the registry storage.
+type node struct {
+	dir      bool
+	children []string
+	// content is the content of links, and file the filesystem path of
+	// blob data.
+	content []byte
+	file    string
+	modTime time.Time
+}
+
+func dirNode(children ...string) *node {
+	return &node{dir: true, children: children}
+}
+
+func linkNode(dgst digest.Digest, modTime time.Time) *node {
+	return &node{content: []byte(dgst), modTime: modTime}
+}
+
+// resolve returns the node at a registry storage path, which is not an
+// upload path.
+func (d *driver) resolve(subPath string) (*node, error) {
+	notFound := storagedriver.PathNotFoundError{Path: subPath}
+
+	switch subPath {
+	case "/":
+		return dirNode("docker"), nil
+	case "/docker":
+		return dirNode("registry"), nil
+	case "/docker/registry":
+		return dirNode("v2"), nil
+	case rootPath:
+		return dirNode("blobs", "repositories"), nil
+	}
+
+	p := parsePath(subPath)
+	switch p.kind {
+	case kindBlobs:
+		children, err := d.allBlobs(p.elems)
+		if err != nil {
+			return nil, err
+		}
+		if len(children) == 0 && len(p.elems) > 0 {
+			return nil, notFound
+		}
+		return dirNode(children...), nil
+	case kindBlob:
+		if d.findBlob(p.dgst) == "" {
+			return nil, notFound
+		}
+		return dirNode("data"), nil
+	case kindBlobData:
+		file := d.findBlob(p.dgst)
+		if file == "" {
+			return nil, notFound
+		}
+		return &node{file: file}, nil
+	case kindRepositoryDirectory:
+		children, err := d.repositoryChildren(p.repository)
+		if err != nil {
+			return nil, err
+		}
+		if len(children) == 0 && p.repository != "" {
+			return nil, notFound
+		}
+		return dirNode(children...), nil
+	}
+
+	if p.repository == "" || !d.isLayout(p.repository) {
+		return nil, notFound
+	}
+
+	switch p.kind {
+	case kindLayers:
+		children, err := d.layoutBlobs(p.repository, p.elems)
+		if err != nil {
+			return nil, err
+		}
+		if len(children) == 0 {
+			return nil, notFound
+		}
+		return dirNode(children...), nil
+	case kindLayer, kindLayerLink:
+		fi, err := os.Stat(d.layoutBlobPath(p.repository, p.dgst))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, notFound
+			}
+			return nil, err
+		}
+		if p.kind == kindLayer {
+			return dirNode("link"), nil
+		}
+		return linkNode(p.dgst, fi.ModTime()), nil
+	case kindManifests:
+		return dirNode("revisions", "tags"), nil
+	}
+
+	idx, modTime, err := d.readIndex(p.repository)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.kind {
+	case kindRevisions:
+		children := digestChildren(d.reachable(p.repository, idx.Manifests), p.elems)
+		if len(children) == 0 {
+			return nil, notFound
+		}
+		return dirNode(children...), nil
+	case kindRevision, kindRevisionLink:
+		if _, ok := d.reachable(p.repository, idx.Manifests)[p.dgst]; !ok {
+			return nil, notFound
+		}
+		if p.kind == kindRevision {
+			return dirNode("link"), nil
+		}
+		return linkNode(p.dgst, modTime), nil
+	case kindTags:
+		var children []string
+		for tag := range tags(idx) {
+			children = append(children, tag)
+		}
+		if len(children) == 0 {
+			return nil, notFound
+		}
+		return dirNode(children...), nil
+	}
+
+	dgst, ok := tags(idx)[p.tag]
+	if !ok {
+		return nil, notFound
+	}
+	switch p.kind {
+	case kindTag:
+		return dirNode("current", "index"), nil
+	case kindTagCurrent:
+		return dirNode("link"), nil
+	case kindTagCurrentLink:
+		return linkNode(dgst, modTime), nil
+	case kindTagIndex:
+		children := digestChildren(map[digest.Digest]struct{}{dgst: {}}, p.elems)
+		if len(children) == 0 {
+			return nil, notFound
+		}
+		return dirNode(children...), nil
+	case kindTagIndexEntry, kindTagIndexLink:
+		if p.dgst != dgst {
+			return nil, notFound
+		}
+		if p.kind == kindTagIndexEntry {
+			return dirNode("link"), nil
+		}
+		return linkNode(dgst, modTime), nil
+	}
+	return nil, notFound
+}
+
+// digestChildren returns the children of a directory of digests, with the
+// given path components under it: algorithms when there is none, and the
+// encoded digests of an algorithm otherwise.
+func digestChildren(digests map[digest.Digest]struct{}, elems []string) []string {
+	seen := make(map[string]struct{})
+	var children []string
+	for dgst := range digests {
+		var child string
+		switch len(elems) {
+		case 0:
+			child = dgst.Algorithm().String()
+		case 1:
+			if dgst.Algorithm().String() != elems[0] {
+				continue
+			}
+			child = dgst.Encoded()
+		}
+		if _, ok := seen[child]; !ok && child != "" {
+			seen[child] = struct{}{}
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// deleteBlob deletes a blob from all the layouts holding it.
+func (d *driver) deleteBlob(ctx context.Context, subPath string, dgst digest.Digest) error {
+	found := false
+	layouts, err := d.layouts()
+	if err != nil {
+		return err
+	}
+	for _, layout := range layouts {
+		err := os.Remove(d.layoutBlobPath(layout, dgst))
+		switch {
+		case err == nil:
+			found = true
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+	d.blobs.Delete(dgst)
+
+	err = d.scratch.Delete(ctx, pendingPath(dgst))
+	switch err.(type) {
+	case nil:
+		found = true
+	case storagedriver.PathNotFoundError:
+	default:
+		return err
+	}
+
+	if !found {
+		return storagedriver.PathNotFoundError{Path: subPath}
+	}
+	return nil
+}
+
+// deleteRepository deletes a repository, with its uploads.
+func (d *driver) deleteRepository(ctx context.Context, subPath, repository string) error {
+	found := false
+	if d.isLayout(repository) {
+		d.mu.Lock()
+		err := os.RemoveAll(d.layoutPath(repository))
+		d.invalidateLayouts()
+		d.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+
+	err := d.scratch.Delete(ctx, path.Join("/uploads", repository))
+	switch err.(type) {
+	case nil:
+		found = true
+	case storagedriver.PathNotFoundError:
+	default:
+		return err
+	}
+
+	if !found {
+		return storagedriver.PathNotFoundError{Path: subPath}
+	}
+	return nil
+}
+
+// repositoryChildren returns the children of a directory of the
+// repositories directory: the repositories or the directories of nested
+// repositories under it, and the layers, manifests and uploads directories
+// of the repository it is.
+func (d *driver) repositoryChildren(prefix string) ([]string, error) {
+	layouts, err := d.layouts()
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := scanRepositories(filepath.Join(d.rootDirectory, scratchDirectory, "uploads"), func(dir string) bool {
+		fi, err := os.Stat(filepath.Join(dir, "_uploads"))
+		return err == nil && fi.IsDir()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	var children []string
+	add := func(child string) {
+		if _, ok := seen[child]; !ok {
+			seen[child] = struct{}{}
+			children = append(children, child)
+		}
+	}
+
+	for _, repository := range append(layouts, uploads...) {
+		if prefix == "" {
+			add(strings.SplitN(repository, "/", 2)[0])
+		} else if strings.HasPrefix(repository, prefix+"/") {
+			add(strings.SplitN(strings.TrimPrefix(repository, prefix+"/"), "/", 2)[0])
+		}
+	}
+	if prefix == "" {
+		return children, nil
+	}
+
+	for _, layout := range layouts {
+		if layout == prefix {
+			add("_layers")
+			add("_manifests")
+		}
+	}
+	for _, upload := range uploads {
+		if upload == prefix {
+			add("_uploads")
+		}
+	}
+	return children, nil
+}
+
+// uploadPath returns the path of the scratch storage of an upload path.
+func uploadPath(subPath string) (string, bool) {
+	rel, ok := strings.CutPrefix(subPath, rootPath+"/repositories/")
+	if !ok {
+		return "", false
+	}
+	repository, rest, ok := strings.Cut(rel, "/_uploads")
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+	return path.Join("/uploads", repository, "_uploads", rest), true
+}
+
+// pendingPath returns the path of the scratch storage of a blob which is
+// not linked to a repository yet.
+func pendingPath(dgst digest.Digest) string {
+	return path.Join("/blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
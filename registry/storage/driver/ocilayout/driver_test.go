@@ -0,0 +1,324 @@
+package ocilayout
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLayout writes a layout holding an image tagged with tag, returning
+// the digests of its manifest and of its layer.
+func writeLayout(t *testing.T, dir, tag string) (digest.Digest, digest.Digest) {
+	writeBlob := func(content []byte) v1.Descriptor {
+		dgst := digest.FromBytes(content)
+		p := filepath.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o777))
+		require.NoError(t, os.WriteFile(p, content, 0o644))
+		return v1.Descriptor{Digest: dgst, Size: int64(len(content))}
+	}
+	marshal := func(v interface{}) []byte {
+		content, err := json.Marshal(v)
+		require.NoError(t, err)
+		return content
+	}
+
+	config := writeBlob([]byte(`{"architecture":"amd64","os":"linux"}`))
+	config.MediaType = v1.MediaTypeImageConfig
+	layer := writeBlob([]byte("layer of " + dir))
+	layer.MediaType = v1.MediaTypeImageLayer
+	manifest := writeBlob(marshal(v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []v1.Descriptor{layer},
+	}))
+	manifest.MediaType = v1.MediaTypeImageManifest
+	manifest.Annotations = map[string]string{v1.AnnotationRefName: tag}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "oci-layout"), marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion}), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), marshal(v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []v1.Descriptor{manifest},
+	}), 0o644))
+	return manifest.Digest, layer.Digest
+}
+
+func readIndex(t *testing.T, dir string) v1.Index {
+	content, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	require.NoError(t, err)
+	var idx v1.Index
+	require.NoError(t, json.Unmarshal(content, &idx))
+	return idx
+}
+
+func newTestRegistry(t *testing.T, root string, readOnly bool) distribution.Namespace {
+	d, err := FromParameters(map[string]interface{}{"rootdirectory": root, "readonly": readOnly})
+	require.NoError(t, err)
+	registry, err := storage.NewRegistry(context.Background(), d, storage.EnableDelete)
+	require.NoError(t, err)
+	return registry
+}
+
+func repository(t *testing.T, registry distribution.Namespace, name string) distribution.Repository {
+	named, err := reference.WithName(name)
+	require.NoError(t, err)
+	repo, err := registry.Repository(context.Background(), named)
+	require.NoError(t, err)
+	return repo
+}
+
+func TestParameters(t *testing.T) {
+	_, err := FromParameters(map[string]interface{}{})
+	require.ErrorContains(t, err, "no rootdirectory parameter provided")
+	_, err = FromParameters(map[string]interface{}{"rootdirectory": filepath.Join(t.TempDir(), "missing")})
+	require.ErrorContains(t, err, "unable to access rootdirectory")
+	_, err = FromParameters(map[string]interface{}{"rootdirectory": t.TempDir(), "readonly": "sometimes"})
+	require.ErrorContains(t, err, "the readonly parameter should be a boolean")
+}
+
+func TestServeLayouts(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	appDigest, layerDigest := writeLayout(t, filepath.Join(root, "library", "app"), "v1")
+	writeLayout(t, filepath.Join(root, "tools"), "latest")
+	// Nested layouts are repositories as well, unlike hidden directories.
+	writeLayout(t, filepath.Join(root, "tools", "debug"), "latest")
+	writeLayout(t, filepath.Join(root, ".staging", "app"), "v2")
+
+	registry := newTestRegistry(t, root, true)
+	repos := make([]string, 10)
+	n, _ := registry.Repositories(ctx, repos, "")
+	require.Equal(t, []string{"library/app", "tools", "tools/debug"}, repos[:n])
+
+	repo := repository(t, registry, "library/app")
+	tags, err := repo.Tags(ctx).All(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"v1"}, tags)
+	desc, err := repo.Tags(ctx).Get(ctx, "v1")
+	require.NoError(t, err)
+	require.Equal(t, appDigest, desc.Digest)
+
+	manifests, err := repo.Manifests(ctx)
+	require.NoError(t, err)
+	manifest, err := manifests.Get(ctx, appDigest)
+	require.NoError(t, err)
+	require.Len(t, manifest.References(), 2)
+
+	content, err := repo.Blobs(ctx).Get(ctx, layerDigest)
+	require.NoError(t, err)
+	require.Equal(t, "layer of "+filepath.Join(root, "library", "app"), string(content))
+
+	// The blobs of a layout are not linked to the other repositories.
+	_, err = repository(t, registry, "tools").Blobs(ctx).Stat(ctx, layerDigest)
+	require.ErrorIs(t, err, distribution.ErrBlobUnknown)
+
+	// Read-only layouts are not modified.
+	require.Error(t, repo.Tags(ctx).Tag(ctx, "v2", desc))
+	_, err = repo.Blobs(ctx).Create(ctx)
+	require.Error(t, err)
+	require.Len(t, readIndex(t, filepath.Join(root, "library", "app")).Manifests, 1)
+}
+
+func TestPushToLayouts(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	registry := newTestRegistry(t, root, false)
+	repo := repository(t, registry, "library/app")
+	dir := filepath.Join(root, "library", "app")
+
+	layers, err := testutil.CreateRandomLayers(2)
+	require.NoError(t, err)
+	require.NoError(t, testutil.UploadBlobs(repo, layers))
+	var digests []digest.Digest
+	for dgst := range layers {
+		digests = append(digests, dgst)
+	}
+	manifest, err := testutil.MakeOCIManifest(repo, digests)
+	require.NoError(t, err)
+	manifests, err := repo.Manifests(ctx)
+	require.NoError(t, err)
+	manifestDigest, err := manifests.Put(ctx, manifest)
+	require.NoError(t, err)
+	tagService := repo.Tags(ctx)
+	require.NoError(t, tagService.Tag(ctx, "latest", distribution.Descriptor{Digest: manifestDigest}))
+
+	// The pushed content is written as a layout.
+	_, err = os.Stat(filepath.Join(dir, "oci-layout"))
+	require.NoError(t, err)
+	for _, dgst := range append(digests, manifestDigest) {
+		_, err := os.Stat(filepath.Join(dir, "blobs", "sha256", dgst.Encoded()))
+		require.NoError(t, err)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, scratchDirectory, "blobs", "sha256"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	idx := readIndex(t, dir)
+	require.Len(t, idx.Manifests, 1)
+	require.Equal(t, manifestDigest, idx.Manifests[0].Digest)
+	require.Equal(t, v1.MediaTypeImageManifest, idx.Manifests[0].MediaType)
+	require.Equal(t, "latest", idx.Manifests[0].Annotations[v1.AnnotationRefName])
+
+	// Tags are annotations of the manifests of the index.
+	require.NoError(t, tagService.Tag(ctx, "stable", distribution.Descriptor{Digest: manifestDigest}))
+	require.Len(t, readIndex(t, dir).Manifests, 2)
+	tags, err := tagService.Lookup(ctx, distribution.Descriptor{Digest: manifestDigest})
+	require.NoError(t, err)
+	sort.Strings(tags)
+	require.Equal(t, []string{"latest", "stable"}, tags)
+
+	require.NoError(t, tagService.Untag(ctx, "latest"))
+	require.NoError(t, tagService.Untag(ctx, "stable"))
+	idx = readIndex(t, dir)
+	require.Len(t, idx.Manifests, 1)
+	require.Empty(t, idx.Manifests[0].Annotations[v1.AnnotationRefName])
+	_, err = manifests.Get(ctx, manifestDigest)
+	require.NoError(t, err)
+
+	// Indexes replace the untagged manifests they reference.
+	list, err := testutil.MakeManifestList(registry.BlobStatter(), []digest.Digest{manifestDigest})
+	require.NoError(t, err)
+	listDigest, err := manifests.Put(ctx, list)
+	require.NoError(t, err)
+	require.NoError(t, tagService.Tag(ctx, "multi", distribution.Descriptor{Digest: listDigest}))
+	idx = readIndex(t, dir)
+	require.Len(t, idx.Manifests, 1)
+	require.Equal(t, listDigest, idx.Manifests[0].Digest)
+	_, err = manifests.Get(ctx, manifestDigest)
+	require.NoError(t, err)
+
+	// Manifests referenced by an index cannot be deleted.
+	require.ErrorContains(t, manifests.Delete(ctx, manifestDigest), errReferencedManifest.Error())
+	_, err = manifests.Get(ctx, manifestDigest)
+	require.NoError(t, err)
+
+	// Deleting an index keeps the manifests it references.
+	require.NoError(t, manifests.Delete(ctx, listDigest))
+	idx = readIndex(t, dir)
+	require.Len(t, idx.Manifests, 1)
+	require.Equal(t, manifestDigest, idx.Manifests[0].Digest)
+	require.NoError(t, manifests.Delete(ctx, manifestDigest))
+	require.Empty(t, readIndex(t, dir).Manifests)
+
+	// Mounted blobs are copied to the layout of the target repository.
+	canonical, err := reference.WithDigest(repo.Named(), digests[0])
+	require.NoError(t, err)
+	_, err = repository(t, registry, "mirror/app").Blobs(ctx).Create(ctx, storage.WithMountFrom(canonical))
+	require.IsType(t, distribution.ErrBlobMounted{}, err)
+	_, err = os.Stat(filepath.Join(root, "mirror", "app", "blobs", "sha256", digests[0].Encoded()))
+	require.NoError(t, err)
+
+	// Repositories are removed with their layout.
+	require.NoError(t, registry.(distribution.RepositoryRemover).Remove(ctx, repo.Named()))
+	_, err = os.Stat(dir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestLayoutsCache(t *testing.T) {
+	root := t.TempDir()
+	writeLayout(t, filepath.Join(root, "app"), "v1")
+	d, err := New(DriverParameters{RootDirectory: root})
+	require.NoError(t, err)
+	inner := d.StorageDriver.(*driver)
+
+	layouts, err := inner.layouts()
+	require.NoError(t, err)
+	require.Equal(t, []string{"app"}, layouts)
+
+	// The layouts added by other processes are found once the cache expires,
+	// and the layouts created or deleted by the driver right away.
+	writeLayout(t, filepath.Join(root, "tools"), "latest")
+	layouts, err = inner.layouts()
+	require.NoError(t, err)
+	require.Equal(t, []string{"app"}, layouts)
+
+	inner.mu.Lock()
+	require.NoError(t, inner.ensureLayout("pushed"))
+	inner.mu.Unlock()
+	layouts, err = inner.layouts()
+	require.NoError(t, err)
+	require.Equal(t, []string{"app", "pushed", "tools"}, layouts)
+
+	require.NoError(t, inner.deleteRepository(context.Background(), "/docker/registry/v2/repositories/pushed", "pushed"))
+	writeLayout(t, filepath.Join(root, "later"), "latest")
+	layouts, err = inner.layouts()
+	require.NoError(t, err)
+	require.Equal(t, []string{"app", "later", "tools"}, layouts)
+
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "later")))
+	inner.layoutsScanned = time.Now().Add(-layoutsTTL)
+	layouts, err = inner.layouts()
+	require.NoError(t, err)
+	require.Equal(t, []string{"app", "tools"}, layouts)
+}
+
+func TestParsePath(t *testing.T) {
+	dgst := digest.FromString("content")
+	for _, tc := range []struct {
+		path     string
+		expected registryPath
+	}{
+		{"/docker/registry/v2/blobs/sha256", registryPath{kind: kindBlobs, elems: []string{"sha256"}}},
+		{"/docker/registry/v2/blobs/sha256/" + dgst.Encoded()[:2] + "/" + dgst.Encoded() + "/data", registryPath{kind: kindBlobData, dgst: dgst}},
+		{"/docker/registry/v2/blobs/sha256/00/" + dgst.Encoded() + "/data", registryPath{kind: kindOther}},
+		{"/docker/registry/v2/repositories/library", registryPath{kind: kindRepositoryDirectory, repository: "library"}},
+		{"/docker/registry/v2/repositories/library/app/_layers/sha256/" + dgst.Encoded() + "/link", registryPath{kind: kindLayerLink, repository: "library/app", dgst: dgst}},
+		{"/docker/registry/v2/repositories/app/_manifests/revisions/sha256", registryPath{kind: kindRevisions, repository: "app", elems: []string{"sha256"}}},
+		{"/docker/registry/v2/repositories/app/_manifests/revisions/sha256/" + dgst.Encoded() + "/tags", registryPath{kind: kindRevisionTag, repository: "app", dgst: dgst}},
+		{"/docker/registry/v2/repositories/app/_manifests/revisions/sha256/" + dgst.Encoded() + "/tags/v1/tag", registryPath{kind: kindRevisionTag, repository: "app", dgst: dgst}},
+		{"/docker/registry/v2/repositories/app/_manifests/revisiontags", registryPath{kind: kindRevisionTag, repository: "app"}},
+		{"/docker/registry/v2/catalog/repositories/team..app", registryPath{kind: kindCatalog}},
+		{"/docker/registry/v2/repositories/app/_manifests/tags/v1/current/link", registryPath{kind: kindTagCurrentLink, repository: "app", tag: "v1"}},
+		{"/docker/registry/v2/repositories/app/_manifests/tags/v1/index/sha256/" + dgst.Encoded(), registryPath{kind: kindTagIndexEntry, repository: "app", tag: "v1", dgst: dgst}},
+		{"/docker/registry/v2/repositories/app/_manifests/tags/v1/index/sha256/invalid", registryPath{kind: kindOther}},
+		{"/docker/registry/v2/repositories/_layers", registryPath{kind: kindOther}},
+		{"/docker/registry/v3", registryPath{kind: kindOther}},
+	} {
+		require.Equal(t, tc.expected, parsePath(tc.path), tc.path)
+	}
+
+	scratchPath, ok := uploadPath("/docker/registry/v2/repositories/library/app/_uploads/id/data")
+	require.True(t, ok)
+	require.Equal(t, "/uploads/library/app/_uploads/id/data", scratchPath)
+	_, ok = uploadPath("/docker/registry/v2/repositories/library/app/_uploadsx")
+	require.False(t, ok)
+}
+
+func TestWalk(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	manifestDigest, layerDigest := writeLayout(t, filepath.Join(root, "app"), "v1")
+	d, err := New(DriverParameters{RootDirectory: root, ReadOnly: true})
+	require.NoError(t, err)
+
+	var files []string
+	require.NoError(t, d.Walk(ctx, "/", func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() {
+			files = append(files, fi.Path())
+		}
+		return nil
+	}))
+	require.Contains(t, files, "/docker/registry/v2/blobs/sha256/"+layerDigest.Encoded()[:2]+"/"+layerDigest.Encoded()+"/data")
+	require.Contains(t, files, "/docker/registry/v2/repositories/app/_layers/sha256/"+layerDigest.Encoded()+"/link")
+	require.Contains(t, files, "/docker/registry/v2/repositories/app/_manifests/revisions/sha256/"+manifestDigest.Encoded()+"/link")
+	require.Contains(t, files, "/docker/registry/v2/repositories/app/_manifests/tags/v1/current/link")
+	require.Contains(t, files, "/docker/registry/v2/repositories/app/_manifests/tags/v1/index/sha256/"+manifestDigest.Encoded()+"/link")
+
+	content, err := d.GetContent(ctx, "/docker/registry/v2/repositories/app/_manifests/tags/v1/current/link")
+	require.NoError(t, err)
+	require.Equal(t, manifestDigest.String(), string(content))
+}
@@ -0,0 +1,601 @@
+package ocilayout
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// mediaTypeManifestList is the media type of Docker manifest lists, which
+// layouts may hold as well as OCI image indexes.
+const mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == v1.MediaTypeImageIndex || mediaType == mediaTypeManifestList
+}
+
+func isLayoutDir(dir string) bool {
+	fi, err := os.Stat(filepath.Join(dir, v1.ImageLayoutFile))
+	return err == nil && !fi.IsDir()
+}
+
+// scanRepositories returns the names of the repositories under root, the
+// directories for which isRepository returns true. Hidden directories, the
+// directories of the registry storage and the blobs directories of the
+// layouts are skipped.
+func scanRepositories(root string, isRepository func(dir string) bool) ([]string, error) {
+	var repositories []string
+	err := filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !entry.IsDir() || p == root {
+			return nil
+		}
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+			(name == "blobs" && isLayoutDir(filepath.Dir(p))) {
+			return filepath.SkipDir
+		}
+		if isRepository(p) {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			repositories = append(repositories, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return repositories, err
+}
+
+// layouts returns the names of the repositories of the layouts. The names
+// are cached for layoutsTTL, or until a layout is created or deleted by the
+// driver, so that looking up blobs does not walk the root directory.
+func (d *driver) layouts() ([]string, error) {
+	d.layoutsMu.Lock()
+	defer d.layoutsMu.Unlock()
+
+	if !d.layoutsScanned.IsZero() && time.Since(d.layoutsScanned) < layoutsTTL {
+		// the callers may append to the names, but not modify them
+		return d.layoutNames[:len(d.layoutNames):len(d.layoutNames)], nil
+	}
+	layouts, err := scanRepositories(d.rootDirectory, isLayoutDir)
+	if err != nil {
+		return nil, err
+	}
+	d.layoutNames, d.layoutsScanned = layouts, time.Now()
+	return layouts[:len(layouts):len(layouts)], nil
+}
+
+// invalidateLayouts drops the cached names of the layouts.
+func (d *driver) invalidateLayouts() {
+	d.layoutsMu.Lock()
+	defer d.layoutsMu.Unlock()
+	d.layoutNames, d.layoutsScanned = nil, time.Time{}
+}
+
+func (d *driver) layoutPath(repository string) string {
+	return filepath.Join(d.rootDirectory, filepath.FromSlash(repository))
+}
+
+func (d *driver) layoutBlobPath(repository string, dgst digest.Digest) string {
+	return filepath.Join(d.layoutPath(repository), v1.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func (d *driver) pendingBlobPath(dgst digest.Digest) string {
+	return filepath.Join(d.rootDirectory, scratchDirectory, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func (d *driver) isLayout(repository string) bool {
+	return repository != "" && isLayoutDir(d.layoutPath(repository))
+}
+
+// blobsIn returns the digests of the blobs stored in a blobs directory.
+func blobsIn(dir string) ([]digest.Digest, error) {
+	algorithms, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var digests []digest.Digest
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(dir, algorithm.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if dgst, ok := parseDigest(algorithm.Name(), entry.Name()); ok && !entry.IsDir() {
+				digests = append(digests, dgst)
+			}
+		}
+	}
+	return digests, nil
+}
+
+// layoutBlobs returns the children of a directory of the layers of a
+// repository.
+func (d *driver) layoutBlobs(repository string, elems []string) ([]string, error) {
+	digests, err := blobsIn(filepath.Join(d.layoutPath(repository), v1.ImageBlobsDir))
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[digest.Digest]struct{}, len(digests))
+	for _, dgst := range digests {
+		set[dgst] = struct{}{}
+	}
+	return digestChildren(set, elems), nil
+}
+
+// allBlobs returns the children of a directory of the blobs directory, with
+// the blobs of all the layouts and the blobs not linked to a repository yet.
+func (d *driver) allBlobs(elems []string) ([]string, error) {
+	layouts, err := d.layouts()
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{filepath.Join(d.rootDirectory, scratchDirectory, "blobs")}
+	for _, layout := range layouts {
+		dirs = append(dirs, filepath.Join(d.layoutPath(layout), v1.ImageBlobsDir))
+	}
+
+	seen := make(map[string]struct{})
+	var children []string
+	for _, dir := range dirs {
+		digests, err := blobsIn(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, dgst := range digests {
+			var child string
+			switch len(elems) {
+			case 0:
+				child = dgst.Algorithm().String()
+			case 1:
+				if dgst.Algorithm().String() == elems[0] {
+					child = dgst.Encoded()[:2]
+				}
+			case 2:
+				if dgst.Algorithm().String() == elems[0] && strings.HasPrefix(dgst.Encoded(), elems[1]) {
+					child = dgst.Encoded()
+				}
+			}
+			if _, ok := seen[child]; !ok && child != "" {
+				seen[child] = struct{}{}
+				children = append(children, child)
+			}
+		}
+	}
+	return children, nil
+}
+
+// findBlob returns the filesystem path of a blob, in a layout or in the
+// blobs not linked to a repository yet, or an empty string if it does not
+// exist.
+func (d *driver) findBlob(dgst digest.Digest) string {
+	exists := func(p string) bool {
+		fi, err := os.Stat(p)
+		return err == nil && !fi.IsDir()
+	}
+
+	if cached, ok := d.blobs.Load(dgst); ok && exists(cached.(string)) {
+		return cached.(string)
+	}
+	layouts, err := d.layouts()
+	if err == nil {
+		for _, layout := range layouts {
+			if p := d.layoutBlobPath(layout, dgst); exists(p) {
+				d.blobs.Store(dgst, p)
+				return p
+			}
+		}
+	}
+	if p := d.pendingBlobPath(dgst); exists(p) {
+		return p
+	}
+	return ""
+}
+
+// ensureLayout creates the layout of a repository if it does not exist.
+// It must be called with d.mu held.
+func (d *driver) ensureLayout(repository string) error {
+	dir := d.layoutPath(repository)
+	if isLayoutDir(dir) {
+		return nil
+	}
+
+	components := strings.Split(repository, "/")
+	for i := 1; i < len(components); i++ {
+		if components[i] == v1.ImageBlobsDir && d.isLayout(strings.Join(components[:i], "/")) {
+			return fmt.Errorf("repository %s would be created in the blobs directory of a layout", repository)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, v1.ImageBlobsDir), 0o777); err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(dir, v1.ImageIndexFile), v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}); err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(dir, v1.ImageLayoutFile), v1.ImageLayout{Version: v1.ImageLayoutVersion}); err != nil {
+		return err
+	}
+	d.invalidateLayouts()
+	return nil
+}
+
+// linkBlob stores a blob in the layout of a repository, creating it if
+// needed. Blobs not linked to a repository yet are moved to the layout, and
+// blobs of other layouts are copied.
+func (d *driver) linkBlob(repository string, dgst digest.Digest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.ensureLayout(repository); err != nil {
+		return err
+	}
+
+	target := d.layoutBlobPath(repository, dgst)
+	pending := d.pendingBlobPath(dgst)
+	if _, err := os.Stat(target); err == nil {
+		_ = os.Remove(pending)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o777); err != nil {
+		return err
+	}
+
+	err := os.Rename(pending, target)
+	if err == nil {
+		d.blobs.Store(dgst, target)
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	source := d.findBlob(dgst)
+	if source == "" {
+		return storagedriver.PathNotFoundError{Path: fmt.Sprintf("%s/blobs/%s/%s/%s/data", rootPath, dgst.Algorithm(), dgst.Encoded()[:2], dgst.Encoded())}
+	}
+	return copyFile(source, target)
+}
+
+// copyFile copies a file, hard linking it when possible.
+func copyFile(source, target string) error {
+	if err := os.Link(source, target); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// writeJSON atomically writes a JSON document to a file.
+func writeJSON(p string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// readIndex reads the index of the layout of a repository, returning its
+// modification time.
+func (d *driver) readIndex(repository string) (*v1.Index, time.Time, error) {
+	p := filepath.Join(d.layoutPath(repository), v1.ImageIndexFile)
+	content, err := os.ReadFile(p)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var idx v1.Index
+	if err := json.Unmarshal(content, &idx); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid index of layout %s: %v", repository, err)
+	}
+	return &idx, fi.ModTime(), nil
+}
+
+func (d *driver) writeIndex(repository string, idx *v1.Index) error {
+	if idx.Manifests == nil {
+		idx.Manifests = []v1.Descriptor{}
+	}
+	return writeJSON(filepath.Join(d.layoutPath(repository), v1.ImageIndexFile), idx)
+}
+
+// reachable returns the digests of the manifests reachable from descriptors
+// in the layout of a repository, following the manifests of the indexes.
+func (d *driver) reachable(repository string, descriptors []v1.Descriptor) map[digest.Digest]struct{} {
+	manifests := make(map[digest.Digest]struct{})
+	queue := append([]v1.Descriptor(nil), descriptors...)
+	for len(queue) > 0 {
+		desc := queue[0]
+		queue = queue[1:]
+		if _, ok := manifests[desc.Digest]; ok {
+			continue
+		}
+		manifests[desc.Digest] = struct{}{}
+
+		if !isIndexMediaType(desc.MediaType) {
+			continue
+		}
+		content, err := os.ReadFile(d.layoutBlobPath(repository, desc.Digest))
+		if err != nil {
+			continue
+		}
+		var idx v1.Index
+		if err := json.Unmarshal(content, &idx); err == nil {
+			queue = append(queue, idx.Manifests...)
+		}
+	}
+	return manifests
+}
+
+// tags returns the digests of the manifests of an index by tag.
+func tags(idx *v1.Index) map[string]digest.Digest {
+	tags := make(map[string]digest.Digest)
+	for _, desc := range idx.Manifests {
+		if tag := desc.Annotations[v1.AnnotationRefName]; tag != "" {
+			tags[tag] = desc.Digest
+		}
+	}
+	return tags
+}
+
+// describe returns the descriptor of a manifest of the layout of a
+// repository.
+func (d *driver) describe(repository string, dgst digest.Digest) (v1.Descriptor, error) {
+	content, err := os.ReadFile(d.layoutBlobPath(repository, dgst))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	var manifest struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("invalid manifest %s: %v", dgst, err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = v1.MediaTypeImageManifest
+		if manifest.Manifests != nil {
+			manifest.MediaType = v1.MediaTypeImageIndex
+		}
+	}
+	return v1.Descriptor{MediaType: manifest.MediaType, Digest: dgst, Size: int64(len(content))}, nil
+}
+
+// pruneChildren removes the untagged manifests of an index which are
+// reachable from desc, which has been added to it.
+func (d *driver) pruneChildren(repository string, idx *v1.Index, desc v1.Descriptor) {
+	if !isIndexMediaType(desc.MediaType) {
+		return
+	}
+	children := d.reachable(repository, []v1.Descriptor{desc})
+	delete(children, desc.Digest)
+
+	manifests := idx.Manifests[:0]
+	for _, m := range idx.Manifests {
+		if _, ok := children[m.Digest]; ok && m.Annotations[v1.AnnotationRefName] == "" {
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	idx.Manifests = manifests
+}
+
+// keepManifests adds the manifests which are not reachable anymore to an
+// index, untagged, so that they are kept until they are deleted.
+func (d *driver) keepManifests(repository string, idx *v1.Index, digests []digest.Digest) {
+	for _, dgst := range digests {
+		if _, ok := d.reachable(repository, idx.Manifests)[dgst]; ok {
+			continue
+		}
+		if desc, err := d.describe(repository, dgst); err == nil {
+			idx.Manifests = append(idx.Manifests, desc)
+		}
+	}
+}
+
+// addManifest adds a manifest to the index of the layout of a repository,
+// unless it is reachable already.
+func (d *driver) addManifest(repository string, dgst digest.Digest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	idx, _, err := d.readIndex(repository)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.reachable(repository, idx.Manifests)[dgst]; ok {
+		return nil
+	}
+	desc, err := d.describe(repository, dgst)
+	if err != nil {
+		return err
+	}
+	idx.Manifests = append(idx.Manifests, desc)
+	d.pruneChildren(repository, idx, desc)
+	return d.writeIndex(repository, idx)
+}
+
+// setTag tags a manifest of the layout of a repository, annotating it with
+// the tag in the index.
+func (d *driver) setTag(repository, tag string, dgst digest.Digest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.ensureLayout(repository); err != nil {
+		return err
+	}
+	idx, _, err := d.readIndex(repository)
+	if err != nil {
+		return err
+	}
+
+	var untagged []digest.Digest
+	manifests := idx.Manifests[:0]
+	for _, m := range idx.Manifests {
+		if m.Annotations[v1.AnnotationRefName] == tag {
+			untagged = append(untagged, m.Digest)
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	idx.Manifests = manifests
+
+	var desc *v1.Descriptor
+	for i, m := range idx.Manifests {
+		if m.Digest == dgst && m.Annotations[v1.AnnotationRefName] == "" {
+			desc = &idx.Manifests[i]
+			break
+		}
+	}
+	if desc == nil {
+		added, err := d.describe(repository, dgst)
+		if err != nil {
+			return err
+		}
+		idx.Manifests = append(idx.Manifests, added)
+		desc = &idx.Manifests[len(idx.Manifests)-1]
+	}
+	if desc.Annotations == nil {
+		desc.Annotations = make(map[string]string)
+	}
+	desc.Annotations[v1.AnnotationRefName] = tag
+
+	d.pruneChildren(repository, idx, *desc)
+	d.keepManifests(repository, idx, untagged)
+	return d.writeIndex(repository, idx)
+}
+
+// removeTag removes a tag from the index of the layout of a repository. The
+// manifest it pointed at is kept.
+func (d *driver) removeTag(subPath, repository, tag string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.isLayout(repository) {
+		return storagedriver.PathNotFoundError{Path: subPath}
+	}
+	idx, _, err := d.readIndex(repository)
+	if err != nil {
+		return err
+	}
+
+	var untagged []digest.Digest
+	manifests := idx.Manifests[:0]
+	for _, m := range idx.Manifests {
+		if m.Annotations[v1.AnnotationRefName] == tag {
+			untagged = append(untagged, m.Digest)
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	if len(untagged) == 0 {
+		return storagedriver.PathNotFoundError{Path: subPath}
+	}
+	idx.Manifests = manifests
+
+	d.keepManifests(repository, idx, untagged)
+	return d.writeIndex(repository, idx)
+}
+
+// removeManifest removes a manifest, with its tags, from the index of the
+// layout of a repository. The manifests it references are kept. Manifests
+// referenced by the indexes kept in the layout cannot be removed.
+func (d *driver) removeManifest(subPath, repository string, dgst digest.Digest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.isLayout(repository) {
+		return storagedriver.PathNotFoundError{Path: subPath}
+	}
+	idx, _, err := d.readIndex(repository)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.reachable(repository, idx.Manifests)[dgst]; !ok {
+		return storagedriver.PathNotFoundError{Path: subPath}
+	}
+
+	var removed []v1.Descriptor
+	manifests := idx.Manifests[:0]
+	for _, m := range idx.Manifests {
+		if m.Digest == dgst {
+			removed = append(removed, m)
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	idx.Manifests = manifests
+	if _, ok := d.reachable(repository, idx.Manifests)[dgst]; ok {
+		return errReferencedManifest
+	}
+
+	var children []digest.Digest
+	for child := range d.reachable(repository, removed) {
+		if child != dgst {
+			children = append(children, child)
+		}
+	}
+	d.keepManifests(repository, idx, children)
+	return d.writeIndex(repository, idx)
+}
@@ -0,0 +1,194 @@
+package ocilayout
+
+import (
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// pathKind is the kind of a registry storage path.
+type pathKind int
+
+const (
+	kindOther pathKind = iota
+	// kindBlobs is the blobs directory, or one of its algorithm or digest
+	// prefix directories.
+	kindBlobs
+	kindBlob
+	kindBlobData
+	// kindRepositoryDirectory is the repositories directory, a repository
+	// or a directory of nested repositories.
+	kindRepositoryDirectory
+	kindLayers
+	kindLayer
+	kindLayerLink
+	kindManifests
+	kindRevisions
+	kindRevision
+	kindRevisionLink
+	// kindRevisionTag is a path under the tags of a revision, or the file
+	// marking them as maintained.
+	kindRevisionTag
+	kindTags
+	kindTag
+	kindTagCurrent
+	kindTagCurrentLink
+	kindTagIndex
+	kindTagIndexEntry
+	kindTagIndexLink
+	// kindCatalog is a path under the catalog index.
+	kindCatalog
+)
+
+// registryPath is a parsed registry storage path.
+type registryPath struct {
+	kind       pathKind
+	repository string
+	tag        string
+	dgst       digest.Digest
+	// elems are the path components under the blobs directory, or under
+	// the directory of the digests of a repository.
+	elems []string
+}
+
+// parsePath parses a registry storage path, as laid out by the storage
+// package.
+func parsePath(subPath string) registryPath {
+	other := registryPath{kind: kindOther}
+
+	var components []string
+	if subPath != rootPath {
+		rel, ok := strings.CutPrefix(subPath, rootPath+"/")
+		if !ok {
+			return other
+		}
+		components = strings.Split(rel, "/")
+	}
+	if len(components) == 0 {
+		return other
+	}
+
+	switch components[0] {
+	case "blobs":
+		rest := components[1:]
+		switch len(rest) {
+		case 0, 1, 2:
+			return registryPath{kind: kindBlobs, elems: rest}
+		case 3, 4:
+			dgst, ok := parseDigest(rest[0], rest[2])
+			if !ok || rest[1] != rest[2][:2] {
+				return other
+			}
+			if len(rest) == 3 {
+				return registryPath{kind: kindBlob, dgst: dgst}
+			}
+			if rest[3] == "data" {
+				return registryPath{kind: kindBlobData, dgst: dgst}
+			}
+		}
+		return other
+	case "catalog":
+		return registryPath{kind: kindCatalog}
+	case "repositories":
+	default:
+		return other
+	}
+
+	rest := components[1:]
+	i := 0
+	for i < len(rest) && !strings.HasPrefix(rest[i], "_") {
+		i++
+	}
+	p := registryPath{repository: strings.Join(rest[:i], "/")}
+	sub := rest[i:]
+	if len(sub) == 0 {
+		p.kind = kindRepositoryDirectory
+		return p
+	}
+	if p.repository == "" {
+		return other
+	}
+
+	// digestPath sets the kind of a path of digests, laid out as
+	// <algorithm>/<encoded>/link under a directory.
+	digestPath := func(elems []string, dir, entry, link pathKind) registryPath {
+		switch len(elems) {
+		case 0, 1:
+			p.kind = dir
+			p.elems = elems
+			return p
+		case 2, 3:
+			dgst, ok := parseDigest(elems[0], elems[1])
+			if !ok {
+				return other
+			}
+			p.dgst = dgst
+			if len(elems) == 2 {
+				p.kind = entry
+				return p
+			}
+			if elems[2] == "link" {
+				p.kind = link
+				return p
+			}
+		}
+		return other
+	}
+
+	switch sub[0] {
+	case "_layers":
+		return digestPath(sub[1:], kindLayers, kindLayer, kindLayerLink)
+	case "_manifests":
+		if len(sub) == 1 {
+			p.kind = kindManifests
+			return p
+		}
+		switch sub[1] {
+		case "revisions":
+			if elems := sub[2:]; len(elems) >= 3 && elems[2] == "tags" {
+				if p := digestPath(elems[:2], kindRevisions, kindRevision, kindRevisionLink); p.kind == kindRevision {
+					p.kind = kindRevisionTag
+					return p
+				}
+				return other
+			}
+			return digestPath(sub[2:], kindRevisions, kindRevision, kindRevisionLink)
+		case "revisiontags":
+			if len(sub) == 2 {
+				p.kind = kindRevisionTag
+				return p
+			}
+		case "tags":
+			if len(sub) == 2 {
+				p.kind = kindTags
+				return p
+			}
+			p.tag = sub[2]
+			if len(sub) == 3 {
+				p.kind = kindTag
+				return p
+			}
+			switch sub[3] {
+			case "current":
+				switch {
+				case len(sub) == 4:
+					p.kind = kindTagCurrent
+					return p
+				case len(sub) == 5 && sub[4] == "link":
+					p.kind = kindTagCurrentLink
+					return p
+				}
+			case "index":
+				return digestPath(sub[4:], kindTagIndex, kindTagIndexEntry, kindTagIndexLink)
+			}
+		}
+	}
+	return other
+}
+
+// parseDigest returns the digest of a path laid out as
+// <algorithm>/<encoded>.
+func parseDigest(algorithm, encoded string) (digest.Digest, bool) {
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(algorithm), encoded)
+	return dgst, dgst.Validate() == nil
+}
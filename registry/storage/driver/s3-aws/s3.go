@@ -35,6 +35,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
@@ -52,6 +53,10 @@ const minChunkSize = 5 * 1024 * 1024
 // S3 API requires max upload chunk to be 5GB.
 const maxChunkSize = 5 * 1024 * 1024 * 1024
 
+// maxParts defines the maximum number of parts of a multipart upload allowed
+// by S3.
+const maxParts = 10000
+
 const defaultChunkSize = 2 * minChunkSize
 
 const (
@@ -68,6 +73,10 @@ const (
 	// above which multipart copy will be used. (PUT Object - Copy is used
 	// for objects at or below this size.)  Empirically, 32 MB is optimal.
 	defaultMultipartCopyThresholdSize = 32 * 1024 * 1024
+
+	// defaultMultipartUploadConcurrency defines the default maximum number
+	// of parts uploaded concurrently by a writer.
+	defaultMultipartUploadConcurrency = 1
 )
 
 // listMax is the largest amount of objects you can request from S3 in a list call
@@ -111,6 +120,8 @@ type DriverParameters struct {
 	MultipartCopyChunkSize      int64
 	MultipartCopyMaxConcurrency int64
 	MultipartCopyThresholdSize  int64
+	MultipartUploadConcurrency  int64
+	MultipartUploadMaxMemory    int64
 	RootDirectory               string
 	StorageClass                string
 	UserAgent                   string
@@ -164,10 +175,15 @@ type driver struct {
 	MultipartCopyChunkSize      int64
 	MultipartCopyMaxConcurrency int64
 	MultipartCopyThresholdSize  int64
+	MultipartUploadConcurrency  int64
 	RootDirectory               string
 	StorageClass                string
 	ObjectACL                   string
 	pool                        *sync.Pool
+	// uploadMemory bounds the size of the parts being uploaded by all the
+	// writers, if a memory budget is configured.
+	uploadMemory     *semaphore.Weighted
+	uploadMemorySize int64
 }
 
 type baseEmbed struct {
@@ -333,6 +349,19 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 		return nil, err
 	}
 
+	multipartUploadConcurrency, err := getParameterAsInt64(parameters, "multipartuploadconcurrency", defaultMultipartUploadConcurrency, 1, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+
+	multipartUploadMaxMemory, err := getParameterAsInt64(parameters, "multipartuploadmaxmemory", 0, 0, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	if multipartUploadMaxMemory > 0 && multipartUploadMaxMemory < chunkSize {
+		return nil, fmt.Errorf("the multipartuploadmaxmemory parameter %d should be at least the chunksize %d", multipartUploadMaxMemory, chunkSize)
+	}
+
 	rootDirectory := parameters["rootdirectory"]
 	if rootDirectory == nil {
 		rootDirectory = ""
@@ -439,6 +468,8 @@ func FromParameters(ctx context.Context, parameters map[string]interface{}) (*Dr
 		multipartCopyChunkSize,
 		multipartCopyMaxConcurrency,
 		multipartCopyThresholdSize,
+		multipartUploadConcurrency,
+		multipartUploadMaxMemory,
 		fmt.Sprint(rootDirectory),
 		storageClass,
 		fmt.Sprint(userAgent),
@@ -588,6 +619,7 @@ func New(ctx context.Context, params DriverParameters) (*Driver, error) {
 		MultipartCopyChunkSize:      params.MultipartCopyChunkSize,
 		MultipartCopyMaxConcurrency: params.MultipartCopyMaxConcurrency,
 		MultipartCopyThresholdSize:  params.MultipartCopyThresholdSize,
+		MultipartUploadConcurrency:  params.MultipartUploadConcurrency,
 		RootDirectory:               params.RootDirectory,
 		StorageClass:                params.StorageClass,
 		ObjectACL:                   params.ObjectACL,
@@ -599,6 +631,13 @@ func New(ctx context.Context, params DriverParameters) (*Driver, error) {
 			},
 		},
 	}
+	if d.MultipartUploadConcurrency < 1 {
+		d.MultipartUploadConcurrency = defaultMultipartUploadConcurrency
+	}
+	if params.MultipartUploadMaxMemory > 0 {
+		d.uploadMemory = semaphore.NewWeighted(params.MultipartUploadMaxMemory)
+		d.uploadMemorySize = params.MultipartUploadMaxMemory
+	}
 
 	return &Driver{
 		baseEmbed: baseEmbed{
@@ -1003,6 +1042,90 @@ func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) e
 	return err
 }
 
+// Compose stores at destPath the concatenation of the objects stored at
+// sourcePaths, copying each source into a part of a multipart upload. S3
+// requires all but the last part to be at least minChunkSize large, so
+// sources which don't meet the part constraints are not composed.
+func (d *driver) Compose(ctx context.Context, destPath string, sourcePaths []string) error {
+	if len(sourcePaths) == 0 || len(sourcePaths) > maxParts {
+		return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	}
+
+	for i, sourcePath := range sourcePaths {
+		fileInfo, err := d.Stat(ctx, sourcePath)
+		if err != nil {
+			return parseError(sourcePath, err)
+		}
+		if fileInfo.Size() > maxChunkSize || (i < len(sourcePaths)-1 && fileInfo.Size() < minChunkSize) {
+			return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+		}
+	}
+
+	createResp, err := d.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(d.Bucket),
+		Key:                  aws.String(d.s3Path(destPath)),
+		ContentType:          d.getContentType(),
+		ACL:                  d.getACL(),
+		SSEKMSKeyId:          d.getSSEKMSKeyID(),
+		ServerSideEncryption: d.getEncryptionMode(),
+		StorageClass:         d.getStorageClass(),
+	})
+	if err != nil {
+		return err
+	}
+
+	completedParts := make([]*s3.CompletedPart, len(sourcePaths))
+	errChan := make(chan error, len(sourcePaths))
+	limiter := make(chan struct{}, d.MultipartCopyMaxConcurrency)
+
+	for i, sourcePath := range sourcePaths {
+		i, sourcePath := int64(i), sourcePath
+		go func() {
+			limiter <- struct{}{}
+			uploadResp, err := d.S3.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+				Bucket:     aws.String(d.Bucket),
+				CopySource: aws.String(d.Bucket + "/" + d.s3Path(sourcePath)),
+				Key:        aws.String(d.s3Path(destPath)),
+				PartNumber: aws.Int64(i + 1),
+				UploadId:   createResp.UploadId,
+			})
+			if err == nil {
+				completedParts[i] = &s3.CompletedPart{
+					ETag:       uploadResp.CopyPartResult.ETag,
+					PartNumber: aws.Int64(i + 1),
+				}
+			}
+			errChan <- err
+			<-limiter
+		}()
+	}
+
+	var copyErr error
+	for range completedParts {
+		if err := <-errChan; err != nil && copyErr == nil {
+			copyErr = err
+		}
+	}
+	if copyErr != nil {
+		// The upload is aborted only once all copies are done, so that no
+		// part is left behind.
+		_, _ = d.S3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(d.Bucket),
+			Key:      aws.String(d.s3Path(destPath)),
+			UploadId: createResp.UploadId,
+		})
+		return copyErr
+	}
+
+	_, err = d.S3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(d.Bucket),
+		Key:             aws.String(d.s3Path(destPath)),
+		UploadId:        createResp.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+	})
+	return err
+}
+
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 // We must be careful since S3 does not guarantee read after delete consistency
 func (d *driver) Delete(ctx context.Context, path string) error {
@@ -1363,6 +1486,11 @@ func (b *buffer) Clear() {
 // part is at least as large as the chunksize, so the multipart upload could be
 // cleanly resumed in the future. This is violated if Close is called after less
 // than a full chunk is written.
+//
+// Parts are uploaded in the background, up to MultipartUploadConcurrency at a
+// time, while the next ones are buffered. Close, Commit and Cancel wait for
+// the parts being uploaded. A part failing to upload fails the writer and
+// aborts the multipart upload.
 type writer struct {
 	ctx       context.Context
 	driver    *driver
@@ -1375,6 +1503,27 @@ type writer struct {
 	closed    bool
 	committed bool
 	cancelled bool
+
+	// uploads are the parts being uploaded, in the order of their part
+	// numbers, and workers bounds their number.
+	uploads []*partUpload
+	workers chan struct{}
+	// uploadCtx is canceled by the first part which fails to upload, to stop
+	// uploading the next ones.
+	uploadCtx     context.Context
+	cancelUploads context.CancelFunc
+	// err is the error of the first part which failed to upload. The
+	// multipart upload is then aborted, as the parts after the failed one
+	// would leave a hole in the part numbers of a resumed upload.
+	err     error
+	aborted bool
+}
+
+// partUpload is a part uploaded in the background.
+type partUpload struct {
+	part *s3.Part
+	done chan struct{}
+	err  error
 }
 
 func (d *driver) newWriter(ctx context.Context, key, uploadID string, parts []*s3.Part) storagedriver.FileWriter {
@@ -1382,15 +1531,19 @@ func (d *driver) newWriter(ctx context.Context, key, uploadID string, parts []*s
 	for _, part := range parts {
 		size += *part.Size
 	}
+	uploadCtx, cancelUploads := context.WithCancel(ctx)
 	return &writer{
-		ctx:      ctx,
-		driver:   d,
-		key:      key,
-		uploadID: uploadID,
-		parts:    parts,
-		size:     size,
-		ready:    d.NewBuffer(),
-		pending:  d.NewBuffer(),
+		ctx:           ctx,
+		driver:        d,
+		key:           key,
+		uploadID:      uploadID,
+		parts:         parts,
+		size:          size,
+		ready:         d.NewBuffer(),
+		pending:       d.NewBuffer(),
+		workers:       make(chan struct{}, d.MultipartUploadConcurrency),
+		uploadCtx:     uploadCtx,
+		cancelUploads: cancelUploads,
 	}
 }
 
@@ -1548,13 +1701,18 @@ func (w *writer) Close() error {
 	w.closed = true
 
 	defer func() {
+		w.cancelUploads()
 		w.ready.Clear()
 		w.driver.pool.Put(w.ready)
 		w.pending.Clear()
 		w.driver.pool.Put(w.pending)
 	}()
 
-	return w.flush()
+	err := w.flush()
+	if waitErr := w.wait(true); err == nil {
+		err = waitErr
+	}
+	return err
 }
 
 func (w *writer) Cancel(ctx context.Context) error {
@@ -1564,6 +1722,11 @@ func (w *writer) Cancel(ctx context.Context) error {
 		return fmt.Errorf("already committed")
 	}
 	w.cancelled = true
+	// The parts being uploaded would be left behind by the abort.
+	_ = w.wait(true)
+	if w.aborted {
+		return nil
+	}
 	_, err := w.driver.S3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
 		Bucket:   aws.String(w.driver.Bucket),
 		Key:      aws.String(w.key),
@@ -1585,6 +1748,9 @@ func (w *writer) Commit(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := w.wait(true); err != nil {
+		return err
+	}
 
 	w.committed = true
 
@@ -1646,42 +1812,136 @@ func (w *writer) Commit(ctx context.Context) error {
 
 // flush flushes all buffers to write a part to S3.
 // flush is only called by Write (with both buffers full) and Close/Commit (always)
+// The part is uploaded in the background: it returns the error of a part
+// which failed to upload previously.
 func (w *writer) flush() error {
+	if err := w.wait(false); err != nil {
+		return err
+	}
 	if w.ready.Len() == 0 && w.pending.Len() == 0 {
 		return nil
 	}
 
-	buf := bytes.NewBuffer(w.ready.data)
+	part := w.ready
+	pooled := true
 	if w.pending.Len() > 0 && w.pending.Len() < int(w.driver.ChunkSize) {
-		if _, err := buf.Write(w.pending.data); err != nil {
-			return err
-		}
+		data := make([]byte, 0, w.ready.Len()+w.pending.Len())
+		data = append(append(data, w.ready.data...), w.pending.data...)
+		part = &buffer{data: data}
+		pooled = false
+		w.ready.Clear()
 		w.pending.Clear()
+	} else {
+		// the ready buffer is handed over to the upload, swap buffers
+		w.ready, w.pending = w.pending, w.driver.NewBuffer()
 	}
 
-	partSize := buf.Len()
-	partNumber := aws.Int64(int64(len(w.parts) + 1))
+	release := func() {
+		if pooled {
+			part.Clear()
+			w.driver.pool.Put(part)
+		}
+	}
 
-	resp, err := w.driver.S3.UploadPartWithContext(w.ctx, &s3.UploadPartInput{
-		Bucket:     aws.String(w.driver.Bucket),
-		Key:        aws.String(w.key),
-		PartNumber: partNumber,
-		UploadId:   aws.String(w.uploadID),
-		Body:       bytes.NewReader(buf.Bytes()),
-	})
-	if err != nil {
-		return err
+	select {
+	case w.workers <- struct{}{}:
+	case <-w.uploadCtx.Done():
+		release()
+		// a part failed to upload, or the context of the writer is done
+		return w.wait(true)
+	}
+	partSize := int64(part.Len())
+	memory := partSize
+	if w.driver.uploadMemory != nil {
+		// parts merged with the pending buffer may exceed the budget
+		if memory > w.driver.uploadMemorySize {
+			memory = w.driver.uploadMemorySize
+		}
+		if err := w.driver.uploadMemory.Acquire(w.ctx, memory); err != nil {
+			<-w.workers
+			release()
+			return err
+		}
 	}
 
-	w.parts = append(w.parts, &s3.Part{
-		ETag:       resp.ETag,
-		PartNumber: partNumber,
-		Size:       aws.Int64(int64(partSize)),
-	})
+	upload := &partUpload{
+		part: &s3.Part{
+			PartNumber: aws.Int64(int64(len(w.parts) + len(w.uploads) + 1)),
+			Size:       aws.Int64(partSize),
+		},
+		done: make(chan struct{}),
+	}
+	w.uploads = append(w.uploads, upload)
 
-	// reset the flushed buffer and swap buffers
-	w.ready.Clear()
-	w.ready, w.pending = w.pending, w.ready
+	key, uploadID := w.key, w.uploadID
+	go func() {
+		defer func() {
+			if w.driver.uploadMemory != nil {
+				w.driver.uploadMemory.Release(memory)
+			}
+			<-w.workers
+			release()
+			close(upload.done)
+		}()
+
+		resp, err := w.driver.S3.UploadPartWithContext(w.uploadCtx, &s3.UploadPartInput{
+			Bucket:     aws.String(w.driver.Bucket),
+			Key:        aws.String(key),
+			PartNumber: upload.part.PartNumber,
+			UploadId:   aws.String(uploadID),
+			Body:       bytes.NewReader(part.data),
+		})
+		if err != nil {
+			upload.err = err
+			w.cancelUploads()
+			return
+		}
+		upload.part.ETag = resp.ETag
+	}()
 
 	return nil
 }
+
+// wait adds the parts which were uploaded to the parts of the writer, in
+// order, waiting for all the parts being uploaded if block is set or a part
+// failed to upload. It returns the error of the first part which failed to
+// upload, once the multipart upload has been aborted.
+func (w *writer) wait(block bool) error {
+	if w.uploadCtx.Err() != nil {
+		block = true
+	}
+	for len(w.uploads) > 0 {
+		upload := w.uploads[0]
+		if block {
+			<-upload.done
+		} else {
+			select {
+			case <-upload.done:
+			default:
+				return w.err
+			}
+		}
+		w.uploads = w.uploads[1:]
+		if upload.err != nil {
+			// the parts canceled after a failure do not hide its error
+			if w.err == nil || (errors.Is(w.err, context.Canceled) && !errors.Is(upload.err, context.Canceled)) {
+				w.err = upload.err
+			}
+			continue
+		}
+		if w.err == nil {
+			w.parts = append(w.parts, upload.part)
+		}
+	}
+	if w.err != nil && !w.aborted {
+		w.aborted = true
+		if _, err := w.driver.S3.AbortMultipartUploadWithContext(w.ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(w.driver.Bucket),
+			Key:      aws.String(w.key),
+			UploadId: aws.String(w.uploadID),
+		}); err != nil {
+			w.err = errors.Join(w.err, err)
+		}
+	}
+	return w.err
+}
@@ -117,6 +117,8 @@ func init() {
 			defaultMultipartCopyChunkSize,
 			defaultMultipartCopyMaxConcurrency,
 			defaultMultipartCopyThresholdSize,
+			defaultMultipartUploadConcurrency,
+			0,
 			rootDirectory,
 			storageClass,
 			driverName + "-test",
@@ -0,0 +1,293 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 is a minimal S3-compatible stand-in serving the multipart upload
+// operations used by the writer, for path-style requests.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int64][]byte
+	nextID   int
+	inFlight int
+	// maxInFlight is the maximum number of parts uploaded concurrently.
+	maxInFlight int
+	// delay is the time taken to upload a part.
+	delay time.Duration
+	// failPart is the number of a part whose upload fails.
+	failPart int64
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int64][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[1]
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.mu.Lock()
+		f.nextID++
+		uploadID = strconv.Itoa(f.nextID)
+		f.uploads[uploadID] = make(map[int64][]byte)
+		f.mu.Unlock()
+		f.writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Key      string
+			UploadId string
+		}{Key: key, UploadId: uploadID})
+	case r.Method == http.MethodPut && uploadID != "":
+		partNumber, _ := strconv.ParseInt(query.Get("partNumber"), 10, 64)
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		f.mu.Lock()
+		f.inFlight++
+		if f.inFlight > f.maxInFlight {
+			f.maxInFlight = f.inFlight
+		}
+		f.mu.Unlock()
+		time.Sleep(f.delay)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.inFlight--
+
+		if partNumber == f.failPart {
+			f.writeError(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		parts[partNumber] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, partNumber))
+	case r.Method == http.MethodPost && uploadID != "":
+		var complete struct {
+			Parts []struct {
+				PartNumber int64
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			f.writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var object []byte
+		for _, part := range complete.Parts {
+			data, ok := parts[part.PartNumber]
+			if !ok || part.ETag != fmt.Sprintf(`"%d"`, part.PartNumber) {
+				f.writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, data...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, uploadID)
+		f.writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string
+		}{Key: key})
+	case r.Method == http.MethodDelete && uploadID != "":
+		f.mu.Lock()
+		delete(f.uploads, uploadID)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
+
+func newFakeS3Driver(t *testing.T, fake *fakeS3, concurrency, maxMemory int64) *Driver {
+	t.Helper()
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	d, err := New(context.Background(), DriverParameters{
+		AccessKey:                   "accesskey",
+		SecretKey:                   "secretkey",
+		Bucket:                      "bucket",
+		Region:                      "us-east-1",
+		RegionEndpoint:              server.URL,
+		ForcePathStyle:              true,
+		V4Auth:                      true,
+		ChunkSize:                   minChunkSize,
+		MultipartCopyChunkSize:      defaultMultipartCopyChunkSize,
+		MultipartCopyMaxConcurrency: defaultMultipartCopyMaxConcurrency,
+		MultipartCopyThresholdSize:  defaultMultipartCopyThresholdSize,
+		MultipartUploadConcurrency:  concurrency,
+		MultipartUploadMaxMemory:    maxMemory,
+		StorageClass:                s3.StorageClassStandard,
+		ObjectACL:                   s3.ObjectCannedACLPrivate,
+		LogLevel:                    aws.LogOff,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	return d
+}
+
+// writeRandom writes size random bytes in small writes, as blob uploads do.
+func writeRandom(t *testing.T, d *Driver, path string, size int) ([]byte, error) {
+	t.Helper()
+
+	contents := make([]byte, size)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	w, err := d.Writer(ctx, path, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	r := bytes.NewReader(contents)
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				_ = w.Cancel(ctx)
+				return contents, err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+	}
+	if err := w.Commit(ctx); err != nil {
+		_ = w.Cancel(ctx)
+		return contents, err
+	}
+	if w.Size() != int64(size) {
+		t.Fatalf("unexpected writer size %d, expected %d", w.Size(), size)
+	}
+	return contents, w.Close()
+}
+
+func TestWriterParallelUploads(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		concurrency int64
+		maxMemory   int64
+		// maxInFlight is the maximum number of parts expected to be
+		// uploaded concurrently.
+		maxInFlight int
+	}{
+		{name: "sequential", concurrency: 1, maxInFlight: 1},
+		{name: "concurrent", concurrency: 4, maxInFlight: 4},
+		{name: "memory budget", concurrency: 4, maxMemory: 2 * minChunkSize, maxInFlight: 2},
+		{name: "small memory budget", concurrency: 4, maxMemory: minChunkSize, maxInFlight: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := newFakeS3()
+			fake.delay = 100 * time.Millisecond
+			d := newFakeS3Driver(t, fake, tc.concurrency, tc.maxMemory)
+
+			// 8 full parts, the last one merged with the remaining half chunk.
+			contents, err := writeRandom(t, d, "/blob", 8*minChunkSize+minChunkSize/2)
+			if err != nil {
+				t.Fatalf("unexpected error writing: %v", err)
+			}
+
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if !bytes.Equal(fake.objects["blob"], contents) {
+				t.Fatalf("uploaded object does not match the written contents")
+			}
+			if fake.maxInFlight > tc.maxInFlight {
+				t.Fatalf("%d parts were uploaded concurrently, expected at most %d", fake.maxInFlight, tc.maxInFlight)
+			}
+			if tc.maxInFlight > 1 && fake.maxInFlight < 2 {
+				t.Fatal("parts were not uploaded concurrently")
+			}
+		})
+	}
+}
+
+func TestWriterSmallUpload(t *testing.T) {
+	fake := newFakeS3()
+	d := newFakeS3Driver(t, fake, 4, 0)
+
+	for _, size := range []int{0, 1024, minChunkSize, minChunkSize + 1} {
+		contents, err := writeRandom(t, d, "/blob", size)
+		if err != nil {
+			t.Fatalf("unexpected error writing %d bytes: %v", size, err)
+		}
+		fake.mu.Lock()
+		uploaded := fake.objects["blob"]
+		fake.mu.Unlock()
+		if !bytes.Equal(uploaded, contents) {
+			t.Fatalf("uploaded object of %d bytes does not match the written contents", size)
+		}
+	}
+}
+
+func TestWriterFailedPart(t *testing.T) {
+	fake := newFakeS3()
+	fake.failPart = 2
+	d := newFakeS3Driver(t, fake, 4, 0)
+
+	if _, err := writeRandom(t, d, "/blob", 6*minChunkSize); err == nil {
+		t.Fatal("expected an error when a part fails to upload")
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if _, ok := fake.objects["blob"]; ok {
+		t.Fatal("object was committed despite a failed part")
+	}
+	if len(fake.uploads) != 0 {
+		t.Fatalf("%d multipart uploads were not aborted", len(fake.uploads))
+	}
+}
@@ -131,6 +131,17 @@ type FileWriter interface {
 	Commit(context.Context) error
 }
 
+// Composer is an optional interface of StorageDriver implementations which
+// can concatenate stored objects without transferring their content through
+// the registry.
+type Composer interface {
+	// Compose stores at destPath the concatenation of the objects stored at
+	// sourcePaths, in order, leaving the sources in place. ErrUnsupportedMethod
+	// is returned when the sources cannot be composed by the backend, in
+	// which case the caller must concatenate them itself.
+	Compose(ctx context.Context, destPath string, sourcePaths []string) error
+}
+
 // PathRegexp is the regular expression which each file path must match. A
 // file path is absolute, beginning with a slash and containing a positive
 // number of path components separated by slashes, where each component is
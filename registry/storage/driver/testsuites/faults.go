@@ -0,0 +1,319 @@
+package testsuites
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"path"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	faults "github.com/distribution/distribution/v3/registry/storage/driver/middleware/faults"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/suite"
+)
+
+// DriverStack is a function which returns the storage driver under test,
+// built on top of the given storagedriver.StorageDriver.
+type DriverStack func(storagedriver.StorageDriver) (storagedriver.StorageDriver, error)
+
+// FaultsSuite is a [suite.Suite] test suite designed to test how a
+// storagedriver.StorageDriver behaves when faults are injected in the driver
+// it is built on: operations may fail, but must never return wrong content,
+// report truncated content as complete, or leave wrong content behind them.
+type FaultsSuite struct {
+	suite.Suite
+	Constructor DriverConstructor
+	Stack       DriverStack
+	Teardown    DriverTeardown
+	storagedriver.StorageDriver
+	faults *faults.Driver
+	ctx    context.Context
+	paths  []string
+}
+
+// Faults runs [FaultsSuite] for the given [DriverConstructor]. Faults are
+// injected in the driver it returns, and the driver under test is built on
+// top of it by stack, which can be nil to test the driver itself.
+func Faults(t *testing.T, driverConstructor DriverConstructor, stack DriverStack) {
+	suite.Run(t, &FaultsSuite{
+		Constructor: driverConstructor,
+		Stack:       stack,
+		ctx:         context.Background(),
+	})
+}
+
+// SetupSuite implements [suite.SetupAllSuite] interface.
+func (suite *FaultsSuite) SetupSuite() {
+	d, err := suite.Constructor()
+	suite.Require().NoError(err)
+	suite.faults, err = faults.New(d, faults.Config{})
+	suite.Require().NoError(err)
+
+	suite.StorageDriver = suite.faults
+	if suite.Stack != nil {
+		suite.StorageDriver, err = suite.Stack(suite.faults)
+		suite.Require().NoError(err)
+	}
+}
+
+// TearDownSuite implements [suite.TearDownAllSuite].
+func (suite *FaultsSuite) TearDownSuite() {
+	if suite.Teardown != nil {
+		suite.Require().NoError(suite.Teardown())
+	}
+}
+
+// TearDownTest implements [suite.TearDownTestSuite].
+// The faults are removed and the paths written by the test deleted. This
+// causes the suite to abort if any files are left around in the storage
+// driver.
+func (suite *FaultsSuite) TearDownTest() {
+	suite.inject()
+	for _, p := range suite.paths {
+		err := suite.StorageDriver.Delete(suite.ctx, firstPart(p))
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			suite.Require().NoError(err)
+		}
+	}
+	suite.paths = nil
+
+	files, _ := suite.StorageDriver.List(suite.ctx, "/")
+	if len(files) > 0 {
+		suite.T().Fatalf("Storage driver did not clean up properly. Offending files: %#v", files)
+	}
+}
+
+// inject replaces the faults injected in the driver, removing them all when
+// no rule is given.
+func (suite *FaultsSuite) inject(rules ...faults.Rule) {
+	suite.Require().NoError(suite.faults.SetConfig(faults.Config{Seed: 1, Rules: rules}))
+}
+
+// put writes content to a path without faults, and records the path to be
+// deleted by TearDownTest.
+func (suite *FaultsSuite) put(p string, content []byte) {
+	suite.paths = append(suite.paths, p)
+	suite.Require().NoError(suite.StorageDriver.PutContent(suite.ctx, p, content))
+}
+
+// TestLatency checks that operations succeed when they are slowed down.
+func (suite *FaultsSuite) TestLatency() {
+	filename := randomPath(32)
+	contents := randomContents(1024)
+	suite.paths = append(suite.paths, filename)
+
+	suite.inject(faults.Rule{Operations: []string{faults.OpPutContent, faults.OpGetContent}, Latency: 20 * time.Millisecond})
+	start := time.Now()
+	suite.Require().NoError(suite.StorageDriver.PutContent(suite.ctx, filename, contents))
+	received, err := suite.StorageDriver.GetContent(suite.ctx, filename)
+	suite.Require().NoError(err)
+	suite.Require().Equal(contents, received)
+	suite.Require().GreaterOrEqual(time.Since(start), 40*time.Millisecond)
+}
+
+// TestErrors runs random operations while a share of the operations of the
+// underlying driver fail, and checks that the successful operations are
+// consistent with the operations which preceded them.
+func (suite *FaultsSuite) TestErrors() {
+	root := randomPath(16)
+	suite.paths = append(suite.paths, root)
+	paths := make([]string, 8)
+	for i := range paths {
+		paths[i] = path.Join(root, randomFilename(16))
+	}
+
+	// Content of the paths known to exist, and paths known not to exist.
+	// The state of the paths targeted by failed writes is unknown.
+	existing := make(map[string][]byte)
+	deleted := make(map[string]bool)
+	for _, p := range paths {
+		deleted[p] = true
+	}
+	unknown := func(p string) {
+		delete(existing, p)
+		delete(deleted, p)
+	}
+
+	suite.inject(faults.Rule{ErrorRate: 0.3})
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		p := paths[rng.Intn(len(paths))]
+		switch rng.Intn(6) {
+		case 0:
+			contents := randomContents(rng.Int63n(1024) + 1)
+			if err := suite.StorageDriver.PutContent(suite.ctx, p, contents); err != nil {
+				unknown(p)
+				continue
+			}
+			existing[p] = contents
+			delete(deleted, p)
+		case 1:
+			contents := randomContents(rng.Int63n(1024) + 1)
+			if err := suite.write(p, contents); err != nil {
+				unknown(p)
+				continue
+			}
+			existing[p] = contents
+			delete(deleted, p)
+		case 2:
+			received, err := suite.StorageDriver.GetContent(suite.ctx, p)
+			suite.checkRead(p, received, err, existing, deleted)
+		case 3:
+			received, err := suite.read(p, 0)
+			suite.checkRead(p, received, err, existing, deleted)
+		case 4:
+			fi, err := suite.StorageDriver.Stat(suite.ctx, p)
+			if err == nil {
+				suite.Require().False(deleted[p], "stat of deleted path %s succeeded", p)
+				if contents, ok := existing[p]; ok {
+					suite.Require().Equal(int64(len(contents)), fi.Size(), "stat of %s", p)
+				}
+			}
+		case 5:
+			err := suite.StorageDriver.Delete(suite.ctx, p)
+			switch err.(type) {
+			case nil, storagedriver.PathNotFoundError:
+				if _, ok := existing[p]; ok {
+					suite.Require().NoError(err, "deletion of existing path %s", p)
+				}
+				delete(existing, p)
+				deleted[p] = true
+			default:
+				unknown(p)
+			}
+		}
+	}
+
+	// Without faults, the paths must be in the state of their last
+	// successful operation.
+	suite.inject()
+	for _, p := range paths {
+		received, err := suite.StorageDriver.GetContent(suite.ctx, p)
+		if contents, ok := existing[p]; ok {
+			suite.Require().NoError(err, "content of %s", p)
+			suite.Require().Equal(contents, received, "content of %s", p)
+		}
+		if deleted[p] {
+			suite.Require().IsType(storagedriver.PathNotFoundError{}, err, "content of %s", p)
+		}
+	}
+}
+
+// TestPartialReads checks that reads cut short by the underlying driver are
+// reported as failed, and that they do not affect later reads.
+func (suite *FaultsSuite) TestPartialReads() {
+	// Blob paths, so that the drivers caching blobs attempt to cache them.
+	var paths []string
+	expected := make(map[string][]byte)
+	for i := 0; i < 4; i++ {
+		contents := randomContents(8192 + rand.Int63n(8192))
+		dgst := digest.FromBytes(contents)
+		p := path.Join("/docker/registry/v2/blobs", dgst.Algorithm().String(), dgst.Encoded()[:2], dgst.Encoded(), "data")
+		suite.put(p, contents)
+		paths = append(paths, p)
+		expected[p] = contents
+	}
+
+	suite.inject(faults.Rule{Operations: []string{faults.OpGetContent, faults.OpReader}, PartialReadRate: 1})
+	for _, p := range paths {
+		received, err := suite.StorageDriver.GetContent(suite.ctx, p)
+		suite.checkPartialRead(p, expected[p], received, err)
+		received, err = suite.read(p, 0)
+		suite.checkPartialRead(p, expected[p], received, err)
+		received, err = suite.read(p, 4096)
+		suite.checkPartialRead(p, expected[p][4096:], received, err)
+	}
+
+	suite.inject()
+	for _, p := range paths {
+		received, err := suite.StorageDriver.GetContent(suite.ctx, p)
+		suite.Require().NoError(err)
+		suite.Require().Equal(expected[p], received, "content of %s", p)
+		received, err = suite.read(p, 0)
+		suite.Require().NoError(err)
+		suite.Require().Equal(expected[p], received, "content of %s", p)
+	}
+}
+
+// TestNotFound checks that paths reported missing by the underlying driver
+// are still readable once it reports them again.
+func (suite *FaultsSuite) TestNotFound() {
+	filename := randomPath(32)
+	contents := randomContents(1024)
+	suite.put(filename, contents)
+
+	suite.inject(faults.Rule{
+		Paths:        "^" + filename + "$",
+		Operations:   []string{faults.OpGetContent, faults.OpReader, faults.OpStat},
+		NotFoundRate: 1,
+	})
+	received, err := suite.StorageDriver.GetContent(suite.ctx, filename)
+	if err == nil {
+		suite.Require().Equal(contents, received)
+	}
+	received, err = suite.read(filename, 0)
+	if err == nil {
+		suite.Require().Equal(contents, received)
+	}
+	if fi, err := suite.StorageDriver.Stat(suite.ctx, filename); err == nil {
+		suite.Require().Equal(int64(len(contents)), fi.Size())
+	}
+
+	suite.inject()
+	received, err = suite.StorageDriver.GetContent(suite.ctx, filename)
+	suite.Require().NoError(err)
+	suite.Require().Equal(contents, received)
+	received, err = suite.read(filename, 0)
+	suite.Require().NoError(err)
+	suite.Require().Equal(contents, received)
+}
+
+// write writes content to a path with a FileWriter.
+func (suite *FaultsSuite) write(p string, contents []byte) error {
+	writer, err := suite.StorageDriver.Writer(suite.ctx, p, false)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(contents); err != nil {
+		_ = writer.Cancel(suite.ctx)
+		_ = writer.Close()
+		return err
+	}
+	if err := writer.Commit(suite.ctx); err != nil {
+		_ = writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// read reads a path from an offset with a reader.
+func (suite *FaultsSuite) read(p string, offset int64) ([]byte, error) {
+	reader, err := suite.StorageDriver.Reader(suite.ctx, p, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func (suite *FaultsSuite) checkRead(p string, received []byte, err error, existing map[string][]byte, deleted map[string]bool) {
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			_, exists := existing[p]
+			suite.Require().False(exists, "existing path %s reported missing", p)
+		}
+		return
+	}
+	suite.Require().False(deleted[p], "read of deleted path %s succeeded", p)
+	if contents, ok := existing[p]; ok {
+		suite.Require().Equal(contents, received, "content of %s", p)
+	}
+}
+
+func (suite *FaultsSuite) checkPartialRead(p string, expected, received []byte, err error) {
+	if err == nil {
+		suite.Require().Equal(expected, received, "truncated read of %s reported complete", p)
+	}
+}
@@ -44,6 +44,9 @@ type DriverSuite struct {
 	Teardown    DriverTeardown
 	storagedriver.StorageDriver
 	ctx context.Context
+
+	// skipLargeStreams skips the tests writing streams of several gigabytes.
+	skipLargeStreams bool
 }
 
 // Driver runs [DriverSuite] for the given [DriverConstructor].
@@ -54,6 +57,17 @@ func Driver(t *testing.T, driverConstructor DriverConstructor) {
 	})
 }
 
+// DriverWithoutLargeStreams runs [DriverSuite] for the given
+// [DriverConstructor], skipping the tests writing large streams for drivers
+// too slow to run them.
+func DriverWithoutLargeStreams(t *testing.T, driverConstructor DriverConstructor) {
+	suite.Run(t, &DriverSuite{
+		Constructor:      driverConstructor,
+		ctx:              context.Background(),
+		skipLargeStreams: true,
+	})
+}
+
 // SetupSuite implements [suite.SetupAllSuite] interface.
 func (suite *DriverSuite) SetupSuite() {
 	d, err := suite.Constructor()
@@ -266,6 +280,9 @@ func (suite *DriverSuite) TestWriteReadLargeStreams() {
 	if testing.Short() {
 		suite.T().Skip("Skipping test in short mode")
 	}
+	if suite.skipLargeStreams {
+		suite.T().Skip("Skipping large streams for this driver")
+	}
 
 	filename := randomPath(32)
 	defer suite.deletePath(firstPart(filename))
@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// annotationImageName is the annotation of the manifests of the index of an
+// exported OCI image layout naming their repository, with their tag or
+// digest, as containerd does.
+const annotationImageName = "io.containerd.image.name"
+
+// ExportOpts contains options for exporting repositories
+type ExportOpts struct {
+	// Include and Exclude are glob patterns selecting the exported
+	// repositories, such as library/*, or tags when they contain a colon,
+	// such as library/*:v1.*. All the tags are selected when Include is
+	// empty.
+	Include []string
+	Exclude []string
+}
+
+// ExportStats summarizes an export
+type ExportStats struct {
+	Repositories int
+	Tags         int
+	Manifests    int
+	Blobs        int
+	// Bytes is the size of the exported blobs, manifests excluded.
+	Bytes int64
+}
+
+// referenceFilter selects repositories and tags with glob patterns.
+type referenceFilter struct {
+	include []string
+	exclude []string
+}
+
+func newReferenceFilter(include, exclude []string) (referenceFilter, error) {
+	for _, pattern := range append(append([]string(nil), include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return referenceFilter{}, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return referenceFilter{include: include, exclude: exclude}, nil
+}
+
+// matchPattern reports whether a pattern matches a tag of a repository, or
+// a repository when the pattern does not contain a colon.
+func matchPattern(pattern, repository, tag string) bool {
+	name := repository
+	if strings.Contains(pattern, ":") {
+		if tag == "" {
+			return false
+		}
+		name = repository + ":" + tag
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// match reports whether a tag of a repository is selected. An empty tag
+// selects the untagged manifests of the repository.
+func (f referenceFilter) match(repository, tag string) bool {
+	for _, pattern := range f.exclude {
+		if matchPattern(pattern, repository, tag) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if matchPattern(pattern, repository, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestReferences returns the manifests and the blobs referenced by a
+// manifest: the manifests of indexes, and the config and layers of images.
+func manifestReferences(m distribution.Manifest) (manifests, blobs []distribution.Descriptor) {
+	switch m.(type) {
+	case *manifestlist.DeserializedManifestList, *ocischema.DeserializedImageIndex:
+		return m.References(), nil
+	}
+	return nil, m.References()
+}
+
+// manifestSubject returns the digest of the subject of a manifest, the
+// manifest it refers to, if any.
+func manifestSubject(payload []byte) digest.Digest {
+	var m struct {
+		Subject *struct {
+			Digest digest.Digest `json:"digest"`
+		} `json:"subject"`
+	}
+	if err := json.Unmarshal(payload, &m); err != nil || m.Subject == nil {
+		return ""
+	}
+	return m.Subject.Digest
+}
+
+// exportedBlob is a blob of an export, read from a repository holding it.
+type exportedBlob struct {
+	repository distribution.Repository
+	desc       distribution.Descriptor
+}
+
+type exporter struct {
+	ctx   context.Context
+	stats ExportStats
+
+	index     []v1.Descriptor
+	manifests map[digest.Digest][]byte
+	// manifestOrder and blobOrder are the digests of the manifests and
+	// blobs in the order they are written.
+	manifestOrder []digest.Digest
+	blobs         map[digest.Digest]exportedBlob
+	blobOrder     []digest.Digest
+}
+
+// Export writes the selected tags of the repositories of the registry to w,
+// as an OCI image layout tar archive. The manifests are exported with the
+// manifests of the indexes and the blobs they reference, and with their
+// referrers, the manifests whose subject they are.
+//
+// The manifests of the index.json of the archive are annotated with their
+// tag and with their repository, so that they can be imported back with
+// Import. The index and the manifests are written before the other blobs,
+// so that the archive can be imported as it is read.
+func Export(ctx context.Context, registry distribution.Namespace, w io.Writer, opts ExportOpts) (ExportStats, error) {
+	filter, err := newReferenceFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return ExportStats{}, err
+	}
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return ExportStats{}, errors.New("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	var names []string
+	err = repositoryEnumerator.Enumerate(ctx, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return ExportStats{}, fmt.Errorf("failed to enumerate repositories: %v", err)
+	}
+	sort.Strings(names)
+
+	e := &exporter{
+		ctx:       ctx,
+		manifests: make(map[digest.Digest][]byte),
+		blobs:     make(map[digest.Digest]exportedBlob),
+	}
+	for _, name := range names {
+		if err := e.addRepository(registry, name, filter); err != nil {
+			return e.stats, fmt.Errorf("failed to export repository %s: %v", name, err)
+		}
+	}
+
+	if err := e.write(w); err != nil {
+		return e.stats, err
+	}
+	return e.stats, nil
+}
+
+// addRepository adds the selected tags of a repository to the export, with
+// their referrers.
+func (e *exporter) addRepository(registry distribution.Namespace, name string, filter referenceFilter) error {
+	named, err := reference.WithName(name)
+	if err != nil {
+		return err
+	}
+	repository, err := registry.Repository(e.ctx, named)
+	if err != nil {
+		return err
+	}
+	manifestService, err := repository.Manifests(e.ctx)
+	if err != nil {
+		return err
+	}
+
+	tags, err := repository.Tags(e.ctx).All(e.ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return nil
+		}
+		return err
+	}
+	sort.Strings(tags)
+
+	// exported holds the manifests exported from the repository.
+	exported := make(map[digest.Digest]struct{})
+	for _, tag := range tags {
+		if !filter.match(name, tag) {
+			continue
+		}
+		desc, err := repository.Tags(e.ctx).Get(e.ctx, tag)
+		if err != nil {
+			return fmt.Errorf("failed to resolve tag %s: %v", tag, err)
+		}
+		top, err := e.addManifest(repository, manifestService, desc.Digest, exported)
+		if err != nil {
+			return err
+		}
+		top.Annotations = map[string]string{
+			v1.AnnotationRefName: tag,
+			annotationImageName:  name + ":" + tag,
+		}
+		e.index = append(e.index, top)
+		e.stats.Tags++
+	}
+	if len(exported) == 0 {
+		return nil
+	}
+	e.stats.Repositories++
+
+	return e.addReferrers(repository, manifestService, exported)
+}
+
+// addReferrers adds the manifests of a repository whose subject is an
+// exported manifest, recursively.
+func (e *exporter) addReferrers(repository distribution.Repository, manifestService distribution.ManifestService, exported map[digest.Digest]struct{}) error {
+	enumerator, ok := manifestService.(distribution.ManifestEnumerator)
+	if !ok {
+		return nil
+	}
+
+	referrers := make(map[digest.Digest][]digest.Digest)
+	err := enumerator.Enumerate(e.ctx, func(dgst digest.Digest) error {
+		m, err := manifestService.Get(e.ctx, dgst)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve manifest %s: %v", dgst, err)
+		}
+		_, payload, err := m.Payload()
+		if err != nil {
+			return err
+		}
+		if subject := manifestSubject(payload); subject != "" {
+			referrers[subject] = append(referrers[subject], dgst)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	queue := make([]digest.Digest, 0, len(exported))
+	for dgst := range exported {
+		queue = append(queue, dgst)
+	}
+	sort.Slice(queue, func(i, j int) bool { return queue[i] < queue[j] })
+	for len(queue) > 0 {
+		subject := queue[0]
+		queue = queue[1:]
+		for _, referrer := range referrers[subject] {
+			if _, ok := exported[referrer]; ok {
+				continue
+			}
+			top, err := e.addManifest(repository, manifestService, referrer, exported)
+			if err != nil {
+				return err
+			}
+			top.Annotations = map[string]string{
+				annotationImageName: repository.Named().Name() + "@" + referrer.String(),
+			}
+			e.index = append(e.index, top)
+			queue = append(queue, referrer)
+		}
+	}
+	return nil
+}
+
+// addManifest adds a manifest of a repository to the export, with the
+// manifests and blobs it references, returning its descriptor.
+func (e *exporter) addManifest(repository distribution.Repository, manifestService distribution.ManifestService, dgst digest.Digest, exported map[digest.Digest]struct{}) (v1.Descriptor, error) {
+	m, err := manifestService.Get(e.ctx, dgst)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to retrieve manifest %s: %v", dgst, err)
+	}
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc := v1.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(payload))}
+
+	if _, ok := exported[dgst]; ok {
+		return desc, nil
+	}
+	exported[dgst] = struct{}{}
+	if _, ok := e.manifests[dgst]; !ok {
+		e.manifests[dgst] = payload
+		e.manifestOrder = append(e.manifestOrder, dgst)
+		e.stats.Manifests++
+	}
+
+	manifests, blobs := manifestReferences(m)
+	for _, child := range manifests {
+		if _, err := e.addManifest(repository, manifestService, child.Digest, exported); err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+	for _, blob := range blobs {
+		if _, ok := e.blobs[blob.Digest]; ok {
+			continue
+		}
+		blobDesc, err := repository.Blobs(e.ctx).Stat(e.ctx, blob.Digest)
+		if err != nil {
+			if errors.Is(err, distribution.ErrBlobUnknown) && len(blob.URLs) > 0 {
+				// Foreign layers are not stored in the registry.
+				continue
+			}
+			return v1.Descriptor{}, fmt.Errorf("failed to stat blob %s of manifest %s: %v", blob.Digest, dgst, err)
+		}
+		e.blobs[blob.Digest] = exportedBlob{repository: repository, desc: blobDesc}
+		e.blobOrder = append(e.blobOrder, blob.Digest)
+		e.stats.Blobs++
+		e.stats.Bytes += blobDesc.Size
+	}
+	return desc, nil
+}
+
+// write writes the archive: the layout file, the index, the manifests and
+// the blobs.
+func (e *exporter) write(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	modTime := time.Unix(0, 0)
+
+	writeFile := func(name string, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+			ModTime:  modTime,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(v1.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+	index, err := json.Marshal(v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: append([]v1.Descriptor{}, e.index...),
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(v1.ImageIndexFile, index); err != nil {
+		return err
+	}
+
+	directories := make(map[string]struct{})
+	writeDirectories := func(dgst digest.Digest) error {
+		for _, dir := range []string{v1.ImageBlobsDir + "/", path.Join(v1.ImageBlobsDir, dgst.Algorithm().String()) + "/"} {
+			if _, ok := directories[dir]; ok {
+				continue
+			}
+			directories[dir] = struct{}{}
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0o755, ModTime: modTime}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	blobPath := func(dgst digest.Digest) string {
+		return path.Join(v1.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+	}
+
+	for _, dgst := range e.manifestOrder {
+		if err := writeDirectories(dgst); err != nil {
+			return err
+		}
+		if err := writeFile(blobPath(dgst), e.manifests[dgst]); err != nil {
+			return err
+		}
+	}
+
+	for _, dgst := range e.blobOrder {
+		blob := e.blobs[dgst]
+		if err := writeDirectories(dgst); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     blobPath(dgst),
+			Mode:     0o644,
+			Size:     blob.desc.Size,
+			ModTime:  modTime,
+		}); err != nil {
+			return err
+		}
+		if err := e.copyBlob(tw, blob); err != nil {
+			return fmt.Errorf("failed to export blob %s: %v", dgst, err)
+		}
+	}
+	return tw.Close()
+}
+
+// copyBlob copies a blob to w, verifying its digest.
+func (e *exporter) copyBlob(w io.Writer, blob exportedBlob) error {
+	rc, err := blob.repository.Blobs(e.ctx).Open(e.ctx, blob.desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	verifier := blob.desc.Digest.Verifier()
+	if _, err := io.CopyN(io.MultiWriter(w, verifier), rc, blob.desc.Size); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return errors.New("content does not match its digest")
+	}
+	return nil
+}
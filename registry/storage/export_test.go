@@ -0,0 +1,391 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func tagManifest(t *testing.T, repository distribution.Repository, tag string, dgst digest.Digest) {
+	ctx := dcontext.Background()
+	manifest, err := makeManifestService(t, repository).Get(ctx, dgst)
+	if err != nil {
+		t.Fatalf("failed to get manifest %s: %v", dgst, err)
+	}
+	mediaType, _, _ := manifest.Payload()
+	if err := repository.Tags(ctx).Tag(ctx, tag, distribution.Descriptor{MediaType: mediaType, Digest: dgst}); err != nil {
+		t.Fatalf("failed to tag %s: %v", tag, err)
+	}
+}
+
+// uploadReferrer uploads a manifest referring to subject.
+func uploadReferrer(t *testing.T, repository distribution.Repository, subject digest.Digest) digest.Digest {
+	ctx := dcontext.Background()
+	config, err := repository.Blobs(ctx).Put(ctx, "application/vnd.example.signature", []byte(fmt.Sprintf("signature of %s", subject)))
+	if err != nil {
+		t.Fatalf("failed to upload config: %v", err)
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageManifest,
+		"config":        config,
+		"layers":        []distribution.Descriptor{},
+		"subject":       distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: subject, Size: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := distribution.UnmarshalManifest(v1.MediaTypeImageManifest, payload)
+	if err != nil {
+		t.Fatalf("failed to unmarshal referrer: %v", err)
+	}
+	return uploadImage(t, repository, image{manifest: m})
+}
+
+func exportArchive(t *testing.T, registry distribution.Namespace, opts ExportOpts) ([]byte, ExportStats) {
+	var buf bytes.Buffer
+	stats, err := Export(dcontext.Background(), registry, &buf, opts)
+	if err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+	return buf.Bytes(), stats
+}
+
+func readArchive(t *testing.T, archive []byte) (map[string][]byte, []string) {
+	files := make(map[string][]byte)
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = content
+		names = append(names, hdr.Name)
+	}
+	return files, names
+}
+
+func checkManifest(t *testing.T, repository distribution.Repository, dgst digest.Digest, expected bool) {
+	ctx := dcontext.Background()
+	manifestService := makeManifestService(t, repository)
+	exists, err := manifestService.Exists(ctx, dgst)
+	if err != nil {
+		t.Fatalf("failed to check manifest %s: %v", dgst, err)
+	}
+	if exists != expected {
+		t.Fatalf("manifest %s exists in %s: %t, expected %t", dgst, repository.Named(), exists, expected)
+	}
+}
+
+func checkTag(t *testing.T, repository distribution.Repository, tag string, expected digest.Digest) {
+	ctx := dcontext.Background()
+	desc, err := repository.Tags(ctx).Get(ctx, tag)
+	if expected == "" {
+		if err == nil {
+			t.Fatalf("tag %s of %s exists, expected none", tag, repository.Named())
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("failed to get tag %s of %s: %v", tag, repository.Named(), err)
+	}
+	if desc.Digest != expected {
+		t.Fatalf("tag %s of %s is %s, expected %s", tag, repository.Named(), desc.Digest, expected)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := dcontext.Background()
+	source := createRegistry(t, inmemory.New())
+
+	app := makeRepository(t, source, "team/app")
+	amd64 := uploadRandomOCIImage(t, app)
+	arm64 := uploadRandomOCIImage(t, app)
+	list, err := testutil.MakeManifestList(source.BlobStatter(), []digest.Digest{amd64.manifestDigest, arm64.manifestDigest})
+	if err != nil {
+		t.Fatalf("failed to make manifest list: %v", err)
+	}
+	listDigest := uploadImage(t, app, image{manifest: list})
+	tagManifest(t, app, "latest", listDigest)
+	tagManifest(t, app, "amd64", amd64.manifestDigest)
+	signature := uploadReferrer(t, app, listDigest)
+	untagged := uploadRandomOCIImage(t, app)
+
+	tools := makeRepository(t, source, "tools")
+	tool := uploadRandomOCIImage(t, tools)
+	tagManifest(t, tools, "v1", tool.manifestDigest)
+
+	archive, stats := exportArchive(t, source, ExportOpts{})
+	if stats.Repositories != 2 || stats.Tags != 3 {
+		t.Fatalf("unexpected export stats: %+v", stats)
+	}
+	// The list, its two images, the referrer and the tool.
+	if stats.Manifests != 5 {
+		t.Fatalf("exported %d manifests, expected 5", stats.Manifests)
+	}
+
+	files, names := readArchive(t, archive)
+	if len(names) < 2 || names[0] != v1.ImageLayoutFile || names[1] != v1.ImageIndexFile {
+		t.Fatalf("unexpected order of archive entries: %v", names)
+	}
+	for name, content := range files {
+		if name == v1.ImageLayoutFile || name == v1.ImageIndexFile {
+			continue
+		}
+		rel, ok := strings.CutPrefix(name, v1.ImageBlobsDir+"/")
+		if !ok {
+			t.Fatalf("unexpected archive entry %s", name)
+		}
+		algorithm, encoded, _ := strings.Cut(rel, "/")
+		if dgst := digest.NewDigestFromEncoded(digest.Algorithm(algorithm), encoded); dgst != digest.FromBytes(content) {
+			t.Fatalf("content of %s does not match its digest", name)
+		}
+	}
+	if _, ok := files["blobs/sha256/"+untagged.manifestDigest.Encoded()]; ok {
+		t.Fatal("untagged manifest was exported")
+	}
+
+	var index v1.Index
+	if err := json.Unmarshal(files[v1.ImageIndexFile], &index); err != nil {
+		t.Fatalf("invalid index: %v", err)
+	}
+	names = nil
+	for _, desc := range index.Manifests {
+		names = append(names, desc.Annotations[annotationImageName])
+	}
+	expected := []string{"team/app:amd64", "team/app:latest", "team/app@" + signature.String(), "tools:v1"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected index entries %v, expected %v", names, expected)
+	}
+
+	destination := createRegistry(t, inmemory.New())
+	imported, err := Import(ctx, destination, bytes.NewReader(archive), ImportOpts{})
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if imported.Repositories != 2 || imported.Tags != 3 || imported.Manifests != 5 || imported.Skipped != 0 {
+		t.Fatalf("unexpected import stats: %+v", imported)
+	}
+	if imported.Bytes != stats.Bytes {
+		t.Fatalf("imported %d bytes, exported %d", imported.Bytes, stats.Bytes)
+	}
+
+	app = makeRepository(t, destination, "team/app")
+	checkTag(t, app, "latest", listDigest)
+	checkTag(t, app, "amd64", amd64.manifestDigest)
+	checkManifest(t, app, arm64.manifestDigest, true)
+	checkManifest(t, app, signature, true)
+	checkManifest(t, app, untagged.manifestDigest, false)
+	for dgst := range arm64.layers {
+		if _, err := app.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatalf("layer %s was not imported: %v", dgst, err)
+		}
+	}
+	checkTag(t, makeRepository(t, destination, "tools"), "v1", tool.manifestDigest)
+
+	// Importing again skips what is present already.
+	imported, err = Import(ctx, destination, bytes.NewReader(archive), ImportOpts{})
+	if err != nil {
+		t.Fatalf("failed to import again: %v", err)
+	}
+	if imported.Manifests != 0 || imported.Blobs != 0 || imported.Skipped == 0 {
+		t.Fatalf("unexpected stats of second import: %+v", imported)
+	}
+}
+
+func TestExportImportFilters(t *testing.T) {
+	ctx := dcontext.Background()
+	source := createRegistry(t, inmemory.New())
+
+	app := makeRepository(t, source, "team/app")
+	stable := uploadRandomOCIImage(t, app)
+	tagManifest(t, app, "1.0", stable.manifestDigest)
+	dev := uploadRandomOCIImage(t, app)
+	tagManifest(t, app, "dev", dev.manifestDigest)
+	devSignature := uploadReferrer(t, app, dev.manifestDigest)
+
+	other := makeRepository(t, source, "other/app")
+	otherImage := uploadRandomOCIImage(t, other)
+	tagManifest(t, other, "1.0", otherImage.manifestDigest)
+
+	archive, stats := exportArchive(t, source, ExportOpts{Include: []string{"team/*"}, Exclude: []string{"team/app:dev"}})
+	if stats.Repositories != 1 || stats.Tags != 1 || stats.Manifests != 1 {
+		t.Fatalf("unexpected export stats: %+v", stats)
+	}
+	files, _ := readArchive(t, archive)
+	if _, ok := files["blobs/sha256/"+devSignature.Encoded()]; ok {
+		t.Fatal("referrer of an excluded tag was exported")
+	}
+
+	// Filter on import.
+	archive, _ = exportArchive(t, source, ExportOpts{})
+	destination := createRegistry(t, inmemory.New())
+	if _, err := Import(ctx, destination, bytes.NewReader(archive), ImportOpts{Include: []string{"team/app:dev"}}); err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	app = makeRepository(t, destination, "team/app")
+	checkTag(t, app, "dev", dev.manifestDigest)
+	checkManifest(t, app, devSignature, true)
+	checkTag(t, app, "1.0", "")
+	checkManifest(t, app, stable.manifestDigest, false)
+	checkTag(t, makeRepository(t, destination, "other/app"), "1.0", "")
+
+	if _, err := Export(ctx, source, io.Discard, ExportOpts{Include: []string{"["}}); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+func TestImportLayout(t *testing.T) {
+	ctx := dcontext.Background()
+
+	// An archive written by another tool: blobs first, tags named by
+	// org.opencontainers.image.ref.name only.
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	layer := []byte("layer")
+	manifest, err := json.Marshal(v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers:    []v1.Descriptor{{MediaType: v1.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := json.Marshal(v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{{
+			MediaType:   v1.MediaTypeImageManifest,
+			Digest:      digest.FromBytes(manifest),
+			Size:        int64(len(manifest)),
+			Annotations: map[string]string{v1.AnnotationRefName: "1.0"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, content := range [][]byte{layer, manifest, config} {
+		if err := tw.WriteHeader(&tar.Header{Name: "./blobs/sha256/" + digest.FromBytes(content).Encoded(), Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string][]byte{
+		v1.ImageLayoutFile: []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		v1.ImageIndexFile:  index,
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := createRegistry(t, inmemory.New())
+	if _, err := Import(ctx, registry, bytes.NewReader(buf.Bytes()), ImportOpts{}); err == nil {
+		t.Fatal("expected an error importing manifests without a repository")
+	}
+	stats, err := Import(ctx, registry, bytes.NewReader(buf.Bytes()), ImportOpts{Repository: "imported"})
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if stats.Tags != 1 || stats.Manifests != 1 || stats.Blobs != 2 {
+		t.Fatalf("unexpected import stats: %+v", stats)
+	}
+	checkTag(t, makeRepository(t, registry, "imported"), "1.0", digest.FromBytes(manifest))
+}
+
+func TestImportLayoutSHA512(t *testing.T) {
+	ctx := dcontext.Background()
+
+	// An archive referencing its manifest by a sha512 digest.
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	layer := []byte("layer")
+	manifest, err := json.Marshal(v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers:    []v1.Descriptor{{MediaType: v1.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := digest.SHA512.FromBytes(manifest)
+	index, err := json.Marshal(v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{{
+			MediaType:   v1.MediaTypeImageManifest,
+			Digest:      manifestDigest,
+			Size:        int64(len(manifest)),
+			Annotations: map[string]string{v1.AnnotationRefName: "1.0"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range map[string][]byte{
+		v1.ImageLayoutFile: []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		"blobs/sha256/" + digest.FromBytes(config).Encoded(): config,
+		"blobs/sha256/" + digest.FromBytes(layer).Encoded():  layer,
+		"blobs/sha512/" + manifestDigest.Encoded():           manifest,
+		v1.ImageIndexFile: index,
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := createRegistry(t, inmemory.New())
+	stats, err := Import(ctx, registry, bytes.NewReader(buf.Bytes()), ImportOpts{Repository: "imported"})
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if stats.Tags != 1 || stats.Manifests != 1 || stats.Blobs != 2 {
+		t.Fatalf("unexpected import stats: %+v", stats)
+	}
+	repository := makeRepository(t, registry, "imported")
+	checkManifest(t, repository, manifestDigest, true)
+	checkTag(t, repository, "1.0", manifestDigest)
+}
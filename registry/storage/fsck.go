@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// FsckOpts contains options for the integrity check
+type FsckOpts struct {
+	// Repair removes dangling links and quarantines corrupted blobs.
+	Repair bool
+}
+
+// Types of the issues found by Fsck.
+const (
+	// FsckCorruptedBlob is a blob whose data does not match its digest.
+	FsckCorruptedBlob = "corrupted-blob"
+	// FsckInvalidLink is a link which does not hold a digest.
+	FsckInvalidLink = "invalid-link"
+	// FsckDanglingLink is a link to a blob which is missing or corrupted.
+	FsckDanglingLink = "dangling-link"
+	// FsckInvalidManifest is a manifest which cannot be parsed.
+	FsckInvalidManifest = "invalid-manifest"
+	// FsckMissingReference is a manifest referencing a blob which is
+	// missing or corrupted.
+	FsckMissingReference = "missing-reference"
+)
+
+// FsckIssue is an issue found by Fsck
+type FsckIssue struct {
+	Type       string        `json:"type"`
+	Path       string        `json:"path"`
+	Repository string        `json:"repository,omitempty"`
+	Digest     digest.Digest `json:"digest,omitempty"`
+	// Reference is the digest of the blob referenced by the manifest of a
+	// missing-reference issue.
+	Reference digest.Digest `json:"reference,omitempty"`
+	Repaired  bool          `json:"repaired"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// FsckReport is the result of an integrity check
+type FsckReport struct {
+	Blobs     int         `json:"blobs"`
+	Links     int         `json:"links"`
+	Manifests int         `json:"manifests"`
+	Issues    []FsckIssue `json:"issues"`
+}
+
+// Unrepaired returns the number of issues which have not been repaired.
+func (r *FsckReport) Unrepaired() int {
+	n := 0
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// Fsck checks the integrity of registry data: it verifies that blob data
+// matches its digest, that links point at valid blobs and that manifests
+// only reference valid blobs. When repairing, corrupted blobs are moved to a
+// quarantine directory next to the blobs directory, and dangling links are
+// removed. Manifests referencing missing blobs are only reported.
+func Fsck(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts FsckOpts) (*FsckReport, error) {
+	c := &fsck{
+		driver:   storageDriver,
+		registry: registry,
+		opts:     opts,
+		report:   &FsckReport{Issues: []FsckIssue{}},
+		valid:    make(map[digest.Digest]bool),
+	}
+	err := c.checkBlobs(ctx)
+	c.applyRepairs()
+	if err != nil {
+		return c.report, err
+	}
+	err = c.checkRepositories(ctx)
+	c.applyRepairs()
+	return c.report, err
+}
+
+type fsck struct {
+	driver   driver.StorageDriver
+	registry distribution.Namespace
+	opts     FsckOpts
+	report   *FsckReport
+
+	// valid records whether the blobs checked so far are valid.
+	valid   map[digest.Digest]bool
+	repairs []pendingRepair
+}
+
+type pendingRepair struct {
+	issue  int
+	repair func() error
+}
+
+// addIssue records an issue, and the function repairing it if any. Repairs
+// are applied once the walk which found the issues is over.
+func (c *fsck) addIssue(issue FsckIssue, repair func() error) {
+	emit("%s: %s", issue.Type, issue.Path)
+	c.report.Issues = append(c.report.Issues, issue)
+	if c.opts.Repair && repair != nil {
+		c.repairs = append(c.repairs, pendingRepair{issue: len(c.report.Issues) - 1, repair: repair})
+	}
+}
+
+func (c *fsck) applyRepairs() {
+	for _, r := range c.repairs {
+		issue := &c.report.Issues[r.issue]
+		err := r.repair()
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			// Removed along with another issue, e.g. the links of a tag.
+			err = nil
+		}
+		if err != nil {
+			issue.Error = err.Error()
+		} else {
+			issue.Repaired = true
+		}
+	}
+	c.repairs = nil
+}
+
+// checkBlobs verifies the digest of the data of all the blobs.
+func (c *fsck) checkBlobs(ctx context.Context) error {
+	root, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		return err
+	}
+	err = c.driver.Walk(ctx, root, func(fi driver.FileInfo) error {
+		if fi.IsDir() || path.Base(fi.Path()) != "data" {
+			return nil
+		}
+		dgst, err := digestFromPath(fi.Path())
+		if err != nil {
+			return nil
+		}
+		c.report.Blobs++
+
+		valid, err := c.verifyBlob(ctx, fi.Path(), dgst)
+		if err != nil {
+			return err
+		}
+		c.valid[dgst] = valid
+		if !valid {
+			c.addIssue(FsckIssue{Type: FsckCorruptedBlob, Path: fi.Path(), Digest: dgst}, func() error {
+				return c.quarantine(ctx, fi.Path(), dgst)
+			})
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+func (c *fsck) verifyBlob(ctx context.Context, p string, dgst digest.Digest) (bool, error) {
+	rc, err := c.driver.Reader(ctx, p, 0)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(verifier, rc); err != nil {
+		return false, err
+	}
+	return verifier.Verified(), nil
+}
+
+// quarantine moves the data of a corrupted blob out of the blobs directory.
+func (c *fsck) quarantine(ctx context.Context, p string, dgst digest.Digest) error {
+	components, err := digestPathComponents(dgst, false)
+	if err != nil {
+		return err
+	}
+	dest := path.Join(append([]string{storagePathRoot, storagePathVersion, "quarantine"}, append(components, "data")...)...)
+	return c.driver.Move(ctx, p, dest)
+}
+
+// blobValid returns whether the data of the blob exists and matches its
+// digest.
+func (c *fsck) blobValid(ctx context.Context, dgst digest.Digest) (bool, error) {
+	if valid, ok := c.valid[dgst]; ok {
+		return valid, nil
+	}
+	p, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return false, nil
+	}
+	_, err = c.driver.Stat(ctx, p)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		c.valid[dgst] = false
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	// The blob was added since the blobs were checked.
+	return true, nil
+}
+
+// checkRepositories checks the links of all the repositories, and the
+// references of their manifests.
+func (c *fsck) checkRepositories(ctx context.Context) error {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return err
+	}
+
+	manifests := make(map[string][]digest.Digest)
+	var repositories []string
+	err = c.driver.Walk(ctx, root, func(fi driver.FileInfo) error {
+		p := fi.Path()
+		if fi.IsDir() {
+			if path.Base(p) == "_uploads" {
+				return driver.ErrSkipDir
+			}
+			return nil
+		}
+		if path.Base(p) != "link" {
+			return nil
+		}
+
+		repository, kind, ok := parseLinkPath(strings.TrimPrefix(p, root+"/"))
+		if !ok {
+			return nil
+		}
+		c.report.Links++
+
+		dgst, err := c.readlink(ctx, p)
+		if err != nil {
+			c.addIssue(FsckIssue{Type: FsckInvalidLink, Path: p, Repository: repository, Error: err.Error()}, func() error {
+				return c.removeLink(ctx, p, kind)
+			})
+			return nil
+		}
+		valid, err := c.blobValid(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			c.addIssue(FsckIssue{Type: FsckDanglingLink, Path: p, Repository: repository, Digest: dgst}, func() error {
+				return c.removeLink(ctx, p, kind)
+			})
+			return nil
+		}
+
+		if kind == "revision" {
+			if _, ok := manifests[repository]; !ok {
+				repositories = append(repositories, repository)
+			}
+			manifests[repository] = append(manifests[repository], dgst)
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, repository := range repositories {
+		if err := c.checkManifests(ctx, repository, manifests[repository]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseLinkPath returns the repository and the kind of a link from its path
+// relative to the repositories directory.
+func parseLinkPath(p string) (repository string, kind string, ok bool) {
+	for _, sep := range []string{"/_layers/", "/_manifests/"} {
+		i := strings.Index(p, sep)
+		if i < 0 {
+			continue
+		}
+		repository = p[:i]
+		components := strings.Split(p[i+len(sep):], "/")
+		switch {
+		case sep == "/_layers/" && len(components) == 3:
+			return repository, "layer", true
+		case len(components) == 4 && components[0] == "revisions":
+			return repository, "revision", true
+		case len(components) == 4 && components[0] == "tags" && components[2] == "current":
+			return repository, "tag", true
+		case len(components) == 6 && components[0] == "tags" && components[2] == "index":
+			return repository, "tag-index", true
+		}
+	}
+	return "", "", false
+}
+
+func (c *fsck) readlink(ctx context.Context, p string) (digest.Digest, error) {
+	content, err := c.driver.GetContent(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	return digest.Parse(string(content))
+}
+
+// removeLink removes a dangling link. A tag whose current link is dangling
+// is removed altogether.
+func (c *fsck) removeLink(ctx context.Context, p string, kind string) error {
+	if kind == "tag" {
+		p = path.Dir(path.Dir(p))
+	}
+	return c.driver.Delete(ctx, p)
+}
+
+// checkManifests checks that the manifests of a repository only reference
+// valid blobs.
+func (c *fsck) checkManifests(ctx context.Context, repository string, dgsts []digest.Digest) error {
+	named, err := reference.WithName(repository)
+	if err != nil {
+		return fmt.Errorf("failed to parse repo name %s: %v", repository, err)
+	}
+	repo, err := c.registry.Repository(ctx, named)
+	if err != nil {
+		return fmt.Errorf("failed to construct repository: %v", err)
+	}
+	manifestService, err := repo.Manifests(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to construct manifest service: %v", err)
+	}
+
+	for _, dgst := range dgsts {
+		c.report.Manifests++
+		p, err := pathFor(manifestRevisionLinkPathSpec{name: repository, revision: dgst})
+		if err != nil {
+			return err
+		}
+		manifest, err := manifestService.Get(ctx, dgst)
+		if err != nil {
+			c.addIssue(FsckIssue{Type: FsckInvalidManifest, Path: p, Repository: repository, Digest: dgst, Error: err.Error()}, nil)
+			continue
+		}
+		for _, ref := range manifest.References() {
+			if len(ref.URLs) > 0 {
+				// Foreign layers are not stored in the registry.
+				continue
+			}
+			valid, err := c.blobValid(ctx, ref.Digest)
+			if err != nil {
+				return err
+			}
+			if !valid {
+				c.addIssue(FsckIssue{Type: FsckMissingReference, Path: p, Repository: repository, Digest: dgst, Reference: ref.Digest}, nil)
+			}
+		}
+	}
+	return nil
+}
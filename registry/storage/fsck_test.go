@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func issuesByType(report *FsckReport) map[string][]FsckIssue {
+	issues := make(map[string][]FsckIssue)
+	for _, issue := range report.Issues {
+		issues[issue.Type] = append(issues[issue.Type], issue)
+	}
+	return issues
+}
+
+func TestFsckNoIssues(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "healthy")
+	image := uploadRandomOCIImage(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: image.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+
+	report, err := Fsck(ctx, inmemoryDriver, registry, FsckOpts{})
+	if err != nil {
+		t.Fatalf("failed to check registry: %v", err)
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("unexpected issues: %+v", report.Issues)
+	}
+	// Two layers, the config and the manifest.
+	if report.Blobs != 4 || report.Manifests != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	// Three layer links, the revision link and the two tag links.
+	if report.Links != 6 {
+		t.Fatalf("unexpected number of links: %d", report.Links)
+	}
+}
+
+func TestFsckForeignLayer(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver, ManifestURLsAllowRegexp(regexp.MustCompile("^https?://foo")))
+	repo := makeRepository(t, registry, "foreign")
+	manifestService := makeManifestService(t, repo)
+
+	config, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayerGzip, []byte("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The foreign layer is only stored at its urls.
+	foreignLayer := distribution.Descriptor{
+		Digest:    digest.FromString("foreign layer"),
+		Size:      6323,
+		MediaType: v1.MediaTypeImageLayerNonDistributableGzip, //nolint:staticcheck // ignore A1019: v1.MediaTypeImageLayerNonDistributableGzip is deprecated: Non-distributable layers are deprecated, and not recommended for future use
+		URLs:      []string{"https://foo/layer"},
+	}
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []distribution.Descriptor{layer, foreignLayer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manifestService.Put(ctx, manifest); err != nil {
+		t.Fatalf("failed to put manifest: %v", err)
+	}
+
+	report, err := Fsck(ctx, inmemoryDriver, registry, FsckOpts{})
+	if err != nil {
+		t.Fatalf("failed to check registry: %v", err)
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("unexpected issues: %+v", report.Issues)
+	}
+}
+
+func TestFsckRepair(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "broken")
+	image := uploadRandomOCIImage(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: image.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+
+	// Corrupt a layer, and remove the other one.
+	layers := getKeys(image.layers)
+	corrupted, removed := layers[0], layers[1]
+	corruptedPath, err := pathFor(blobDataPathSpec{digest: corrupted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inmemoryDriver.PutContent(ctx, corruptedPath, []byte("corrupted")); err != nil {
+		t.Fatalf("failed to corrupt layer: %v", err)
+	}
+	removedPath, err := pathFor(blobPathSpec{digest: removed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inmemoryDriver.Delete(ctx, removedPath); err != nil {
+		t.Fatalf("failed to remove layer: %v", err)
+	}
+
+	// Tag a manifest which does not exist.
+	missing := digest.FromString("missing manifest")
+	for _, spec := range []pathSpec{
+		manifestTagCurrentPathSpec{name: "broken", tag: "missing"},
+		manifestTagIndexEntryLinkPathSpec{name: "broken", tag: "missing", revision: missing},
+	} {
+		p, err := pathFor(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := inmemoryDriver.PutContent(ctx, p, []byte(missing)); err != nil {
+			t.Fatalf("failed to write link: %v", err)
+		}
+	}
+
+	report, err := Fsck(ctx, inmemoryDriver, registry, FsckOpts{})
+	if err != nil {
+		t.Fatalf("failed to check registry: %v", err)
+	}
+	issues := issuesByType(report)
+	if len(issues[FsckCorruptedBlob]) != 1 || issues[FsckCorruptedBlob][0].Digest != corrupted {
+		t.Fatalf("unexpected corrupted blobs: %+v", issues[FsckCorruptedBlob])
+	}
+	// The links of both layers, and the two links of the missing tag.
+	if len(issues[FsckDanglingLink]) != 4 {
+		t.Fatalf("unexpected dangling links: %+v", issues[FsckDanglingLink])
+	}
+	if len(issues[FsckMissingReference]) != 2 {
+		t.Fatalf("unexpected missing references: %+v", issues[FsckMissingReference])
+	}
+	for _, issue := range issues[FsckMissingReference] {
+		if issue.Digest != image.manifestDigest || (issue.Reference != corrupted && issue.Reference != removed) {
+			t.Fatalf("unexpected missing reference: %+v", issue)
+		}
+	}
+	if report.Unrepaired() != len(report.Issues) {
+		t.Fatalf("issues repaired without repair option: %+v", report.Issues)
+	}
+
+	report, err = Fsck(ctx, inmemoryDriver, registry, FsckOpts{Repair: true})
+	if err != nil {
+		t.Fatalf("failed to repair registry: %v", err)
+	}
+	// Missing references cannot be repaired.
+	if report.Unrepaired() != 2 {
+		t.Fatalf("unexpected unrepaired issues: %+v", report.Issues)
+	}
+
+	if _, err := inmemoryDriver.Stat(ctx, corruptedPath); err == nil {
+		t.Fatalf("corrupted blob was not quarantined")
+	}
+	if _, err := inmemoryDriver.Stat(ctx, "/docker/registry/v2/quarantine/"+corrupted.Algorithm().String()+"/"+corrupted.Encoded()+"/data"); err != nil {
+		t.Fatalf("corrupted blob not found in quarantine: %v", err)
+	}
+	if _, err := repo.Tags(ctx).Get(ctx, "missing"); err == nil {
+		t.Fatalf("dangling tag was not removed")
+	}
+	if _, err := repo.Tags(ctx).Get(ctx, "latest"); err != nil {
+		t.Fatalf("failed to resolve tag: %v", err)
+	}
+
+	// Only the manifest referencing the missing layers remains.
+	report, err = Fsck(ctx, inmemoryDriver, registry, FsckOpts{Repair: true})
+	if err != nil {
+		t.Fatalf("failed to check registry: %v", err)
+	}
+	issues = issuesByType(report)
+	if len(report.Issues) != 2 || len(issues[FsckMissingReference]) != 2 {
+		t.Fatalf("unexpected issues after repair: %+v", report.Issues)
+	}
+}
+
+func TestParseLinkPath(t *testing.T) {
+	for p, expected := range map[string][2]string{
+		"foo/bar/_layers/sha256/abcd/link":                  {"foo/bar", "layer"},
+		"foo/_manifests/revisions/sha256/abcd/link":         {"foo", "revision"},
+		"foo/_manifests/tags/latest/current/link":           {"foo", "tag"},
+		"foo/_manifests/tags/latest/index/sha256/abcd/link": {"foo", "tag-index"},
+		"foo/_manifests/tags/latest/link":                   {"", ""},
+		"foo/_uploads/id/data":                              {"", ""},
+		"foo/_layers/sha256/abcd/extra/link":                {"", ""},
+	} {
+		repository, kind, _ := parseLinkPath(p)
+		if repository != expected[0] || kind != expected[1] {
+			t.Errorf("unexpected result for %s: %s %s", p, repository, kind)
+		}
+	}
+}
@@ -0,0 +1,693 @@
+package storage
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxImportManifestSize is the maximum size of the manifests of an
+// imported archive, as for the manifests pushed to the registry.
+const maxImportManifestSize = 4 << 20
+
+// ImportOpts contains options for importing repositories
+type ImportOpts struct {
+	// Include and Exclude select the imported tags, as for ExportOpts.
+	Include []string
+	Exclude []string
+	// Repository is the repository of the manifests of the index of the
+	// archive which do not name their repository, as in the OCI image
+	// layouts written by other tools. Their tag is read from their
+	// org.opencontainers.image.ref.name annotation.
+	Repository string
+}
+
+// ImportStats summarizes an import
+type ImportStats struct {
+	Repositories int
+	Tags         int
+	Manifests    int
+	Blobs        int
+	// Skipped is the number of manifests and blobs which were present in
+	// their repository already.
+	Skipped int
+	// Bytes is the size of the imported blobs, manifests excluded.
+	Bytes int64
+}
+
+// importRef is a manifest of the index of an imported archive.
+type importRef struct {
+	repository string
+	tag        string
+	desc       v1.Descriptor
+}
+
+// importManifest is a manifest of an imported archive.
+type importManifest struct {
+	mediaType string
+	payload   []byte
+	manifest  distribution.Manifest
+	manifests []distribution.Descriptor
+	blobs     []distribution.Descriptor
+}
+
+type importer struct {
+	ctx      context.Context
+	registry distribution.Namespace
+	opts     ImportOpts
+	filter   referenceFilter
+	stats    ImportStats
+
+	spool string
+	index *v1.Index
+	refs  []importRef
+	// pending are the untagged manifests of the index, imported when their
+	// subject is.
+	pending []importRef
+
+	mediaTypes map[digest.Digest]string
+	manifests  map[digest.Digest]*importManifest
+	// wantManifests and wantBlobs are the repositories the manifests and
+	// blobs are imported to.
+	wantManifests map[digest.Digest]map[string]struct{}
+	wantBlobs     map[digest.Digest]map[string]struct{}
+	blobDescs     map[digest.Digest]distribution.Descriptor
+	// spooled holds the blobs read before it was known whether they were
+	// needed, and pushed the repositories blobs were pushed to.
+	spooled map[digest.Digest]string
+	pushed  map[digest.Digest]map[string]struct{}
+
+	repositories map[string]distribution.Repository
+}
+
+// Import imports the manifests of an OCI image layout tar archive to the
+// repositories of the registry, preserving their digests and tags. The
+// repositories and tags are read from the annotations of the index of the
+// archive, as written by Export, and the referrers of the imported manifests
+// are imported with them.
+//
+// The blobs of the archive are pushed as they are read when the index and
+// the manifests precede them, as in the archives written by Export, and are
+// spooled to a temporary directory otherwise.
+func Import(ctx context.Context, registry distribution.Namespace, r io.Reader, opts ImportOpts) (ImportStats, error) {
+	filter, err := newReferenceFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	if opts.Repository != "" {
+		if _, err := reference.WithName(opts.Repository); err != nil {
+			return ImportStats{}, fmt.Errorf("invalid repository %s: %v", opts.Repository, err)
+		}
+	}
+
+	spool, err := os.MkdirTemp("", "registry-import-")
+	if err != nil {
+		return ImportStats{}, err
+	}
+	defer os.RemoveAll(spool)
+
+	im := &importer{
+		ctx:           ctx,
+		registry:      registry,
+		opts:          opts,
+		filter:        filter,
+		spool:         spool,
+		mediaTypes:    make(map[digest.Digest]string),
+		manifests:     make(map[digest.Digest]*importManifest),
+		wantManifests: make(map[digest.Digest]map[string]struct{}),
+		wantBlobs:     make(map[digest.Digest]map[string]struct{}),
+		blobDescs:     make(map[digest.Digest]distribution.Descriptor),
+		spooled:       make(map[digest.Digest]string),
+		pushed:        make(map[digest.Digest]map[string]struct{}),
+		repositories:  make(map[string]distribution.Repository),
+	}
+	if err := im.read(r); err != nil {
+		return im.stats, err
+	}
+	if err := im.resolve(); err != nil {
+		return im.stats, err
+	}
+	if err := im.push(); err != nil {
+		return im.stats, err
+	}
+	return im.stats, nil
+}
+
+// read reads the archive, pushing the blobs which are known to be needed
+// and spooling the others.
+func (im *importer) read(r io.Reader) error {
+	tr := tar.NewReader(r)
+	layout := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		switch {
+		case name == v1.ImageLayoutFile:
+			var l v1.ImageLayout
+			if err := json.NewDecoder(tr).Decode(&l); err != nil {
+				return fmt.Errorf("invalid %s: %v", v1.ImageLayoutFile, err)
+			}
+			if l.Version != v1.ImageLayoutVersion {
+				return fmt.Errorf("unsupported image layout version %q", l.Version)
+			}
+			layout = true
+		case name == v1.ImageIndexFile:
+			var idx v1.Index
+			if err := json.NewDecoder(tr).Decode(&idx); err != nil {
+				return fmt.Errorf("invalid %s: %v", v1.ImageIndexFile, err)
+			}
+			im.index = &idx
+			if err := im.readIndex(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(name, v1.ImageBlobsDir+"/"):
+			parts := strings.Split(name, "/")
+			if len(parts) != 3 {
+				continue
+			}
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2])
+			if err := dgst.Validate(); err != nil {
+				return fmt.Errorf("invalid blob %s: %v", name, err)
+			}
+			if err := im.readBlob(dgst, hdr.Size, tr); err != nil {
+				return fmt.Errorf("failed to import blob %s: %v", dgst, err)
+			}
+		}
+	}
+
+	if !layout {
+		return fmt.Errorf("the archive is not an OCI image layout: %s is missing", v1.ImageLayoutFile)
+	}
+	if im.index == nil {
+		return fmt.Errorf("the archive is not an OCI image layout: %s is missing", v1.ImageIndexFile)
+	}
+	return nil
+}
+
+// readIndex selects the tags of the index to import.
+func (im *importer) readIndex() error {
+	for _, desc := range im.index.Manifests {
+		ref := importRef{desc: desc, repository: im.opts.Repository, tag: desc.Annotations[v1.AnnotationRefName]}
+		if name := desc.Annotations[annotationImageName]; name != "" {
+			parsed, err := reference.Parse(name)
+			if err != nil {
+				return fmt.Errorf("invalid image name %q of manifest %s: %v", name, desc.Digest, err)
+			}
+			named, ok := parsed.(reference.Named)
+			if !ok {
+				return fmt.Errorf("image name %q of manifest %s has no repository", name, desc.Digest)
+			}
+			ref.repository = named.Name()
+			ref.tag = ""
+			if tagged, ok := named.(reference.Tagged); ok {
+				ref.tag = tagged.Tag()
+			}
+		}
+		if ref.repository == "" {
+			return fmt.Errorf("manifest %s of the index does not name its repository: set the repository to import it to", desc.Digest)
+		}
+		im.mediaTypes[desc.Digest] = desc.MediaType
+
+		if ref.tag == "" {
+			im.pending = append(im.pending, ref)
+			continue
+		}
+		if !im.filter.match(ref.repository, ref.tag) {
+			continue
+		}
+		im.refs = append(im.refs, ref)
+		if err := im.wantManifest(ref.repository, desc.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wantManifest marks a manifest to be imported to a repository, with the
+// manifests and blobs it references when it has been read.
+func (im *importer) wantManifest(repository string, dgst digest.Digest) error {
+	if _, ok := im.wantManifests[dgst][repository]; ok {
+		return nil
+	}
+	if im.wantManifests[dgst] == nil {
+		im.wantManifests[dgst] = make(map[string]struct{})
+	}
+	im.wantManifests[dgst][repository] = struct{}{}
+
+	m, ok := im.manifests[dgst]
+	if !ok {
+		if p, ok := im.spooled[dgst]; ok {
+			payload, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			if err := im.loadManifest(dgst, payload); err != nil {
+				return err
+			}
+			m = im.manifests[dgst]
+		}
+	}
+	if m == nil {
+		return nil
+	}
+	return im.expand(repository, m)
+}
+
+// expand marks the manifests and blobs referenced by a manifest to be
+// imported to a repository.
+func (im *importer) expand(repository string, m *importManifest) error {
+	for _, child := range m.manifests {
+		if _, ok := im.mediaTypes[child.Digest]; !ok {
+			im.mediaTypes[child.Digest] = child.MediaType
+		}
+		if err := im.wantManifest(repository, child.Digest); err != nil {
+			return err
+		}
+	}
+	for _, blob := range m.blobs {
+		if im.wantBlobs[blob.Digest] == nil {
+			im.wantBlobs[blob.Digest] = make(map[string]struct{})
+			im.blobDescs[blob.Digest] = blob
+		}
+		im.wantBlobs[blob.Digest][repository] = struct{}{}
+	}
+	return nil
+}
+
+// loadManifest parses a manifest of the archive.
+func (im *importer) loadManifest(dgst digest.Digest, payload []byte) error {
+	// The media type of the payload takes precedence over the one of the
+	// descriptors referencing it, which may be generic.
+	var versioned struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(payload, &versioned); err != nil {
+		return fmt.Errorf("invalid manifest %s: %v", dgst, err)
+	}
+	mediaType := versioned.MediaType
+	if mediaType == "" {
+		mediaType = im.mediaTypes[dgst]
+	}
+	if mediaType == "" {
+		mediaType = v1.MediaTypeImageManifest
+		if versioned.Manifests != nil {
+			mediaType = v1.MediaTypeImageIndex
+		}
+	}
+
+	m, _, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return fmt.Errorf("invalid manifest %s: %v", dgst, err)
+	}
+	manifests, blobs := manifestReferences(m)
+	im.manifests[dgst] = &importManifest{
+		mediaType: mediaType,
+		payload:   payload,
+		manifest:  m,
+		manifests: manifests,
+		blobs:     blobs,
+	}
+	return nil
+}
+
+// readBlob reads a blob of the archive: manifests are loaded, blobs known to
+// be needed are pushed, and the others are spooled.
+func (im *importer) readBlob(dgst digest.Digest, size int64, r io.Reader) error {
+	verifier := dgst.Verifier()
+	r = io.TeeReader(r, verifier)
+
+	if repositories, ok := im.wantManifests[dgst]; ok {
+		if size > maxImportManifestSize {
+			return fmt.Errorf("manifest is larger than %d bytes", maxImportManifestSize)
+		}
+		payload, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if !verifier.Verified() {
+			return errors.New("content does not match its digest")
+		}
+		if err := im.loadManifest(dgst, payload); err != nil {
+			return err
+		}
+		for _, repository := range sortedKeys(repositories) {
+			if err := im.expand(repository, im.manifests[dgst]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if repositories, ok := im.wantBlobs[dgst]; ok {
+		desc := im.blobDescs[dgst]
+		desc.Size = size
+		for _, repository := range sortedKeys(repositories) {
+			if err := im.pushBlob(repository, desc, r); err != nil {
+				return err
+			}
+			if _, ok := im.pushed[dgst]; ok {
+				// The blob is mounted to the other repositories.
+				break
+			}
+		}
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+
+	p := filepath.Join(im.spool, dgst.Algorithm().String()+"-"+dgst.Encoded())
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return errors.New("content does not match its digest")
+	}
+	im.spooled[dgst] = p
+	return nil
+}
+
+// resolve selects the untagged manifests of the index whose subject is
+// imported, and loads the manifests which were spooled.
+func (im *importer) resolve() error {
+	for changed := true; changed; {
+		changed = false
+		pending := im.pending[:0]
+		for _, ref := range im.pending {
+			m, err := im.manifest(ref.desc.Digest)
+			if err != nil {
+				return err
+			}
+			// Manifests missing from the archive are not selected.
+			selected := false
+			if m != nil {
+				if subject := manifestSubject(m.payload); subject != "" {
+					_, selected = im.wantManifests[subject][ref.repository]
+				} else {
+					selected = im.filter.match(ref.repository, "")
+				}
+			}
+			if !selected {
+				pending = append(pending, ref)
+				continue
+			}
+			im.refs = append(im.refs, ref)
+			if err := im.wantManifest(ref.repository, ref.desc.Digest); err != nil {
+				return err
+			}
+			changed = true
+		}
+		im.pending = pending
+	}
+
+	for dgst, repositories := range im.wantManifests {
+		if _, ok := im.manifests[dgst]; ok {
+			continue
+		}
+		m, err := im.manifest(dgst)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return fmt.Errorf("manifest %s is missing from the archive", dgst)
+		}
+		for _, repository := range sortedKeys(repositories) {
+			if err := im.expand(repository, m); err != nil {
+				return err
+			}
+		}
+		// Expanding the manifest may have added manifests to import.
+		return im.resolve()
+	}
+	return nil
+}
+
+// manifest returns a manifest of the archive, loading it if it was spooled,
+// or nil if it is not in the archive.
+func (im *importer) manifest(dgst digest.Digest) (*importManifest, error) {
+	if m, ok := im.manifests[dgst]; ok {
+		return m, nil
+	}
+	p, ok := im.spooled[dgst]
+	if !ok {
+		return nil, nil
+	}
+	payload, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := im.loadManifest(dgst, payload); err != nil {
+		return nil, err
+	}
+	return im.manifests[dgst], nil
+}
+
+// push pushes the blobs which were not pushed as they were read, then the
+// manifests and the tags.
+func (im *importer) push() error {
+	blobs := make([]digest.Digest, 0, len(im.wantBlobs))
+	for dgst := range im.wantBlobs {
+		blobs = append(blobs, dgst)
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i] < blobs[j] })
+	for _, dgst := range blobs {
+		for _, repository := range sortedKeys(im.wantBlobs[dgst]) {
+			if err := im.pushSpooledBlob(repository, dgst); err != nil {
+				return fmt.Errorf("failed to import blob %s to %s: %v", dgst, repository, err)
+			}
+		}
+	}
+
+	pushed := make(map[string]map[digest.Digest]struct{})
+	for _, ref := range im.refs {
+		if pushed[ref.repository] == nil {
+			pushed[ref.repository] = make(map[digest.Digest]struct{})
+		}
+		if err := im.pushManifest(ref.repository, ref.desc.Digest, pushed[ref.repository]); err != nil {
+			return fmt.Errorf("failed to import manifest %s to %s: %v", ref.desc.Digest, ref.repository, err)
+		}
+	}
+
+	for _, ref := range im.refs {
+		if ref.tag == "" {
+			continue
+		}
+		repository, err := im.repository(ref.repository)
+		if err != nil {
+			return err
+		}
+		desc := distribution.Descriptor{MediaType: im.manifests[ref.desc.Digest].mediaType, Digest: ref.desc.Digest}
+		if err := repository.Tags(im.ctx).Tag(im.ctx, ref.tag, desc); err != nil {
+			return fmt.Errorf("failed to tag %s:%s: %v", ref.repository, ref.tag, err)
+		}
+		im.stats.Tags++
+	}
+	im.stats.Repositories = len(pushed)
+	return nil
+}
+
+func (im *importer) repository(name string) (distribution.Repository, error) {
+	if repository, ok := im.repositories[name]; ok {
+		return repository, nil
+	}
+	named, err := reference.WithName(name)
+	if err != nil {
+		return nil, err
+	}
+	repository, err := im.registry.Repository(im.ctx, named)
+	if err != nil {
+		return nil, err
+	}
+	im.repositories[name] = repository
+	return repository, nil
+}
+
+// pushBlob pushes a blob to a repository, unless it is present already. The
+// blob is mounted from another repository when it has been pushed already,
+// and uploaded from r otherwise.
+func (im *importer) pushBlob(name string, desc distribution.Descriptor, r io.Reader) error {
+	if _, ok := im.pushed[desc.Digest][name]; ok {
+		return nil
+	}
+	repository, err := im.repository(name)
+	if err != nil {
+		return err
+	}
+	blobs := repository.Blobs(im.ctx)
+
+	markPushed := func() {
+		if im.pushed[desc.Digest] == nil {
+			im.pushed[desc.Digest] = make(map[string]struct{})
+		}
+		im.pushed[desc.Digest][name] = struct{}{}
+	}
+
+	if _, err := blobs.Stat(im.ctx, desc.Digest); err == nil {
+		im.stats.Skipped++
+		markPushed()
+		return nil
+	} else if !errors.Is(err, distribution.ErrBlobUnknown) {
+		return err
+	}
+
+	var options []distribution.BlobCreateOption
+	for source := range im.pushed[desc.Digest] {
+		named, err := reference.WithName(source)
+		if err != nil {
+			return err
+		}
+		canonical, err := reference.WithDigest(named, desc.Digest)
+		if err != nil {
+			return err
+		}
+		options = append(options, WithMountFrom(canonical))
+		break
+	}
+
+	bw, err := blobs.Create(im.ctx, options...)
+	if _, ok := err.(distribution.ErrBlobMounted); ok {
+		markPushed()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(options) > 0 || r == nil {
+		_ = bw.Cancel(im.ctx)
+		return errors.New("the blob is not available")
+	}
+
+	n, err := io.Copy(bw, r)
+	if err != nil {
+		_ = bw.Cancel(im.ctx)
+		return err
+	}
+	if _, err := bw.Commit(im.ctx, distribution.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: n}); err != nil {
+		return err
+	}
+	im.stats.Blobs++
+	im.stats.Bytes += n
+	markPushed()
+	return nil
+}
+
+// pushSpooledBlob pushes a blob to a repository, mounting it if it has been
+// pushed already, and uploading it from the spool otherwise.
+func (im *importer) pushSpooledBlob(name string, dgst digest.Digest) error {
+	if _, ok := im.pushed[dgst][name]; ok {
+		return nil
+	}
+	desc := im.blobDescs[dgst]
+	if len(im.pushed[dgst]) > 0 {
+		return im.pushBlob(name, desc, nil)
+	}
+
+	p, ok := im.spooled[dgst]
+	if !ok {
+		repository, err := im.repository(name)
+		if err != nil {
+			return err
+		}
+		if _, err := repository.Blobs(im.ctx).Stat(im.ctx, dgst); err == nil {
+			im.stats.Skipped++
+			return nil
+		}
+		if len(desc.URLs) > 0 {
+			// Foreign layers are not stored in the registry.
+			return nil
+		}
+		return errors.New("the blob is missing from the archive")
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return im.pushBlob(name, desc, f)
+}
+
+// pushManifest pushes a manifest to a repository, after the manifests it
+// references.
+func (im *importer) pushManifest(name string, dgst digest.Digest, pushed map[digest.Digest]struct{}) error {
+	if _, ok := pushed[dgst]; ok {
+		return nil
+	}
+	pushed[dgst] = struct{}{}
+
+	m := im.manifests[dgst]
+	for _, child := range m.manifests {
+		if err := im.pushManifest(name, child.Digest, pushed); err != nil {
+			return err
+		}
+	}
+
+	repository, err := im.repository(name)
+	if err != nil {
+		return err
+	}
+	var options []distribution.ManifestServiceOption
+	if dgst.Algorithm() != digest.Canonical {
+		// store the manifest under the digest it is referenced by
+		options = append(options, WithDigestAlgorithm(dgst.Algorithm()))
+	}
+	manifestService, err := repository.Manifests(im.ctx, options...)
+	if err != nil {
+		return err
+	}
+	if exists, err := manifestService.Exists(im.ctx, dgst); err != nil {
+		return err
+	} else if exists {
+		im.stats.Skipped++
+		return nil
+	}
+
+	put, err := manifestService.Put(im.ctx, m.manifest)
+	if err != nil {
+		return err
+	}
+	if put != dgst {
+		return fmt.Errorf("manifest was stored with digest %s", put)
+	}
+	im.stats.Manifests++
+	return nil
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
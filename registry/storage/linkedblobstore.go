@@ -33,6 +33,17 @@ type linkedBlobStore struct {
 	deleteEnabled          bool
 	resumableDigestEnabled bool
 
+	// digestAlgorithms are the algorithms with which uploads are hashed as
+	// they are written. The canonical algorithm is used if empty.
+	digestAlgorithms []digest.Algorithm
+
+	// digestAlgorithm is the algorithm of the digests of the content stored
+	// by Put. The canonical algorithm is used if empty.
+	digestAlgorithm digest.Algorithm
+
+	// maxBlobSize limits the size of uploads, unless zero.
+	maxBlobSize int64
+
 	// linkPath allows one to control the repository blob link set to which
 	// the blob store dispatches. This is required because manifest and layer
 	// blobs have not yet been fully merged. At some point, this functionality
@@ -82,9 +93,13 @@ func (lbs *linkedBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter
 }
 
 func (lbs *linkedBlobStore) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
-	dgst := digest.FromBytes(p)
+	algorithm := lbs.digestAlgorithm
+	if algorithm == "" {
+		algorithm = digest.Canonical
+	}
+	dgst := algorithm.FromBytes(p)
 	// Place the data in the blob store first.
-	desc, err := lbs.blobStore.Put(ctx, mediaType, p)
+	desc, err := lbs.blobStore.put(ctx, dgst, mediaType, p)
 	if err != nil {
 		dcontext.GetLogger(ctx).Errorf("error putting into main store: %v", err)
 		return distribution.Descriptor{}, err
@@ -306,16 +321,26 @@ func (lbs *linkedBlobStore) newBlobUpload(ctx context.Context, uuid, path string
 		return nil, err
 	}
 
+	algorithms := lbs.digestAlgorithms
+	if len(algorithms) == 0 {
+		algorithms = []digest.Algorithm{digest.Canonical}
+	}
+	digesters := make(map[digest.Algorithm]digest.Digester, len(algorithms))
+	for _, algorithm := range algorithms {
+		digesters[algorithm] = algorithm.Digester()
+	}
+
 	bw := &blobWriter{
 		ctx:                    ctx,
 		blobStore:              lbs,
 		id:                     uuid,
 		startedAt:              startedAt,
-		digester:               digest.Canonical.Digester(),
+		digesters:              digesters,
 		fileWriter:             fw,
 		driver:                 lbs.driver,
 		path:                   path,
 		resumableDigestEnabled: lbs.resumableDigestEnabled,
+		maxSize:                lbs.maxBlobSize,
 	}
 
 	return bw, nil
@@ -10,6 +10,7 @@ import (
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
 	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -40,6 +41,28 @@ func (o skipLayerOption) Apply(m distribution.ManifestService) error {
 	return fmt.Errorf("skip layer verification only valid for manifestStore")
 }
 
+// WithDigestAlgorithm stores the manifests Put under digests of the given
+// algorithm rather than the canonical one, so that they can be referenced by
+// such digests.
+func WithDigestAlgorithm(algorithm digest.Algorithm) distribution.ManifestServiceOption {
+	return digestAlgorithmOption{algorithm}
+}
+
+type digestAlgorithmOption struct {
+	algorithm digest.Algorithm
+}
+
+func (o digestAlgorithmOption) Apply(m distribution.ManifestService) error {
+	if !o.algorithm.Available() {
+		return digest.ErrDigestUnsupported
+	}
+	if ms, ok := m.(*manifestStore); ok {
+		ms.blobStore.digestAlgorithm = o.algorithm
+		return nil
+	}
+	return fmt.Errorf("digest algorithm only valid for manifestStore")
+}
+
 type manifestStore struct {
 	repository *repository
 	blobStore  *linkedBlobStore
@@ -76,15 +99,8 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 	// TODO(stevvooe): Need to check descriptor from above to ensure that the
 	// mediatype is as we expect for the manifest store.
 
-	content, err := ms.blobStore.Get(ctx, dgst)
+	content, err := ms.content(ctx, dgst)
 	if err != nil {
-		if err == distribution.ErrBlobUnknown {
-			return nil, distribution.ErrManifestUnknownRevision{
-				Name:     ms.repository.Named().Name(),
-				Revision: dgst,
-			}
-		}
-
 		return nil, err
 	}
 
@@ -134,24 +150,112 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 func (ms *manifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Put")
 
+	var handler ManifestHandler
 	switch manifest.(type) {
 	case *schema2.DeserializedManifest:
-		return ms.schema2Handler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.schema2Handler
 	case *ocischema.DeserializedManifest:
-		return ms.ocischemaHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.ocischemaHandler
 	case *manifestlist.DeserializedManifestList:
-		return ms.manifestListHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.manifestListHandler
 	case *ocischema.DeserializedImageIndex:
-		return ms.ocischemaIndexHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.ocischemaIndexHandler
+	default:
+		return "", fmt.Errorf("unrecognized manifest type %T", manifest)
+	}
+
+	dgst, err := handler.Put(ctx, manifest, ms.skipDependencyVerification)
+	if err != nil {
+		return "", err
 	}
 
-	return "", fmt.Errorf("unrecognized manifest type %T", manifest)
+	if ci := ms.repository.catalogIndex; ci != nil {
+		if err := ci.add(ctx, ms.repository.Named().Name()); err != nil {
+			return "", err
+		}
+	} else if err := (&catalogIndex{driver: ms.repository.driver}).invalidate(ctx, ms.repository.Named().Name(), true); err != nil {
+		return "", err
+	}
+	return dgst, nil
 }
 
-// Delete removes the revision of the specified manifest.
+// content returns the payload of a manifest, from the manifest cache if any.
+// The revision link is read first, as manifests deleted by the garbage
+// collector are not cleared from the cache.
+func (ms *manifestStore) content(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	desc, err := ms.blobStore.Stat(ctx, dgst)
+	if err != nil {
+		if err == distribution.ErrBlobUnknown {
+			return nil, distribution.ErrManifestUnknownRevision{
+				Name:     ms.repository.Named().Name(),
+				Revision: dgst,
+			}
+		}
+
+		return nil, err
+	}
+
+	manifestCache := ms.repository.manifestCache
+	if manifestCache != nil {
+		content, err := manifestCache.Manifest(ctx, dgst)
+		if err == nil {
+			return content, nil
+		}
+		if _, ok := err.(distribution.ErrManifestUnknownRevision); !ok {
+			dcontext.GetLoggerWithField(ctx, "manifest", dgst).WithError(err).Error("error from cache getting manifest")
+		}
+	}
+
+	content, err := ms.blobStore.blobStore.Get(ctx, desc.Digest)
+	if err != nil {
+		if err == distribution.ErrBlobUnknown {
+			return nil, distribution.ErrManifestUnknownRevision{
+				Name:     ms.repository.Named().Name(),
+				Revision: dgst,
+			}
+		}
+
+		return nil, err
+	}
+
+	if manifestCache != nil {
+		if err := manifestCache.SetManifest(ctx, dgst, content); err != nil {
+			dcontext.GetLoggerWithField(ctx, "manifest", dgst).WithError(err).Error("error from cache setting manifest")
+		}
+	}
+	return content, nil
+}
+
+// Delete removes the revision of the specified manifest, and the tags of
+// the revision, which must be looked up beforehand to untag them.
 func (ms *manifestStore) Delete(ctx context.Context, dgst digest.Digest) error {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Delete")
-	return ms.blobStore.Delete(ctx, dgst)
+	err := ms.blobStore.Delete(ctx, dgst)
+	if err != nil && err != distribution.ErrBlobUnknown {
+		return err
+	}
+	if err == nil {
+		// the tags of the revision go with it
+		tagsPath, err := pathFor(manifestRevisionTagsPathSpec{
+			name:     ms.repository.Named().Name(),
+			revision: dgst,
+		})
+		if err != nil {
+			return err
+		}
+		if err := ms.repository.driver.Delete(ctx, tagsPath); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+	}
+	// the manifest may still be cached if it was deleted from the backend
+	if manifestCache := ms.repository.manifestCache; manifestCache != nil {
+		if err := manifestCache.ClearManifest(ctx, dgst); err != nil {
+			return err
+		}
+	}
+	return err
 }
 
 func (ms *manifestStore) Enumerate(ctx context.Context, ingester func(digest.Digest) error) error {
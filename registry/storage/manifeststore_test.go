@@ -7,6 +7,7 @@ import (
 	"io"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
@@ -58,6 +59,175 @@ func TestManifestStorage(t *testing.T) {
 	testManifestStorage(t, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)), EnableDelete, EnableRedirect, EnableValidateImageIndexImagesExist)
 }
 
+func TestManifestStorageWithManifestCache(t *testing.T) {
+	testManifestStorage(t, ManifestCacheProvider(memory.NewInMemoryManifestCacheProvider(memory.UnlimitedSize, time.Hour)), EnableDelete, EnableRedirect, EnableValidateImageIndexImagesExist)
+}
+
+func TestManifestCache(t *testing.T) {
+	repoName, _ := reference.WithName("foo/bar")
+	env := newManifestStoreTestEnv(t, repoName, "thetag", ManifestCacheProvider(memory.NewInMemoryManifestCacheProvider(memory.UnlimitedSize, time.Hour)), EnableDelete)
+	ms, err := env.repository.Manifests(env.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := env.repository.Tags(env.ctx)
+
+	put := func() digest.Digest {
+		layers, err := testutil.CreateRandomLayers(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.UploadBlobs(env.repository, layers); err != nil {
+			t.Fatalf("failed to upload layers: %v", err)
+		}
+		var digests []digest.Digest
+		for dgst := range layers {
+			digests = append(digests, dgst)
+		}
+		manifest, err := testutil.MakeSchema2Manifest(env.repository, digests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgst, err := ms.Put(env.ctx, manifest)
+		if err != nil {
+			t.Fatalf("manifest upload failed: %v", err)
+		}
+		return dgst
+	}
+	first, second := put(), put()
+
+	if err := tags.Tag(env.ctx, env.tag, distribution.Descriptor{Digest: first}); err != nil {
+		t.Fatalf("unexpected error tagging: %v", err)
+	}
+	desc, err := tags.Get(env.ctx, env.tag)
+	if err != nil || desc.Digest != first {
+		t.Fatalf("unexpected tag resolution: %v, %v", desc.Digest, err)
+	}
+	if _, err := ms.Get(env.ctx, first); err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
+	}
+
+	// the tag and the manifest are served from the cache
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{name: repoName.Name(), tag: env.tag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.driver.Delete(env.ctx, currentPath); err != nil {
+		t.Fatal(err)
+	}
+	dataPath, err := pathFor(blobDataPathSpec{digest: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.driver.PutContent(env.ctx, dataPath, []byte("not a manifest")); err != nil {
+		t.Fatal(err)
+	}
+	desc, err = tags.Get(env.ctx, env.tag)
+	if err != nil || desc.Digest != first {
+		t.Fatalf("unexpected cached tag resolution: %v, %v", desc.Digest, err)
+	}
+	if _, err := ms.Get(env.ctx, first); err != nil {
+		t.Fatalf("unexpected error getting cached manifest: %v", err)
+	}
+
+	// but not once the revision link is gone
+	revisionPath, err := pathFor(manifestRevisionLinkPathSpec{name: repoName.Name(), revision: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.driver.Delete(env.ctx, revisionPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Get(env.ctx, first); err == nil {
+		t.Fatal("expected error getting cached manifest without a revision link")
+	}
+	if exists, err := ms.Exists(env.ctx, first); err != nil || exists {
+		t.Fatalf("expected cached manifest without a revision link not to exist: %v", err)
+	}
+
+	// tagging, untagging and deleting invalidate the cache
+	if err := tags.Tag(env.ctx, env.tag, distribution.Descriptor{Digest: second}); err != nil {
+		t.Fatalf("unexpected error tagging: %v", err)
+	}
+	desc, err = tags.Get(env.ctx, env.tag)
+	if err != nil || desc.Digest != second {
+		t.Fatalf("unexpected tag resolution after tagging: %v, %v", desc.Digest, err)
+	}
+
+	if err := tags.Untag(env.ctx, env.tag); err != nil {
+		t.Fatalf("unexpected error untagging: %v", err)
+	}
+	if _, err := tags.Get(env.ctx, env.tag); err != (distribution.ErrTagUnknown{Tag: env.tag}) {
+		t.Fatalf("expected unknown tag error after untagging: %v", err)
+	}
+
+	if err := ms.Delete(env.ctx, first); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected unknown blob error deleting manifest removed from the backend: %v", err)
+	}
+	if _, err := ms.Get(env.ctx, first); err == nil {
+		t.Fatal("expected error getting deleted manifest")
+	}
+	if exists, err := ms.Exists(env.ctx, first); err != nil || exists {
+		t.Fatalf("expected deleted manifest not to exist: %v", err)
+	}
+}
+
+func TestManifestStorageSHA512(t *testing.T) {
+	repoName, _ := reference.WithName("foo/bar")
+	env := newManifestStoreTestEnv(t, repoName, "thetag", EnableDelete)
+	ms, err := env.repository.Manifests(env.ctx, WithDigestAlgorithm(digest.SHA512))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.UploadBlobs(env.repository, layers); err != nil {
+		t.Fatalf("failed to upload layers: %v", err)
+	}
+	var digests []digest.Digest
+	for dgst := range layers {
+		digests = append(digests, dgst)
+	}
+	manifest, err := testutil.MakeSchema2Manifest(env.repository, digests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dgst, err := ms.Put(env.ctx, manifest)
+	if err != nil {
+		t.Fatalf("manifest upload failed: %v", err)
+	}
+	if expected := digest.SHA512.FromBytes(payload); dgst != expected {
+		t.Fatalf("unexpected manifest digest: %v != %v", dgst, expected)
+	}
+
+	ms, err = env.repository.Manifests(env.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := ms.Get(env.ctx, dgst)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
+	}
+	_, fetchedPayload, err := fetched.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetchedPayload, payload) {
+		t.Fatal("fetched payload does not match original payload")
+	}
+	if exists, err := ms.Exists(env.ctx, digest.FromBytes(payload)); err != nil || exists {
+		t.Fatalf("expected manifest not to be stored under its sha256 digest: %v", err)
+	}
+}
+
 func testManifestStorage(t *testing.T, options ...RegistryOption) {
 	repoName, _ := reference.WithName("foo/bar")
 	env := newManifestStoreTestEnv(t, repoName, "thetag", options...)
@@ -225,11 +395,35 @@ func testManifestStorage(t *testing.T, options ...RegistryOption) {
 		t.Fatalf("payloads are not equal")
 	}
 
-	// Test deleting manifests
+	// Test deleting manifests, along with the tags of their revision
+	if err := env.repository.Tags(ctx).Tag(ctx, env.tag, distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("unexpected error tagging manifest: %v", err)
+	}
+	if err := env.repository.Tags(ctx).Untag(ctx, env.tag); err != nil {
+		t.Fatalf("unexpected error untagging manifest: %v", err)
+	}
+	revisionTagsPath, err := pathFor(manifestRevisionTagsPathSpec{name: env.name.Name(), revision: dgst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a stale entry, left by an interrupted tag
+	staleTagPath, err := pathFor(manifestRevisionTagPathSpec{name: env.name.Name(), revision: dgst, tag: "stale"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.driver.PutContent(ctx, staleTagPath, []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+
 	err = ms.Delete(ctx, dgst)
 	if err != nil {
 		t.Fatalf("unexpected an error deleting manifest by digest: %v", err)
 	}
+	if _, err := env.driver.Stat(ctx, revisionTagsPath); err == nil {
+		t.Errorf("tags of deleted manifest revision should not exist")
+	} else if _, ok := err.(driver.PathNotFoundError); !ok {
+		t.Fatalf("unexpected error checking tags of deleted manifest: %v", err)
+	}
 
 	exists, err = ms.Exists(ctx, dgst)
 	if err != nil {
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// defaultMigrateConcurrency is the default number of files copied
+// concurrently by Migrate.
+const defaultMigrateConcurrency = 8
+
+// MigrateOpts contains options for storage migration
+type MigrateOpts struct {
+	DryRun bool
+	// Concurrency is the number of files copied concurrently.
+	Concurrency int
+}
+
+// MigrateStats summarizes a storage migration
+type MigrateStats struct {
+	// Files is the number of files found in the source driver.
+	Files int64
+	// Copied is the number of files copied to the destination driver.
+	Copied int64
+	// Skipped is the number of files already present in the destination
+	// driver: blob data of the same size, or other files of the same
+	// content.
+	Skipped int64
+	// Failed is the number of files which could not be copied.
+	Failed int64
+	// Bytes is the number of bytes copied.
+	Bytes int64
+}
+
+// Migrate copies the content of the registry from the source driver to the
+// destination driver. Blob data already present in the destination driver
+// with the same size, and other files with the same content, are skipped, so
+// that an interrupted migration can be resumed by running it again. The
+// digest of blob data is verified as it is copied. Uploads in progress are
+// not copied.
+func Migrate(ctx context.Context, source, destination driver.StorageDriver, opts MigrateOpts) (MigrateStats, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultMigrateConcurrency
+	}
+
+	root := path.Join(storagePathRoot, storagePathVersion)
+	blobsRoot, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		return MigrateStats{}, err
+	}
+
+	var (
+		stats MigrateStats
+		wg    sync.WaitGroup
+		files = make(chan driver.FileInfo)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fi := range files {
+				isBlobData := strings.HasPrefix(fi.Path(), blobsRoot+"/") && path.Base(fi.Path()) == "data"
+				copied, n, err := migrateFile(ctx, source, destination, fi, isBlobData, opts.DryRun)
+				switch {
+				case err != nil:
+					atomic.AddInt64(&stats.Failed, 1)
+					emit("failed to copy %s: %v", fi.Path(), err)
+				case copied:
+					atomic.AddInt64(&stats.Copied, 1)
+					atomic.AddInt64(&stats.Bytes, n)
+				default:
+					atomic.AddInt64(&stats.Skipped, 1)
+				}
+			}
+		}()
+	}
+
+	err = source.Walk(ctx, root, func(fi driver.FileInfo) error {
+		if fi.IsDir() {
+			if path.Base(fi.Path()) == "_uploads" {
+				return driver.ErrSkipDir
+			}
+			return nil
+		}
+		stats.Files++
+		select {
+		case files <- fi:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(files)
+	wg.Wait()
+
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		err = nil
+	}
+	if err != nil {
+		return stats, fmt.Errorf("failed to walk source storage: %v", err)
+	}
+	if stats.Failed > 0 {
+		return stats, fmt.Errorf("failed to copy %d files", stats.Failed)
+	}
+	return stats, nil
+}
+
+// migrateFile copies a file unless the destination driver already holds it,
+// returning whether it was copied and the number of bytes copied.
+func migrateFile(ctx context.Context, source, destination driver.StorageDriver, fi driver.FileInfo, isBlobData bool, dryRun bool) (bool, int64, error) {
+	p := fi.Path()
+	existing, err := destination.Stat(ctx, p)
+	if err == nil && !existing.IsDir() && existing.Size() == fi.Size() {
+		unchanged, err := migratedFileUnchanged(ctx, source, destination, p, isBlobData)
+		if err != nil {
+			return false, 0, err
+		}
+		if unchanged {
+			return false, 0, nil
+		}
+	} else if _, ok := err.(driver.PathNotFoundError); err != nil && !ok {
+		return false, 0, err
+	}
+
+	if dryRun {
+		emit("would copy %s", p)
+		return true, 0, nil
+	}
+
+	var verifier digest.Verifier
+	if isBlobData {
+		dgst, err := digestFromPath(p)
+		if err != nil {
+			return false, 0, fmt.Errorf("invalid blob path: %v", err)
+		}
+		verifier = dgst.Verifier()
+	}
+
+	rc, err := source.Reader(ctx, p, 0)
+	if err != nil {
+		return false, 0, err
+	}
+	defer rc.Close()
+
+	fw, err := destination.Writer(ctx, p, false)
+	if err != nil {
+		return false, 0, err
+	}
+
+	var w io.Writer = fw
+	if verifier != nil {
+		w = io.MultiWriter(fw, verifier)
+	}
+	n, err := io.Copy(w, rc)
+	if err == nil && n != fi.Size() {
+		err = fmt.Errorf("copied %d bytes, expected %d", n, fi.Size())
+	}
+	if err == nil && verifier != nil && !verifier.Verified() {
+		err = fmt.Errorf("content does not match its digest")
+	}
+	if err != nil {
+		fw.Cancel(ctx)
+		fw.Close()
+		return false, n, err
+	}
+
+	if err := fw.Commit(ctx); err != nil {
+		fw.Close()
+		return false, n, err
+	}
+	return true, n, fw.Close()
+}
+
+// migratedFileUnchanged returns whether a file of the same size in the
+// destination driver holds the content of the source driver. Blob data is
+// named by its digest, so its size is enough, but the links all have the same
+// size whatever revision they point at, so their content is compared.
+func migratedFileUnchanged(ctx context.Context, source, destination driver.StorageDriver, p string, isBlobData bool) (bool, error) {
+	if isBlobData {
+		return true, nil
+	}
+	sourceContent, err := source.GetContent(ctx, p)
+	if err != nil {
+		return false, err
+	}
+	destinationContent, err := destination.GetContent(ctx, p)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sourceContent, destinationContent), nil
+}
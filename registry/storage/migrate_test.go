@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func allFiles(t *testing.T, d driver.StorageDriver) []string {
+	var files []string
+	err := d.Walk(dcontext.Background(), "/", func(fi driver.FileInfo) error {
+		if !fi.IsDir() {
+			files = append(files, fi.Path())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk storage: %v", err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := dcontext.Background()
+	source := inmemory.New()
+	registry := createRegistry(t, source)
+	repo := makeRepository(t, registry, "migrated")
+	image := uploadRandomOCIImage(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: image.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+
+	// Uploads in progress are not migrated.
+	upload, err := repo.Blobs(ctx).Create(ctx)
+	if err != nil {
+		t.Fatalf("failed to start upload: %v", err)
+	}
+	if _, err := upload.Write([]byte("in progress")); err != nil {
+		t.Fatalf("failed to write upload: %v", err)
+	}
+	if err := upload.Close(); err != nil {
+		t.Fatalf("failed to close upload: %v", err)
+	}
+
+	var expected []string
+	for _, p := range allFiles(t, source) {
+		if !strings.Contains(p, "/_uploads/") {
+			expected = append(expected, p)
+		}
+	}
+
+	destination := inmemory.New()
+	stats, err := Migrate(ctx, source, destination, MigrateOpts{DryRun: true})
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if files := allFiles(t, destination); len(files) != 0 {
+		t.Fatalf("dry run copied files: %v", files)
+	}
+
+	stats, err = Migrate(ctx, source, destination, MigrateOpts{Concurrency: 2})
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if stats.Files != int64(len(expected)) || stats.Copied != stats.Files || stats.Skipped != 0 || stats.Failed != 0 {
+		t.Fatalf("unexpected migration stats: %+v", stats)
+	}
+	files := allFiles(t, destination)
+	if len(files) != len(expected) {
+		t.Fatalf("unexpected migrated files: %v != %v", files, expected)
+	}
+	for i := range files {
+		if files[i] != expected[i] {
+			t.Fatalf("unexpected migrated files: %v != %v", files, expected)
+		}
+	}
+
+	// The migrated registry serves the image.
+	migrated := makeRepository(t, createRegistry(t, destination), "migrated")
+	desc, err := migrated.Tags(ctx).Get(ctx, "latest")
+	if err != nil {
+		t.Fatalf("failed to resolve tag: %v", err)
+	}
+	if desc.Digest != image.manifestDigest {
+		t.Fatalf("unexpected tag digest: %v != %v", desc.Digest, image.manifestDigest)
+	}
+	for dgst := range image.layers {
+		if _, err := migrated.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatalf("failed to stat migrated layer %s: %v", dgst, err)
+		}
+	}
+
+	// Migrating again skips the files already copied.
+	stats, err = Migrate(ctx, source, destination, MigrateOpts{})
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if stats.Skipped != stats.Files || stats.Copied != 0 {
+		t.Fatalf("unexpected migration stats: %+v", stats)
+	}
+
+	// Migrating again after the tag moved copies its links, which have the
+	// same size.
+	image2 := uploadRandomOCIImage(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: image2.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	if _, err := Migrate(ctx, source, destination, MigrateOpts{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	desc, err = migrated.Tags(ctx).Get(ctx, "latest")
+	if err != nil {
+		t.Fatalf("failed to resolve tag: %v", err)
+	}
+	if desc.Digest != image2.manifestDigest {
+		t.Fatalf("unexpected tag digest after moving the tag: %v != %v", desc.Digest, image2.manifestDigest)
+	}
+}
+
+func TestMigrateCorruptedBlob(t *testing.T) {
+	ctx := dcontext.Background()
+	source := inmemory.New()
+
+	dgst := digest.FromString("expected content")
+	p, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		t.Fatalf("failed to build blob path: %v", err)
+	}
+	if err := source.PutContent(ctx, p, []byte("corrupted content")); err != nil {
+		t.Fatalf("failed to write blob: %v", err)
+	}
+
+	destination := inmemory.New()
+	stats, err := Migrate(ctx, source, destination, MigrateOpts{})
+	if err == nil {
+		t.Fatalf("expected migration of corrupted blob to fail")
+	}
+	if stats.Failed != 1 {
+		t.Fatalf("unexpected migration stats: %+v", stats)
+	}
+	if files := allFiles(t, destination); len(files) != 0 {
+		t.Fatalf("corrupted blob was copied: %v", files)
+	}
+}
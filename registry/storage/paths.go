@@ -81,12 +81,21 @@ const (
 //
 //	repositoriesRootPathSpec:     <root>/v2/repositories
 //
+//	Catalog:
+//
+//	catalogEntriesPathSpec:       <root>/v2/catalog/repositories/
+//	catalogEntryPathSpec:         <root>/v2/catalog/repositories/<name with ".." for "/">
+//	catalogIndexedPathSpec:       <root>/v2/catalog/indexed
+//
 //	Manifests:
 //
 //	manifestsPathSpec:             <root>/v2/repositories/<name>/_manifests
 //	manifestRevisionsPathSpec:     <root>/v2/repositories/<name>/_manifests/revisions/
 //	manifestRevisionPathSpec:      <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/
 //	manifestRevisionLinkPathSpec:  <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/link
+//	manifestRevisionTagsPathSpec:  <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/tags/
+//	manifestRevisionTagPathSpec:   <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/tags/<tag>/tag
+//	manifestRevisionTagsIndexedPathSpec: <root>/v2/repositories/<name>/_manifests/revisiontags
 //
 //	Tags:
 //
@@ -107,6 +116,7 @@ const (
 //	uploadDataPathSpec:             <root>/v2/repositories/<name>/_uploads/<id>/data
 //	uploadStartedAtPathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/startedat
 //	uploadHashStatePathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/hashstates/<algorithm>/<offset>
+//	uploadPartPathSpec:             <root>/v2/repositories/<name>/_uploads/<id>/parts/<offset>
 //
 //	Blob Store:
 //
@@ -154,6 +164,25 @@ func pathFor(spec pathSpec) (string, error) {
 		}
 
 		return path.Join(root, "link"), nil
+	case manifestRevisionTagsPathSpec:
+		root, err := pathFor(manifestRevisionPathSpec(v))
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, "tags"), nil
+	case manifestRevisionTagPathSpec:
+		root, err := pathFor(manifestRevisionTagsPathSpec{
+			name:     v.name,
+			revision: v.revision,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, v.tag, "tag"), nil
+	case manifestRevisionTagsIndexedPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_manifests", "revisiontags")...), nil
 	case manifestTagsPathSpec:
 		return path.Join(append(repoPrefix, v.name, "_manifests", "tags")...), nil
 	case manifestTagPathSpec:
@@ -248,8 +277,21 @@ func pathFor(spec pathSpec) (string, error) {
 			offset = "" // Limit to the prefix for listing offsets.
 		}
 		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "hashstates", string(v.alg), offset)...), nil
+	case uploadPartPathSpec:
+		// Offsets are zero padded so that parts list in offset order.
+		offset := fmt.Sprintf("%020d", v.offset)
+		if v.list {
+			offset = ""
+		}
+		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "parts", offset)...), nil
 	case repositoriesRootPathSpec:
 		return path.Join(repoPrefix...), nil
+	case catalogEntriesPathSpec:
+		return path.Join(append(rootPrefix, "catalog", "repositories")...), nil
+	case catalogEntryPathSpec:
+		return path.Join(append(rootPrefix, "catalog", "repositories", strings.ReplaceAll(v.name, "/", catalogEntrySeparator))...), nil
+	case catalogIndexedPathSpec:
+		return path.Join(append(rootPrefix, "catalog", "indexed")...), nil
 	default:
 		// TODO(sday): This is an internal error. Ensure it doesn't escape (panic?).
 		return "", fmt.Errorf("unknown path spec: %#v", v)
@@ -298,6 +340,36 @@ type manifestRevisionLinkPathSpec struct {
 
 func (manifestRevisionLinkPathSpec) pathSpec() {}
 
+// manifestRevisionTagsPathSpec describes the directory of the tags of a
+// revision of a manifest, the reverse of the current links of the tags.
+type manifestRevisionTagsPathSpec struct {
+	name     string
+	revision digest.Digest
+}
+
+func (manifestRevisionTagsPathSpec) pathSpec() {}
+
+// manifestRevisionTagPathSpec describes the entry of a tag in the tags of a
+// revision of a manifest. The entry may outlive the tag or its move to
+// another revision, so the current link of the tag must be checked.
+type manifestRevisionTagPathSpec struct {
+	name     string
+	revision digest.Digest
+	tag      string
+}
+
+func (manifestRevisionTagPathSpec) pathSpec() {}
+
+// manifestRevisionTagsIndexedPathSpec describes the file marking that the
+// tags of the revisions of a repository hold all of its tags. It is absent
+// from the repositories tagged before the tags of the revisions were
+// maintained, until they are rebuilt.
+type manifestRevisionTagsIndexedPathSpec struct {
+	name string
+}
+
+func (manifestRevisionTagsIndexedPathSpec) pathSpec() {}
+
 // manifestTagsPathSpec describes the path elements required to point to the
 // manifest tags directory.
 type manifestTagsPathSpec struct {
@@ -445,11 +517,52 @@ type uploadHashStatePathSpec struct {
 
 func (uploadHashStatePathSpec) pathSpec() {}
 
+// uploadPartPathSpec defines the path parameters for the file that stores a
+// part of an upload written at a specific byte offset, out of order with the
+// rest of the upload. If `list` is set, then the path mapper will generate a
+// list prefix for all parts of the upload identified by the name and id.
+type uploadPartPathSpec struct {
+	name   string
+	id     string
+	offset int64
+	list   bool
+}
+
+func (uploadPartPathSpec) pathSpec() {}
+
 // repositoriesRootPathSpec returns the root of repositories
 type repositoriesRootPathSpec struct{}
 
 func (repositoriesRootPathSpec) pathSpec() {}
 
+// catalogEntriesPathSpec describes the directory of the entries of the
+// catalog index.
+type catalogEntriesPathSpec struct{}
+
+func (catalogEntriesPathSpec) pathSpec() {}
+
+// catalogEntryPathSpec describes the entry of a repository in the catalog
+// index. The path components of the name of the repository are joined with
+// catalogEntrySeparator, so that entries are not nested.
+type catalogEntryPathSpec struct {
+	name string
+}
+
+func (catalogEntryPathSpec) pathSpec() {}
+
+// catalogEntrySeparator replaces the path separator of the names of the
+// repositories in their catalog entries. It cannot occur in a path component
+// of a name, which starts and ends with an alphanumeric character and has no
+// consecutive periods.
+const catalogEntrySeparator = ".."
+
+// catalogIndexedPathSpec describes the file marking that the catalog index
+// holds all the repositories of the registry. It is absent until the index
+// is rebuilt.
+type catalogIndexedPathSpec struct{}
+
+func (catalogIndexedPathSpec) pathSpec() {}
+
 // digestPathComponents provides a consistent path breakdown for a given
 // digest. For a generic digest, it will be as follows:
 //
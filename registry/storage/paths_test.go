@@ -31,6 +31,12 @@ func TestPathMapper(t *testing.T) {
 			},
 			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/tags",
 		},
+		{
+			spec: catalogEntryPathSpec{
+				name: "foo/bar-baz/qux",
+			},
+			expected: "/docker/registry/v2/catalog/repositories/foo..bar-baz..qux",
+		},
 		{
 			spec: manifestTagPathSpec{
 				name: "foo/bar",
@@ -83,6 +89,14 @@ func TestPathMapper(t *testing.T) {
 			},
 			expected: "/docker/registry/v2/repositories/foo/bar/_uploads/asdf-asdf-asdf-adsf/startedat",
 		},
+		{
+			spec: uploadPartPathSpec{
+				name:   "foo/bar",
+				id:     "asdf-asdf-asdf-adsf",
+				offset: 1024,
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_uploads/asdf-asdf-asdf-adsf/parts/00000000000000001024",
+		},
 		{
 			spec:     layersPathSpec{name: "foo/bar"},
 			expected: "/docker/registry/v2/repositories/foo/bar/_layers",
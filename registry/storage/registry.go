@@ -2,13 +2,17 @@ package storage
 
 import (
 	"context"
+	_ "crypto/sha512" // make the sha512 digest algorithm available
+	"fmt"
 	"regexp"
 	"runtime"
+	"slices"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/cache"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
 )
 
 var (
@@ -22,15 +26,19 @@ type registry struct {
 	blobServer                   *blobServer
 	statter                      *blobStatter // global statter service.
 	blobDescriptorCacheProvider  cache.BlobDescriptorCacheProvider
+	manifestCacheProvider        cache.ManifestCacheProvider
 	deleteEnabled                bool
 	tagLookupConcurrencyLimit    int
 	resumableDigestEnabled       bool
+	digestAlgorithms             []digest.Algorithm
 	blobDescriptorServiceFactory distribution.BlobDescriptorServiceFactory
 	driver                       storagedriver.StorageDriver
+	catalogIndex                 *catalogIndex
 
 	// Validation
 	manifestURLs         manifestURLs
 	validateImageIndexes validateImageIndexes
+	maxBlobSize          int64
 }
 
 // manifestURLs holds regular expressions for controlling manifest URL whitelisting
@@ -77,6 +85,16 @@ func EnableDelete(registry *registry) error {
 	return nil
 }
 
+// EnableCatalogIndex is a functional option for NewRegistry. It maintains
+// the catalog index on the first push and the removal of repositories, and
+// lists the catalog from it once it has been rebuilt. Registries without the
+// option invalidate a rebuilt index when they push or remove a repository it
+// does not reflect.
+func EnableCatalogIndex(registry *registry) error {
+	registry.catalogIndex = &catalogIndex{driver: registry.driver}
+	return nil
+}
+
 // DisableDigestResumption is a functional option for NewRegistry. It should be
 // used if the registry is acting as a caching proxy.
 func DisableDigestResumption(registry *registry) error {
@@ -84,6 +102,24 @@ func DisableDigestResumption(registry *registry) error {
 	return nil
 }
 
+// DigestAlgorithms returns a functional option for NewRegistry. It sets the
+// algorithms with which blob uploads are hashed as they are written, in
+// addition to the canonical algorithm, so that uploads completed with a digest
+// of any of these algorithms are verified without reading them back.
+func DigestAlgorithms(algorithms ...digest.Algorithm) RegistryOption {
+	return func(registry *registry) error {
+		for _, algorithm := range algorithms {
+			if !algorithm.Available() {
+				return fmt.Errorf("unsupported digest algorithm: %s", algorithm)
+			}
+			if !slices.Contains(registry.digestAlgorithms, algorithm) {
+				registry.digestAlgorithms = append(registry.digestAlgorithms, algorithm)
+			}
+		}
+		return nil
+	}
+}
+
 // ManifestURLsAllowRegexp is a functional option for NewRegistry.
 func ManifestURLsAllowRegexp(r *regexp.Regexp) RegistryOption {
 	return func(registry *registry) error {
@@ -100,6 +136,19 @@ func ManifestURLsDenyRegexp(r *regexp.Regexp) RegistryOption {
 	}
 }
 
+// MaxBlobSize returns a functional option for NewRegistry. It limits the size
+// of uploaded blobs: writes beyond the limit fail with
+// distribution.ErrBlobTooLarge.
+func MaxBlobSize(size int64) RegistryOption {
+	return func(registry *registry) error {
+		if size < 0 {
+			return fmt.Errorf("invalid maximum blob size: %d", size)
+		}
+		registry.maxBlobSize = size
+		return nil
+	}
+}
+
 // EnableValidateImageIndexImagesExist is a functional option for NewRegistry. It enables
 // validation that references exist before an image index is accepted.
 func EnableValidateImageIndexImagesExist(registry *registry) error {
@@ -131,6 +180,15 @@ func BlobDescriptorServiceFactory(factory distribution.BlobDescriptorServiceFact
 	}
 }
 
+// ManifestCacheProvider returns a functional option for NewRegistry. It
+// caches the resolution of tags and the payloads of manifests.
+func ManifestCacheProvider(manifestCacheProvider cache.ManifestCacheProvider) RegistryOption {
+	return func(registry *registry) error {
+		registry.manifestCacheProvider = manifestCacheProvider
+		return nil
+	}
+}
+
 // BlobDescriptorCacheProvider returns a functional option for
 // NewRegistry. It creates a cached blob statter for use by the
 // registry.
@@ -175,6 +233,7 @@ func NewRegistry(ctx context.Context, driver storagedriver.StorageDriver, option
 		},
 		statter:                statter,
 		resumableDigestEnabled: true,
+		digestAlgorithms:       []digest.Algorithm{digest.Canonical},
 		driver:                 driver,
 	}
 
@@ -206,11 +265,21 @@ func (reg *registry) Repository(ctx context.Context, canonicalName reference.Nam
 		}
 	}
 
+	var manifestCache cache.ManifestCache
+	if reg.manifestCacheProvider != nil {
+		var err error
+		manifestCache, err = reg.manifestCacheProvider.RepositoryScoped(canonicalName.Name())
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &repository{
 		ctx:             ctx,
 		registry:        reg,
 		name:            canonicalName,
 		descriptorCache: descriptorCache,
+		manifestCache:   manifestCache,
 	}, nil
 }
 
@@ -228,6 +297,7 @@ type repository struct {
 	ctx             context.Context
 	name            reference.Named
 	descriptorCache distribution.BlobDescriptorService
+	manifestCache   cache.ManifestCache
 }
 
 // Name returns the name of the repository.
@@ -350,5 +420,7 @@ func (repo *repository) Blobs(ctx context.Context) distribution.BlobStore {
 		linkDirectoryPathSpec:  layersPathSpec{name: repo.name.Name()},
 		deleteEnabled:          repo.registry.deleteEnabled,
 		resumableDigestEnabled: repo.resumableDigestEnabled,
+		digestAlgorithms:       repo.digestAlgorithms,
+		maxBlobSize:            repo.registry.maxBlobSize,
 	}
 }
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/reference"
+)
+
+// RebuildTagsStats summarizes a rebuild of the tags of the manifest revisions
+type RebuildTagsStats struct {
+	Repositories int
+	Tags         int
+}
+
+// RebuildTags rebuilds the tags of the manifest revisions of all the
+// repositories of the registry from the current links of their tags, so that
+// looking up the tags of a manifest no longer reads every tag of the
+// repositories tagged before they were maintained. The registry must not
+// accept pushes while it runs, as a tag moved during the rebuild may be
+// missing from the tags of its revision, and left dangling when the manifest
+// is deleted.
+func RebuildTags(ctx context.Context, registry distribution.Namespace) (RebuildTagsStats, error) {
+	var stats RebuildTagsStats
+
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return stats, fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		named, err := reference.WithName(repoName)
+		if err != nil {
+			return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+		}
+		repository, err := registry.Repository(ctx, named)
+		if err != nil {
+			return fmt.Errorf("failed to construct repository: %v", err)
+		}
+		ts, ok := repository.Tags(ctx).(*tagStore)
+		if !ok {
+			return fmt.Errorf("unable to convert TagService of %s into tagStore", repoName)
+		}
+
+		tags, err := ts.rebuildRevisionTags(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to rebuild tags of %s: %v", repoName, err)
+		}
+		dcontext.GetLogger(ctx).Infof("rebuilt %d tags of %s", tags, repoName)
+		stats.Repositories++
+		stats.Tags += tags
+		return nil
+	})
+	return stats, err
+}
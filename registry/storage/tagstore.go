@@ -10,6 +10,7 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 )
 
@@ -60,6 +61,10 @@ func (ts *tagStore) All(ctx context.Context) ([]string, error) {
 
 // Tag tags the digest with the given tag, updating the store to point at
 // the current tag. The digest must point to a manifest.
+//
+// The tag is added to the tags of the revision before the current link is
+// overwritten, and removed from the tags of the revision it pointed at
+// after, so that Lookup never misses it.
 func (ts *tagStore) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
 	currentPath, err := pathFor(manifestTagCurrentPathSpec{
 		name: ts.repository.Named().Name(),
@@ -69,6 +74,22 @@ func (ts *tagStore) Tag(ctx context.Context, tag string, desc distribution.Descr
 		return err
 	}
 
+	if err := ts.ensureRevisionTagsIndexed(ctx); err != nil {
+		return err
+	}
+
+	previous, err := ts.blobStore.readlink(ctx, currentPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+		previous = ""
+	}
+
+	if err := ts.addRevisionTag(ctx, desc.Digest, tag); err != nil {
+		return err
+	}
+
 	lbs := ts.linkedBlobStore(ctx, tag)
 
 	// Link into the index
@@ -77,7 +98,18 @@ func (ts *tagStore) Tag(ctx context.Context, tag string, desc distribution.Descr
 	}
 
 	// Overwrite the current link
-	return ts.blobStore.link(ctx, currentPath, desc.Digest)
+	if err := ts.blobStore.link(ctx, currentPath, desc.Digest); err != nil {
+		return err
+	}
+
+	if err := ts.clearCachedTag(ctx, tag); err != nil {
+		return err
+	}
+
+	if previous != "" && previous != desc.Digest {
+		return ts.removeRevisionTag(ctx, previous, tag)
+	}
+	return nil
 }
 
 // resolve the current revision for name and tag.
@@ -90,6 +122,26 @@ func (ts *tagStore) Get(ctx context.Context, tag string) (distribution.Descripto
 		return distribution.Descriptor{}, err
 	}
 
+	manifestCache := ts.repository.manifestCache
+	var generation int64
+	if manifestCache != nil {
+		revision, err := manifestCache.ResolveTag(ctx, tag)
+		if err == nil {
+			return distribution.Descriptor{Digest: revision}, nil
+		}
+		if _, ok := err.(distribution.ErrTagUnknown); !ok {
+			dcontext.GetLoggerWithField(ctx, "tag", tag).WithError(err).Error("error from cache resolving tag")
+		}
+
+		// read the generation before the link, so that the revision is not
+		// cached if the tag is moved, and cleared, in between.
+		generation, err = manifestCache.TagGeneration(ctx, tag)
+		if err != nil {
+			dcontext.GetLoggerWithField(ctx, "tag", tag).WithError(err).Error("error from cache getting tag generation")
+			manifestCache = nil
+		}
+	}
+
 	revision, err := ts.blobStore.readlink(ctx, currentPath)
 	if err != nil {
 		switch err.(type) {
@@ -100,9 +152,23 @@ func (ts *tagStore) Get(ctx context.Context, tag string) (distribution.Descripto
 		return distribution.Descriptor{}, err
 	}
 
+	if manifestCache != nil {
+		if err := manifestCache.SetTag(ctx, tag, revision, generation); err != nil {
+			dcontext.GetLoggerWithField(ctx, "tag", tag).WithError(err).Error("error from cache setting tag")
+		}
+	}
+
 	return distribution.Descriptor{Digest: revision}, nil
 }
 
+// clearCachedTag removes a tag from the manifest cache, if any.
+func (ts *tagStore) clearCachedTag(ctx context.Context, tag string) error {
+	if ts.repository.manifestCache == nil {
+		return nil
+	}
+	return ts.repository.manifestCache.ClearTag(ctx, tag)
+}
+
 // Untag removes the tag association
 func (ts *tagStore) Untag(ctx context.Context, tag string) error {
 	tagPath, err := pathFor(manifestTagPathSpec{
@@ -112,8 +178,34 @@ func (ts *tagStore) Untag(ctx context.Context, tag string) error {
 	if err != nil {
 		return err
 	}
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{
+		name: ts.repository.Named().Name(),
+		tag:  tag,
+	})
+	if err != nil {
+		return err
+	}
+
+	current, err := ts.blobStore.readlink(ctx, currentPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+		current = ""
+	}
+
+	if err := ts.blobStore.driver.Delete(ctx, tagPath); err != nil {
+		return err
+	}
+
+	if err := ts.clearCachedTag(ctx, tag); err != nil {
+		return err
+	}
 
-	return ts.blobStore.driver.Delete(ctx, tagPath)
+	if current != "" {
+		return ts.removeRevisionTag(ctx, current, tag)
+	}
+	return nil
 }
 
 // linkedBlobStore returns the linkedBlobStore for the named tag, allowing one
@@ -137,7 +229,29 @@ func (ts *tagStore) linkedBlobStore(ctx context.Context, tag string) *linkedBlob
 
 // Lookup recovers a list of tags which refer to this digest.  When a manifest is deleted by
 // digest, tag entries which point to it need to be recovered to avoid dangling tags.
+//
+// The tags are read from the tags of the revision, unless the repository was
+// tagged before they were maintained and they have not been rebuilt, in
+// which case the current link of every tag is read.
 func (ts *tagStore) Lookup(ctx context.Context, desc distribution.Descriptor) ([]string, error) {
+	indexed, err := ts.revisionTagsIndexed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !indexed {
+		return ts.lookupAll(ctx, desc)
+	}
+
+	candidates, err := ts.revisionTags(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return ts.matchingTags(ctx, candidates, desc.Digest)
+}
+
+// lookupAll returns the tags which refer to the digest, reading the current
+// link of every tag.
+func (ts *tagStore) lookupAll(ctx context.Context, desc distribution.Descriptor) ([]string, error) {
 	allTags, err := ts.All(ctx)
 	switch err.(type) {
 	case distribution.ErrRepositoryUnknown:
@@ -149,6 +263,11 @@ func (ts *tagStore) Lookup(ctx context.Context, desc distribution.Descriptor) ([
 		return nil, err
 	}
 
+	return ts.matchingTags(ctx, allTags, desc.Digest)
+}
+
+// matchingTags returns the tags whose current link points at the digest.
+func (ts *tagStore) matchingTags(ctx context.Context, candidates []string, dgst digest.Digest) ([]string, error) {
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(ts.concurrencyLimit)
 
@@ -156,7 +275,7 @@ func (ts *tagStore) Lookup(ctx context.Context, desc distribution.Descriptor) ([
 		tags []string
 		mu   sync.Mutex
 	)
-	for _, tag := range allTags {
+	for _, tag := range candidates {
 		if ctx.Err() != nil {
 			break
 		}
@@ -178,7 +297,7 @@ func (ts *tagStore) Lookup(ctx context.Context, desc distribution.Descriptor) ([
 				return err
 			}
 
-			if tagDigest == desc.Digest {
+			if tagDigest == dgst {
 				mu.Lock()
 				tags = append(tags, tag)
 				mu.Unlock()
@@ -188,7 +307,7 @@ func (ts *tagStore) Lookup(ctx context.Context, desc distribution.Descriptor) ([
 		})
 	}
 
-	err = g.Wait()
+	err := g.Wait()
 	if err != nil {
 		return nil, err
 	}
@@ -196,6 +315,215 @@ func (ts *tagStore) Lookup(ctx context.Context, desc distribution.Descriptor) ([
 	return tags, nil
 }
 
+// revisionTags returns the tags of a revision, some of which may no longer
+// point at it.
+func (ts *tagStore) revisionTags(ctx context.Context, dgst digest.Digest) ([]string, error) {
+	tagsPath, err := pathFor(manifestRevisionTagsPathSpec{
+		name:     ts.repository.Named().Name(),
+		revision: dgst,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ts.blobStore.driver.List(ctx, tagsPath)
+	if err != nil {
+		switch err.(type) {
+		case storagedriver.PathNotFoundError:
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	tags := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		tags = append(tags, path.Base(entry))
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (ts *tagStore) addRevisionTag(ctx context.Context, dgst digest.Digest, tag string) error {
+	entryPath, err := pathFor(manifestRevisionTagPathSpec{
+		name:     ts.repository.Named().Name(),
+		revision: dgst,
+		tag:      tag,
+	})
+	if err != nil {
+		return err
+	}
+	return ts.blobStore.driver.PutContent(ctx, entryPath, []byte(tag))
+}
+
+func (ts *tagStore) removeRevisionTag(ctx context.Context, dgst digest.Digest, tag string) error {
+	entryPath, err := pathFor(manifestRevisionTagPathSpec{
+		name:     ts.repository.Named().Name(),
+		revision: dgst,
+		tag:      tag,
+	})
+	if err != nil {
+		return err
+	}
+	err = ts.blobStore.driver.Delete(ctx, path.Dir(entryPath))
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// revisionTagsIndexed returns whether the tags of the revisions of the
+// repository hold all of its tags.
+func (ts *tagStore) revisionTagsIndexed(ctx context.Context) (bool, error) {
+	markerPath, err := pathFor(manifestRevisionTagsIndexedPathSpec{
+		name: ts.repository.Named().Name(),
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = ts.blobStore.driver.Stat(ctx, markerPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (ts *tagStore) markRevisionTagsIndexed(ctx context.Context) error {
+	markerPath, err := pathFor(manifestRevisionTagsIndexedPathSpec{
+		name: ts.repository.Named().Name(),
+	})
+	if err != nil {
+		return err
+	}
+	return ts.blobStore.driver.PutContent(ctx, markerPath, []byte("1"))
+}
+
+// ensureRevisionTagsIndexed marks the tags of the revisions of a repository
+// which has never been tagged as holding all of its tags. The tags of
+// repositories tagged before they were maintained are left to RebuildTags,
+// rather than listed on every tag.
+func (ts *tagStore) ensureRevisionTagsIndexed(ctx context.Context) error {
+	indexed, err := ts.revisionTagsIndexed(ctx)
+	if err != nil || indexed {
+		return err
+	}
+	tagsPath, err := pathFor(manifestTagsPathSpec{
+		name: ts.repository.Named().Name(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = ts.blobStore.driver.Stat(ctx, tagsPath)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		return err
+	}
+	return ts.markRevisionTagsIndexed(ctx)
+}
+
+// currentRevision returns the revision the tag currently points at, or an
+// empty digest if the tag does not exist.
+func (ts *tagStore) currentRevision(ctx context.Context, tag string) (digest.Digest, error) {
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{
+		name: ts.repository.Named().Name(),
+		tag:  tag,
+	})
+	if err != nil {
+		return "", err
+	}
+	revision, err := ts.blobStore.readlink(ctx, currentPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return "", nil
+		}
+		return "", err
+	}
+	return revision, nil
+}
+
+// rebuildRevisionTags rebuilds the tags of the revisions of the repository
+// from the current links of its tags, removing the stale ones, and marks
+// them as holding all of its tags. It returns the number of tags. The current
+// link of a tag is read again before its entry is removed from a revision,
+// but a tag moved at that very moment may still lose its entry, so the
+// repository must not be tagged during the rebuild.
+func (ts *tagStore) rebuildRevisionTags(ctx context.Context) (int, error) {
+	tags, err := ts.All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+			return 0, err
+		}
+	}
+
+	current := make(map[string]digest.Digest, len(tags))
+	for _, tag := range tags {
+		desc, err := ts.Get(ctx, tag)
+		if err != nil {
+			if _, ok := err.(distribution.ErrTagUnknown); ok {
+				continue
+			}
+			return 0, err
+		}
+		current[tag] = desc.Digest
+		if err := ts.addRevisionTag(ctx, desc.Digest, tag); err != nil {
+			return 0, err
+		}
+	}
+
+	revisionsPath, err := pathFor(manifestRevisionsPathSpec{name: ts.repository.Named().Name()})
+	if err != nil {
+		return 0, err
+	}
+	algorithms, err := ts.blobStore.driver.List(ctx, revisionsPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return 0, err
+		}
+	}
+	for _, algorithm := range algorithms {
+		revisions, err := ts.blobStore.driver.List(ctx, algorithm)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				continue
+			}
+			return 0, err
+		}
+		for _, revision := range revisions {
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(algorithm)), path.Base(revision))
+			if dgst.Validate() != nil {
+				continue
+			}
+			revisionTags, err := ts.revisionTags(ctx, dgst)
+			if err != nil {
+				return 0, err
+			}
+			for _, tag := range revisionTags {
+				if current[tag] == dgst {
+					continue
+				}
+				// the tag may have been moved to the revision since the
+				// tags were read
+				tagDigest, err := ts.currentRevision(ctx, tag)
+				if err != nil {
+					return 0, err
+				}
+				if tagDigest == dgst {
+					continue
+				}
+				if err := ts.removeRevisionTag(ctx, dgst, tag); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	return len(current), ts.markRevisionTagsIndexed(ctx)
+}
+
 func (ts *tagStore) ManifestDigests(ctx context.Context, tag string) ([]digest.Digest, error) {
 	tagLinkPath := func(name string, dgst digest.Digest) (string, error) {
 		return pathFor(manifestTagIndexEntryLinkPathSpec{
@@ -2,11 +2,15 @@ package storage
 
 import (
 	"context"
+	"path"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/reference"
 	digest "github.com/opencontainers/go-digest"
@@ -220,6 +224,306 @@ func TestTagLookup(t *testing.T) {
 	}
 }
 
+func TestTagLookupRevisionTags(t *testing.T) {
+	env := testTagStore(t)
+	ts := env.ts.(*tagStore)
+	ctx := env.ctx
+	driver := ts.blobStore.driver
+
+	descA := distribution.Descriptor{Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	desc0 := distribution.Descriptor{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+
+	for _, tag := range []string{"a", "b", "link"} {
+		if err := ts.Tag(ctx, tag, descA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexed, err := ts.revisionTagsIndexed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !indexed {
+		t.Fatal("tags of the revisions of a new repository are not maintained")
+	}
+
+	// Moving and removing tags updates the tags of the revisions.
+	if err := ts.Tag(ctx, "b", desc0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Untag(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc     distribution.Descriptor
+		expected []string
+	}{
+		{descA, []string{"link"}},
+		{desc0, []string{"b"}},
+	} {
+		revisionTags, err := ts.revisionTags(ctx, tc.desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(revisionTags, tc.expected) {
+			t.Errorf("tags of revision %s are %v, expected %v", tc.desc.Digest, revisionTags, tc.expected)
+		}
+		tags, err := ts.Lookup(ctx, tc.desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tags, tc.expected) {
+			t.Errorf("Lookup of %s returned %v, expected %v", tc.desc.Digest, tags, tc.expected)
+		}
+	}
+
+	// Stale entries are not returned.
+	if err := ts.addRevisionTag(ctx, descA.Digest, "b"); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := ts.Lookup(ctx, descA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"link"}) {
+		t.Errorf("Lookup of descA returned %v, expected [link]", tags)
+	}
+
+	// Enumerating the manifests ignores the tags of the revisions.
+	manifestsPath, err := pathFor(manifestRevisionsPathSpec{name: "a/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Walk(ctx, manifestsPath, func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() && path.Base(fi.Path()) == "link" {
+			t.Errorf("unexpected link %s", fi.Path())
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuildTags(t *testing.T) {
+	ctx := context.Background()
+	d := &listHookDriver{StorageDriver: inmemory.New(), onList: func(string) {}}
+	reg, err := NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoRef, _ := reference.WithName("a/b")
+	repo, err := reg.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := repo.Tags(ctx).(*tagStore)
+
+	descA := distribution.Descriptor{Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	desc0 := distribution.Descriptor{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+	for _, tag := range []string{"a", "b"} {
+		if err := ts.Tag(ctx, tag, descA); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate a repository tagged before the tags of the revisions were
+	// maintained.
+	markerPath, _ := pathFor(manifestRevisionTagsIndexedPathSpec{name: "a/b"})
+	if err := d.Delete(ctx, markerPath); err != nil {
+		t.Fatal(err)
+	}
+	tagsPath, _ := pathFor(manifestRevisionTagsPathSpec{name: "a/b", revision: descA.Digest})
+	if err := d.Delete(ctx, tagsPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tagging keeps the repository unindexed, without reading every tag, and
+	// lookups read every tag.
+	allTagsPath, _ := pathFor(manifestTagsPathSpec{name: "a/b"})
+	d.onList = func(p string) {
+		if p == allTagsPath {
+			t.Errorf("tagging listed the tags of the repository")
+		}
+	}
+	if err := ts.Tag(ctx, "c", desc0); err != nil {
+		t.Fatal(err)
+	}
+	d.onList = func(string) {}
+	if err := ts.addRevisionTag(ctx, desc0.Digest, "stale"); err != nil {
+		t.Fatal(err)
+	}
+	indexed, err := ts.revisionTagsIndexed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed {
+		t.Fatal("tags of the revisions of an existing repository are marked as maintained")
+	}
+	tags, err := ts.Lookup(ctx, descA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"a", "b"}) {
+		t.Errorf("Lookup of descA returned %v, expected [a b]", tags)
+	}
+
+	stats, err := RebuildTags(ctx, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Repositories != 1 || stats.Tags != 3 {
+		t.Errorf("unexpected rebuild stats %+v", stats)
+	}
+	indexed, err = ts.revisionTagsIndexed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !indexed {
+		t.Fatal("tags of the revisions are not marked as maintained after a rebuild")
+	}
+	for _, tc := range []struct {
+		desc     distribution.Descriptor
+		expected []string
+	}{
+		{descA, []string{"a", "b"}},
+		{desc0, []string{"c"}},
+	} {
+		revisionTags, err := ts.revisionTags(ctx, tc.desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(revisionTags, tc.expected) {
+			t.Errorf("tags of revision %s are %v, expected %v", tc.desc.Digest, revisionTags, tc.expected)
+		}
+	}
+}
+
+// listHookDriver calls a hook before listing a path.
+type listHookDriver struct {
+	storagedriver.StorageDriver
+	onList func(path string)
+}
+
+func (d *listHookDriver) List(ctx context.Context, path string) ([]string, error) {
+	d.onList(path)
+	return d.StorageDriver.List(ctx, path)
+}
+
+func TestRebuildTagsConcurrentTag(t *testing.T) {
+	ctx := context.Background()
+	d := &listHookDriver{StorageDriver: inmemory.New(), onList: func(string) {}}
+	reg, err := NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoRef, _ := reference.WithName("a/b")
+	repo, err := reg.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := repo.Tags(ctx).(*tagStore)
+
+	descA := distribution.Descriptor{Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	desc0 := distribution.Descriptor{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+	if err := ts.Tag(ctx, "a", descA); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tag is moved once the rebuild has read the current tags, before it
+	// removes the stale entries of the revisions.
+	revisionsPath, _ := pathFor(manifestRevisionsPathSpec{name: "a/b"})
+	moved := false
+	d.onList = func(p string) {
+		if p != revisionsPath || moved {
+			return
+		}
+		moved = true
+		if err := ts.Tag(ctx, "a", desc0); err != nil {
+			t.Errorf("unexpected error moving tag: %v", err)
+		}
+	}
+
+	if _, err := ts.rebuildRevisionTags(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !moved {
+		t.Fatal("tag was not moved during the rebuild")
+	}
+	tags, err := ts.Lookup(ctx, desc0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"a"}) {
+		t.Errorf("Lookup of desc0 returned %v, expected [a]", tags)
+	}
+}
+
+// getContentHookDriver calls a hook after reading the content of a path.
+type getContentHookDriver struct {
+	storagedriver.StorageDriver
+	onGetContent func(path string)
+}
+
+func (d *getContentHookDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := d.StorageDriver.GetContent(ctx, path)
+	d.onGetContent(path)
+	return content, err
+}
+
+func TestTagCacheConcurrentTag(t *testing.T) {
+	ctx := context.Background()
+	d := &getContentHookDriver{StorageDriver: inmemory.New(), onGetContent: func(string) {}}
+	reg, err := NewRegistry(ctx, d, ManifestCacheProvider(memory.NewInMemoryManifestCacheProvider(memory.UnlimitedSize, time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoRef, _ := reference.WithName("a/b")
+	repo, err := reg.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := repo.Tags(ctx)
+
+	descA := distribution.Descriptor{Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	desc0 := distribution.Descriptor{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+	if err := ts.Tag(ctx, "a", descA); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tag is moved once Get has read its link, before it caches the
+	// revision read.
+	currentPath, _ := pathFor(manifestTagCurrentPathSpec{name: "a/b", tag: "a"})
+	moved := false
+	d.onGetContent = func(p string) {
+		if p != currentPath || moved {
+			return
+		}
+		moved = true
+		if err := ts.Tag(ctx, "a", desc0); err != nil {
+			t.Errorf("unexpected error moving tag: %v", err)
+		}
+	}
+
+	desc, err := ts.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !moved {
+		t.Fatal("tag was not moved during Get")
+	}
+	if desc.Digest != descA.Digest {
+		t.Fatalf("Get returned %v, expected %v", desc.Digest, descA.Digest)
+	}
+
+	desc, err = ts.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != desc0.Digest {
+		t.Errorf("Get of moved tag returned %v, expected %v", desc.Digest, desc0.Digest)
+	}
+}
+
 func TestTagIndexes(t *testing.T) {
 	env := testTagStore(t)
 	tagStore := env.ts